@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -332,7 +333,18 @@ func main() {
 		peersdb.Testnet = common.Testnet
 		peersdb.ConnectOnly = common.CFG.ConnectOnly
 		peersdb.Services = common.Services
-		peersdb.InitPeers(common.DuodHomeDir)
+		seeded, e := peersdb.InitPeers(context.Background(), common.DuodHomeDir)
+		if e != nil {
+			L.Error(e.Error())
+			common.CloseBlockChain()
+			sys.UnlockDatabaseDir()
+			os.Exit(1)
+		}
+		go func() {
+			if e := <-seeded; e != nil {
+				L.Warn(e.Error(), "- use -c to connect to a known node")
+			}
+		}()
 		if common.FLAG.UnbanAllPeers {
 			var keys []qdb.KeyType
 			var vals [][]byte
@@ -341,6 +353,7 @@ func main() {
 				if peer.Banned != 0 {
 					L.Debug("Unban", peer.NetAddr.String())
 					peer.Banned = 0
+					peer.BanReason = ""
 					keys = append(keys, k)
 					vals = append(vals, peer.Bytes())
 				}
@@ -154,12 +154,12 @@ func (c *OneConnection) ParseAddr(pl []byte) {
 				k := qdb.KeyType(a.UniqID())
 				v := peersdb.PeerDB.Get(k)
 				if v != nil {
-					a.Banned = peersdb.NewPeer(v[:]).Banned
+					old := peersdb.NewPeer(v[:])
+					a.Banned, a.BanReason, a.Labels = old.Banned, old.BanReason, old.Labels
+					a.Misbehaving, a.GoodConnections = old.Misbehaving, old.GoodConnections
 				}
 				a.Time = uint32(time.Now().Add(-5 * time.Minute).Unix()) // add new peers as not just alive
-				if a.Time > uint32(time.Now().Unix()) {
-					println("wtf", a.Time, time.Now().Unix())
-				}
+				a.NetGroup = a.CalcNetGroup()
 				peersdb.PeerDB.Put(k, a.Bytes())
 			} else {
 				common.CountSafe("AddrStale")
@@ -17,7 +17,6 @@ import (
 	"github.com/ParallelCoinTeam/duod/client/common"
 	"github.com/ParallelCoinTeam/duod/lib/btc"
 	"github.com/ParallelCoinTeam/duod/lib/chain"
-	"github.com/dchest/siphash"
 )
 
 // CompactBlocksMutex -
@@ -113,7 +112,7 @@ func (c *OneConnection) SendCompactBlock(hash *btc.Uint256) bool {
 		} else {
 			hasz = &crec.Block.Txs[i].Hash
 		}
-		binary.LittleEndian.PutUint64(lsb[:], siphash.Hash(k0, k1, hasz.Hash[:]))
+		binary.LittleEndian.PutUint64(lsb[:], btc.ShortID(hasz.Hash, k0, k1))
 		msg.Write(lsb[:6])
 	}
 	msg.Write([]byte{1}) // one preffiled tx
@@ -302,11 +301,7 @@ func (c *OneConnection) ProcessCompactBlock(pl []byte) {
 	}
 
 	// calculate K0 and K1 params for siphash-4-2
-	sha := sha256.New()
-	sha.Write(pl[:88])
-	kks := sha.Sum(nil)
-	col.K0 = binary.LittleEndian.Uint64(kks[0:8])
-	col.K1 = binary.LittleEndian.Uint64(kks[8:16])
+	col.K0, col.K1 = btc.ShortIDKeys(pl[:80], binary.LittleEndian.Uint64(pl[80:88]))
 
 	var cntFound int
 
@@ -319,7 +314,7 @@ func (c *OneConnection) ProcessCompactBlock(pl []byte) {
 		} else {
 			hash2take = &v.Tx.Hash
 		}
-		sid := siphash.Hash(col.K0, col.K1, hash2take.Hash[:]) & 0xffffffffffff
+		sid := btc.ShortID(hash2take.Hash, col.K0, col.K1)
 		if ptr, ok := shortids[sid]; ok {
 			if ptr != nil {
 				common.CountSafe("ShortIDSame")
@@ -341,7 +336,7 @@ func (c *OneConnection) ProcessCompactBlock(pl []byte) {
 		} else {
 			hash2take = &v.Hash
 		}
-		sid := siphash.Hash(col.K0, col.K1, hash2take.Hash[:]) & 0xffffffffffff
+		sid := btc.ShortID(hash2take.Hash, col.K0, col.K1)
 		if ptr, ok := shortids[sid]; ok {
 			if ptr != nil {
 				common.CountSafe("ShortIDSame")
@@ -517,7 +512,7 @@ func (c *OneConnection) ProcessBlockTx(pl []byte) {
 		}
 		offs += n
 
-		sid := siphash.Hash(col.K0, col.K1, txHash.Hash[:]) & 0xffffffffffff
+		sid := btc.ShortID(txHash.Hash, col.K0, col.K1)
 		if idx, ok := col.Sid2idx[sid]; ok {
 			col.Txs[idx] = rawTx
 		} else {
@@ -261,7 +261,7 @@ func tcpServer() {
 					if ok && time.Now().Sub(ti) < HammeringMinReconnect {
 						//println(ad.IP(), "is hammering within", time.Now().Sub(ti).String())
 						common.CountSafe("BanHammerIn")
-						ad.Ban()
+						ad.BanWithReason("hammering")
 						terminate = true
 					}
 
@@ -444,9 +444,7 @@ func HandleNetTx(ntx *TxRcvd, retry bool) (accepted bool) {
 	}
 
 	// Check if total output value does not exceed total input
-	for i := range tx.TxOut {
-		totout += tx.TxOut[i].Value
-	}
+	totout = tx.TotalOutputValue()
 
 	if totout > totinp {
 		RejectTx(ntx.Tx, TxRejectedOverspend)
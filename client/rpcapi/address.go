@@ -1,6 +1,7 @@
 package rpcapi
 
 import (
+	"bytes"
 	"encoding/hex"
 
 	"github.com/ParallelCoinTeam/duod/lib/btc"
@@ -35,18 +36,52 @@ type InvalidAddressResponse struct {
 	IsValid bool `json:"isvalid"`
 }
 
+var (
+	// AllowedHRPs - if not empty, only bech32 addresses with these human readable parts are valid
+	AllowedHRPs []string
+	// AllowedVersions - if not empty, only base58 addresses with these version bytes are valid
+	AllowedVersions []byte
+	// OwnershipChecker - if set, ValidateAddress uses it to tell if the address belongs to the wallet
+	// (or is watched by it). Without it, both are reported as false.
+	OwnershipChecker func(a *btc.Addr) (mine, watchonly bool)
+)
+
+// SetAddrNetwork - Makes ValidateAddress accept only addresses from the given network
+func SetAddrNetwork(testnet bool) {
+	AllowedHRPs = []string{btc.GetSegwitHRP(testnet)}
+	AllowedVersions = []byte{btc.AddrVerPubkey(testnet), btc.AddrVerScript(testnet)}
+}
+
+func addrAllowed(a *btc.Addr) bool {
+	if a.SegwitProg != nil {
+		if len(AllowedHRPs) == 0 {
+			return true
+		}
+		for _, hrp := range AllowedHRPs {
+			if a.SegwitProg.HRP == hrp {
+				return true
+			}
+		}
+		return false
+	}
+	return len(AllowedVersions) == 0 || bytes.IndexByte(AllowedVersions, a.Version) != -1
+}
+
 // ValidateAddress -
 func ValidateAddress(addr string) interface{} {
 	a, e := btc.NewAddrFromString(addr)
-	if e != nil {
+	if e != nil || a == nil || !addrAllowed(a) {
 		return new(InvalidAddressResponse)
 	}
 	res := new(ValidAddressResponse)
 	res.IsValid = true
 	res.Address = addr
-	res.ScriptPubKey = hex.EncodeToString(a.OutScript())
+	scr := a.OutScript()
+	res.ScriptPubKey = hex.EncodeToString(scr)
+	if OwnershipChecker != nil {
+		res.IsMine, res.IsWatchOnly = OwnershipChecker(a)
+	}
+	typ := btc.ClassifyScript(scr)
+	res.IsScript = typ == btc.ScriptP2SH || typ == btc.ScriptP2WSH
 	return res
-	//res.IsMine = false
-	//res.IsWatchOnly = false
-	//res.IsScript = false
 }
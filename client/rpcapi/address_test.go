@@ -0,0 +1,94 @@
+package rpcapi
+
+import (
+	"testing"
+
+	"github.com/ParallelCoinTeam/duod/lib/btc"
+)
+
+func TestValidateAddressNetwork(t *testing.T) {
+	var h160 [20]byte
+	mainnet := []string{
+		"1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2",
+		btc.NewAddrFromHash160(h160[:], btc.AddrVerScript(false)).String(),
+		"bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4",
+	}
+	testnet := []string{
+		btc.NewAddrFromHash160(h160[:], btc.AddrVerPubkey(true)).String(),
+		btc.NewAddrFromHash160(h160[:], btc.AddrVerScript(true)).String(),
+		"tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+	}
+	isValid := func(addr string) bool {
+		_, ok := ValidateAddress(addr).(*ValidAddressResponse)
+		return ok
+	}
+	defer func() {
+		AllowedHRPs, AllowedVersions = nil, nil
+	}()
+
+	AllowedHRPs, AllowedVersions = nil, nil
+	for _, a := range append(mainnet, testnet...) {
+		if !isValid(a) {
+			t.Error("Address should be valid with no restrictions", a)
+		}
+	}
+
+	SetAddrNetwork(false)
+	for _, a := range mainnet {
+		if !isValid(a) {
+			t.Error("Mainnet address should be valid", a)
+		}
+	}
+	for _, a := range testnet {
+		if isValid(a) {
+			t.Error("Testnet address should not be valid on mainnet", a)
+		}
+	}
+
+	SetAddrNetwork(true)
+	for _, a := range mainnet {
+		if isValid(a) {
+			t.Error("Mainnet address should not be valid on testnet", a)
+		}
+	}
+}
+
+func TestValidateAddressTaproot(t *testing.T) {
+	res, ok := ValidateAddress("bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqzk5jj0").(*ValidAddressResponse)
+	if !ok {
+		t.Fatal("Taproot address not valid")
+	}
+	if res.ScriptPubKey != "512079be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798" {
+		t.Error("Bad Taproot scriptPubKey", res.ScriptPubKey)
+	}
+}
+
+func TestValidateAddressOwnership(t *testing.T) {
+	var h160 [20]byte
+	p2pkh := btc.NewAddrFromHash160(h160[:], btc.AddrVerPubkey(false)).String()
+	p2sh := btc.NewAddrFromHash160(h160[:], btc.AddrVerScript(false)).String()
+	p2wsh := "bc1qrp33g0q5c5txsp9arysrx4k6zdkfs4nce4xj0gdcccefvpysxf3qccfmv3"
+
+	res := ValidateAddress(p2pkh).(*ValidAddressResponse)
+	if res.IsMine || res.IsWatchOnly || res.IsScript {
+		t.Error("Bad flags for P2PKH without OwnershipChecker", res)
+	}
+	for _, a := range []string{p2sh, p2wsh} {
+		if res := ValidateAddress(a).(*ValidAddressResponse); !res.IsScript {
+			t.Error("IsScript not set", a)
+		}
+	}
+
+	defer func() {
+		OwnershipChecker = nil
+	}()
+	OwnershipChecker = func(a *btc.Addr) (bool, bool) {
+		return a.String() == p2pkh, a.String() == p2sh
+	}
+	if res := ValidateAddress(p2pkh).(*ValidAddressResponse); !res.IsMine || res.IsWatchOnly {
+		t.Error("Bad ownership of P2PKH", res)
+	}
+	if res := ValidateAddress(p2sh).(*ValidAddressResponse); res.IsMine || !res.IsWatchOnly {
+		t.Error("Bad ownership of P2SH", res)
+	}
+}
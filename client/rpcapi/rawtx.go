@@ -0,0 +1,127 @@
+package rpcapi
+
+import (
+	"encoding/hex"
+
+	"github.com/ParallelCoinTeam/duod/client/common"
+	"github.com/ParallelCoinTeam/duod/lib/btc"
+)
+
+// DecodedScript -
+type DecodedScript struct {
+	Asm string `json:"asm"`
+	Hex string `json:"hex"`
+}
+
+// DecodedPkScript -
+type DecodedPkScript struct {
+	Asm       string   `json:"asm"`
+	Hex       string   `json:"hex"`
+	Type      string   `json:"type"`
+	Addresses []string `json:"addresses,omitempty"`
+}
+
+// DecodedTxIn -
+type DecodedTxIn struct {
+	Coinbase    string         `json:"coinbase,omitempty"`
+	TxID        string         `json:"txid,omitempty"`
+	Vout        uint32         `json:"vout"`
+	ScriptSig   *DecodedScript `json:"scriptSig,omitempty"`
+	TxInWitness []string       `json:"txinwitness,omitempty"`
+	Sequence    uint32         `json:"sequence"`
+}
+
+// DecodedTxOut -
+type DecodedTxOut struct {
+	Value        float64         `json:"value"`
+	N            int             `json:"n"`
+	ScriptPubKey DecodedPkScript `json:"scriptPubKey"`
+}
+
+// DecodedTxResponse -
+type DecodedTxResponse struct {
+	TxID     string         `json:"txid"`
+	Hash     string         `json:"hash"`
+	Version  uint32         `json:"version"`
+	Size     int            `json:"size"`
+	VSize    int            `json:"vsize"`
+	Weight   int            `json:"weight"`
+	LockTime uint32         `json:"locktime"`
+	Vin      []DecodedTxIn  `json:"vin"`
+	Vout     []DecodedTxOut `json:"vout"`
+}
+
+// InvalidTxResponse -
+type InvalidTxResponse struct {
+	Error string `json:"error"`
+}
+
+// DecodeRawTransaction - Returns the transaction given as a hex string,
+// in the format of bitcoind's decoderawtransaction
+func DecodeRawTransaction(hexstr string) interface{} {
+	if len(hexstr) > 2*btc.MaxBlockWeight { // no transaction can be bigger than a block
+		return &InvalidTxResponse{Error: "TX decode failed: too long"}
+	}
+	raw, e := hex.DecodeString(hexstr)
+	if e != nil {
+		return &InvalidTxResponse{Error: "TX decode failed: " + e.Error()}
+	}
+	tx, n := btc.NewTx(raw)
+	if tx == nil || n != len(raw) {
+		return &InvalidTxResponse{Error: "TX decode failed"}
+	}
+	tx.SetHash(raw)
+
+	res := new(DecodedTxResponse)
+	res.TxID = tx.Hash.String()
+	res.Hash = tx.WTxID().String()
+	res.Version = tx.Version
+	res.Size = int(tx.Size)
+	res.VSize = tx.VSize()
+	res.Weight = tx.Weight()
+	res.LockTime = tx.LockTime
+
+	res.Vin = make([]DecodedTxIn, len(tx.TxIn))
+	for i, in := range tx.TxIn {
+		vin := &res.Vin[i]
+		if tx.IsCoinBase() {
+			vin.Coinbase = hex.EncodeToString(in.ScriptSig)
+		} else {
+			vin.TxID = btc.NewUint256(in.Input.Hash[:]).String()
+			vin.Vout = in.Input.Vout
+			vin.ScriptSig = &DecodedScript{Asm: disasm(in.ScriptSig), Hex: hex.EncodeToString(in.ScriptSig)}
+		}
+		if tx.SegWit != nil {
+			for _, w := range tx.SegWit[i] {
+				vin.TxInWitness = append(vin.TxInWitness, hex.EncodeToString(w))
+			}
+		}
+		vin.Sequence = in.Sequence
+	}
+
+	res.Vout = make([]DecodedTxOut, len(tx.TxOut))
+	for i, out := range tx.TxOut {
+		vout := &res.Vout[i]
+		vout.Value = float64(out.Value) / 1e8
+		vout.N = i
+		vout.ScriptPubKey.Asm = disasm(out.PkScript)
+		vout.ScriptPubKey.Hex = hex.EncodeToString(out.PkScript)
+		vout.ScriptPubKey.Type = btc.ClassifyScript(out.PkScript).String()
+		if a, e := btc.ExtractAddress(out.PkScript, common.CFG.Testnet); e == nil {
+			vout.ScriptPubKey.Addresses = []string{a.String()}
+		}
+	}
+	return res
+}
+
+// disasm - like btc.DisasmScript, but marks the place of an error, as bitcoind does
+func disasm(scr []byte) string {
+	asm, e := btc.DisasmScript(scr)
+	if e != nil {
+		if asm != "" {
+			asm += " "
+		}
+		asm += "[error]"
+	}
+	return asm
+}
@@ -0,0 +1,109 @@
+package rpcapi
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/ParallelCoinTeam/duod/lib/btc"
+)
+
+// rawTx builds a serialized transaction spending one input to a P2PKH and a nulldata output
+func rawTx(witness bool) (raw []byte, tx *btc.Tx) {
+	tx = new(btc.Tx)
+	tx.Version = 2
+	tx.LockTime = 500
+	in := new(btc.TxIn)
+	in.Input.Hash[0] = 0xab
+	in.Input.Vout = 3
+	in.ScriptSig = []byte{0x01, 0x02}
+	in.Sequence = 0xfffffffe
+	tx.TxIn = []*btc.TxIn{in}
+	var h160 [20]byte
+	p2pkh := btc.NewAddrFromHash160(h160[:], btc.AddrVerPubkey(false))
+	tx.TxOut = []*btc.TxOut{
+		{Value: 150000000, PkScript: p2pkh.OutScript()},
+		{Value: 1, PkScript: []byte{0x6a}},
+	}
+	if !witness {
+		return tx.Serialize(), tx
+	}
+	tx.SegWit = [][][]byte{{{0xde, 0xad}, {}}}
+
+	buf := new(bytes.Buffer)
+	buf.Write(tx.Serialize()[:4])
+	buf.Write([]byte{0, 1})
+	nowit := tx.Serialize()
+	buf.Write(nowit[4 : len(nowit)-4])
+	buf.Write([]byte{2, 2, 0xde, 0xad, 0})
+	buf.Write(nowit[len(nowit)-4:])
+	return buf.Bytes(), tx
+}
+
+func TestDecodeRawTransaction(t *testing.T) {
+	for _, witness := range []bool{false, true} {
+		raw, tx := rawTx(witness)
+		res, ok := DecodeRawTransaction(hex.EncodeToString(raw)).(*DecodedTxResponse)
+		if !ok {
+			t.Fatal("DecodeRawTransaction failed", witness)
+		}
+		tx.SetHash(raw)
+		if res.TxID != tx.Hash.String() || res.Hash != tx.WTxID().String() {
+			t.Error("Bad txid", witness, res.TxID, res.Hash)
+		}
+		if witness == (res.TxID == res.Hash) {
+			t.Error("Bad hash / txid", witness)
+		}
+		if res.Version != 2 || res.LockTime != 500 || res.Size != len(raw) {
+			t.Error("Bad header", witness, res.Version, res.LockTime, res.Size)
+		}
+		if len(res.Vin) != 1 || res.Vin[0].Vout != 3 || res.Vin[0].ScriptSig == nil ||
+			res.Vin[0].ScriptSig.Hex != "0102" || res.Vin[0].Sequence != 0xfffffffe ||
+			res.Vin[0].TxID != btc.NewUint256(tx.TxIn[0].Input.Hash[:]).String() {
+			t.Error("Bad vin", witness, res.Vin)
+		}
+		if witness && (len(res.Vin[0].TxInWitness) != 2 || res.Vin[0].TxInWitness[0] != "dead") {
+			t.Error("Bad txinwitness", res.Vin[0].TxInWitness)
+		}
+		if len(res.Vout) != 2 || res.Vout[0].Value != 1.5 || res.Vout[1].N != 1 {
+			t.Fatal("Bad vout", witness, res.Vout)
+		}
+		if len(res.Vout[0].ScriptPubKey.Addresses) != 1 || res.Vout[0].ScriptPubKey.Addresses[0] != "1111111111111111111114oLvT2" {
+			t.Error("Bad vout address", res.Vout[0].ScriptPubKey.Addresses)
+		}
+		if res.Vin[0].ScriptSig.Asm != "2" || res.Vout[1].ScriptPubKey.Asm != "OP_RETURN" ||
+			res.Vout[0].ScriptPubKey.Asm != "OP_DUP OP_HASH160 0000000000000000000000000000000000000000 OP_EQUALVERIFY OP_CHECKSIG" {
+			t.Error("Bad asm", res.Vin[0].ScriptSig.Asm, res.Vout[0].ScriptPubKey.Asm, res.Vout[1].ScriptPubKey.Asm)
+		}
+		if res.Vout[1].ScriptPubKey.Hex != "6a" || res.Vout[1].ScriptPubKey.Addresses != nil {
+			t.Error("Bad nulldata vout", res.Vout[1].ScriptPubKey)
+		}
+		if res.Vout[0].ScriptPubKey.Type != "pubkeyhash" || res.Vout[1].ScriptPubKey.Type != "nulldata" {
+			t.Error("Bad vout type", res.Vout[0].ScriptPubKey.Type, res.Vout[1].ScriptPubKey.Type)
+		}
+		if _, e := json.Marshal(res); e != nil {
+			t.Error(e)
+		}
+	}
+}
+
+func TestDecodeRawTransactionInvalid(t *testing.T) {
+	raw, _ := rawTx(false)
+	for _, s := range []string{"", "zz", "0100", hex.EncodeToString(raw[:len(raw)-1]), hex.EncodeToString(append(raw, 0))} {
+		if _, ok := DecodeRawTransaction(s).(*InvalidTxResponse); !ok {
+			t.Error("Invalid transaction decoded", s)
+		}
+	}
+
+	// huge input count in a segwit tx (it must not try to allocate for it)
+	raw, _ = rawTx(true)
+	bad := append(append(append([]byte{}, raw[:6]...), 0xfe, 0xff, 0xff, 0xff, 0xff), raw[7:]...)
+	if _, ok := DecodeRawTransaction(hex.EncodeToString(bad)).(*InvalidTxResponse); !ok {
+		t.Error("Transaction with huge input count decoded")
+	}
+	if _, ok := DecodeRawTransaction(strings.Repeat("00", btc.MaxBlockWeight+1)).(*InvalidTxResponse); !ok {
+		t.Error("Too long transaction decoded")
+	}
+}
@@ -124,6 +124,18 @@ func myHandler(w http.ResponseWriter, r *http.Request) {
 			L.Debug("unexpected type", uu)
 		}
 
+	case "decoderawtransaction":
+		switch uu := RPCCmd.Params.(type) {
+		case []interface{}:
+			if len(uu) >= 1 {
+				if s, ok := uu[0].(string); ok {
+					resp.Result = DecodeRawTransaction(s)
+				}
+			}
+		default:
+			L.Debug("unexpected type", uu)
+		}
+
 	case "submitblock":
 		//ioutil.WriteFile("submitblock.json", b, 0777)
 		SubmitBlock(&RPCCmd, &resp, b)
@@ -146,6 +158,7 @@ func myHandler(w http.ResponseWriter, r *http.Request) {
 // StartServer -
 func StartServer(port uint32) {
 	L.Debug("Starting RPC server at port ", port)
+	SetAddrNetwork(common.CFG.Testnet)
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", myHandler)
 	http.ListenAndServe(fmt.Sprint("127.0.0.1:", port), mux)
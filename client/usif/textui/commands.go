@@ -392,7 +392,7 @@ func showAddresses(par string) {
 		cnt := 0
 		peersdb.PeerDB.Browse(func(k qdb.KeyType, v []byte) uint32 {
 			pr := peersdb.NewPeer(v)
-			if pr.Banned != 0 {
+			if pr.IsBanned() {
 				cnt++
 				fmt.Printf("%4d) %s\n", cnt, pr.String())
 			}
@@ -442,25 +442,22 @@ func unbanPeer(par string) {
 		fmt.Println("Unban all peers ...")
 	}
 
-	var keys []qdb.KeyType
-	var vals [][]byte
+	var peers []*peersdb.PeerAddr
 	peersdb.PeerDB.Browse(func(k qdb.KeyType, v []byte) uint32 {
 		peer := peersdb.NewPeer(v)
 		if peer.Banned != 0 {
 			if ad == nil || peer.IP() == ad.IP() {
 				fmt.Println(" -", peer.NetAddr.String())
-				peer.Banned = 0
-				keys = append(keys, k)
-				vals = append(vals, peer.Bytes())
+				peers = append(peers, peer) // we cannot call Put() from here
 			}
 		}
 		return 0
 	})
-	for i := range keys {
-		peersdb.PeerDB.Put(keys[i], vals[i])
+	for _, peer := range peers {
+		peer.Unban()
 	}
 
-	fmt.Println(len(keys), "peer(s) un-baned")
+	fmt.Println(len(peers), "peer(s) un-baned")
 }
 
 func showCached(par string) {
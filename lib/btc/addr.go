@@ -39,9 +39,10 @@ type SegwitProg struct {
 // NewAddrFromString -
 func NewAddrFromString(hs string) (a *Addr, e error) {
 	if strings.HasPrefix(hs, "bc1") || strings.HasPrefix(hs, "tb1") {
+		// version 0 has bech32 checksum, while 1+ (i.e. Taproot) has bech32m (BIP-350)
 		var sw = &SegwitProg{HRP: hs[:2]}
-		sw.Version, sw.Program = bech32.SegwitDecode(sw.HRP, hs)
-		if sw.Program != nil {
+		if version, program, er := bech32.SegwitAddrDecode(sw.HRP, hs); er == nil {
+			sw.Version, sw.Program = int(version), program
 			a = &Addr{SegwitProg: sw}
 		}
 		return
@@ -118,7 +119,7 @@ func NewAddrFromPkScript(scr []byte, testnet bool) *Addr {
 	if version, program := IsWitnessProgram(scr); program != nil {
 		sw := &SegwitProg{HRP: GetSegwitHRP(testnet), Version: version, Program: program}
 
-		str := bech32.SegwitEncode(sw.HRP, version, program)
+		str := sw.String()
 		if str == "" {
 			return nil
 		}
@@ -232,13 +233,19 @@ func (a *Addr) Owns(scr []byte) (yes bool) {
 // OutScript -
 func (a *Addr) OutScript() (res []byte) {
 	if a.SegwitProg != nil {
-		if a.SegwitProg.Version != 0 || (len(a.SegwitProg.Program) != 20 && len(a.SegwitProg.Program) != 32) {
-			panic("Only Segwit programs version 0 and length 20 or 32 supported")
+		ver, prog := a.SegwitProg.Version, a.SegwitProg.Program
+		if ver < 0 || ver > 16 || len(prog) < 2 || len(prog) > 40 ||
+			ver == 0 && len(prog) != 20 && len(prog) != 32 {
+			panic(fmt.Sprint("Invalid Segwit program version ", ver, " length ", len(prog)))
 		}
-		res = make([]byte, 2+len(a.SegwitProg.Program))
-		res[0] = 0x00 // OP_0
-		res[1] = byte(len(a.SegwitProg.Program))
-		copy(res[2:], a.SegwitProg.Program)
+		res = make([]byte, 2+len(prog))
+		if ver == 0 {
+			res[0] = OP_0
+		} else {
+			res[0] = byte(OP_1 - 1 + ver) // OP_1 (Taproot) ... OP_16
+		}
+		res[1] = byte(len(prog))
+		copy(res[2:], prog)
 	} else if a.Version == AddrVerPubkey(false) || a.Version == AddrVerPubkey(true) || a.Version == 48 /*Litecoin*/ {
 		res = make([]byte, 25)
 		res[0] = 0x76
@@ -321,8 +328,12 @@ func DecodeBase58(s string) (res []byte) {
 	return
 }
 
+// String - bech32 (version 0) or bech32m (version 1+) encoded address
 func (sw *SegwitProg) String() (res string) {
-	res = bech32.SegwitEncode(sw.HRP, sw.Version, sw.Program)
+	if sw.Version < 0 || sw.Version > 16 {
+		return
+	}
+	res, _ = bech32.SegwitAddrEncode(sw.HRP, byte(sw.Version), sw.Program)
 	return
 }
 
@@ -115,3 +115,31 @@ func TestBase58(t *testing.T) {
 		}
 	}
 }
+
+func TestTaprootAddr(t *testing.T) {
+	const addr = "bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqzk5jj0"
+	const spk = "512079be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798"
+	a, e := NewAddrFromString(addr)
+	if e != nil || a == nil || a.SegwitProg == nil || a.SegwitProg.Version != 1 || len(a.SegwitProg.Program) != 32 {
+		t.Fatal("NewAddrFromString fails for Taproot address", e)
+	}
+	if s := hex.EncodeToString(a.OutScript()); s != spk {
+		t.Error("Bad Taproot OutScript", s)
+	}
+	if a.String() != addr {
+		t.Error("Bad Taproot String", a.String())
+	}
+	scr, _ := hex.DecodeString(spk)
+	if b := NewAddrFromPkScript(scr, false); b == nil || b.String() != addr {
+		t.Error("NewAddrFromPkScript fails for Taproot")
+	}
+
+	// the same program with bech32 checksum (as per BIP-173) is not valid anymore
+	if a, _ := NewAddrFromString("bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqh2y7hd"); a != nil {
+		t.Error("NewAddrFromString accepts version 1 with bech32 checksum")
+	}
+	if a, _ := NewAddrFromString("bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4"); a == nil ||
+		hex.EncodeToString(a.OutScript()) != "0014751e76e8199196d454941c45d1b3a323f1433bd6" {
+		t.Error("NewAddrFromString fails for version 0")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"io"
 	"sync"
 )
 
@@ -28,6 +29,8 @@ type Block struct {
 	NoWitnessData []byte // This is set by BuildNoWitnessData()
 }
 
+var witnessCommitmentHeader = []byte{0x6a, 0x24, 0xaa, 0x21, 0xa9, 0xed} // OP_RETURN, push 36 bytes, 0xaa21a9ed
+
 // BlockExtraInfo -
 type BlockExtraInfo struct {
 	VerifyFlags uint32
@@ -46,6 +49,157 @@ func NewBlock(data []byte) (bl *Block, er error) {
 	return
 }
 
+// NewBlockFromReader - Reads one serialized block from the given stream (e.g. a blkXXXXX.dat file
+// or a network connection) and returns it with the transactions already parsed, like BuildTxList does.
+// The transactions are read one by one, so no more than the block's own bytes are taken from the reader
+// and a bogus length field fails as soon as the data ends, instead of allocating the claimed size upfront.
+// Returns io.EOF if the stream ends before the block starts and io.ErrUnexpectedEOF if it ends in the middle.
+func NewBlockFromReader(r io.Reader) (bl *Block, er error) {
+	br := &blockReader{r: r}
+	if er = br.read(80); er != nil {
+		if er == io.ErrUnexpectedEOF && br.buf.Len() == 0 {
+			er = io.EOF
+		}
+		return
+	}
+	var cnt uint64
+	if cnt, er = br.varint(); er != nil {
+		return
+	}
+	if cnt == 0 {
+		er = errors.New("Block's txn_count field corrupt - RPC_Result:bad-blk-length")
+		return
+	}
+	txoffs := br.buf.Len()
+	for i := uint64(0); i < cnt; i++ {
+		if er = br.tx(); er != nil {
+			return
+		}
+	}
+	data := br.buf.Bytes()
+	bl = new(Block)
+	bl.Hash = NewSha2Hash(data[:80])
+	bl.Raw = data
+	bl.TxCount, bl.TxOffset = int(cnt), txoffs
+	if er = bl.BuildTxList(); er != nil {
+		bl = nil
+	}
+	return
+}
+
+// blockReader - Copies the fields of a block from the reader into buf, as they get parsed
+type blockReader struct {
+	r   io.Reader
+	buf bytes.Buffer
+}
+
+// read - Copies n bytes, never growing the buffer beyond what has actually been read
+func (br *blockReader) read(n uint64) error {
+	if n > MaxBlockWeight-uint64(br.buf.Len()) { // the sum could overflow for a huge n
+		return errors.New("NewBlockFromReader: block too big")
+	}
+	if _, e := io.CopyN(&br.buf, br.r, int64(n)); e != nil {
+		if e == io.EOF {
+			e = io.ErrUnexpectedEOF
+		}
+		return e
+	}
+	return nil
+}
+
+// varint - Copies a var_int and returns its value
+func (br *blockReader) varint() (uint64, error) {
+	offs := br.buf.Len()
+	if e := br.read(1); e != nil {
+		return 0, e
+	}
+	var size uint64
+	switch br.buf.Bytes()[offs] {
+	case 0xfd:
+		size = 2
+	case 0xfe:
+		size = 4
+	case 0xff:
+		size = 8
+	}
+	if size > 0 {
+		if e := br.read(size); e != nil {
+			return 0, e
+		}
+	}
+	res, _ := VULe(br.buf.Bytes()[offs:])
+	return res, nil
+}
+
+// bytes - Copies a var_int length followed by that many bytes
+func (br *blockReader) bytes() error {
+	le, e := br.varint()
+	if e == nil {
+		e = br.read(le)
+	}
+	return e
+}
+
+// tx - Copies one transaction, following the same layout as NewTx
+func (br *blockReader) tx() (e error) {
+	var cnt, ins, i, j uint64
+	var segwit bool
+	if e = br.read(4); e != nil { // version
+		return
+	}
+	if ins, e = br.varint(); e != nil {
+		return
+	}
+	if ins == 0 { // segwit marker
+		offs := br.buf.Len()
+		if e = br.read(1); e != nil {
+			return
+		}
+		if br.buf.Bytes()[offs] != 1 {
+			return errors.New("NewBlockFromReader: bad segwit flag")
+		}
+		segwit = true
+		if ins, e = br.varint(); e != nil {
+			return
+		}
+	}
+	for i = 0; i < ins; i++ {
+		if e = br.read(36); e != nil { // outpoint
+			return
+		}
+		if e = br.bytes(); e != nil { // script
+			return
+		}
+		if e = br.read(4); e != nil { // sequence
+			return
+		}
+	}
+	if cnt, e = br.varint(); e != nil {
+		return
+	}
+	for i = 0; i < cnt; i++ {
+		if e = br.read(8); e != nil { // value
+			return
+		}
+		if e = br.bytes(); e != nil { // pk_script
+			return
+		}
+	}
+	if segwit {
+		for i = 0; i < ins; i++ {
+			if cnt, e = br.varint(); e != nil {
+				return
+			}
+			for j = 0; j < cnt; j++ {
+				if e = br.bytes(); e != nil {
+					return
+				}
+			}
+		}
+	}
+	return br.read(4) // lock_time
+}
+
 // UpdateContent -
 func (bl *Block) UpdateContent(data []byte) error {
 	if len(data) < 81 {
@@ -152,6 +306,11 @@ func (bl *Block) BuildTxList() (e error) {
 	return
 }
 
+// Weight - Returns the block's weight (3 * stripped size + total size), as calculated by BuildTxList()
+func (bl *Block) Weight() int {
+	return int(bl.BlockWeight)
+}
+
 // BuildNoWitnessData - The block data in non-segwit format
 func (bl *Block) BuildNoWitnessData() (e error) {
 	if bl.TxCount == 0 {
@@ -175,6 +334,24 @@ func (bl *Block) BuildNoWitnessData() (e error) {
 	return
 }
 
+// WitnessCommitment - Returns the witness commitment from the coinbase transaction.
+// If more than one output matches, the one with the highest index is taken (BIP141).
+// BuildTxList() must have been called before.
+func (bl *Block) WitnessCommitment() (res [32]byte, ok bool) {
+	if len(bl.Txs) == 0 {
+		return
+	}
+	outs := bl.Txs[0].TxOut
+	for i := len(outs) - 1; i >= 0; i-- {
+		if pks := outs[i].PkScript; len(pks) >= 38 && bytes.Equal(pks[:6], witnessCommitmentHeader) {
+			copy(res[:], pks[6:38])
+			ok = true
+			return
+		}
+	}
+	return
+}
+
 // GetBlockReward -
 func GetBlockReward(height uint32) uint64 {
 	return 50e8 >> (height / 210000)
@@ -1,15 +1,21 @@
 package btc
 
 import (
+	"bytes"
 	"encoding/hex"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"strings"
 	"testing"
 )
 
 const blockHash = "0000000000000000000884ad62c7036a7e2022bca3f0bd68628414150e8a0ea6"
 
+// The signed transaction from the native P2WPKH example of BIP-143
+const segwitTxHex = "01000000000102fff7f7881a8099afa6940d42d1e7f6362bec38171ea3edf433541db4e4ad969f00000000494830450221008b9d1dc26ba6a9cb62127b02742fa9d754cd3bebf337f7a55d114c8e5cdd30be022040529b194ba3f9281a99f2b1c0a19c0489bc22ede944ccf4ecbab4cc618ef3ed01eeffffffef51e1b804cc89d182d279655c3aa89e815b1b309fe287d9b2b55d57b90ec68a0100000000ffffffff02202cb206000000001976a9148280b37df378db99f66f85c95a783a76ac7a6d5988ac9093510d000000001976a9143bde42dbee7e4dbe6a21b2d50ce2f0167faa815988ac000247304402203609e17b84f6a7d30c80bfa610b5b4542f32a8a0d5447a12fb1366d7f01cc44a0220573a954c4518331561406f90300e8f3358f51928d43c212a8caed02de67eebee0121025476c2e83188368da1ff3e292e7acafcdb3566bb0ad253f62fc70f07aeee635711000000"
+
 var _blockFilename = ""
 
 func blockFilename() string {
@@ -84,3 +90,164 @@ func BenchmarkCalcMerkle(b *testing.B) {
 		CalcMerkle(mtr)
 	}
 }
+
+func TestWitnessCommitment(t *testing.T) {
+	var nonce [32]byte
+	tx1 := &Tx{Version: 1, TxIn: []*TxIn{{Input: TxPrevOut{Hash: [32]byte{1}}, ScriptSig: []byte{0x51}, Sequence: 0xffffffff}},
+		TxOut: []*TxOut{{Value: 1000, PkScript: []byte{0x51}}}}
+	cb := &Tx{Version: 1, TxIn: []*TxIn{{Input: TxPrevOut{Vout: 0xffffffff}, ScriptSig: []byte{3, 1, 2, 3}, Sequence: 0xffffffff}},
+		SegWit: [][][]byte{{nonce[:]}}}
+	tx1.SetHash(tx1.Serialize())
+
+	merkle, _ := GetWitnessMerkle([]*Tx{cb, tx1})
+	exp := Sha2Sum(append(merkle, nonce[:]...))
+	cb.TxOut = []*TxOut{{Value: 50e8, PkScript: []byte{0x51}},
+		{Value: 0, PkScript: append([]byte{0x6a, 0x24, 0xaa, 0x21, 0xa9, 0xed}, exp[:]...)}}
+
+	raw := new(bytes.Buffer)
+	raw.Write(make([]byte, 80))
+	WriteVlen(raw, 2)
+	raw.Write(cb.SerializeNew())
+	raw.Write(tx1.Serialize())
+
+	bl, e := NewBlock(raw.Bytes())
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	if res, ok := bl.WitnessCommitment(); ok {
+		t.Error("Commitment found before BuildTxList", res)
+	}
+	if e = bl.BuildTxList(); e != nil {
+		t.Fatal(e.Error())
+	}
+	res, ok := bl.WitnessCommitment()
+	if !ok || res != exp {
+		t.Error("Bad witness commitment", ok, hex.EncodeToString(res[:]))
+	}
+	merkle, _ = GetWitnessMerkle(bl.Txs)
+	if Sha2Sum(append(merkle, bl.Txs[0].SegWit[0][0]...)) != res {
+		t.Error("Witness commitment does not match the block")
+	}
+}
+
+func TestBuildTxListSegwit(t *testing.T) {
+	var nonce [32]byte
+	txraw, _ := hex.DecodeString(segwitTxHex)
+	tx1, _ := NewTx(txraw)
+	tx1.SetHash(txraw)
+	cb := &Tx{Version: 1, TxIn: []*TxIn{{Input: TxPrevOut{Vout: 0xffffffff}, ScriptSig: []byte{3, 1, 2, 3}, Sequence: 0xffffffff}},
+		SegWit: [][][]byte{{nonce[:]}}}
+	merkle, _ := GetWitnessMerkle([]*Tx{cb, tx1})
+	exp := Sha2Sum(append(merkle, nonce[:]...))
+	cb.TxOut = []*TxOut{{Value: 50e8, PkScript: []byte{0x51}},
+		{Value: 0, PkScript: append(append([]byte{}, witnessCommitmentHeader...), exp[:]...)}}
+	cbraw := cb.SerializeNew()
+
+	raw := new(bytes.Buffer)
+	raw.Write(make([]byte, 80))
+	WriteVlen(raw, 2)
+	raw.Write(cbraw)
+	raw.Write(txraw)
+
+	bl, e := NewBlock(raw.Bytes())
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	if e = bl.BuildTxList(); e != nil {
+		t.Fatal(e.Error())
+	}
+
+	// witness stack lengths of each input
+	exps := [][]int{{1}, {0, 2}}
+	for i, tx := range bl.Txs {
+		if len(tx.SegWit) != len(exps[i]) {
+			t.Fatal("Bad number of witnesses in tx", i, len(tx.SegWit))
+		}
+		for j, l := range exps[i] {
+			if len(tx.Witness(j)) != l {
+				t.Error("Bad witness stack length", i, j, len(tx.Witness(j)))
+			}
+		}
+	}
+	if !bytes.Equal(bl.Txs[1].Witness(1)[1], txraw[len(txraw)-4-33:len(txraw)-4]) {
+		t.Error("Bad witness data")
+	}
+
+	if bl.Txs[1].Hash != tx1.Hash || *bl.Txs[1].WTxID() != *tx1.WTxID() || bl.Txs[1].Hash == *bl.Txs[1].WTxID() {
+		t.Error("Bad txid / wtxid", bl.Txs[1].Hash.String(), bl.Txs[1].WTxID().String())
+	}
+	if bl.Txs[1].Size != 343 || bl.Txs[1].NoWitSize != 233 {
+		t.Error("Bad tx sizes", bl.Txs[1].Size, bl.Txs[1].NoWitSize)
+	}
+	if res, ok := bl.WitnessCommitment(); !ok || res != exp {
+		t.Error("Bad witness commitment", ok, hex.EncodeToString(res[:]))
+	}
+	if merkle, _ = GetWitnessMerkle(bl.Txs); Sha2Sum(append(merkle, bl.Txs[0].Witness(0)[0]...)) != exp {
+		t.Error("Witness commitment does not match the block")
+	}
+	if e = bl.BuildNoWitnessData(); e != nil || len(bl.NoWitnessData) != bl.NoWitnessSize {
+		t.Error("Bad NoWitnessData", e)
+	}
+	if w := 3*len(bl.NoWitnessData) + len(bl.Raw); bl.Weight() != w {
+		t.Error("Bad block weight", bl.Weight(), w)
+	}
+	if w := 4*(80+1) + 3*len(cb.Serialize()) + len(cbraw) + 1042; bl.Weight() != w {
+		t.Error("Bad block weight", bl.Weight(), w)
+	}
+}
+
+func TestNewBlockFromReader(t *testing.T) {
+	gen, _ := hex.DecodeString(genesisBlockHex)
+	txraw, _ := hex.DecodeString(segwitTxHex)
+	sw := new(bytes.Buffer)
+	sw.Write(gen[:80])
+	WriteVlen(sw, 2)
+	sw.Write(gen[81:])
+	sw.Write(txraw)
+
+	// two blocks in a row, as in a blkXXXXX.dat file
+	rd := bytes.NewReader(append(append([]byte{}, gen...), sw.Bytes()...))
+	for _, raw := range [][]byte{gen, sw.Bytes()} {
+		bl, e := NewBlockFromReader(rd)
+		if e != nil {
+			t.Fatal(e.Error())
+		}
+		exp, _ := NewBlock(raw)
+		exp.BuildTxList()
+		if !bytes.Equal(bl.Raw, raw) || bl.Hash.String() != exp.Hash.String() || bl.TxOffset != exp.TxOffset {
+			t.Error("Bad block", bl.Hash.String())
+		}
+		if len(bl.Txs) != len(exp.Txs) || bl.Weight() != exp.Weight() || bl.NoWitnessSize != exp.NoWitnessSize {
+			t.Fatal("Bad transactions", len(bl.Txs), bl.Weight(), exp.Weight())
+		}
+		for i, tx := range bl.Txs {
+			if tx.Hash != exp.Txs[i].Hash || *tx.WTxID() != *exp.Txs[i].WTxID() || !bytes.Equal(tx.Raw, exp.Txs[i].Raw) {
+				t.Error("Bad tx", i, tx.Hash.String())
+			}
+		}
+	}
+	if bl, e := NewBlockFromReader(rd); e != io.EOF {
+		t.Error("Expected io.EOF at the end of stream", bl, e)
+	}
+
+	for _, n := range []int{1, 79, 80, 81, 100, len(sw.Bytes()) - 1} {
+		if bl, e := NewBlockFromReader(bytes.NewReader(sw.Bytes()[:n])); e != io.ErrUnexpectedEOF {
+			t.Error("Expected io.ErrUnexpectedEOF for truncated block", n, bl, e)
+		}
+	}
+
+	// a huge script length must fail on the missing data, not try to allocate it
+	bad := append(append([]byte{}, gen[:81+4+1+36]...), 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+	// ... even if it is so close to 2^64 that adding the size read so far overflows
+	if _, e := NewBlockFromReader(bytes.NewReader(append(bad, gen[81+4+1+36:]...))); e == nil || !strings.Contains(e.Error(), "too big") {
+		t.Error("Expected block too big error for length overflowing", e)
+	}
+	bad[len(bad)-1] = 0x7f
+	if _, e := NewBlockFromReader(bytes.NewReader(bad)); e == nil || !strings.Contains(e.Error(), "too big") {
+		t.Error("Expected block too big error", e)
+	}
+	bad[len(bad)-9], bad[len(bad)-8], bad[len(bad)-7] = 0xfd, 0x00, 0x10
+	if _, e := NewBlockFromReader(bytes.NewReader(bad[:len(bad)-6])); e != io.ErrUnexpectedEOF {
+		t.Error("Expected io.ErrUnexpectedEOF for truncated script", e)
+	}
+}
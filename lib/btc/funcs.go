@@ -2,7 +2,6 @@ package btc
 
 import (
 	"bytes"
-	"crypto/sha256"
 	"encoding/base64"
 	"encoding/binary"
 	"errors"
@@ -121,16 +120,7 @@ func CalcMerkle(mtr [][32]byte) (res []byte, mutated bool) {
 			if i != i2 && bytes.Equal(mtr[j+i][:], mtr[j+i2][:]) {
 				mutated = true
 			}
-			s := sha256.New()
-			s.Write(mtr[j+i][:])
-			s.Write(mtr[j+i2][:])
-			tmp := s.Sum(nil)
-			s.Reset()
-			s.Write(tmp)
-
-			var sum [32]byte
-			copy(sum[:], s.Sum(nil))
-			mtr = append(mtr, sum)
+			mtr = append(mtr, merkleParent(mtr[j+i], mtr[j+i2]))
 		}
 		j += siz
 	}
@@ -207,6 +197,44 @@ func WriteVlen(b io.Writer, varLen uint64) {
 	binary.Write(b, binary.LittleEndian, varLen)
 }
 
+// ReadVarInt - Reads Bitcoin's compact size (var_int) from the given reader.
+// Unlike ReadVLen, it returns an error if the value is not encoded in the shortest form.
+func ReadVarInt(r io.Reader) (uint64, error) {
+	var buf [9]byte
+	if e := ReadAll(r, buf[:1]); e != nil {
+		return 0, e
+	}
+	size := 1
+	switch buf[0] {
+	case 0xfd:
+		size = 3
+	case 0xfe:
+		size = 5
+	case 0xff:
+		size = 9
+	}
+	if size > 1 {
+		if e := ReadAll(r, buf[1:size]); e != nil {
+			return 0, e
+		}
+	}
+	res, _ := VULe(buf[:size])
+	if VLenSize(res) != size {
+		return 0, errors.New("ReadVarInt: non-canonical encoding")
+	}
+	return res, nil
+}
+
+// WriteVarInt - Writes Bitcoin's compact size (var_int) into the given writer
+func WriteVarInt(w io.Writer, v uint64) {
+	WriteVlen(w, v)
+}
+
+// VarIntSize - Returns number of bytes that WriteVarInt writes for the given value
+func VarIntSize(v uint64) int {
+	return VLenSize(v)
+}
+
 // WritePutLen - Writes opcode to put a specific number of bytes to stack
 func WritePutLen(b io.Writer, dataLen uint32) {
 	switch {
@@ -323,6 +351,29 @@ func IsP2SH(d []byte) bool {
 	return len(d) == 23 && d[0] == 0xa9 && d[1] == 20 && d[22] == 0x87
 }
 
+// IsOpReturn - Returns true if the given PK_script is a data-carrier (starts with OP_RETURN)
+func IsOpReturn(scr []byte) bool {
+	return len(scr) > 0 && scr[0] == OP_RETURN
+}
+
+// OpReturnData - Returns the data pushed after OP_RETURN (concatenated, if there are more pushes).
+// Returns nil if the script is not a data-carrier, or an empty slice if it carries no data.
+func OpReturnData(scr []byte) (res []byte) {
+	if !IsOpReturn(scr) {
+		return
+	}
+	res = []byte{}
+	for idx := 1; idx < len(scr); {
+		_, dat, n, e := GetOpcode(scr[idx:])
+		if e != nil {
+			break
+		}
+		res = append(res, dat...)
+		idx += n
+	}
+	return
+}
+
 // IsUsefullOutScript - Returns true if the given PK_script is anyhow usefull to Duod's node
 func IsUsefullOutScript(v []byte) bool {
 	if len(v) == 25 && v[0] == 0x76 && v[1] == 0xa9 && v[2] == 0x14 && v[23] == 0x88 && v[24] == 0xac {
@@ -368,7 +419,7 @@ func GetOpcode(b []byte) (opcode int, ret []byte, pc int, e error) {
 				e = errors.New("GetOpcode error 4")
 				return
 			}
-			size = int(binary.LittleEndian.Uint16(b[pc : pc+4]))
+			size = int(binary.LittleEndian.Uint32(b[pc : pc+4]))
 			pc += 4
 		}
 		if pc+size > len(b) {
@@ -1,6 +1,7 @@
 package btc
 
 import (
+	"bytes"
 	"testing"
 )
 
@@ -59,3 +60,38 @@ func TestParseAmount(t *testing.T) {
 		}
 	}
 }
+
+func TestVarInt(t *testing.T) {
+	var tv = []struct {
+		v    uint64
+		size int
+	}{
+		{0, 1}, {0xfc, 1}, {0xfd, 3}, {0xffff, 3}, {0x10000, 5},
+		{0xffffffff, 5}, {0x100000000, 9}, {0xffffffffffffffff, 9},
+	}
+	for _, x := range tv {
+		buf := new(bytes.Buffer)
+		WriteVarInt(buf, x.v)
+		if buf.Len() != x.size || VarIntSize(x.v) != x.size {
+			t.Error("Bad size", x.v, buf.Len(), VarIntSize(x.v))
+		}
+		v, e := ReadVarInt(buf)
+		if e != nil || v != x.v {
+			t.Error("Bad value read", x.v, v, e)
+		}
+		if buf.Len() != 0 {
+			t.Error("Bytes left after ReadVarInt", x.v)
+		}
+	}
+
+	for _, b := range [][]byte{{0xfd, 0xfc, 0}, {0xfe, 0xff, 0xff, 0, 0}, {0xff, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0}} {
+		if _, e := ReadVarInt(bytes.NewReader(b)); e == nil {
+			t.Error("Non-canonical var_int accepted", b)
+		}
+	}
+	for _, b := range [][]byte{{}, {0xfd, 0xfd}, {0xff, 1, 2, 3}} {
+		if _, e := ReadVarInt(bytes.NewReader(b)); e == nil {
+			t.Error("Truncated var_int accepted", b)
+		}
+	}
+}
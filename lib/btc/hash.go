@@ -3,41 +3,73 @@ package btc
 import (
 	"bytes"
 	"crypto/sha256"
+	"hash"
+	"sync"
 
 	"golang.org/x/crypto/ripemd160"
 )
 
-// ShaHash -
-func ShaHash(b []byte, out []byte) {
-	s := sha256.New()
-	s.Write(b[:])
-	tmp := s.Sum(nil)
+// hasher - hash.Hash with a buffer for its result, kept in a pool, so hashing does not allocate
+type hasher struct {
+	hash.Hash
+	buf [32]byte
+}
+
+var (
+	sha256Pool    = sync.Pool{New: func() interface{} { return &hasher{Hash: sha256.New()} }}
+	ripemd160Pool = sync.Pool{New: func() interface{} { return &hasher{Hash: ripemd160.New()} }}
+)
+
+// DoubleSha256 - Returns hash: SHA256( SHA256( data ) )
+func DoubleSha256(b []byte) (out [32]byte) {
+	s := sha256Pool.Get().(*hasher)
+	s.Reset()
+	s.Write(b)
+	s.Sum(s.buf[:0])
+	s.Reset()
+	s.Write(s.buf[:])
+	copy(out[:], s.Sum(s.buf[:0]))
+	sha256Pool.Put(s)
+	return
+}
+
+// Hash160 - Returns hash: RIPEMD160( SHA256( data ) )
+func Hash160(b []byte) (out [20]byte) {
+	s := sha256Pool.Get().(*hasher)
 	s.Reset()
-	s.Write(tmp)
-	copy(out[:], s.Sum(nil))
+	s.Write(b)
+	s.Sum(s.buf[:0])
+	r := ripemd160Pool.Get().(*hasher)
+	r.Reset()
+	r.Write(s.buf[:])
+	copy(out[:], r.Sum(r.buf[:0]))
+	ripemd160Pool.Put(r)
+	sha256Pool.Put(s)
+	return
+}
+
+// ShaHash - Stores SHA256( SHA256( data ) ) in out
+func ShaHash(b []byte, out []byte) {
+	h := DoubleSha256(b)
+	copy(out, h[:])
 }
 
 // Sha2Sum - Returns hash: SHA256( SHA256( data ) )
-// Where possible, using ShaHash() should be a bit faster
+// Same as DoubleSha256
 func Sha2Sum(b []byte) (out [32]byte) {
-	ShaHash(b, out[:])
-	return
+	return DoubleSha256(b)
 }
 
-// RimpHash -
+// RimpHash - Stores RIPEMD160( SHA256( data ) ) in out
 func RimpHash(in []byte, out []byte) {
-	sha := sha256.New()
-	sha.Write(in)
-	rim := ripemd160.New()
-	rim.Write(sha.Sum(nil)[:])
-	copy(out, rim.Sum(nil))
+	h := Hash160(in)
+	copy(out, h[:])
 }
 
 // Rimp160AfterSha256 -Returns hash: RIMP160( SHA256( data ) )
-// Where possible, using RimpHash() should be a bit faster
+// Same as Hash160
 func Rimp160AfterSha256(b []byte) (out [20]byte) {
-	RimpHash(b, out[:])
-	return
+	return Hash160(b)
 }
 
 // HashFromMessage - This function is used to sign and verify messages using the bitcoin standard.
@@ -0,0 +1,71 @@
+package btc
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"testing"
+)
+
+func TestHashes(t *testing.T) {
+	if h := DoubleSha256(nil); hex.EncodeToString(h[:]) != "5df6e0e2761359d30a8275058e299fcc0381534545f55cf43e41983f5d4c9456" {
+		t.Error("Bad DoubleSha256", hex.EncodeToString(h[:]))
+	}
+	if h := Hash160(nil); hex.EncodeToString(h[:]) != "b472a266d0bd89c13706a4132ccfb16f7c3b9fcb" {
+		t.Error("Bad Hash160", hex.EncodeToString(h[:]))
+	}
+	pk, _ := hex.DecodeString("04678afdb0fe5548271967f1a67130b7105cd6a828e03909a67962e0ea1f61deb649f6bc3f4cef38c4f35504e51ec112de5c384df7ba0b8d578a4c702b6bf11d5f")
+	if h := Hash160(pk); hex.EncodeToString(h[:]) != "62e907b15cbf27d5425399ebf6f0fb50ebb88f18" {
+		t.Error("Bad Hash160 of genesis pubkey", hex.EncodeToString(h[:]))
+	}
+
+	// the pooled hashers must not mix up data of concurrent callers
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i byte) {
+			defer wg.Done()
+			d := []byte{i}
+			s1 := sha256.Sum256(d)
+			exp := sha256.Sum256(s1[:])
+			for j := 0; j < 1000; j++ {
+				if DoubleSha256(d) != exp {
+					t.Error("Bad DoubleSha256 in goroutine", i)
+					return
+				}
+			}
+		}(byte(i))
+	}
+	wg.Wait()
+}
+
+// 64 bytes long data, like the nodes of a block's merkle tree
+func benchHashData() (data [4096][64]byte) {
+	for i := range data {
+		data[i][0], data[i][1] = byte(i), byte(i>>8)
+	}
+	return
+}
+
+func BenchmarkDoubleSha256(b *testing.B) {
+	data := benchHashData()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for i := range data {
+			DoubleSha256(data[i][:])
+		}
+	}
+}
+
+func BenchmarkDoubleSha256Naive(b *testing.B) {
+	data := benchHashData()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for i := range data {
+			h := sha256.Sum256(data[i][:])
+			sha256.Sum256(h[:])
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package btc
+
+import (
+	"errors"
+)
+
+// merkleParent - hash of two concatenated nodes of the merkle tree
+func merkleParent(left, right [32]byte) [32]byte {
+	var b [64]byte
+	copy(b[:32], left[:])
+	copy(b[32:], right[:])
+	return Sha2Sum(b[:])
+}
+
+// BuildMerkleProof - Returns the sibling hashes (from the leaf up to the root) that prove
+// that hashes[index] is included in the merkle tree calculated by CalcMerkle.
+// Like in CalcMerkle, the last hash of a level with odd number of nodes is paired with itself.
+func BuildMerkleProof(hashes [][32]byte, index int) (proof [][32]byte, err error) {
+	if index < 0 || index >= len(hashes) {
+		err = errors.New("BuildMerkleProof: index out of range")
+		return
+	}
+	level := make([][32]byte, len(hashes))
+	copy(level, hashes)
+	for len(level) > 1 {
+		if index^1 < len(level) {
+			proof = append(proof, level[index^1])
+		} else {
+			proof = append(proof, level[index])
+		}
+		next := make([][32]byte, (len(level)+1)/2)
+		for i := range next {
+			if 2*i+1 < len(level) {
+				next[i] = merkleParent(level[2*i], level[2*i+1])
+			} else {
+				next[i] = merkleParent(level[2*i], level[2*i])
+			}
+		}
+		level = next
+		index /= 2
+	}
+	return
+}
+
+// VerifyMerkleProof - Returns true if the proof made by BuildMerkleProof leads
+// from txHash at the given index to the merkle root.
+// Note that, because of the duplicated hashes, the last transaction of a level with odd number
+// of nodes is also proven at the index following it.
+func VerifyMerkleProof(txHash [32]byte, index int, proof [][32]byte, root [32]byte) bool {
+	if index < 0 || (len(proof) < 31 && index >= 1<<uint(len(proof))) {
+		return false
+	}
+	h := txHash
+	for _, sibling := range proof {
+		if index&1 != 0 {
+			h = merkleParent(sibling, h)
+		} else {
+			h = merkleParent(h, sibling)
+		}
+		index >>= 1
+	}
+	return h == root
+}
@@ -0,0 +1,97 @@
+package btc
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestMerkleProof(t *testing.T) {
+	for cnt := 1; cnt <= 13; cnt++ {
+		hashes := make([][32]byte, cnt, 3*cnt)
+		for i := range hashes {
+			hashes[i] = Sha2Sum([]byte{byte(cnt), byte(i)})
+		}
+		var root [32]byte
+		res, _ := CalcMerkle(append([][32]byte{}, hashes...))
+		copy(root[:], res)
+
+		for i := range hashes {
+			proof, e := BuildMerkleProof(hashes, i)
+			if e != nil {
+				t.Fatal(e.Error())
+			}
+			if !VerifyMerkleProof(hashes[i], i, proof, root) {
+				t.Error("Proof not verified", cnt, i)
+			}
+			if i^1 < cnt && VerifyMerkleProof(hashes[i], i^1, proof, root) {
+				t.Error("Proof verified at a wrong index", cnt, i)
+			}
+			if VerifyMerkleProof(hashes[(i+1)%cnt], i, proof, root) && cnt > 1 {
+				t.Error("Proof verified for a wrong hash", cnt, i)
+			}
+			if len(proof) > 0 {
+				proof[0][0] ^= 1
+				if VerifyMerkleProof(hashes[i], i, proof, root) {
+					t.Error("Proof verified with a wrong sibling", cnt, i)
+				}
+			}
+		}
+	}
+
+	hashes := make([][32]byte, 4)
+	if _, e := BuildMerkleProof(hashes, 4); e == nil {
+		t.Error("BuildMerkleProof accepts index out of range")
+	}
+	if _, e := BuildMerkleProof(nil, 0); e == nil {
+		t.Error("BuildMerkleProof accepts no hashes")
+	}
+}
+
+func TestMerkleProofBlock(t *testing.T) {
+	// a block with 3 transactions, so one level has odd number of nodes
+	txraw, _ := hex.DecodeString(segwitTxHex)
+	tx1, _ := NewTx(txraw)
+	cb := &Tx{Version: 1, TxIn: []*TxIn{{Input: TxPrevOut{Vout: 0xffffffff}, ScriptSig: []byte{3, 1, 2, 3}, Sequence: 0xffffffff}},
+		TxOut: []*TxOut{{Value: 50e8, PkScript: []byte{0x51}}}}
+	tx2 := &Tx{Version: 1, TxIn: []*TxIn{{Input: TxPrevOut{Hash: [32]byte{1}}, ScriptSig: []byte{0x51}, Sequence: 0xffffffff}},
+		TxOut: []*TxOut{{Value: 1000, PkScript: []byte{0x51}}}}
+	mtr := make([][32]byte, 3, 9)
+	for i, tx := range []*Tx{cb, tx1, tx2} {
+		tx.SetHash(tx.Serialize())
+		mtr[i] = tx.Hash.Hash
+	}
+	merkle, _ := CalcMerkle(mtr)
+
+	raw := new(bytes.Buffer)
+	raw.Write(make([]byte, 36))
+	raw.Write(merkle)
+	raw.Write(make([]byte, 12))
+	WriteVlen(raw, 3)
+	raw.Write(cb.Serialize())
+	raw.Write(txraw)
+	raw.Write(tx2.Serialize())
+
+	bl, e := NewBlock(raw.Bytes())
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	if e = bl.BuildTxList(); e != nil {
+		t.Fatal(e.Error())
+	}
+	if !bl.MerkleRootMatch() {
+		t.Fatal("Merkle root of the test block does not match")
+	}
+	hashes := make([][32]byte, len(bl.Txs))
+	for i, tx := range bl.Txs {
+		hashes[i] = tx.Hash.Hash
+	}
+	var root [32]byte
+	copy(root[:], bl.MerkleRoot())
+	for i := range hashes {
+		proof, e := BuildMerkleProof(hashes, i)
+		if e != nil || len(proof) != 2 || !VerifyMerkleProof(hashes[i], i, proof, root) {
+			t.Error("Proof not verified", i, e)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+package btc
+
+import (
+	"github.com/ParallelCoinTeam/duod/lib/secp256k1"
+)
+
+// SchnorrVerify - Verifies BIP-340 signature of the message against the x-only public key,
+// as used by the Taproot key path spends.
+func SchnorrVerify(pubkey [32]byte, msg [32]byte, sig [64]byte) bool {
+	return secp256k1.SchnorrVerify(pubkey[:], sig[:], msg[:])
+}
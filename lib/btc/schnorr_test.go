@@ -0,0 +1,96 @@
+package btc
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/hex"
+	"math/big"
+	"os"
+	"testing"
+
+	"github.com/ParallelCoinTeam/duod/lib/secp256k1"
+)
+
+// schnorrSign - Reference BIP-340 signing, used to check the secret key rows of the test vectors
+func schnorrSign(seckey, msg, aux []byte) []byte {
+	n := &secp256k1.TheCurve.Order.Int
+	var p, r [33]byte
+	secp256k1.BaseMultiply(seckey, p[:])
+	d := new(big.Int).SetBytes(seckey)
+	if p[0] == 0x03 {
+		d.Sub(n, d)
+	}
+	var t [32]byte
+	d.FillBytes(t[:])
+	a := secp256k1.TaggedHash("BIP0340/aux", aux)
+	for i := range t {
+		t[i] ^= a[i]
+	}
+	rnd := secp256k1.TaggedHash("BIP0340/nonce", t[:], p[1:], msg)
+	k := new(big.Int).SetBytes(rnd[:])
+	k.Mod(k, n)
+	var kb [32]byte
+	secp256k1.BaseMultiply(k.FillBytes(kb[:]), r[:])
+	if r[0] == 0x03 {
+		k.Sub(n, k)
+	}
+	h := secp256k1.TaggedHash("BIP0340/challenge", r[1:], p[1:], msg)
+	e := new(big.Int).SetBytes(h[:])
+	e.Mul(e, d)
+	e.Add(e, k)
+	e.Mod(e, n)
+	sig := make([]byte, 64)
+	copy(sig, r[1:])
+	e.FillBytes(sig[32:])
+	return sig
+}
+
+func TestSchnorrVerify(t *testing.T) {
+	f, er := os.Open("../test/bip340_test_vectors.csv")
+	if er != nil {
+		t.Fatal(er.Error())
+	}
+	defer f.Close()
+	rows, er := csv.NewReader(f).ReadAll()
+	if er != nil {
+		t.Fatal(er.Error())
+	}
+	if len(rows) < 2 {
+		t.Fatal("No test vectors")
+	}
+
+	for _, row := range rows[1:] {
+		sec, _ := hex.DecodeString(row[1])
+		pub, _ := hex.DecodeString(row[2])
+		aux, _ := hex.DecodeString(row[3])
+		msg, _ := hex.DecodeString(row[4])
+		sig, _ := hex.DecodeString(row[5])
+		exp := row[6] == "TRUE"
+
+		if len(sec) > 0 {
+			var p [33]byte
+			secp256k1.BaseMultiply(sec, p[:])
+			if !bytes.Equal(p[1:], pub) {
+				t.Error(row[0], "Bad public key", hex.EncodeToString(p[1:]))
+			}
+			if s := schnorrSign(sec, msg, aux); !bytes.Equal(s, sig) {
+				t.Error(row[0], "Bad signature", hex.EncodeToString(s))
+			}
+		}
+
+		var res bool
+		if len(msg) == 32 {
+			var k, m [32]byte
+			var s [64]byte
+			copy(k[:], pub)
+			copy(m[:], msg)
+			copy(s[:], sig)
+			res = SchnorrVerify(k, m, s)
+		} else {
+			res = secp256k1.SchnorrVerify(pub, sig, msg) // messages of other sizes
+		}
+		if res != exp {
+			t.Error(row[0], "SchnorrVerify returned", res, row[7])
+		}
+	}
+}
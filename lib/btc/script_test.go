@@ -0,0 +1,41 @@
+package btc
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestDisasmScript(t *testing.T) {
+	var tv = []struct {
+		scr string
+		asm string
+	}{
+		{"76a91472fc9e6b1bbbd40a66653989a758098bfbf1b54788ac",
+			"OP_DUP OP_HASH160 72fc9e6b1bbbd40a66653989a758098bfbf1b547 OP_EQUALVERIFY OP_CHECKSIG"}, // P2PKH
+		{"a914751e76e8199196d454941c45d1b3a323f1433bd687",
+			"OP_HASH160 751e76e8199196d454941c45d1b3a323f1433bd6 OP_EQUAL"}, // P2SH
+		{"0014751e76e8199196d454941c45d1b3a323f1433bd6",
+			"0 751e76e8199196d454941c45d1b3a323f1433bd6"}, // P2WPKH
+		{"5221aabbccddeeff00112233445566778899aabbccddeeff00112233445566778899aa52ae",
+			"2 aabbccddeeff00112233445566778899aabbccddeeff00112233445566778899aa 2 OP_CHECKMULTISIG"},
+		{"4f0201804c020100ff6a", "-1 -1 1 OP_UNKNOWN OP_RETURN"},
+		{"", ""},
+	}
+	for _, v := range tv {
+		scr, _ := hex.DecodeString(v.scr)
+		asm, e := DisasmScript(scr)
+		if e != nil || asm != v.asm {
+			t.Error("Bad disassembly of", v.scr, e, asm)
+		}
+	}
+
+	// truncated push
+	scr, _ := hex.DecodeString("76a91472fc9e6b1bbbd40a66653989a758098bfbf1b5")
+	asm, e := DisasmScript(scr)
+	if e == nil || asm != "OP_DUP OP_HASH160" {
+		t.Error("Truncated push not detected", asm)
+	}
+	if _, e := DisasmScript([]byte{OP_PUSHDATA2, 1}); e == nil {
+		t.Error("Truncated PUSHDATA2 not detected")
+	}
+}
@@ -0,0 +1,91 @@
+package btc
+
+import (
+	"errors"
+)
+
+// ScriptType - Kind of an output script, as returned by ClassifyScript
+type ScriptType int
+
+const (
+	ScriptNonStandard ScriptType = iota
+	ScriptP2PK
+	ScriptP2PKH
+	ScriptP2SH
+	ScriptMultisig
+	ScriptNullData
+	ScriptP2WPKH
+	ScriptP2WSH
+	ScriptP2TR
+	ScriptWitnessUnknown
+)
+
+var scriptTypeNames = map[ScriptType]string{
+	ScriptNonStandard:    "nonstandard",
+	ScriptP2PK:           "pubkey",
+	ScriptP2PKH:          "pubkeyhash",
+	ScriptP2SH:           "scripthash",
+	ScriptMultisig:       "multisig",
+	ScriptNullData:       "nulldata",
+	ScriptP2WPKH:         "witness_v0_keyhash",
+	ScriptP2WSH:          "witness_v0_scripthash",
+	ScriptP2TR:           "witness_v1_taproot",
+	ScriptWitnessUnknown: "witness_unknown",
+}
+
+// String - The name of the type, as used by bitcoind
+func (t ScriptType) String() string {
+	if s, ok := scriptTypeNames[t]; ok {
+		return s
+	}
+	return "nonstandard"
+}
+
+// ClassifyScript - Returns the type of the given output script
+func ClassifyScript(scr []byte) ScriptType {
+	if version, program := IsWitnessProgram(scr); program != nil {
+		switch {
+		case version == 0 && len(program) == 20:
+			return ScriptP2WPKH
+		case version == 0 && len(program) == 32:
+			return ScriptP2WSH
+		case version == 1 && len(program) == 32:
+			return ScriptP2TR
+		case version != 0:
+			return ScriptWitnessUnknown
+		}
+		return ScriptNonStandard
+	}
+
+	switch {
+	case len(scr) == 25 && scr[0] == 0x76 && scr[1] == 0xa9 && scr[2] == 0x14 && scr[23] == 0x88 && scr[24] == 0xac:
+		return ScriptP2PKH
+	case IsP2SH(scr):
+		return ScriptP2SH
+	case len(scr) == 67 && scr[0] == 0x41 && scr[1] == 4 && scr[66] == 0xac:
+		return ScriptP2PK
+	case len(scr) == 35 && scr[0] == 0x21 && (scr[1]|1) == 3 && scr[34] == 0xac:
+		return ScriptP2PK
+	case IsOpReturn(scr) && IsPushOnly(scr[1:]):
+		return ScriptNullData
+	case len(scr) > 0 && scr[len(scr)-1] == OP_CHECKMULTISIG:
+		ms := new(MultiSig)
+		if ms.ApplyP2SH(scr) == nil && ms.SigsNeeded <= uint(len(ms.PublicKeys)) {
+			return ScriptMultisig
+		}
+	}
+	return ScriptNonStandard
+}
+
+// ExtractAddress - Returns the address that the given output script pays to.
+// Multisig, nulldata and nonstandard scripts have no address, so an error is returned for them.
+func ExtractAddress(scr []byte, testnet bool) (*Addr, error) {
+	switch t := ClassifyScript(scr); t {
+	case ScriptMultisig, ScriptNullData, ScriptNonStandard:
+		return nil, errors.New("ExtractAddress: no address for " + t.String() + " script")
+	}
+	if a := NewAddrFromPkScript(scr, testnet); a != nil {
+		return a, nil
+	}
+	return nil, errors.New("ExtractAddress: cannot encode the address")
+}
@@ -0,0 +1,59 @@
+package btc
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestClassifyScript(t *testing.T) {
+	var tests = []struct {
+		script string
+		typ    ScriptType
+		addr   string
+	}{
+		{ // genesis block coinbase
+			"4104678afdb0fe5548271967f1a67130b7105cd6a828e03909a67962e0ea1f61deb649f6bc3f4cef38c4f35504e51ec112de5c384df7ba0b8d578a4c702b6bf11d5fac",
+			ScriptP2PK, "1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNa"},
+		{"76a91462e907b15cbf27d5425399ebf6f0fb50ebb88f1888ac", ScriptP2PKH, "1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNa"},
+		{"a914b472a266d0bd89c13706a4132ccfb16f7c3b9fcb87", ScriptP2SH, "3J98t1WpEZ73CNmQviecrnyiWrnqRhWNLy"},
+		{"0014751e76e8199196d454941c45d1b3a323f1433bd6", ScriptP2WPKH, "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4"},
+		{"00201863143c14c5166804bd19203356da136c985678cd4d27a1b8c6329604903262", ScriptP2WSH,
+			"bc1qrp33g0q5c5txsp9arysrx4k6zdkfs4nce4xj0gdcccefvpysxf3qccfmv3"},
+		{"512079be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798", ScriptP2TR,
+			"bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqzk5jj0"},
+		{"5210751e76e8199196d454941c45d1b3a323", ScriptWitnessUnknown, "bc1zw508d6qejxtdg4y5r3zarvaryvaxxpcs"},
+		{ // bare 1-of-2 multisig
+			"51" + "4104678afdb0fe5548271967f1a67130b7105cd6a828e03909a67962e0ea1f61deb649f6bc3f4cef38c4f35504e51ec112de5c384df7ba0b8d578a4c702b6bf11d5f" +
+				"210279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798" + "52ae",
+			ScriptMultisig, ""},
+		{"6a0b68656c6c6f20776f726c64", ScriptNullData, ""},
+		{"6a", ScriptNullData, ""},
+		{"", ScriptNonStandard, ""},
+		{"51", ScriptNonStandard, ""},
+		{"001f751e76e8199196d454941c45d1b3a323f1433bd6751e76e8199196d454941c45d1b3", ScriptNonStandard, ""},
+		{ // 3-of-2 multisig
+			"53" + "210279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798" +
+				"210279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798" + "52ae",
+			ScriptNonStandard, ""},
+	}
+
+	for _, tc := range tests {
+		scr, _ := hex.DecodeString(tc.script)
+		if typ := ClassifyScript(scr); typ != tc.typ {
+			t.Error("Bad type of", tc.script, typ.String(), tc.typ.String())
+		}
+		a, e := ExtractAddress(scr, false)
+		if tc.addr == "" {
+			if e == nil {
+				t.Error("ExtractAddress returns an address for", tc.typ.String(), a.String())
+			}
+		} else if e != nil || a.String() != tc.addr {
+			t.Error("Bad address of", tc.typ.String(), tc.script, e)
+		}
+	}
+
+	scr, _ := hex.DecodeString("0014751e76e8199196d454941c45d1b3a323f1433bd6")
+	if a, e := ExtractAddress(scr, true); e != nil || a.String() != "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx" {
+		t.Error("Bad testnet address", e)
+	}
+}
@@ -0,0 +1,37 @@
+package btc
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+
+	"github.com/dchest/siphash"
+)
+
+// ShortIDKeys - Returns the SipHash keys used for short transaction IDs of a compact block (BIP-152).
+// The keys are the first two little-endian uint64 of a single SHA256(header || nonce).
+func ShortIDKeys(header []byte, nonce uint64) (k0, k1 uint64) {
+	var b [88]byte
+	copy(b[:80], header)
+	binary.LittleEndian.PutUint64(b[80:], nonce)
+	h := sha256.Sum256(b[:])
+	k0 = binary.LittleEndian.Uint64(h[0:8])
+	k1 = binary.LittleEndian.Uint64(h[8:16])
+	return
+}
+
+// ShortID - Returns the 6-byte short transaction ID (BIP-152) of the given (w)txid,
+// as the lower 48 bits of SipHash-2-4 keyed with k0 and k1.
+func ShortID(wtxid [32]byte, k0, k1 uint64) uint64 {
+	return siphash.Hash(k0, k1, wtxid[:]) & 0xffffffffffff
+}
+
+// ShortIDs - Returns the short IDs (BIP-152, version 2) of all the block's transactions,
+// calculated over their wtxids. BuildTxList() must have been called before.
+func (bl *Block) ShortIDs(nonce uint64) []uint64 {
+	k0, k1 := ShortIDKeys(bl.Raw[:80], nonce)
+	res := make([]uint64, len(bl.Txs))
+	for i, tx := range bl.Txs {
+		res[i] = ShortID(tx.WTxID().Hash, k0, k1)
+	}
+	return res
+}
@@ -0,0 +1,41 @@
+package btc
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+const genesisBlockHex = "0100000000000000000000000000000000000000000000000000000000000000000000003ba3edfd7a7b12b27ac72c3e67768f617fc81bc3888a51323a9fb8aa4b1e5e4a29ab5f49ffff001d1dac2b7c" +
+	"01" + "01000000010000000000000000000000000000000000000000000000000000000000000000ffffffff4d04ffff001d0104455468652054696d65732030332f4a616e2f32303039204368616e63656c6c6f72206f6e206272696e6b206f66207365636f6e64206261696c6f757420666f722062616e6b73ffffffff0100f2052a01000000434104678afdb0fe5548271967f1a67130b7105cd6a828e03909a67962e0ea1f61deb649f6bc3f4cef38c4f35504e51ec112de5c384df7ba0b8d578a4c702b6bf11d5fac00000000"
+
+func TestShortID(t *testing.T) {
+	// SipHash-2-4 reference vector for key 00..0f and 32 bytes message 00..1f
+	var msg [32]byte
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	if sid := ShortID(msg, 0x0706050403020100, 0x0f0e0d0c0b0a0908); sid != 0x7127512f72f27cce&0xffffffffffff {
+		t.Errorf("Bad ShortID %x", sid)
+	}
+
+	raw, _ := hex.DecodeString(genesisBlockHex)
+	bl, e := NewBlock(raw)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	if e = bl.BuildTxList(); e != nil {
+		t.Fatal(e.Error())
+	}
+	const nonce = 0x0102030405060708
+	k0, k1 := ShortIDKeys(raw[:80], nonce)
+	if k0 != 0x9604c091d994cfca || k1 != 0x82da4839b1005eb7 {
+		t.Errorf("Bad ShortIDKeys %x %x", k0, k1)
+	}
+	sids := bl.ShortIDs(nonce)
+	if len(sids) != 1 || sids[0] != 0xd3dad4322e88 {
+		t.Errorf("Bad ShortIDs %x", sids)
+	}
+	if sids = bl.ShortIDs(nonce + 1); sids[0] == 0xd3dad4322e88 {
+		t.Error("ShortIDs does not depend on nonce")
+	}
+}
@@ -63,7 +63,29 @@ func GetCompact(b *big.Int) uint32 {
 	return compact
 }
 
+// CompactToBig - Expands the compact ("nBits") representation of a target
+func CompactToBig(bits uint32) *big.Int {
+	return SetCompact(bits)
+}
+
+// BigToCompact - Returns the compact ("nBits") representation of a target
+func BigToCompact(n *big.Int) uint32 {
+	return GetCompact(n)
+}
+
 // CheckProofOfWork -
 func CheckProofOfWork(hash *Uint256, bits uint32) bool {
 	return hash.BigInt().Cmp(SetCompact(bits)) <= 0
 }
+
+// CheckProofOfWork - Returns true if the hash of the block's header is not above the target
+// given by its bits. The hash is calculated again, so bl.Hash is not trusted.
+func (bl *Block) CheckProofOfWork() bool {
+	if len(bl.Raw) < 80 {
+		return false
+	}
+	if target := CompactToBig(bl.Bits()); target.Sign() <= 0 {
+		return false
+	}
+	return CheckProofOfWork(NewSha2Hash(bl.Raw[:80]), bl.Bits())
+}
@@ -2,6 +2,7 @@ package btc
 
 import (
 //	"fmt"
+	"encoding/hex"
 	"testing"
 	"math"
 	"math/big"
@@ -51,3 +52,37 @@ func TestTarget(t *testing.T) {
 		}
 	}
 }
+
+func TestBlockProofOfWork(t *testing.T) {
+	// The header of the genesis block
+	raw, _ := hex.DecodeString("0100000000000000000000000000000000000000000000000000000000000000000000003ba3edfd7a7b12b27ac72c3e67768f617fc81bc3888a51323a9fb8aa4b1e5e4a29ab5f49ffff001d1dac2b7c")
+	bl := &Block{Raw: raw}
+	if NewSha2Hash(raw).String() != "000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f" {
+		t.Fatal("Bad genesis block hash")
+	}
+	if !bl.CheckProofOfWork() {
+		t.Error("CheckProofOfWork fails for genesis block")
+	}
+	bl.Raw = append([]byte{}, raw...)
+	bl.Raw[79]++ // tamper the nonce
+	if bl.CheckProofOfWork() {
+		t.Error("CheckProofOfWork passes for tampered nonce")
+	}
+	bl.Raw = append([]byte{}, raw...)
+	bl.Raw[74] |= 0x80 // negative target
+	if bl.CheckProofOfWork() {
+		t.Error("CheckProofOfWork passes for negative target")
+	}
+
+	if CompactToBig(0x1d00ffff).Text(16) != "ffff0000000000000000000000000000000000000000000000000000" {
+		t.Error("Bad CompactToBig", CompactToBig(0x1d00ffff).Text(16))
+	}
+	for _, b := range []uint32{0x1d00ffff, 0x1b0404cb, 0x170b8c8b, 0x03123456} {
+		if c := BigToCompact(CompactToBig(b)); c != b {
+			t.Errorf("BigToCompact(CompactToBig(%08x)) = %08x", b, c)
+		}
+	}
+	if c := BigToCompact(big.NewInt(0x80)); c != 0x02008000 {
+		t.Errorf("Bad BigToCompact(0x80): %08x", c)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"strconv"
 	"sync"
 )
@@ -333,6 +334,48 @@ func (tx *Tx) IsCoinBase() bool {
 	return false
 }
 
+// addValue - Adds v to sum, returning false if the result would overflow
+func addValue(sum *uint64, v uint64) bool {
+	if v > math.MaxUint64-*sum {
+		return false
+	}
+	*sum += v
+	return true
+}
+
+// TotalOutputValue - Returns the sum of all the outputs' values.
+// If the sum would overflow, returns math.MaxUint64, so it cannot pass for a small value.
+func (tx *Tx) TotalOutputValue() (res uint64) {
+	for _, out := range tx.TxOut {
+		if !addValue(&res, out.Value) {
+			return math.MaxUint64
+		}
+	}
+	return
+}
+
+// CalcFee - Returns the transaction's fee (total input minus total output value), given the values
+// of the outputs spent by each of its inputs. The result is negative if the tx spends more than it has.
+// Fails if the number of values does not match the inputs or if any of the amounts is out of range.
+func (tx *Tx) CalcFee(inputValues []uint64) (int64, error) {
+	if len(inputValues) != len(tx.TxIn) {
+		return 0, errors.New("CalcFee: " + strconv.Itoa(len(inputValues)) + " input values for " +
+			strconv.Itoa(len(tx.TxIn)) + " inputs")
+	}
+	var totin, totout uint64
+	for _, v := range inputValues {
+		if !addValue(&totin, v) || totin > MaxTokenSupply {
+			return 0, errors.New("CalcFee: input values out of range - RPC_Result:bad-txns-inputvalues-outofrange")
+		}
+	}
+	for _, out := range tx.TxOut {
+		if !addValue(&totout, out.Value) || totout > MaxTokenSupply {
+			return 0, errors.New("CalcFee: output values out of range - RPC_Result:bad-txns-txouttotal-toolarge")
+		}
+	}
+	return int64(totin) - int64(totout), nil
+}
+
 // CheckTransaction -
 func (tx *Tx) CheckTransaction() error {
 	// Basic checks that utils.IsOn'tx depend on any context
@@ -403,6 +446,9 @@ func NewTxOut(b []byte) (txout *TxOut, offs int) {
 		return nil, 0
 	}
 	offs += n
+	if le < 0 || le > len(b)-offs {
+		return nil, 0
+	}
 
 	txout.PkScript = make([]byte, le)
 	copy(txout.PkScript[:], b[offs:offs+le])
@@ -411,6 +457,12 @@ func NewTxOut(b []byte) (txout *TxOut, offs int) {
 	return
 }
 
+// The smallest possible serialized input (with empty script) and output (with empty pkscript)
+const (
+	minTxInSize  = 32 + 4 + 1 + 4
+	minTxOutSize = 8 + 1
+)
+
 // NewTxIn - Decode a raw transaction input from a given bytes slice.
 // Returns the input and the size it took in the buffer.
 func NewTxIn(b []byte) (txin *TxIn, offs int) {
@@ -427,6 +479,9 @@ func NewTxIn(b []byte) (txin *TxIn, offs int) {
 		return nil, 0
 	}
 	offs += n
+	if le < 0 || le > len(b)-offs {
+		return nil, 0
+	}
 
 	txin.ScriptSig = make([]byte, le)
 	copy(txin.ScriptSig[:], b[offs:offs+le])
@@ -442,10 +497,11 @@ func NewTxIn(b []byte) (txin *TxIn, offs int) {
 // NewTx - Decode a raw transaction from a given bytes slice.
 // Returns the transaction and the size it took in the buffer.
 // WARNING: This function does not set Tx.Hash, Tx.Size and Tx.Raw
+// The counts and lengths read from the buffer are checked against its remaining size before
+// anything gets allocated for them, so malformed data cannot make it allocate too much memory.
 func NewTx(b []byte) (tx *Tx, offs int) {
 	defer func() { // In case if the buffer was too short, to recover from a panic
 		if r := recover(); r != nil {
-			println("NewTx failed")
 			tx = nil
 			offs = 0
 		}
@@ -470,9 +526,14 @@ func NewTx(b []byte) (tx *Tx, offs int) {
 		return nil, 0
 	}
 	offs += n
+	if le < 0 || le > (len(b)-offs)/minTxInSize {
+		return nil, 0
+	}
 	tx.TxIn = make([]*TxIn, le)
 	for i := range tx.TxIn {
-		tx.TxIn[i], n = NewTxIn(b[offs:])
+		if tx.TxIn[i], n = NewTxIn(b[offs:]); tx.TxIn[i] == nil {
+			return nil, 0
+		}
 		offs += n
 	}
 
@@ -482,9 +543,14 @@ func NewTx(b []byte) (tx *Tx, offs int) {
 		return nil, 0
 	}
 	offs += n
+	if le < 0 || le > (len(b)-offs)/minTxOutSize {
+		return nil, 0
+	}
 	tx.TxOut = make([]*TxOut, le)
 	for i := range tx.TxOut {
-		tx.TxOut[i], n = NewTxOut(b[offs:])
+		if tx.TxOut[i], n = NewTxOut(b[offs:]); tx.TxOut[i] == nil {
+			return nil, 0
+		}
 		offs += n
 	}
 
@@ -496,6 +562,9 @@ func NewTx(b []byte) (tx *Tx, offs int) {
 				return nil, 0
 			}
 			offs += n
+			if le < 0 || le > len(b)-offs { // each item takes at least one byte
+				return nil, 0
+			}
 			tx.SegWit[i] = make([][]byte, le)
 			for idx = 0; idx < le; idx++ {
 				lel, n = VLen(b[offs:])
@@ -503,6 +572,9 @@ func NewTx(b []byte) (tx *Tx, offs int) {
 					return nil, 0
 				}
 				offs += n
+				if lel < 0 || lel > len(b)-offs {
+					return nil, 0
+				}
 				tx.SegWit[i][idx] = make([]byte, lel)
 				copy(tx.SegWit[i][idx], b[offs:offs+lel])
 				offs += lel
@@ -784,6 +856,45 @@ func (tx *Tx) VSize() int {
 	return (3*int(tx.NoWitSize+1) + int(tx.Size)) >> 2
 }
 
+// OutputAddresses - Returns the address of each output, or an empty string for non-standard ones
+func (tx *Tx) OutputAddresses(testnet bool) (res []string) {
+	res = make([]string, len(tx.TxOut))
+	for i := range tx.TxOut {
+		if ad := NewAddrFromPkScript(tx.TxOut[i].PkScript, testnet); ad != nil {
+			res[i] = ad.String()
+		}
+	}
+	return
+}
+
+// OpReturns - Returns the data carried by each OP_RETURN output (see OpReturnData)
+func (tx *Tx) OpReturns() (res [][]byte) {
+	for _, out := range tx.TxOut {
+		if IsOpReturn(out.PkScript) {
+			res = append(res, OpReturnData(out.PkScript))
+		}
+	}
+	return
+}
+
+// HasWitness - Returns true if any of the inputs has a non-empty witness stack
+func (tx *Tx) HasWitness() bool {
+	for _, sw := range tx.SegWit {
+		if len(sw) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Witness - Returns the witness stack of the given input (nil if it has none)
+func (tx *Tx) Witness(inputIndex int) [][]byte {
+	if inputIndex < 0 || inputIndex >= len(tx.SegWit) {
+		return nil
+	}
+	return tx.SegWit[inputIndex]
+}
+
 // WriteSerializedNew - SegWit format
 func (tx *Tx) WriteSerializedNew(wr io.Writer) {
 	if tx.SegWit == nil {
@@ -0,0 +1,186 @@
+package btc
+
+import (
+	"encoding/hex"
+	"math"
+	"testing"
+)
+
+func TestOutputAddresses(t *testing.T) {
+	h160, _ := hex.DecodeString("751e76e8199196d454941c45d1b3a323f1433bd6")
+
+	tx := new(Tx)
+	tx.TxOut = []*TxOut{
+		{Value: 1000, PkScript: append(append([]byte{0x76, 0xa9, 0x14}, h160...), 0x88, 0xac)},
+		{Value: 2000, PkScript: append([]byte{0x00, 0x14}, h160...)},
+		{Value: 0, PkScript: []byte{0x6a, 0x04, 'd', 'u', 'o', 'd'}},
+	}
+
+	res := tx.OutputAddresses(false)
+	exp := []string{
+		"1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH",
+		"bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4",
+		"",
+	}
+	if len(res) != len(exp) {
+		t.Fatal("Bad number of addresses", len(res))
+	}
+	for i := range exp {
+		if res[i] != exp[i] {
+			t.Error("Output", i, "expected", exp[i], "got", res[i])
+		}
+	}
+
+	if res = tx.OutputAddresses(true); res[1] != "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx" {
+		t.Error("Bad testnet segwit address", res[1])
+	}
+}
+
+func TestWitness(t *testing.T) {
+	tx := new(Tx)
+	tx.Version = 2
+	tx.TxIn = []*TxIn{{Sequence: 0xffffffff}, {ScriptSig: []byte{0x51}, Sequence: 0xffffffff}}
+	tx.TxIn[0].Input.Vout = 1
+	tx.TxOut = []*TxOut{{Value: 1000, PkScript: []byte{0x51}}}
+	legacy, _ := NewTx(tx.Serialize())
+	if legacy == nil || legacy.HasWitness() || legacy.Witness(0) != nil || legacy.Witness(1) != nil {
+		t.Error("Witness found in a legacy tx")
+	}
+
+	tx.SegWit = [][][]byte{{[]byte("signature"), []byte("pubkey")}, {}}
+	sw, _ := NewTx(tx.SerializeNew())
+	if sw == nil || !sw.HasWitness() {
+		t.Fatal("No witness found in a segwit tx")
+	}
+	if w := sw.Witness(0); len(w) != 2 || string(w[0]) != "signature" || string(w[1]) != "pubkey" {
+		t.Error("Bad witness stack of input 0", w)
+	}
+	if len(sw.Witness(1)) != 0 || sw.Witness(2) != nil || sw.Witness(-1) != nil {
+		t.Error("Unexpected witness stack")
+	}
+}
+
+func TestWeight(t *testing.T) {
+	raw, _ := hex.DecodeString(segwitTxHex)
+	tx, _ := NewTx(raw)
+	tx.SetHash(raw)
+	if tx.Size != 343 || tx.NoWitSize != 233 {
+		t.Error("Bad sizes", tx.Size, tx.NoWitSize)
+	}
+	if tx.Weight() != 1042 || tx.VSize() != 261 {
+		t.Error("Bad weight / vsize", tx.Weight(), tx.VSize())
+	}
+
+	// without witness, vsize is the size and weight is four times it
+	raw = tx.Serialize()
+	tx, _ = NewTx(raw)
+	tx.SetHash(raw)
+	if tx.Weight() != 4*233 || tx.VSize() != 233 {
+		t.Error("Bad legacy weight / vsize", tx.Weight(), tx.VSize())
+	}
+}
+
+func TestOpReturns(t *testing.T) {
+	var tv = []struct {
+		scr  string
+		data string
+	}{
+		{"6a", ""}, // empty
+		{"6a146f6d6e69000000000000001f000000002faf0800", "6f6d6e69000000000000001f000000002faf0800"}, // Omni Layer
+		{"6a24aa21a9ede2f61c3f71d1defd3fa999dfa36953755c690689799962b48bebd836974e8cf9",
+			"aa21a9ede2f61c3f71d1defd3fa999dfa36953755c690689799962b48bebd836974e8cf9"}, // witness commitment
+		{"6a0401020304" + "4c020506" + "00", "010203040506"}, // more pushes
+	}
+	tx := new(Tx)
+	tx.TxOut = []*TxOut{{Value: 1000, PkScript: []byte{0x51}}}
+	for _, v := range tv {
+		scr, _ := hex.DecodeString(v.scr)
+		if !IsOpReturn(scr) {
+			t.Error("Not OP_RETURN", v.scr)
+		}
+		tx.TxOut = append(tx.TxOut, &TxOut{PkScript: scr})
+	}
+	res := tx.OpReturns()
+	if len(res) != len(tv) {
+		t.Fatal("Bad number of OP_RETURN outputs", len(res))
+	}
+	for i, v := range tv {
+		if res[i] == nil || hex.EncodeToString(res[i]) != v.data {
+			t.Error("Bad OP_RETURN data", i, hex.EncodeToString(res[i]))
+		}
+	}
+
+	if IsOpReturn(nil) || IsOpReturn([]byte{0x51}) || OpReturnData([]byte{0x51}) != nil {
+		t.Error("Not OP_RETURN script detected as one")
+	}
+}
+
+func TestFee(t *testing.T) {
+	// the BIP-143 example spends 6.25 and 6 BTC and has two outputs
+	raw, _ := hex.DecodeString(segwitTxHex)
+	tx, _ := NewTx(raw)
+	if v := tx.TotalOutputValue(); v != 112340000+223450000 {
+		t.Error("Bad TotalOutputValue", v)
+	}
+	if fee, e := tx.CalcFee([]uint64{625000000, 600000000}); e != nil || fee != 1225000000-335790000 {
+		t.Error("Bad CalcFee", fee, e)
+	}
+	if fee, e := tx.CalcFee([]uint64{100000000, 100000000}); e != nil || fee != 200000000-335790000 {
+		t.Error("Bad negative CalcFee", fee, e)
+	}
+	if _, e := tx.CalcFee([]uint64{625000000}); e == nil {
+		t.Error("CalcFee should fail for missing input value")
+	}
+	if _, e := tx.CalcFee([]uint64{MaxTokenSupply, 1}); e == nil {
+		t.Error("CalcFee should fail for input values out of range")
+	}
+	if tx.IsCoinBase() {
+		t.Error("Not a coinbase")
+	}
+
+	tx.TxOut = append(tx.TxOut, &TxOut{Value: math.MaxUint64 - 1000})
+	if v := tx.TotalOutputValue(); v != math.MaxUint64 {
+		t.Error("TotalOutputValue overflowed", v)
+	}
+	if _, e := tx.CalcFee([]uint64{625000000, 600000000}); e == nil {
+		t.Error("CalcFee should fail for output values out of range")
+	}
+}
+
+func TestNewTxHugeCounts(t *testing.T) {
+	cat := func(parts ...string) []byte {
+		var s string
+		for _, p := range parts {
+			s += p
+		}
+		b, _ := hex.DecodeString(s)
+		return b
+	}
+	const (
+		ver   = "02000000"
+		prev  = "0000000000000000000000000000000000000000000000000000000000000000" + "00000000"
+		seq   = "ffffffff"
+		value = "0100000000000000"
+		lock  = "00000000"
+	)
+	in := prev + "00" + seq
+	out := value + "00"
+	if tx, n := NewTx(cat(ver, "0001", "01", in, "01", out, "0101aa", lock)); tx == nil || n != 4+2+1+41+1+9+3+4 {
+		t.Fatal("Valid segwit tx not parsed", n)
+	}
+	// none of the counts / lengths may make it allocate more than the data can hold
+	for _, huge := range []string{"feffffffff", "ff0000000000100000", "ffffffffffffffff7f", "ffffffffffffffffff"} {
+		for i, raw := range [][]byte{
+			cat(ver, huge, in, "01", out, lock),
+			cat(ver, "01", prev, huge, seq, "01", out, lock),
+			cat(ver, "01", in, huge, out, lock),
+			cat(ver, "01", in, "01", value, huge, lock),
+			cat(ver, "0001", "01", in, "01", out, huge, "aa", lock),
+			cat(ver, "0001", "01", in, "01", out, "01", huge, "aa", lock),
+		} {
+			if tx, _ := NewTx(raw); tx != nil {
+				t.Error("Tx with a huge count parsed", i, huge)
+			}
+		}
+	}
+}
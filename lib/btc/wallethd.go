@@ -11,6 +11,7 @@ import (
 	"crypto/sha512"
 	"encoding/binary"
 	"errors"
+	"math/big"
 
 	"github.com/ParallelCoinTeam/duod/lib/secp256k1"
 )
@@ -38,8 +39,19 @@ type HDWallet struct {
 
 // Child returns the ith child of wallet w. Values of i >= 2^31
 // signify private key derivation. Attempting private key derivation
-// with a public key will throw an error.
+// with a public key will panic (use ChildKey to get an error instead).
 func (w *HDWallet) Child(i uint32) (res *HDWallet) {
+	res, e := w.ChildKey(i)
+	if e != nil {
+		panic("HDWallet.Child(): " + e.Error())
+	}
+	return
+}
+
+// ChildKey returns the ith child of wallet w, like Child does, but it returns an error
+// for private key derivation with a public key, as well as for the (very unlikely) index
+// that gives an invalid key, in which case BIP-32 says to proceed with the next one.
+func (w *HDWallet) ChildKey(i uint32) (res *HDWallet, e error) {
 	var ha, newkey []byte
 	var chksum [20]byte
 
@@ -53,20 +65,29 @@ func (w *HDWallet) Child(i uint32) (res *HDWallet) {
 		}
 		binary.Write(mac, binary.BigEndian, i)
 		ha = mac.Sum(nil)
+		if !validHDKey(ha[:32]) {
+			return nil, errors.New("Invalid child key - use the next index")
+		}
 		newkey = append([]byte{0}, DeriveNextPrivate(ha[:32], w.Key[1:])...)
+		if !validHDKey(newkey[1:]) {
+			return nil, errors.New("Invalid child key - use the next index")
+		}
 		RimpHash(pub, chksum[:])
 	} else if w.Prefix == Public || w.Prefix == TestPublic {
 		mac := hmac.New(sha512.New, w.ChCode)
 		if i >= uint32(0x80000000) {
-			panic("HDWallet.Child(): Private derivation on Public key")
+			return nil, errors.New("Private derivation on Public key")
 		}
 		mac.Write(w.Key)
 		binary.Write(mac, binary.BigEndian, i)
 		ha = mac.Sum(nil)
+		if !validHDKey(ha[:32]) {
+			return nil, errors.New("Invalid child key - use the next index")
+		}
 		newkey = DeriveNextPublic(w.Key, ha[:32])
 		RimpHash(w.Key, chksum[:])
 	} else {
-		panic("HDWallet.Child(): Unexpected Prefix")
+		return nil, errors.New("Unexpected Prefix")
 	}
 	res = new(HDWallet)
 	res.Prefix = w.Prefix
@@ -119,7 +140,7 @@ func StringWallet(data string) (*HDWallet, error) {
 	return r, nil
 }
 
-// Pub returns a new wallet which is the public key version of w.
+// Pub returns a new wallet which is the public key version of w (for the same network).
 // If w is a public key, Pub returns a copy of w
 func (w *HDWallet) Pub() *HDWallet {
 	if w.Prefix == Public || w.Prefix == TestPublic {
@@ -127,7 +148,7 @@ func (w *HDWallet) Pub() *HDWallet {
 		*r = *w
 		return r
 	}
-	return &HDWallet{Prefix: Public, Depth: w.Depth, Checksum: w.Checksum,
+	return &HDWallet{Prefix: HDKeyPrefix(false, w.Prefix == TestPrivate), Depth: w.Depth, Checksum: w.Checksum,
 		I: w.I, ChCode: w.ChCode, Key: PublicFromPrivate(w.Key[1:], true)}
 }
 
@@ -177,6 +198,27 @@ func MasterKey(seed []byte, testnet bool) *HDWallet {
 	return res
 }
 
+// NewMasterKey returns a new wallet given a seed, like MasterKey, but it checks the seed's
+// length (128 to 512 bits, as BIP-32 says) and the master key, which can be invalid
+// (with a negligible probability), in which case another seed must be used.
+func NewMasterKey(seed []byte, testnet bool) (*HDWallet, error) {
+	if len(seed) < 16 || len(seed) > 64 {
+		return nil, errors.New("NewMasterKey: seed must be 16 to 64 bytes long")
+	}
+	w := MasterKey(seed, testnet)
+	if !validHDKey(w.Key[1:]) {
+		return nil, errors.New("NewMasterKey: invalid master key - use another seed")
+	}
+	return w, nil
+}
+
+// validHDKey checks whether the 32 bytes value is a valid private key (non-zero and below the curve order)
+func validHDKey(k []byte) bool {
+	var n big.Int
+	n.SetBytes(k)
+	return n.Sign() > 0 && n.Cmp(&secp256k1.TheCurve.Order.Int) < 0
+}
+
 // StringCheck is a validation check of a base58-encoded extended key.
 func StringCheck(key string) error {
 	return ByteCheck(DecodeBase58(key))
@@ -9,6 +9,8 @@ import (
 	"bytes"
 	"encoding/hex"
 	"testing"
+
+	"github.com/ParallelCoinTeam/duod/lib/secp256k1"
 )
 
 // implements https://github.com/bitcoin/bips/blob/master/bip-0032.mediawiki#test-vectors
@@ -244,3 +246,64 @@ func BenchmarkStringCheck(b *testing.B) {
 		StringCheck(mPub2)
 	}
 }
+
+func TestChildKey(t *testing.T) {
+	const h = 0x80000000
+	var vectors = []struct {
+		seed string
+		path []uint32 // the first entry (master key) is ignored
+		prv  []string
+		pub  []string
+	}{
+		{masterhex1, []uint32{0, h, 1, h + 2, 2, 1000000000},
+			[]string{mPriv1, m0pPriv1, m0p1Priv1, m0p12pPriv1, m0p12p2Priv1, m0p12p21000000000Priv1},
+			[]string{mPub1, m0pPub1, m0p1Pub1, m0p12pPub1, m0p12p2Pub1, m0p12p21000000000Pub1}},
+		{masterhex2, []uint32{0, 0, h + 2147483647, 1, h + 2147483646, 2},
+			[]string{mPriv2, m0Priv2, m02147483647pPriv2, m02147483647p1Priv2, m02147483647p12147483646pPriv2, m02147483647p12147483646p2Priv2},
+			[]string{mPub2, m0Pub2, m02147483647pPub2, m02147483647p1Pub2, m02147483647p12147483646pPub2, m02147483647p12147483646p2Pub2}},
+	}
+	for vi, v := range vectors {
+		seed, _ := hex.DecodeString(v.seed)
+		prv, e := NewMasterKey(seed, false)
+		if e != nil {
+			t.Fatal(vi, e.Error())
+		}
+		for i := range v.path {
+			if i > 0 {
+				parent := prv.Pub()
+				if prv, e = prv.ChildKey(v.path[i]); e != nil {
+					t.Fatal(vi, i, e.Error())
+				}
+				pub, e := parent.ChildKey(v.path[i])
+				if v.path[i] >= h {
+					if e == nil {
+						t.Error(vi, i, "Hardened derivation from public key")
+					}
+				} else if e != nil || pub.String() != v.pub[i] {
+					t.Error(vi, i, "Bad public derivation", e)
+				}
+			}
+			if prv.String() != v.prv[i] {
+				t.Error(vi, i, "Bad private key", prv.String())
+			}
+			if prv.Pub().String() != v.pub[i] {
+				t.Error(vi, i, "Bad public key", prv.Pub().String())
+			}
+		}
+	}
+
+	if _, e := NewMasterKey(make([]byte, 15), false); e == nil {
+		t.Error("NewMasterKey accepted too short seed")
+	}
+	if _, e := NewMasterKey(make([]byte, 65), false); e == nil {
+		t.Error("NewMasterKey accepted too long seed")
+	}
+	seed, _ := hex.DecodeString(masterhex1)
+	tw, _ := NewMasterKey(seed, true)
+	if s := tw.Pub().String(); s[:4] != "tpub" || tw.String()[:4] != "tprv" {
+		t.Error("Bad testnet keys", tw.String(), s)
+	}
+	if !validHDKey(tw.Key[1:]) || validHDKey(make([]byte, 32)) || validHDKey(secp256k1.TheCurve.Order.Bytes()) {
+		t.Error("validHDKey failed")
+	}
+}
@@ -214,31 +214,26 @@ func (ch *Chain) PostCheckBlock(bl *btc.Block) (err error) {
 
 		// Verify merkle root of witness data
 		if (bl.VerifyFlags & script.VerWitness) != 0 {
-			var i int
-			for i = len(bl.Txs[0].TxOut) - 1; i >= 0; i-- {
-				o := bl.Txs[0].TxOut[i]
-				if len(o.PkScript) >= 38 && bytes.Equal(o.PkScript[:6], []byte{0x6a, 0x24, 0xaa, 0x21, 0xa9, 0xed}) {
-					if len(bl.Txs[0].SegWit) != 1 || len(bl.Txs[0].SegWit[0]) != 1 || len(bl.Txs[0].SegWit[0][0]) != 32 {
-						err = errors.New("CheckBlock() : invalid witness nonce size - RPC_Result:bad-witness-nonce-size")
-						println(err.Error())
-						println(bl.Hash.String(), len(bl.Txs[0].SegWit))
-						return
-					}
-
-					// The malleation check is ignored; as the transaction tree itself
-					// already does not permit it, it is impossible to trigger in the
-					// witness tree.
-					merkle, _ := btc.GetWitnessMerkle(bl.Txs)
-					withNonce := btc.Sha2Sum(append(merkle, bl.Txs[0].SegWit[0][0]...))
-
-					if !bytes.Equal(withNonce[:], o.PkScript[6:38]) {
-						err = errors.New("CheckBlock(): Witness Merkle mismatch - RPC_Result:bad-witness-merkle-match")
-						return
-					}
-
-					hadWitness = true
-					break
+			if commitment, ok := bl.WitnessCommitment(); ok {
+				if len(bl.Txs[0].SegWit) != 1 || len(bl.Txs[0].SegWit[0]) != 1 || len(bl.Txs[0].SegWit[0][0]) != 32 {
+					err = errors.New("CheckBlock() : invalid witness nonce size - RPC_Result:bad-witness-nonce-size")
+					println(err.Error())
+					println(bl.Hash.String(), len(bl.Txs[0].SegWit))
+					return
 				}
+
+				// The malleation check is ignored; as the transaction tree itself
+				// already does not permit it, it is impossible to trigger in the
+				// witness tree.
+				merkle, _ := btc.GetWitnessMerkle(bl.Txs)
+				withNonce := btc.Sha2Sum(append(merkle, bl.Txs[0].SegWit[0][0]...))
+
+				if withNonce != commitment {
+					err = errors.New("CheckBlock(): Witness Merkle mismatch - RPC_Result:bad-witness-merkle-match")
+					return
+				}
+
+				hadWitness = true
 			}
 		}
 
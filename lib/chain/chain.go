@@ -41,6 +41,7 @@ type Chain struct {
 		BIP66Height                         uint32
 		BIP91Height                         uint32
 		S2XHeight                           uint32
+		AllowMinDifficultyBlocks            bool // min-difficulty block allowed after 2*TargetSpacing without one (testnet)
 	}
 }
 
@@ -67,6 +68,7 @@ func NewChainExt(dbrootdir string, genesis *btc.Uint256, rescan bool, opts *NewC
 	ch.Consensus.MaxPOWBits = 0x1e0fffff // 0x1d00ffff
 	ch.Consensus.MaxPOWValue, _ = new(big.Int).SetString("00000000FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF", 16)
 	if ch.testnet() {
+		ch.Consensus.AllowMinDifficultyBlocks = true
 		ch.Consensus.BIP34Height = 1000000 // 21111
 		ch.Consensus.BIP65Height = 1000000 // 581885
 		ch.Consensus.BIP66Height = 1000000 // 330776
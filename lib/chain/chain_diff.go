@@ -23,7 +23,7 @@ func (ch *Chain) GetNextWorkRequired(lst *BlockTreeNode, ts uint32) (res uint32)
 
 	if ((lst.Height + 1) % targetInterval) != 0 {
 		// Special difficulty rule for testnet:
-		if ch.testnet() {
+		if ch.Consensus.AllowMinDifficultyBlocks {
 			// If the new block's timestamp is more than 2* 10 minutes
 			// then allow mining of a min-difficulty block.
 			if ts > lst.Timestamp()+TargetSpacing*2 {
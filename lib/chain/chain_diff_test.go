@@ -0,0 +1,57 @@
+package chain
+
+import (
+	"encoding/binary"
+	"math/big"
+	"testing"
+)
+
+const testBits = 0x1c0fffff // some difficulty above the minimum
+
+// builds a chain of n blocks, with the given bits, spaced by TargetSpacing
+func testChain(n int, bits uint32) (lst *BlockTreeNode) {
+	for i := 0; i < n; i++ {
+		nd := &BlockTreeNode{Height: uint32(i), Parent: lst}
+		binary.LittleEndian.PutUint32(nd.BlockHeader[68:72], 1500000000+uint32(i)*TargetSpacing)
+		binary.LittleEndian.PutUint32(nd.BlockHeader[72:76], bits)
+		lst = nd
+	}
+	return
+}
+
+func testChainParams(testnet bool) (ch *Chain) {
+	ch = new(Chain)
+	ch.Consensus.MaxPOWBits = 0x1e0fffff
+	ch.Consensus.MaxPOWValue, _ = new(big.Int).SetString("00000000FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF", 16)
+	ch.Consensus.AllowMinDifficultyBlocks = testnet
+	return
+}
+
+func TestMinDifficultyBlocks(t *testing.T) {
+	lst := testChain(10, testBits)
+	gap := lst.Timestamp() + 2*TargetSpacing + 1
+
+	ch := testChainParams(true)
+	if res := ch.GetNextWorkRequired(lst, lst.Timestamp()+TargetSpacing); res != testBits {
+		t.Errorf("Testnet without a gap: %08x", res)
+	}
+	if res := ch.GetNextWorkRequired(lst, gap); res != ch.Consensus.MaxPOWBits {
+		t.Errorf("Testnet after a gap: %08x", res)
+	}
+
+	// a min-difficulty block on top must not lower the difficulty of the next one
+	nd := &BlockTreeNode{Height: lst.Height + 1, Parent: lst}
+	binary.LittleEndian.PutUint32(nd.BlockHeader[68:72], gap)
+	binary.LittleEndian.PutUint32(nd.BlockHeader[72:76], ch.Consensus.MaxPOWBits)
+	if res := ch.GetNextWorkRequired(nd, gap+TargetSpacing); res != testBits {
+		t.Errorf("Testnet after a min-difficulty block: %08x", res)
+	}
+
+	ch = testChainParams(false)
+	if res := ch.GetNextWorkRequired(lst, gap); res != testBits {
+		t.Errorf("Mainnet after a gap: %08x", res)
+	}
+	if res := ch.GetNextWorkRequired(lst, gap+24*3600); res != testBits {
+		t.Errorf("Mainnet after a long gap: %08x", res)
+	}
+}
@@ -2,6 +2,24 @@ package bech32
 
 import (
 	"bytes"
+	"errors"
+	"strings"
+)
+
+// Errors returned by EncodeErr and DecodeErr
+var (
+	// ErrMixedCase - the string has both lower and upper case characters (or the hrp to encode is not lower case)
+	ErrMixedCase = errors.New("bech32: mixed case")
+	// ErrInvalidChar - the string has a character out of the allowed range (or the data to encode is over 5 bits)
+	ErrInvalidChar = errors.New("bech32: invalid character")
+	// ErrBadChecksum - the checksum does not match
+	ErrBadChecksum = errors.New("bech32: bad checksum")
+	// ErrTooLong - the string is over 90 characters (or the given limit)
+	ErrTooLong = errors.New("bech32: too long")
+	// ErrNoSeparator - there is no '1' separator in the string
+	ErrNoSeparator = errors.New("bech32: no separator")
+	// ErrInvalidLength - the string is too short, the hrp is empty or the checksum is shorter than 6 characters
+	ErrInvalidLength = errors.New("bech32: invalid length")
 )
 
 func bech32PolymodStep(pre uint32) uint32 {
@@ -16,9 +34,28 @@ func bech32PolymodStep(pre uint32) uint32 {
 
 const (
 	charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+	bech32Const  = 1          // BIP-173
+	bech32mConst = 0x2bc830a3 // BIP-350
+
+	// MaxLength - the length limit of BIP-173, used by all the functions but the WithLimit ones
+	MaxLength = 90
+)
+
+// Variant - the checksum variant of a bech32 string
+type Variant int
+
+const (
+	// Invalid - the checksum does not match any variant
+	Invalid Variant = iota
+	// Bech32 - the original checksum (BIP-173), used by segwit v0 addresses
+	Bech32
+	// Bech32m - the modified checksum (BIP-350), used by segwit v1+ addresses
+	Bech32m
 )
 
 var (
+	// the upper case letters map to the same values as the lower case ones
 	charsetRev = [128]byte{
 		99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99,
 		99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99,
@@ -32,23 +69,46 @@ var (
 
 // Encode - returns empty string on error
 func Encode(hrp string, data []byte) string {
+	res, _ := encode(hrp, data, bech32Const, MaxLength)
+	return res
+}
+
+// EncodeErr - like Encode, but returns the reason of the failure
+func EncodeErr(hrp string, data []byte) (string, error) {
+	return encode(hrp, data, bech32Const, MaxLength)
+}
+
+// EncodeM - like Encode, but with bech32m checksum (BIP-350). Returns empty string on error.
+func EncodeM(hrp string, data []byte) string {
+	res, _ := encode(hrp, data, bech32mConst, MaxLength)
+	return res
+}
+
+// EncodeWithLimit - like Encode, but the result can be up to max characters long, instead of 90.
+// It is meant for the payloads other than addresses (i.e. LNURL). Returns empty string on error.
+func EncodeWithLimit(hrp string, data []byte, max int) string {
+	res, _ := encode(hrp, data, bech32Const, max)
+	return res
+}
+
+func encode(hrp string, data []byte, constant uint32, max int) (string, error) {
 	var chk uint32 = 1
 	var i int
 	output := new(bytes.Buffer)
 	for i = range hrp {
 		ch := int(hrp[i])
 		if ch < 33 || ch > 126 {
-			return ""
+			return "", ErrInvalidChar
 		}
 
 		if ch >= 'A' && ch <= 'Z' {
-			return ""
+			return "", ErrMixedCase
 		}
 		chk = bech32PolymodStep(chk) ^ (uint32(ch) >> 5)
 		i++
 	}
-	if i+7+len(data) > 90 {
-		return ""
+	if i+7+len(data) > max {
+		return "", ErrTooLong
 	}
 	chk = bech32PolymodStep(chk)
 	for i := range hrp {
@@ -60,7 +120,7 @@ func Encode(hrp string, data []byte) string {
 
 	for i = range data {
 		if (data[i] >> 5) != 0 {
-			return ""
+			return "", ErrInvalidChar
 		}
 		chk = bech32PolymodStep(chk) ^ uint32(data[i])
 		output.WriteByte(charset[data[i]])
@@ -68,26 +128,118 @@ func Encode(hrp string, data []byte) string {
 	for i = 0; i < 6; i++ {
 		chk = bech32PolymodStep(chk)
 	}
-	chk ^= 1
+	chk ^= constant
 	for i = 0; i < 6; i++ {
 		output.WriteByte(charset[(chk>>uint((5-i)*5))&0x1f])
 	}
-	return string(output.Bytes())
+	return string(output.Bytes()), nil
+}
+
+// Split - splits the input at the last separator and carves off the 6 character checksum.
+// It does not verify the checksum, so ok only tells whether the input is structurally valid.
+func Split(input string) (hrp, dataPart, checksum string, ok bool) {
+	var haveLower, haveUpper bool
+	sep := strings.LastIndexByte(input, '1')
+	if sep == -1 {
+		return
+	}
+	hrp = input[:sep]
+	if len(input)-(sep+1) < 6 {
+		checksum = input[sep+1:]
+		return
+	}
+	dataPart = input[sep+1 : len(input)-6]
+	checksum = input[len(input)-6:]
+
+	for i := 0; i < len(input); i++ {
+		ch := input[i]
+		if ch < 33 || ch > 126 {
+			return
+		}
+		if i > sep && charsetRev[ch] > 31 {
+			return
+		}
+		if ch >= 'a' && ch <= 'z' {
+			haveLower = true
+		} else if ch >= 'A' && ch <= 'Z' {
+			haveUpper = true
+		}
+	}
+	ok = len(hrp) > 0 && len(input) <= MaxLength && !(haveLower && haveUpper)
+	return
+}
+
+// DecodeTrim - like Decode, but strips any surrounding whitespace first (i.e. a copy-pasted address).
+// trimmed tells whether there was any whitespace to strip. Use Decode for protocol data.
+func DecodeTrim(input string) (resHrp string, resData []byte, trimmed bool) {
+	s := strings.TrimSpace(input)
+	resHrp, resData = Decode(s)
+	trimmed = len(s) != len(input)
+	return
 }
 
 // Decode -returns ("", nil) on error
 func Decode(input string) (resHrp string, resData []byte) {
+	if hrp, data, variant := DecodeGeneric(input); variant == Bech32 {
+		resHrp, resData = hrp, data
+	}
+	return
+}
+
+// DecodeWithLimit - like Decode, but accepts input up to max characters long, instead of 90.
+func DecodeWithLimit(input string, max int) (resHrp string, resData []byte) {
+	if hrp, data, variant, _ := decode(input, max); variant == Bech32 {
+		resHrp, resData = hrp, data
+	}
+	return
+}
+
+// DecodeM - like Decode, but for bech32m checksum (BIP-350). Returns ("", nil) on error.
+func DecodeM(input string) (resHrp string, resData []byte) {
+	if hrp, data, variant := DecodeGeneric(input); variant == Bech32m {
+		resHrp, resData = hrp, data
+	}
+	return
+}
+
+// DecodeErr - like Decode, but returns the reason of the failure
+func DecodeErr(input string) (resHrp string, resData []byte, e error) {
+	var variant Variant
+	if resHrp, resData, variant, e = decode(input, MaxLength); e == nil && variant != Bech32 {
+		resHrp, resData, e = "", nil, ErrBadChecksum
+	}
+	return
+}
+
+// DecodeGeneric - decodes a string with either checksum, returning which one matched.
+// Returns ("", nil, Invalid) on error.
+func DecodeGeneric(input string) (resHrp string, resData []byte, variant Variant) {
+	resHrp, resData, variant, _ = decode(input, MaxLength)
+	return
+}
+
+func decode(input string, max int) (resHrp string, resData []byte, variant Variant, e error) {
 	var chk uint32 = 1
 	var i, dataLen, hrpLen int
 	var haveLower, haveUpper bool
-	if len(input) < 8 || len(input) > 90 {
+	if len(input) > max {
+		e = ErrTooLong
+		return
+	}
+	if len(input) < 8 {
+		e = ErrInvalidLength
 		return
 	}
 	for dataLen < len(input) && input[(len(input)-1)-dataLen] != '1' {
 		dataLen++
 	}
 	hrpLen = len(input) - (1 + dataLen)
+	if hrpLen < 0 {
+		e = ErrNoSeparator
+		return
+	}
 	if hrpLen < 1 || dataLen < 6 {
+		e = ErrInvalidLength
 		return
 	}
 	dataLen -= 6
@@ -96,6 +248,7 @@ func Decode(input string) (resHrp string, resData []byte) {
 	for i = 0; i < hrpLen; i++ {
 		ch := input[i]
 		if ch < 33 || ch > 126 {
+			e = ErrInvalidChar
 			return
 		}
 		if ch >= 'a' && ch <= 'z' {
@@ -114,10 +267,12 @@ func Decode(input string) (resHrp string, resData []byte) {
 	i++
 	for i < len(input) {
 		if (input[i] & 0x80) != 0 {
+			e = ErrInvalidChar
 			return
 		}
 		v := charsetRev[(input[i])]
 		if v > 31 {
+			e = ErrInvalidChar
 			return
 		}
 		if input[i] >= 'a' && input[i] <= 'z' {
@@ -133,11 +288,73 @@ func Decode(input string) (resHrp string, resData []byte) {
 		i++
 	}
 	if haveLower && haveUpper {
+		e = ErrMixedCase
 		return
 	}
-	if chk == 1 {
-		resHrp = string(hrp)
-		resData = data
+	switch chk {
+	case bech32Const:
+		variant = Bech32
+	case bech32mConst:
+		variant = Bech32m
+	default:
+		e = ErrBadChecksum
+		return
 	}
+	resHrp = string(hrp)
+	resData = data
 	return
 }
+
+// VerifyChecksum - tells whether the input is a valid bech32 string (BIP-173), like Decode would,
+// but without allocating the decoded hrp and data. Use ChecksumVariant to accept bech32m as well.
+func VerifyChecksum(input string) bool {
+	return ChecksumVariant(input) == Bech32
+}
+
+// ChecksumVariant - returns the checksum variant of a valid bech32 or bech32m string,
+// or Invalid, like DecodeGeneric would, but without allocating anything.
+func ChecksumVariant(input string) Variant {
+	var chk uint32 = 1
+	var haveLower, haveUpper bool
+	if len(input) < 8 || len(input) > MaxLength {
+		return Invalid
+	}
+	sep := strings.LastIndexByte(input, '1')
+	if sep < 1 || len(input)-(sep+1) < 6 {
+		return Invalid
+	}
+	for i := 0; i < len(input); i++ {
+		ch := input[i]
+		if ch < 33 || ch > 126 {
+			return Invalid
+		}
+		if ch >= 'a' && ch <= 'z' {
+			haveLower = true
+		} else if ch >= 'A' && ch <= 'Z' {
+			haveUpper = true
+			ch = (ch - 'A') + 'a'
+		}
+		if i < sep {
+			chk = bech32PolymodStep(chk) ^ uint32(ch>>5)
+		} else if i > sep && charsetRev[ch] > 31 {
+			return Invalid
+		}
+	}
+	if haveLower && haveUpper {
+		return Invalid
+	}
+	chk = bech32PolymodStep(chk)
+	for i := 0; i < sep; i++ {
+		chk = bech32PolymodStep(chk) ^ uint32(input[i]&0x1f)
+	}
+	for i := sep + 1; i < len(input); i++ {
+		chk = bech32PolymodStep(chk) ^ uint32(charsetRev[input[i]])
+	}
+	switch chk {
+	case bech32Const:
+		return Bech32
+	case bech32mConst:
+		return Bech32m
+	}
+	return Invalid
+}
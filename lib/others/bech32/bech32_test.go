@@ -1,6 +1,7 @@
 package bech32
 
 import (
+	"bytes"
 	"strings"
 	"testing"
 )
@@ -24,6 +25,33 @@ var (
 		"de1lg7wt\xff"}
 )
 
+var (
+	validChecksumM = []string{
+		"A1LQFN3A",
+		"a1lqfn3a",
+		"an83characterlonghumanreadablepartthatcontainsthetheexcludedcharactersbioandnumber11sg7hg6",
+		"abcdef1l7aum6echk45nj3s0wdvt2fg8x9yrzpqzd3ryx",
+		"11llllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllludsr8",
+		"split1checkupstagehandshakeupstreamerranterredcaperredlc445v",
+		"?1v759aa"}
+
+	invalidChecksumM = []string{
+		" 1xj0phk",
+		"\x7f1g6xzxy",
+		"\x801vctc34",
+		"an84characterslonghumanreadablepartthatcontainsthetheexcludedcharactersbioandnumber11d6pts4",
+		"qyrz8wqd2c9m",
+		"1qyrz8wqd2c9m",
+		"y1b0jsk6g",
+		"lt1igcx5c0",
+		"in1muywd",
+		"mm1crxm3i",
+		"au1s5cgom",
+		"M1VUXWEZ",
+		"16plkw9",
+		"1p2gdwpf"}
+)
+
 func TestValidChecksum(t *testing.T) {
 	for _, s := range validChecksum {
 		hrp, data := Decode(s)
@@ -50,3 +78,187 @@ func TestInvalidChecksum(t *testing.T) {
 		}
 	}
 }
+
+func TestSplit(t *testing.T) {
+	var tests = []struct {
+		in, hrp, data, chk string
+		ok                 bool
+	}{
+		{"abcdef1qpzry9x8gf2tvdw0s3jn54khce6mua7lmqqqxw", "abcdef", "qpzry9x8gf2tvdw0s3jn54khce6mua7l", "mqqqxw", true},
+		{"A12UEL5L", "A", "", "2UEL5L", true},
+		{"a12uel5x", "a", "", "2uel5x", true}, // bad checksum, but structurally fine
+		{"split1checkupstagehandshakeupstreamerranterredcaperred2y9e3w", "split",
+			"checkupstagehandshakeupstreamerranterredcaperred", "2y9e3w", true},
+		{"pzry9x0s0muk", "", "", "", false},
+		{"1pzry9x0s0muk", "", "pzry9x", "0s0muk", false},
+		{"li1dgmt3", "li", "", "dgmt3", false},
+		{"a1qpzBy9x0s0muk", "a", "qpzBy9x", "0s0muk", false},
+		{"x1b4n0q5v", "x", "b", "4n0q5v", false},
+	}
+	for _, tc := range tests {
+		hrp, data, chk, ok := Split(tc.in)
+		if hrp != tc.hrp || data != tc.data || chk != tc.chk || ok != tc.ok {
+			t.Error("Split", tc.in, "returned", hrp, data, chk, ok)
+		}
+	}
+}
+
+func TestDecodeTrim(t *testing.T) {
+	const addr = "abcdef1qpzry9x8gf2tvdw0s3jn54khce6mua7lmqqqxw"
+	for _, s := range []string{"  " + addr, addr + " ", addr + "\n", "\t" + addr + "\r\n"} {
+		if hrp, data := Decode(s); data != nil || hrp != "" {
+			t.Errorf("Decode succeeds on %q", s)
+		}
+		hrp, data, trimmed := DecodeTrim(s)
+		if hrp != "abcdef" || data == nil || !trimmed {
+			t.Errorf("DecodeTrim fails on %q", s)
+		}
+	}
+	if hrp, data, trimmed := DecodeTrim(addr); hrp != "abcdef" || data == nil || trimmed {
+		t.Error("DecodeTrim fails on an address without whitespace")
+	}
+	if hrp, data, _ := DecodeTrim(" a b1qpzry9x8gf2tvdw0s3jn54khce6mua7lmqqqxw "); hrp != "" || data != nil {
+		t.Error("DecodeTrim succeeds on whitespace inside")
+	}
+}
+
+func TestBech32m(t *testing.T) {
+	for _, s := range validChecksumM {
+		hrp, data := DecodeM(s)
+		if data == nil || hrp == "" {
+			t.Error("DecodeM fails: ", s)
+		} else if rebuild := EncodeM(hrp, data); !strings.EqualFold(s, rebuild) {
+			t.Error("EncodeM produces incorrect result: ", s, rebuild)
+		}
+		if hrp, data := Decode(s); data != nil || hrp != "" {
+			t.Error("Decode succeeds on bech32m string: ", s)
+		}
+		if _, _, v := DecodeGeneric(s); v != Bech32m {
+			t.Error("DecodeGeneric returns wrong variant: ", s, v)
+		}
+	}
+	for _, s := range validChecksum {
+		if hrp, data := DecodeM(s); data != nil || hrp != "" {
+			t.Error("DecodeM succeeds on bech32 string: ", s)
+		}
+		if _, _, v := DecodeGeneric(s); v != Bech32 {
+			t.Error("DecodeGeneric returns wrong variant: ", s, v)
+		}
+	}
+	for _, s := range invalidChecksumM {
+		if hrp, data, v := DecodeGeneric(s); data != nil || hrp != "" || v != Invalid {
+			t.Error("DecodeGeneric succeeds on invalid string: ", s)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	var tests = []struct {
+		in string
+		e  error
+	}{
+		{"abcdef1qpzry9x8gf2tvdw0s3jn54khce6mua7lmqqqxw", nil},
+		{"A12UEL5L", nil},
+		{"A12uEL5L", ErrMixedCase},
+		{" 1nwldj5", ErrInvalidChar},
+		{"x1b4n0q5v", ErrInvalidChar},
+		{"de1lg7wt\xff", ErrInvalidChar},
+		{"a12uel5x", ErrBadChecksum},
+		{"A1LQFN3A", ErrBadChecksum}, // bech32m
+		{"an84characterslonghumanreadablepartthatcontainsthenumber1andtheexcludedcharactersbio1569pvx", ErrTooLong},
+		{"pzry9x0s0muk", ErrNoSeparator},
+		{"1pzry9x0s0muk", ErrInvalidLength},
+		{"li1dgmt3", ErrInvalidLength},
+		{"a1qqq", ErrInvalidLength},
+	}
+	for _, tc := range tests {
+		hrp, data, e := DecodeErr(tc.in)
+		if e != tc.e {
+			t.Errorf("DecodeErr(%q) returned %v, expected %v", tc.in, e, tc.e)
+		}
+		if (e == nil) != (data != nil && hrp != "") {
+			t.Errorf("DecodeErr(%q) returned %q %v with %v", tc.in, hrp, data, e)
+		}
+		if h, d := Decode(tc.in); h != hrp || !bytes.Equal(d, data) {
+			t.Errorf("Decode(%q) differs from DecodeErr", tc.in)
+		}
+	}
+
+	if _, e := EncodeErr("A", nil); e != ErrMixedCase {
+		t.Error("EncodeErr with upper case hrp:", e)
+	}
+	if _, e := EncodeErr("a b", nil); e != ErrInvalidChar {
+		t.Error("EncodeErr with space in hrp:", e)
+	}
+	if _, e := EncodeErr("a", []byte{32}); e != ErrInvalidChar {
+		t.Error("EncodeErr with 6-bit data:", e)
+	}
+	if _, e := EncodeErr("a", make([]byte, 83)); e != ErrTooLong {
+		t.Error("EncodeErr with too much data:", e)
+	}
+	if s, e := EncodeErr("a", make([]byte, 82)); e != nil || len(s) != 90 || Encode("a", make([]byte, 82)) != s {
+		t.Error("EncodeErr fails:", e)
+	}
+}
+
+func TestWithLimit(t *testing.T) {
+	data := make([]byte, 190)
+	for i := range data {
+		data[i] = byte(i % 32)
+	}
+	if Encode("lnurl", data) != "" {
+		t.Error("Encode ignores the length limit")
+	}
+	s := EncodeWithLimit("lnurl", data, 500)
+	if len(s) != 202 {
+		t.Fatal("EncodeWithLimit fails", len(s))
+	}
+	if hrp, d := Decode(s); hrp != "" || d != nil {
+		t.Error("Decode ignores the length limit")
+	}
+	if hrp, d := DecodeWithLimit(s, 500); hrp != "lnurl" || !bytes.Equal(d, data) {
+		t.Error("DecodeWithLimit fails")
+	}
+	if hrp, d := DecodeWithLimit(s, 201); hrp != "" || d != nil {
+		t.Error("DecodeWithLimit ignores the length limit")
+	}
+	if EncodeWithLimit("lnurl", data, 201) != "" {
+		t.Error("EncodeWithLimit ignores the length limit")
+	}
+}
+
+func TestUpperCase(t *testing.T) {
+	for _, s := range append([]string{"BC1QW508D6QEJXTDG4Y5R3ZARVARY0C5XW7KV8F3T4",
+		"BC1SW50QA3JX3S", "A12UEL5L"}, validChecksum...) {
+		hrp, data := Decode(strings.ToUpper(s))
+		lhrp, ldata := Decode(strings.ToLower(s))
+		if hrp == "" || data == nil || hrp != lhrp || !bytes.Equal(data, ldata) {
+			t.Error("Decode fails on upper case string: ", strings.ToUpper(s))
+		}
+	}
+	if _, _, e := DecodeErr("BC1QW508D6QEJXTDG4Y5R3ZARVARY0C5XW7KV8F3t4"); e != ErrMixedCase {
+		t.Error("Decode accepts upper case string with a lower case character", e)
+	}
+}
+
+func TestVerifyChecksum(t *testing.T) {
+	for _, s := range validChecksum {
+		if !VerifyChecksum(s) || ChecksumVariant(s) != Bech32 {
+			t.Error("VerifyChecksum fails: ", s)
+		}
+	}
+	for _, s := range validChecksumM {
+		if VerifyChecksum(s) || ChecksumVariant(s) != Bech32m {
+			t.Error("ChecksumVariant fails: ", s)
+		}
+	}
+	for _, s := range append(append([]string{"A12uEL5L", "a12uel5x"}, invalidChecksum...), invalidChecksumM...) {
+		if VerifyChecksum(s) || ChecksumVariant(s) != Invalid {
+			t.Error("VerifyChecksum succeeds on invalid string: ", s)
+		}
+	}
+	const s = "abcdef1qpzry9x8gf2tvdw0s3jn54khce6mua7lmqqqxw"
+	if n := testing.AllocsPerRun(100, func() { VerifyChecksum(s) }); n != 0 {
+		t.Error("VerifyChecksum allocates", n)
+	}
+}
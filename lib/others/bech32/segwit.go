@@ -2,70 +2,145 @@ package bech32
 
 import (
 	"bytes"
+	"errors"
 )
 
-// Return nil on error
-func convertBits(outbits uint, in []byte, inbits uint, pad bool) []byte {
+// Errors returned by ConvertBits, SegwitEncodeErr and SegwitDecodeErr
+var (
+	// ErrInvalidData - a value to convert does not fit in the given number of bits
+	ErrInvalidData = errors.New("bech32: invalid data")
+	// ErrInvalidPadding - the padding bits are not zero (or there are too many of them)
+	ErrInvalidPadding = errors.New("bech32: invalid padding")
+	// ErrWrongHRP - the address is for another network
+	ErrWrongHRP = errors.New("bech32: wrong hrp")
+	// ErrInvalidVersion - the witness version is over 16
+	ErrInvalidVersion = errors.New("bech32: invalid witness version")
+	// ErrInvalidProgram - the witness program's length is not allowed (for its version)
+	ErrInvalidProgram = errors.New("bech32: invalid witness program length")
+)
+
+// ConvertBits - regroups the bits of data, from fromBits to toBits per byte (i.e. 8 to 5 for
+// encoding a witness program and 5 to 8 for decoding it), like the reference implementation.
+// With pad, the last group is padded with zero bits. Without it, the padding left over
+// must be shorter than fromBits and all zero, or ErrInvalidPadding is returned.
+func ConvertBits(data []byte, fromBits, toBits uint8, pad bool) ([]byte, error) {
 	var val uint32
-	var bits uint
-	maxv := uint32(1<<outbits) - 1
+	var bits uint8
+	maxv := uint32(1<<toBits) - 1
 	out := new(bytes.Buffer)
-	for inx := range in {
-		val = (val << inbits) | uint32(in[inx])
-		bits += inbits
-		for bits >= outbits {
-			bits -= outbits
+	for _, b := range data {
+		if (b >> fromBits) != 0 {
+			return nil, ErrInvalidData
+		}
+		val = (val << fromBits) | uint32(b)
+		bits += fromBits
+		for bits >= toBits {
+			bits -= toBits
 			out.WriteByte(byte((val >> bits) & maxv))
 		}
 	}
 	if pad {
 		if bits != 0 {
-			out.WriteByte(byte((val << (outbits - bits)) & maxv))
+			out.WriteByte(byte((val << (toBits - bits)) & maxv))
 		}
-	} else if ((val<<(outbits-bits))&maxv) != 0 || bits >= inbits {
-		return nil
+	} else if ((val<<(toBits-bits))&maxv) != 0 || bits >= fromBits {
+		return nil, ErrInvalidPadding
 	}
-	return out.Bytes()
+	return out.Bytes(), nil
 }
 
 // SegwitEncode - Returns empty string on error
 func SegwitEncode(hrp string, witver int, witprog []byte) string {
-	if witver > 16 {
+	if witver < 0 || witver > 0xff {
 		return ""
 	}
-	if witver == 0 && len(witprog) != 20 && len(witprog) != 32 {
-		return ""
+	res, _ := SegwitEncodeErr(hrp, byte(witver), witprog)
+	return res
+}
+
+// SegwitEncodeErr - like SegwitEncode, but returns the reason of the failure
+func SegwitEncodeErr(hrp string, version byte, program []byte) (string, error) {
+	return segwitEncode(hrp, version, program, bech32Const)
+}
+
+// SegwitAddrEncode - encodes a segwit address as specified by BIP-350, so the version 0
+// gets bech32 checksum, while the other versions (i.e. Taproot) get bech32m checksum.
+func SegwitAddrEncode(hrp string, version byte, program []byte) (string, error) {
+	if version == 0 {
+		return segwitEncode(hrp, version, program, bech32Const)
 	}
-	if len(witprog) < 2 || len(witprog) > 40 {
-		return ""
+	return segwitEncode(hrp, version, program, bech32mConst)
+}
+
+func segwitEncode(hrp string, version byte, program []byte, constant uint32) (string, error) {
+	if e := checkWitness(version, program); e != nil {
+		return "", e
 	}
-	return Encode(hrp, append([]byte{byte(witver)}, convertBits(5, witprog, 8, true)...))
+	data, _ := ConvertBits(program, 8, 5, true)
+	return encode(hrp, append([]byte{version}, data...), constant, MaxLength)
 }
 
 // SegwitDecode - returns (0, nil) on error
 func SegwitDecode(hrp, addr string) (witver int, witdata []byte) {
-	hrpActual, data := Decode(addr)
-	if hrpActual == "" || len(data) == 0 || len(data) > 65 {
+	if version, program, e := SegwitDecodeErr(hrp, addr); e == nil {
+		witver, witdata = int(version), program
+	}
+	return
+}
+
+// SegwitDecodeErr - like SegwitDecode, but returns the reason of the failure
+func SegwitDecodeErr(hrp, addr string) (version byte, program []byte, e error) {
+	return segwitDecode(hrp, addr, false)
+}
+
+// SegwitAddrDecode - decodes a segwit address as specified by BIP-350, so the version 0
+// must have bech32 checksum, while the other versions (i.e. Taproot) must have bech32m checksum.
+func SegwitAddrDecode(hrp, addr string) (version byte, program []byte, e error) {
+	return segwitDecode(hrp, addr, true)
+}
+
+func segwitDecode(hrp, addr string, bip350 bool) (version byte, program []byte, e error) {
+	hrpActual, data, variant, e := decode(addr, MaxLength)
+	if e != nil {
 		return
 	}
-	if hrp != hrpActual {
+	expect := Bech32
+	if bip350 && len(data) > 0 && data[0] != 0 {
+		expect = Bech32m
+	}
+	if variant != expect {
+		e = ErrBadChecksum
 		return
 	}
-	if data[0] > 16 {
+	if len(data) == 0 || len(data) > 65 {
+		e = ErrInvalidProgram
 		return
 	}
-	witdata = convertBits(8, data[1:], 5, false)
-	if witdata == nil {
+	if hrp != hrpActual {
+		e = ErrWrongHRP
 		return
 	}
-	if len(witdata) < 2 || len(witdata) > 40 {
-		witdata = nil
+	if program, e = ConvertBits(data[1:], 5, 8, false); e != nil {
 		return
 	}
-	if data[0] == 0 && len(witdata) != 20 && len(witdata) != 32 {
-		witdata = nil
+	if e = checkWitness(data[0], program); e != nil {
+		program = nil
 		return
 	}
-	witver = int(data[0])
+	version = data[0]
 	return
 }
+
+// checkWitness verifies the witness version and the length of the program
+func checkWitness(version byte, program []byte) error {
+	if version > 16 {
+		return ErrInvalidVersion
+	}
+	if version == 0 && len(program) != 20 && len(program) != 32 {
+		return ErrInvalidProgram
+	}
+	if len(program) < 2 || len(program) > 40 {
+		return ErrInvalidProgram
+	}
+	return nil
+}
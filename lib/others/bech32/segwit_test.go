@@ -2,6 +2,7 @@ package bech32
 
 import (
 	"bytes"
+	"encoding/hex"
 	"strings"
 	"testing"
 )
@@ -132,3 +133,108 @@ func TestInvalidAddressEnc(t *testing.T) {
 		}
 	}
 }
+
+func TestConvertBits(t *testing.T) {
+	prog := []byte{0x75, 0x1e, 0x76, 0xe8, 0x19, 0x91, 0x96, 0xd4, 0x54, 0x94}
+	d5, e := ConvertBits(prog, 8, 5, true)
+	if e != nil || len(d5) != 16 {
+		t.Fatal("ConvertBits 8->5 fails", e, len(d5))
+	}
+	if d8, e := ConvertBits(d5, 5, 8, false); e != nil || !bytes.Equal(d8, prog) {
+		t.Error("ConvertBits 5->8 fails", e)
+	}
+	if _, e := ConvertBits([]byte{1, 32}, 5, 8, true); e != ErrInvalidData {
+		t.Error("ConvertBits accepts 6-bit value", e)
+	}
+	if _, e := ConvertBits([]byte{31, 1}, 5, 8, false); e != ErrInvalidPadding {
+		t.Error("ConvertBits accepts non-zero padding", e)
+	}
+	if _, e := ConvertBits([]byte{31, 0, 0}, 5, 8, false); e != ErrInvalidPadding {
+		t.Error("ConvertBits accepts too much padding", e)
+	}
+	if d, e := ConvertBits([]byte{31, 0x1c}, 5, 8, false); e != nil || !bytes.Equal(d, []byte{0xff}) {
+		t.Error("ConvertBits rejects zero padding", e, d)
+	}
+}
+
+func TestSegwitErrors(t *testing.T) {
+	const addr = "BC1QW508D6QEJXTDG4Y5R3ZARVARY0C5XW7KV8F3T4"
+	if v, prog, e := SegwitDecodeErr("bc", addr); e != nil || v != 0 || len(prog) != 20 {
+		t.Error("SegwitDecodeErr fails", e)
+	} else if s, e := SegwitEncodeErr("bc", v, prog); e != nil || !strings.EqualFold(s, addr) {
+		t.Error("SegwitEncodeErr fails", e, s)
+	}
+	var tests = []struct {
+		hrp, addr string
+		e         error
+	}{
+		{"tb", addr, ErrWrongHRP},
+		{"bc", "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t5", ErrBadChecksum},
+		{"bc", "BC13W508D6QEJXTDG4Y5R3ZARVARY0C5XW7KN40WF2", ErrInvalidVersion},
+		{"bc", "bc1rw5uspcuh", ErrInvalidProgram},
+		{"bc", "BC1QR508D6QEJXTDG4Y5R3ZARVARYV98GJ9P", ErrInvalidProgram},
+		{"bc", "bc1zw508d6qejxtdg4y5r3zarvaryvqyzf3du", ErrInvalidPadding},
+		{"tb", "tb1qrp33g0q5c5txsp9arysrx4k6zdkfs4nce4xj0gdcccefvpysxf3pjxtptv", ErrInvalidPadding},
+	}
+	for _, tc := range tests {
+		if _, prog, e := SegwitDecodeErr(tc.hrp, tc.addr); e != tc.e || prog != nil {
+			t.Errorf("SegwitDecodeErr(%q) returned %v, expected %v", tc.addr, e, tc.e)
+		}
+	}
+	if _, e := SegwitEncodeErr("bc", 17, make([]byte, 32)); e != ErrInvalidVersion {
+		t.Error("SegwitEncodeErr accepts version 17", e)
+	}
+	if _, e := SegwitEncodeErr("bc", 0, make([]byte, 21)); e != ErrInvalidProgram {
+		t.Error("SegwitEncodeErr accepts 21 bytes program for version 0", e)
+	}
+}
+
+func TestSegwitAddrBIP350(t *testing.T) {
+	var valid = []struct {
+		address      string
+		scriptPubKey string
+	}{
+		{"BC1QW508D6QEJXTDG4Y5R3ZARVARY0C5XW7KV8F3T4", "0014751e76e8199196d454941c45d1b3a323f1433bd6"},
+		{"tb1qrp33g0q5c5txsp9arysrx4k6zdkfs4nce4xj0gdcccefvpysxf3q0sl5k7",
+			"00201863143c14c5166804bd19203356da136c985678cd4d27a1b8c6329604903262"},
+		{"bc1pw508d6qejxtdg4y5r3zarvary0c5xw7kw508d6qejxtdg4y5r3zarvary0c5xw7kt5nd6y",
+			"5128751e76e8199196d454941c45d1b3a323f1433bd6751e76e8199196d454941c45d1b3a323f1433bd6"},
+		{"BC1SW50QGDZ25J", "6002751e"},
+		{"bc1zw508d6qejxtdg4y5r3zarvaryvaxxpcs", "5210751e76e8199196d454941c45d1b3a323"},
+		{"tb1pqqqqp399et2xygdj5xreqhjjvcmzhxw4aywxecjdzew6hylgvsesf3hn0c",
+			"5120000000c4a5cad46221b2a187905e5266362b99d5e91c6ce24d165dab93e86433"},
+		{"bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqzk5jj0",
+			"512079be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798"},
+	}
+	for _, rec := range valid {
+		hrp := strings.ToLower(rec.address[:2])
+		v, prog, e := SegwitAddrDecode(hrp, rec.address)
+		if e != nil {
+			t.Error("SegwitAddrDecode fails: ", rec.address, e)
+			continue
+		}
+		if spk := hex.EncodeToString(segwitScriptPubKey(int(v), prog)); spk != rec.scriptPubKey {
+			t.Error("SegwitAddrDecode produces wrong result: ", rec.address, spk)
+		}
+		if s, e := SegwitAddrEncode(hrp, v, prog); e != nil || !strings.EqualFold(s, rec.address) {
+			t.Error("SegwitAddrEncode produces wrong result: ", rec.address, s, e)
+		}
+	}
+
+	var invalid = []struct {
+		hrp, address string
+		e            error
+	}{
+		{"bc", "tc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vq5zuyut", ErrWrongHRP},
+		{"bc", "bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqh2y7hd", ErrBadChecksum},
+		{"tb", "tb1z0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqglt7rf", ErrBadChecksum},
+		{"bc", "BC1S0XLXVLHEMJA6C4DQV22UAPCTQUPFHLXM9H8Z3K2E72Q4K9HCZ7VQ54WELL", ErrBadChecksum},
+		{"bc", "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kemeawh", ErrBadChecksum},
+		{"tb", "tb1q0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vq24jc47", ErrBadChecksum},
+	}
+	for _, rec := range invalid {
+		if _, prog, e := SegwitAddrDecode(rec.hrp, rec.address); e != rec.e || prog != nil {
+			t.Errorf("SegwitAddrDecode(%q) returned %v, expected %v", rec.address, e, rec.e)
+		}
+	}
+}
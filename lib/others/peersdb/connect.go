@@ -0,0 +1,136 @@
+package peersdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/ParallelCoinTeam/duod/lib/others/sys"
+)
+
+var (
+	socksProxy string // "host:port" of the SOCKS5 proxy used for the onion peers (protected by peerDBMutex)
+
+	// ErrNoSocksProxy - TryConnect was given an onion peer, but no SOCKS5 proxy is configured
+	ErrNoSocksProxy = errors.New("peersdb: no SOCKS5 proxy configured for onion peers")
+)
+
+// SocksProxy - Returns the address of the SOCKS5 proxy used for the onion peers (empty if none)
+func SocksProxy() string {
+	peerDBMutex.Lock()
+	defer peerDBMutex.Unlock()
+	return socksProxy
+}
+
+// SetSocksProxy - Sets the "host:port" of the SOCKS5 proxy (i.e. Tor) that TryConnect uses
+// for the onion peers (empty string to clear it)
+func SetSocksProxy(addr string) {
+	peerDBMutex.Lock()
+	socksProxy = addr
+	peerDBMutex.Unlock()
+}
+
+// TryConnect - Dials the peer and records the outcome in the database (as Alive or Dead would do),
+// returning the error of the dial or of saving the peer.
+// The onion peers are dialed through the SOCKS5 proxy (see SetSocksProxy).
+func TryConnect(p *PeerAddr, timeout time.Duration) (e error) {
+	if p.IsBanned() {
+		return errors.New("peer is banned")
+	}
+	var con net.Conn
+	if p.IsOnion() {
+		proxy := SocksProxy()
+		if proxy == "" {
+			return ErrNoSocksProxy
+		}
+		con, e = dialSocks5(proxy, p.OnionHost(), p.Port, timeout)
+	} else {
+		if sys.IsIPBlocked(p.IPv4[:]) {
+			return errors.New("peer's IP is blocked")
+		}
+		con, e = net.DialTimeout("tcp", p.IP(), timeout)
+	}
+	if e != nil {
+		p.Time -= 600 // as Dead does, but checking the save
+		if se := p.Save(); se != nil {
+			return se
+		}
+		return e
+	}
+	con.Close()
+	p.Time = uint32(time.Now().Unix())
+	return p.Save()
+}
+
+// dialSocks5 connects to host:port through the SOCKS5 proxy (RFC 1928, no authentication).
+// The host name is resolved by the proxy.
+func dialSocks5(proxy, host string, port uint16, timeout time.Duration) (net.Conn, error) {
+	if len(host) > 255 {
+		return nil, errors.New("socks5: host name too long")
+	}
+	con, e := net.DialTimeout("tcp", proxy, timeout)
+	if e != nil {
+		return nil, e
+	}
+	if e = socks5Connect(con, host, port, timeout); e != nil {
+		con.Close()
+		return nil, e
+	}
+	return con, nil
+}
+
+// socks5Connect does the SOCKS5 handshake and the CONNECT request on an open connection to the proxy.
+func socks5Connect(con net.Conn, host string, port uint16, timeout time.Duration) (e error) {
+	con.SetDeadline(time.Now().Add(timeout))
+
+	var b [4]byte
+	if _, e = con.Write([]byte{5, 1, 0}); e != nil { // version 5, one method: no authentication
+		return
+	}
+	if _, e = io.ReadFull(con, b[:2]); e != nil {
+		return
+	}
+	if b[0] != 5 || b[1] != 0 {
+		return errors.New("socks5: proxy refused the authentication method")
+	}
+
+	req := make([]byte, 0, 7+len(host))
+	req = append(req, 5, 1, 0, 3, byte(len(host))) // CONNECT to a domain name
+	req = append(req, host...)
+	req = append(req, 0, 0)
+	binary.BigEndian.PutUint16(req[len(req)-2:], port)
+	if _, e = con.Write(req); e != nil {
+		return
+	}
+	if _, e = io.ReadFull(con, b[:4]); e != nil {
+		return
+	}
+	if b[0] != 5 {
+		return errors.New("socks5: bad reply from the proxy")
+	}
+	if b[1] != 0 {
+		return fmt.Errorf("socks5: connect failed with code %d", b[1])
+	}
+	var skip int // the bound address and port, which we do not need
+	switch b[3] {
+	case 1:
+		skip = 4 + 2
+	case 4:
+		skip = 16 + 2
+	case 3:
+		if _, e = io.ReadFull(con, b[:1]); e != nil {
+			return
+		}
+		skip = int(b[0]) + 2
+	default:
+		return errors.New("socks5: bad address type in the reply")
+	}
+	if _, e = io.CopyN(ioutil.Discard, con, int64(skip)); e != nil {
+		return
+	}
+	return con.SetDeadline(time.Time{})
+}
@@ -1,9 +1,12 @@
 package peersdb
 
 import (
-	"encoding/binary"
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"math/rand"
 	"net"
 	"os"
 	"sort"
@@ -23,12 +26,18 @@ const (
 	ExpirePeerAfter = (24 * time.Hour) // https://en.bitcoin.it/wiki/Protocol_specification#addr
 	// MinPeersInDB -
 	MinPeersInDB = 512 // Do not expire peers if we have less than this
+	// MaxPeerTimeAhead - How far in the future the peer's Time is allowed to be
+	MaxPeerTimeAhead = time.Hour
+	// MaxAddrGossip - Max number of addresses in a single "addr" message
+	MaxAddrGossip = 1000
+	// MaxMisbehaving - The peer gets banned when its misbehaviour points reach this value
+	MaxMisbehaving = 100
 )
 
 var (
 	// PeerDB -
 	PeerDB      *qdb.DB
-	proxyPeer   *PeerAddr // when this is not nil we should only connect to this single node
+	proxyPeer   *PeerAddr // when this is not nil we should only connect to this single node (protected by peerDBMutex)
 	peerDBMutex sync.Mutex
 	// Testnet -
 	Testnet bool
@@ -36,6 +45,36 @@ var (
 	ConnectOnly string
 	// Services -
 	Services uint64 = 1
+	// Logger - Used for the diagnostic messages (stderr by default, nil to mute them)
+	Logger = func(format string, args ...interface{}) {
+		fmt.Fprintf(os.Stderr, format+"\n", args...)
+	}
+	// MainnetSeeds - DNS seeds used by InitPeers (can be changed before calling it)
+	MainnetSeeds = []string{
+		// "seed1.parallelcoin.info",
+		"seed2.parallelcoin.info",
+		"seed3.parallelcoin.info",
+		"seed4.parallelcoin.info",
+		// "seed5.parallelcoin.info",
+	}
+	// TestnetSeeds - DNS seeds used by InitPeers in testnet mode
+	TestnetSeeds = []string{
+		"seed2.parallelcoin.info",
+	}
+	// BanDuration - How long a banned peer stays banned
+	BanDuration = 24 * time.Hour
+	// MaxPeersPerNetGroup - If not zero, GetBestPeers returns at most this many peers
+	// from the same network group (see CalcNetGroup), to make it harder to eclipse the node
+	MaxPeersPerNetGroup uint
+	// ErrNoSeeds - None of the DNS seeds gave any address
+	ErrNoSeeds = errors.New("peersdb: none of the DNS seeds could be resolved")
+	// ErrFutureTime - Save refused a peer with Time more than MaxPeerTimeAhead in the future
+	ErrFutureTime = errors.New("peersdb: peer's time too far in the future")
+
+	lookupHost = net.DefaultResolver.LookupHost // replaced by the tests
+
+	seedCancel context.CancelFunc // stops resolving the seeds, when closing the database
+	seeding    sync.WaitGroup
 )
 
 // PeerAddr -
@@ -47,6 +86,12 @@ type PeerAddr struct {
 	Friend bool // Connected from friends.txt
 }
 
+func logf(format string, args ...interface{}) {
+	if Logger != nil {
+		Logger(format, args...)
+	}
+}
+
 // DefaultTCPport -
 func DefaultTCPport() uint16 {
 	if Testnet {
@@ -67,9 +112,19 @@ func NewEmptyPeer() (p *PeerAddr) {
 func NewPeer(v []byte) (p *PeerAddr) {
 	p = new(PeerAddr)
 	p.OnePeer = utils.NewPeer(v)
+	if p.OnePeer != nil {
+		p.clampTime()
+	}
 	return
 }
 
+// clampTime makes sure that the peer's Time is not too far in the future
+func (p *PeerAddr) clampTime() {
+	if max := uint32(time.Now().Add(MaxPeerTimeAhead).Unix()); p.Time > max {
+		p.Time = max
+	}
+}
+
 // NewAddrFromString -
 func NewAddrFromString(ipstr string, forceDefaultPort bool) (p *PeerAddr, e error) {
 	port := DefaultTCPport()
@@ -89,6 +144,18 @@ func NewAddrFromString(ipstr string, forceDefaultPort bool) (p *PeerAddr, e erro
 		}
 		ipstr = ipstr[:x] // remove port number
 	}
+	if strings.HasSuffix(strings.ToLower(ipstr), ".onion") {
+		onion, ok := utils.DecodeOnion(ipstr)
+		if !ok {
+			e = errors.New("Error parsing onion address '" + ipstr + "'")
+			return
+		}
+		p = NewEmptyPeer()
+		p.Services = Services
+		p.SetOnion(onion)
+		p.Port = port
+		return
+	}
 	ip := net.ParseIP(ipstr)
 	if ip != nil && len(ip) == 16 {
 		p = NewEmptyPeer()
@@ -109,60 +176,318 @@ func NewPeerFromString(ipstr string, forceDefaultPort bool) (p *PeerAddr, e erro
 		return
 	}
 
-	if sys.IsIPBlocked(p.IPv4[:]) {
+	if !p.IsOnion() && sys.IsIPBlocked(p.IPv4[:]) {
 		e = errors.New(ipstr + " is blocked")
 		return
 	}
 
-	if dbp := PeerDB.Get(qdb.KeyType(p.UniqID())); dbp != nil && NewPeer(dbp).Banned != 0 {
+	dbp := PeerDB.Get(qdb.KeyType(p.UniqID()))
+	if dbp != nil && NewPeer(dbp).IsBanned() {
 		e = errors.New(p.IP() + " is banned")
 		p = nil
 	} else {
+		if dbp != nil {
+			old := NewPeer(dbp)
+			p.Labels, p.Misbehaving, p.GoodConnections = old.Labels, old.Misbehaving, old.GoodConnections
+		}
 		p.Time = uint32(time.Now().Unix())
 		p.Save()
 	}
 	return
 }
 
-// ExpirePeers -
+// ExpirePeers - Removes the peers not seen for ExpirePeerAfter and clears the expired bans.
+// The peers with Time more than MaxPeerTimeAhead in the future (which could only be stored
+// before Save started refusing them) are removed as well, as they would never expire.
 func ExpirePeers() {
 	peerDBMutex.Lock()
-	var delcnt uint32
+	var todel []qdb.KeyType
+	var unbanned []*PeerAddr
 	now := time.Now()
-	todel := make([]qdb.KeyType, PeerDB.Count())
+	maxTime := uint32(now.Add(MaxPeerTimeAhead).Unix())
 	PeerDB.Browse(func(k qdb.KeyType, v []byte) uint32 {
-		ptim := binary.LittleEndian.Uint32(v[0:4])
-		if now.After(time.Unix(int64(ptim), 0).Add(ExpirePeerAfter)) || ptim > uint32(now.Unix()+3600) {
-			todel[delcnt] = k // we cannot call Del() from here
-			delcnt++
+		ptim := utils.PeerTimeFromBytes(v)
+		if ptim > maxTime || now.After(time.Unix(int64(ptim), 0).Add(ExpirePeerAfter)) {
+			todel = append(todel, k) // we cannot call Del() from here
+		} else if utils.PeerBannedFromBytes(v) != 0 {
+			if p := NewPeer(v); !p.IsBanned() {
+				unbanned = append(unbanned, p)
+			}
 		}
 		return 0
 	})
-	if delcnt > 0 {
-		for delcnt > 0 && PeerDB.Count() > MinPeersInDB {
-			delcnt--
-			PeerDB.Del(todel[delcnt])
+	for _, p := range unbanned {
+		p.Unban()
+	}
+	if n := PeerDB.Count() - MinPeersInDB; n > 0 && len(todel) > 0 {
+		if n < len(todel) {
+			todel = todel[len(todel)-n:]
 		}
+		PeerDB.DelMany(todel)
 		PeerDB.Defrag(false)
 	}
 	peerDBMutex.Unlock()
 }
 
-// Save -
-func (p *PeerAddr) Save() {
-	if p.Time > 0x80000000 {
-		println("saving dupa", int32(p.Time), p.IP())
+// CalcNetGroup - Returns the network group of the peer's IP.
+// For IPv4 it is the /16 prefix, for IPv6 the /32 one, both preceded by the IP version.
+func (p *PeerAddr) CalcNetGroup() []byte {
+	var v4mapped bool
+	if p.IPv6[10] == 0xff && p.IPv6[11] == 0xff || p.IPv6[10] == 0 && p.IPv6[11] == 0 {
+		v4mapped = true
+		for _, b := range p.IPv6[:10] {
+			if b != 0 {
+				v4mapped = false
+				break
+			}
+		}
+	}
+	if v4mapped {
+		return []byte{4, p.IPv4[0], p.IPv4[1]}
+	}
+	return []byte{6, p.IPv6[0], p.IPv6[1], p.IPv6[2], p.IPv6[3]}
+}
+
+// Save - Stores the peer in the database.
+// A peer with Time more than MaxPeerTimeAhead in the future is not stored and ErrFutureTime is returned.
+func (p *PeerAddr) Save() error {
+	if max := uint32(time.Now().Add(MaxPeerTimeAhead).Unix()); p.Time > max {
+		logf("Save: %s has time %d in the future (max %d)", p.IP(), p.Time, max)
+		return ErrFutureTime
 	}
+	p.NetGroup = p.CalcNetGroup()
 	PeerDB.Put(qdb.KeyType(p.UniqID()), p.Bytes())
 	PeerDB.Sync()
+	return nil
 }
 
 // Ban -
 func (p *PeerAddr) Ban() {
+	p.BanWithReason("")
+}
+
+// BanWithReason - Bans the peer, storing also why (see ExportBans)
+func (p *PeerAddr) BanWithReason(reason string) {
 	p.Banned = uint32(time.Now().Unix())
+	p.BanReason = reason
+	p.Save()
+}
+
+// IsBanned - Returns true if the peer has been banned less than BanDuration ago
+func (p *PeerAddr) IsBanned() bool {
+	return p.Banned != 0 && time.Since(time.Unix(int64(p.Banned), 0)) < BanDuration
+}
+
+// Unban - Clears the ban of the peer (and its misbehaviour points)
+func (p *PeerAddr) Unban() {
+	p.Banned = 0
+	p.BanReason = ""
+	p.Misbehaving = 0
+	p.Save()
+}
+
+// GotGoodData - Increases the peer's score, after it gave us something useful
+func (p *PeerAddr) GotGoodData() {
+	if p.GoodConnections != 0xffffffff {
+		p.GoodConnections++
+	}
+	p.Save()
+}
+
+// GotBadData - Adds the misbehaviour points to the peer, banning it if they reach MaxMisbehaving
+func (p *PeerAddr) GotBadData(howmuch uint32) {
+	if p.Misbehaving+howmuch < p.Misbehaving {
+		p.Misbehaving = 0xffffffff
+	} else {
+		p.Misbehaving += howmuch
+	}
+	if p.Misbehaving >= MaxMisbehaving {
+		p.BanWithReason("misbehaving")
+		return
+	}
 	p.Save()
 }
 
+// rank returns the peer's Time, adjusted by its score: every good connection counts as if
+// the peer was seen a minute later (up to a day) and every misbehaviour point as 10 minutes earlier.
+func (p *PeerAddr) rank() int64 {
+	good := int64(p.GoodConnections)
+	if good > 24*60 {
+		good = 24 * 60
+	}
+	return int64(p.Time) + 60*good - 600*int64(p.Misbehaving)
+}
+
+// ExportBans - Writes all the banned peers to a text file, one per line: "ip:port ban_time [reason]".
+func ExportBans(path string) error {
+	buf := new(bytes.Buffer)
+	fmt.Fprintln(buf, "# ip:port ban_time [reason]")
+	peerDBMutex.Lock()
+	PeerDB.BrowseAll(func(k qdb.KeyType, v []byte) uint32 {
+		if ad := NewPeer(v); ad.OnePeer != nil && ad.IsBanned() {
+			if reason := strings.Join(strings.Fields(ad.BanReason), " "); reason != "" {
+				fmt.Fprintln(buf, ad.IP(), ad.Banned, reason)
+			} else {
+				fmt.Fprintln(buf, ad.IP(), ad.Banned)
+			}
+		}
+		return 0
+	})
+	peerDBMutex.Unlock()
+	return ioutil.WriteFile(path, buf.Bytes(), 0600)
+}
+
+// ImportBans - Bans the peers listed in a file written by ExportBans, with their reasons.
+// Peers not yet in the database get added to it.
+// The bans older than BanDuration and the peers that cannot be saved are skipped.
+// Returns number of banned peers.
+func ImportBans(path string) (cnt int, e error) {
+	var d []byte
+	if d, e = ioutil.ReadFile(path); e != nil {
+		return
+	}
+	peerDBMutex.Lock()
+	defer peerDBMutex.Unlock()
+	for _, line := range strings.Split(string(d), "\n") {
+		ll := strings.Fields(line)
+		if len(ll) < 2 || strings.HasPrefix(ll[0], "#") {
+			continue
+		}
+		var p *PeerAddr
+		var tim uint64
+		if p, e = NewAddrFromString(ll[0], false); e != nil {
+			return
+		}
+		if tim, e = strconv.ParseUint(ll[1], 10, 32); e != nil {
+			return
+		}
+		if dbp := PeerDB.Get(qdb.KeyType(p.UniqID())); dbp != nil {
+			p = NewPeer(dbp)
+		}
+		p.Banned = uint32(tim)
+		if p.Banned == 0 {
+			p.Banned = uint32(time.Now().Unix())
+		}
+		p.BanReason = strings.Join(ll[2:], " ")
+		if !p.IsBanned() || p.Save() != nil {
+			continue
+		}
+		cnt++
+	}
+	return
+}
+
+// ExportPeers - Writes all the peers to a text file, one per line: "ip:port services last_seen"
+func ExportPeers(path string) error {
+	buf := new(bytes.Buffer)
+	fmt.Fprintln(buf, "# ip:port services last_seen")
+	peerDBMutex.Lock()
+	PeerDB.Browse(func(k qdb.KeyType, v []byte) uint32 {
+		if ad := NewPeer(v); ad.OnePeer != nil {
+			fmt.Fprintln(buf, ad.IP(), ad.Services, ad.Time)
+		}
+		return 0
+	})
+	peerDBMutex.Unlock()
+	return ioutil.WriteFile(path, buf.Bytes(), 0600)
+}
+
+// ImportPeers - Adds the peers listed in a file written by ExportPeers.
+// The port (default one), services and last_seen (now) can be omitted.
+// Blocked peers and the ones already in the database are skipped. Returns number of added peers.
+func ImportPeers(path string) (added int, e error) {
+	var d []byte
+	if d, e = ioutil.ReadFile(path); e != nil {
+		return
+	}
+	peerDBMutex.Lock()
+	defer peerDBMutex.Unlock()
+	for _, line := range strings.Split(string(d), "\n") {
+		ll := strings.Fields(line)
+		if len(ll) == 0 || strings.HasPrefix(ll[0], "#") {
+			continue
+		}
+		var p *PeerAddr
+		if p, e = NewAddrFromString(ll[0], false); e != nil {
+			return
+		}
+		p.Time = uint32(time.Now().Unix())
+		if len(ll) > 1 {
+			if p.Services, e = strconv.ParseUint(ll[1], 10, 64); e != nil {
+				return
+			}
+		}
+		if len(ll) > 2 {
+			var tim uint64
+			if tim, e = strconv.ParseUint(ll[2], 10, 32); e != nil {
+				return
+			}
+			p.Time = uint32(tim)
+		}
+		if !p.IsOnion() && (!sys.ValidIPv4(p.IPv4[:]) || sys.IsIPBlocked(p.IPv4[:])) || PeerDB.Get(qdb.KeyType(p.UniqID())) != nil {
+			continue
+		}
+		p.Save()
+		added++
+	}
+	return
+}
+
+// SetLabel - Adds the label to the peer with the given address, which must be in the database.
+// An empty label removes all the labels of the peer. Labels can be up to 255 bytes long.
+func SetLabel(ipstr, label string) error {
+	if len(label) > 255 {
+		return errors.New("Label too long")
+	}
+	if strings.HasPrefix(label, utils.BanReasonMark) {
+		return errors.New("Label cannot start with a zero byte")
+	}
+	p, e := NewAddrFromString(ipstr, false)
+	if e != nil {
+		return e
+	}
+	peerDBMutex.Lock()
+	defer peerDBMutex.Unlock()
+	dbp := PeerDB.Get(qdb.KeyType(p.UniqID()))
+	if dbp == nil {
+		return errors.New(p.IP() + " not in the database")
+	}
+	p = NewPeer(dbp)
+	if label == "" {
+		p.Labels = nil
+	} else {
+		for _, l := range p.Labels {
+			if l == label {
+				return nil
+			}
+		}
+		if len(p.Labels) >= 255 {
+			return errors.New("Too many labels")
+		}
+		p.Labels = append(p.Labels, label)
+	}
+	p.Save()
+	return nil
+}
+
+// PeersByLabel - Returns all the peers from the database that have the given label.
+func PeersByLabel(label string) (res []*PeerAddr) {
+	peerDBMutex.Lock()
+	PeerDB.BrowseAll(func(k qdb.KeyType, v []byte) uint32 {
+		if ad := NewPeer(v); ad.OnePeer != nil {
+			for _, l := range ad.Labels {
+				if l == label {
+					res = append(res, ad)
+					break
+				}
+			}
+		}
+		return 0
+	})
+	peerDBMutex.Unlock()
+	return
+}
+
 // Alive -
 func (p *PeerAddr) Alive() {
 	prv := int64(p.Time)
@@ -179,8 +504,11 @@ func (p *PeerAddr) Dead() {
 	p.Save()
 }
 
-// IP -
+// IP - Returns "ip:port", or "xxx.onion:port" for a Tor peer
 func (p *PeerAddr) IP() string {
+	if p.IsOnion() {
+		return fmt.Sprint(p.OnionHost(), ":", p.Port)
+	}
 	return fmt.Sprintf("%d.%d.%d.%d:%d", p.IPv4[0], p.IPv4[1], p.IPv4[2], p.IPv4[3], p.Port)
 }
 
@@ -189,7 +517,7 @@ func (p *PeerAddr) String() (s string) {
 	s = fmt.Sprintf("%21s  srv:%16x", p.IP(), p.Services)
 
 	now := uint32(time.Now().Unix())
-	if p.Banned != 0 {
+	if p.IsBanned() {
 		s += fmt.Sprintf("  *BAN %5d sec ago", int(now)-int(p.Time))
 	} else {
 		s += fmt.Sprintf("  Seen %5d sec ago", int(now)-int(p.Time))
@@ -204,9 +532,9 @@ func (mp manyPeers) Len() int {
 	return len(mp)
 }
 
-// Less -
+// Less - The peers with higher rank (see PeerAddr.rank) go first
 func (mp manyPeers) Less(i, j int) bool {
-	return mp[i].Time > mp[j].Time
+	return mp[i].rank() > mp[j].rank()
 }
 
 // Swap -
@@ -214,11 +542,17 @@ func (mp manyPeers) Swap(i, j int) {
 	mp[i], mp[j] = mp[j], mp[i]
 }
 
-// GetBestPeers - Fetch a given number of best (most recenty seen) peers.
+// GetBestPeers - Fetch a given number of best (most recenty seen, with the best score) peers.
 func GetBestPeers(limit uint, isConnected func(*PeerAddr) bool) (res manyPeers) {
-	if proxyPeer != nil {
-		if isConnected == nil || !isConnected(proxyPeer) {
-			return manyPeers{proxyPeer}
+	return GetBestPeersWithServices(limit, 0, isConnected)
+}
+
+// GetBestPeersWithServices - Like GetBestPeers, but only returns the peers having all the required service bits.
+// The proxy peer (ConnectOnly) is returned regardless of its services.
+func GetBestPeersWithServices(limit uint, required uint64, isConnected func(*PeerAddr) bool) (res manyPeers) {
+	if proxy := ProxyPeer(); proxy != nil {
+		if isConnected == nil || !isConnected(proxy) {
+			return manyPeers{proxy}
 		}
 		return manyPeers{}
 	}
@@ -226,7 +560,7 @@ func GetBestPeers(limit uint, isConnected func(*PeerAddr) bool) (res manyPeers)
 	tmp := make(manyPeers, 0)
 	PeerDB.Browse(func(k qdb.KeyType, v []byte) uint32 {
 		ad := NewPeer(v)
-		if ad.Banned == 0 && sys.ValidIPv4(ad.IPv4[:]) && !sys.IsIPBlocked(ad.IPv4[:]) {
+		if ad.usable() && ad.Services&required == required {
 			if isConnected == nil || !isConnected(ad) {
 				tmp = append(tmp, ad)
 			}
@@ -237,6 +571,9 @@ func GetBestPeers(limit uint, isConnected func(*PeerAddr) bool) (res manyPeers)
 	// Copy the top rows to the result buffer
 	if len(tmp) > 0 {
 		sort.Sort(tmp)
+		if MaxPeersPerNetGroup > 0 {
+			tmp = tmp.diverse(MaxPeersPerNetGroup, limit)
+		}
 		if uint(len(tmp)) < limit {
 			limit = uint(len(tmp))
 		}
@@ -246,68 +583,205 @@ func GetBestPeers(limit uint, isConnected func(*PeerAddr) bool) (res manyPeers)
 	return
 }
 
-func initSeeds(seeds []string, port uint16) {
-	for i := range seeds {
-		ad, er := net.LookupHost(seeds[i])
-		if er == nil {
-			for j := range ad {
-				ip := net.ParseIP(ad[j])
-				if ip != nil && len(ip) == 16 {
-					p := NewEmptyPeer()
-					p.Services = 1
-					copy(p.IPv6[:], ip[:12])
-					copy(p.IPv4[:], ip[12:16])
-					p.Port = port
-					p.Save()
+// diverse returns (up to limit of) the peers, keeping their order, but skipping the ones
+// whose network group already has maxPerGroup peers in the result.
+func (mp manyPeers) diverse(maxPerGroup, limit uint) (res manyPeers) {
+	groups := make(map[string]uint)
+	res = make(manyPeers, 0, limit)
+	for _, p := range mp {
+		if uint(len(res)) == limit {
+			break
+		}
+		ng := p.NetGroup
+		if len(ng) == 0 { // stored by an older version
+			ng = p.CalcNetGroup()
+		}
+		if groups[string(ng)] < maxPerGroup {
+			groups[string(ng)]++
+			res = append(res, p)
+		}
+	}
+	return
+}
+
+// GetRandomPeer - Picks one random peer, that we can connect to.
+// Unlike GetBestPeers(1, ...) it does not sort the whole database.
+func GetRandomPeer(isConnected func(*PeerAddr) bool) (res *PeerAddr) {
+	if proxy := ProxyPeer(); proxy != nil {
+		if isConnected == nil || !isConnected(proxy) {
+			return proxy
+		}
+		return nil
+	}
+	var cnt int
+	peerDBMutex.Lock()
+	PeerDB.Browse(func(k qdb.KeyType, v []byte) uint32 {
+		ad := NewPeer(v)
+		if ad.usable() {
+			if isConnected == nil || !isConnected(ad) {
+				cnt++
+				if rand.Intn(cnt) == 0 {
+					res = ad
 				}
 			}
-		} else {
-			println("initSeeds LookupHost", seeds[i], "-", er.Error())
 		}
+		return 0
+	})
+	peerDBMutex.Unlock()
+	return
+}
+
+// SampleForGossip - Returns a random sample of up to MaxAddrGossip recently seen peers,
+// to be sent in an "addr" message.
+func SampleForGossip() (res []*PeerAddr) {
+	var cnt int
+	recent := uint32(time.Now().Add(-ExpirePeerAfter).Unix())
+	res = make([]*PeerAddr, 0, MaxAddrGossip)
+	peerDBMutex.Lock()
+	PeerDB.Browse(func(k qdb.KeyType, v []byte) uint32 {
+		ad := NewPeer(v)
+		if ad.Time >= recent && ad.usable() {
+			cnt++
+			if len(res) < MaxAddrGossip {
+				res = append(res, ad)
+			} else if i := rand.Intn(cnt); i < MaxAddrGossip {
+				res[i] = ad
+			}
+		}
+		return 0
+	})
+	peerDBMutex.Unlock()
+	return
+}
+
+// ProxyPeer - Returns the only peer to connect to (set with ConnectOnly), or nil if there is none
+func ProxyPeer() *PeerAddr {
+	peerDBMutex.Lock()
+	defer peerDBMutex.Unlock()
+	return proxyPeer
+}
+
+// SetProxyPeer - Makes GetBestPeers and GetRandomPeer return only the given peer (nil to clear it)
+func SetProxyPeer(p *PeerAddr) {
+	peerDBMutex.Lock()
+	proxyPeer = p
+	peerDBMutex.Unlock()
+}
+
+// usable returns true if the peer is not banned and its IP is valid and not blocked.
+// Tor peers are not usable, as the node does not connect through a proxy (only TryConnect does).
+func (p *PeerAddr) usable() bool {
+	return !p.IsBanned() && !p.IsOnion() && sys.ValidIPv4(p.IPv4[:]) && !sys.IsIPBlocked(p.IPv4[:])
+}
+
+// initSeeds adds the addresses of the given DNS seeds to the database, returning their number.
+// The seeds that fail are logged in one message and, if all of them fail, ErrNoSeeds is returned.
+func initSeeds(ctx context.Context, seeds []string, port uint16) (cnt int, e error) {
+	var failed []string
+	for i := range seeds {
+		if e = ctx.Err(); e != nil {
+			return
+		}
+		ad, er := lookupHost(ctx, seeds[i])
+		if er != nil {
+			failed = append(failed, seeds[i]+" ("+er.Error()+")")
+			continue
+		}
+		var n int
+		for j := range ad {
+			ip := net.ParseIP(ad[j]).To16()
+			if ip != nil && ip.To4() != nil {
+				p := NewEmptyPeer()
+				p.Services = 1
+				copy(p.IPv6[:], ip[:12])
+				copy(p.IPv4[:], ip[12:16])
+				p.Port = port
+				p.Save()
+				n++
+			}
+		}
+		if n == 0 {
+			failed = append(failed, seeds[i]+" (no IPv4 address)")
+		}
+		cnt += n
+	}
+	if len(failed) > 0 {
+		logf("initSeeds: %d of %d seeds failed: %s", len(failed), len(seeds), strings.Join(failed, ", "))
+	}
+	if cnt == 0 && len(seeds) > 0 {
+		e = ErrNoSeeds
 	}
+	return
 }
 
-// InitPeers - shall be called from the main thread
-func InitPeers(dir string) {
-	PeerDB, _ = qdb.NewDB(dir+"peers3", true)
+// resolveConnectOnly returns the peer given by ConnectOnly ("host[:port]")
+func resolveConnectOnly(ctx context.Context) (p *PeerAddr, e error) {
+	host, port := ConnectOnly, fmt.Sprint(DefaultTCPport())
+	if strings.Contains(ConnectOnly, ":") {
+		if host, port, e = net.SplitHostPort(ConnectOnly); e != nil {
+			return
+		}
+	}
+	var ad []string
+	if ad, e = lookupHost(ctx, host); e != nil {
+		return
+	}
+	for i := range ad {
+		if ip := net.ParseIP(ad[i]).To4(); ip != nil {
+			return NewAddrFromString(net.JoinHostPort(ip.String(), port), false)
+		}
+	}
+	e = errors.New("peersdb: no IPv4 address of " + host)
+	return
+}
 
+// InitPeers - shall be called from the main thread.
+// The DNS seeds are resolved in the background - the returned channel gets the result
+// (nil or ErrNoSeeds) when it is done and then it is closed.
+// With ConnectOnly, the seeds are not used and the channel is just closed.
+// Cancelling ctx (or calling ClosePeerDB) stops the DNS lookups.
+func InitPeers(ctx context.Context, dir string) (<-chan error, error) {
+	var e error
+	if PeerDB, e = qdb.NewDB(dir+"peers3", true); e != nil {
+		return nil, errors.New("Cannot open peers database: " + e.Error())
+	}
+
+	seeded := make(chan error, 1)
 	if ConnectOnly != "" {
-		x := strings.Index(ConnectOnly, ":")
-		if x == -1 {
-			ConnectOnly = fmt.Sprint(ConnectOnly, ":", DefaultTCPport())
-		}
-		oa, e := net.ResolveTCPAddr("tcp4", ConnectOnly)
+		proxy, e := resolveConnectOnly(ctx)
 		if e != nil {
-			println(e.Error(), ConnectOnly)
-			os.Exit(1)
-		}
-		proxyPeer = NewEmptyPeer()
-		proxyPeer.Services = Services
-		copy(proxyPeer.IPv4[:], oa.IP[12:16])
-		proxyPeer.Port = uint16(oa.Port)
-		fmt.Printf("Connect to bitcoin network via %d.%d.%d.%d:%d\n",
-			proxyPeer.IPv4[0], proxyPeer.IPv4[1], proxyPeer.IPv4[2], proxyPeer.IPv4[3], proxyPeer.Port)
+			PeerDB.Close()
+			PeerDB = nil
+			return nil, errors.New(ConnectOnly + ": " + e.Error())
+		}
+		proxy.Services = Services
+		SetProxyPeer(proxy)
+		fmt.Printf("Connect to bitcoin network via %s\n", proxy.IP())
+		close(seeded)
 	} else {
+		seeds := MainnetSeeds
+		if Testnet {
+			seeds = TestnetSeeds
+		}
+		ctx, seedCancel = context.WithCancel(ctx)
+		seeding.Add(1)
 		go func() {
-			if !Testnet {
-				initSeeds([]string{
-					// "seed1.parallelcoin.info",
-					"seed2.parallelcoin.info",
-					"seed3.parallelcoin.info",
-					"seed4.parallelcoin.info",
-					// "seed5.parallelcoin.info",
-				}, 11047)
-			} else {
-				initSeeds([]string{
-					"seed2.parallelcoin.info",
-				}, 21047)
-			}
+			_, e := initSeeds(ctx, seeds, DefaultTCPport())
+			seeded <- e
+			close(seeded)
+			seeding.Done()
 		}()
 	}
+	return seeded, nil
 }
 
 // ClosePeerDB -
 func ClosePeerDB() {
+	if seedCancel != nil {
+		seedCancel()
+		seeding.Wait()
+		seedCancel = nil
+	}
 	if PeerDB != nil {
 		L.Debug("Closing peer DB")
 		PeerDB.Sync()
@@ -0,0 +1,793 @@
+package peersdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ParallelCoinTeam/duod/lib/others/qdb"
+	"github.com/ParallelCoinTeam/duod/lib/others/sys"
+	"github.com/ParallelCoinTeam/duod/lib/others/utils"
+)
+
+const testdir = "peerstest"
+
+func openTestDB(t *testing.T) {
+	os.RemoveAll(testdir)
+	var e error
+	if PeerDB, e = qdb.NewDB(testdir, true); e != nil {
+		t.Fatal("Cannot create db", e.Error())
+	}
+}
+
+func closeTestDB() {
+	PeerDB.Close()
+	PeerDB = nil
+	os.RemoveAll(testdir)
+}
+
+func TestNetGroup(t *testing.T) {
+	openTestDB(t)
+	defer closeTestDB()
+
+	p1, e := NewPeerFromString("85.12.1.2:11047", false)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	p2, e := NewPeerFromString("85.12.200.7:11047", false)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	p3, e := NewPeerFromString("85.13.1.2:11047", false)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+
+	g1 := NewPeer(PeerDB.Get(qdb.KeyType(p1.UniqID()))).NetGroup
+	g2 := NewPeer(PeerDB.Get(qdb.KeyType(p2.UniqID()))).NetGroup
+	g3 := NewPeer(PeerDB.Get(qdb.KeyType(p3.UniqID()))).NetGroup
+	if len(g1) == 0 || !bytes.Equal(g1, g2) {
+		t.Error("Peers in the same /16 should share the netgroup", g1, g2)
+	}
+	if bytes.Equal(g1, g3) {
+		t.Error("Peers in different /16 should not share the netgroup", g1, g3)
+	}
+
+	// with the limit per netgroup, GetBestPeers picks the best two from 85.12/16 and the one from 85.13/16
+	for i := 3; i <= 6; i++ {
+		NewPeerFromString(fmt.Sprint("85.12.1.", i, ":11047"), false)
+	}
+	p2.Time++ // p2 and p3 are the best
+	p2.Save()
+	p3.Time++
+	p3.Save()
+	MaxPeersPerNetGroup = 2
+	defer func() { MaxPeersPerNetGroup = 0 }()
+	res := GetBestPeers(10, nil)
+	if len(res) != 3 {
+		t.Fatal("Bad number of diverse peers", res)
+	}
+	groups := make(map[string]int)
+	for _, p := range res {
+		groups[string(p.NetGroup)]++
+	}
+	if groups[string(g1)] != 2 || groups[string(g3)] != 1 {
+		t.Error("Bad diverse peers", res)
+	}
+	if res = GetBestPeers(2, nil); len(res) != 2 || bytes.Equal(res[0].NetGroup, res[1].NetGroup) {
+		t.Error("Bad limit of diverse peers", res)
+	}
+	MaxPeersPerNetGroup = 0
+	if res = GetBestPeers(10, nil); len(res) != 7 {
+		t.Error("Netgroup limit applied when disabled", len(res))
+	}
+}
+
+func TestGetRandomPeer(t *testing.T) {
+	openTestDB(t)
+	defer closeTestDB()
+
+	for i := 1; i <= 10; i++ {
+		p, _ := NewPeerFromString(fmt.Sprint("85.12.1.", i, ":11047"), false)
+		if i > 8 {
+			p.Ban()
+		}
+	}
+	p, _ := NewAddrFromString("192.168.1.1:11047", false) // not a valid remote address
+	p.Save()
+
+	connected := func(p *PeerAddr) bool {
+		return p.IPv4[3] == 1
+	}
+	seen := make(map[string]bool)
+	for i := 0; i < 200; i++ {
+		p := GetRandomPeer(connected)
+		if p == nil {
+			t.Fatal("No peer returned")
+		}
+		if p.Banned != 0 || !sys.ValidIPv4(p.IPv4[:]) || connected(p) {
+			t.Error("Not eligible peer returned", p.String())
+		}
+		seen[p.IP()] = true
+	}
+	if len(seen) < 2 {
+		t.Error("Returned peer does not vary", len(seen))
+	}
+}
+
+func TestSampleForGossip(t *testing.T) {
+	openTestDB(t)
+	defer closeTestDB()
+
+	for i := 0; i < 1200; i++ {
+		p, _ := NewAddrFromString(fmt.Sprint("85.", i/250, ".", i%250, ".1:11047"), false)
+		if i%10 == 0 {
+			p.Banned = uint32(time.Now().Unix())
+		}
+		p.Save()
+	}
+	res := SampleForGossip()
+	if len(res) != MaxAddrGossip {
+		t.Error("Bad sample size", len(res))
+	}
+	for _, p := range res {
+		if p.Banned != 0 {
+			t.Error("Banned peer in the sample", p.String())
+		}
+	}
+}
+
+func TestExportImportBans(t *testing.T) {
+	openTestDB(t)
+	defer closeTestDB()
+
+	banned := make(map[string]bool)
+	for i := 1; i <= 20; i++ {
+		p, _ := NewPeerFromString(fmt.Sprint("85.12.1.", i, ":11047"), false)
+		if i%3 == 0 {
+			p.BanWithReason(fmt.Sprint("reason number ", i))
+			banned[p.IP()] = true
+		}
+	}
+	p, _ := NewPeerFromString("85.12.1.99:11047", false)
+	p.Ban() // without a reason
+	banned[p.IP()] = true
+	fn := testdir + "_bans.txt"
+	defer os.Remove(fn)
+	if e := ExportBans(fn); e != nil {
+		t.Fatal(e.Error())
+	}
+
+	var keys []qdb.KeyType
+	PeerDB.BrowseAll(func(k qdb.KeyType, v []byte) uint32 {
+		keys = append(keys, k)
+		return 0
+	})
+	for _, k := range keys {
+		PeerDB.Del(k)
+	}
+
+	// an expired ban is not imported, while the text after the ban time is ignored
+	f, _ := os.OpenFile(fn, os.O_APPEND|os.O_WRONLY, 0600)
+	fmt.Fprintln(f, "85.12.2.1:11047", time.Now().Add(-2*BanDuration).Unix())
+	fmt.Fprintln(f, "85.12.2.2:11047", time.Now().Unix(), "spam")
+	f.Close()
+	banned["85.12.2.2:11047"] = true
+
+	n, e := ImportBans(fn)
+	if e != nil || n != len(banned) {
+		t.Fatal("ImportBans failed", n, e)
+	}
+	var cnt int
+	PeerDB.BrowseAll(func(k qdb.KeyType, v []byte) uint32 {
+		p := NewPeer(v)
+		if p.Banned == 0 || !banned[p.IP()] {
+			t.Error("Unexpected peer after import", p.String())
+		}
+		var reason string
+		switch {
+		case p.IP() == "85.12.2.2:11047":
+			reason = "spam"
+		case p.IPv4[3] != 99:
+			reason = fmt.Sprint("reason number ", p.IPv4[3])
+		}
+		if p.BanReason != reason {
+			t.Error("Bad ban reason after import", p.IP(), p.BanReason, reason)
+		}
+		cnt++
+		return 0
+	})
+	if cnt != len(banned) {
+		t.Error("Wrong number of banned peers", cnt)
+	}
+}
+
+func TestFutureTime(t *testing.T) {
+	openTestDB(t)
+	defer closeTestDB()
+
+	p, _ := NewAddrFromString("85.12.1.2:11047", false)
+	p.Time = uint32(time.Now().Add(24 * 365 * time.Hour).Unix())
+	if e := p.Save(); e != ErrFutureTime {
+		t.Error("Save accepted time in the future", e)
+	}
+	if PeerDB.Get(qdb.KeyType(p.UniqID())) != nil {
+		t.Error("Peer with time in the future stored")
+	}
+
+	p.Time = uint32(time.Now().Add(MaxPeerTimeAhead / 2).Unix())
+	if e := p.Save(); e != nil {
+		t.Error("Save failed", e)
+	}
+	if stored := utils.NewPeer(PeerDB.Get(qdb.KeyType(p.UniqID()))); stored == nil || stored.Time != p.Time {
+		t.Error("Peer not stored")
+	}
+
+	// a peer stored with time in the future before Save refused it must still expire
+	for i := 0; i < MinPeersInDB; i++ {
+		fp, _ := NewAddrFromString(fmt.Sprintf("85.13.%d.%d:11047", i/250, i%250+1), false)
+		fp.Time = uint32(time.Now().Unix())
+		fp.Save()
+	}
+	p.Time = uint32(time.Now().Add(24 * 365 * time.Hour).Unix())
+	PeerDB.Put(qdb.KeyType(p.UniqID()), p.Bytes())
+	ExpirePeers()
+	if PeerDB.Get(qdb.KeyType(p.UniqID())) != nil {
+		t.Error("Peer with time in the future not expired")
+	}
+	if PeerDB.Count() != MinPeersInDB {
+		t.Error("Bad number of peers after expiry", PeerDB.Count())
+	}
+}
+
+func TestTryConnect(t *testing.T) {
+	openTestDB(t)
+	defer closeTestDB()
+
+	ln, e := net.Listen("tcp4", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	addr := ln.Addr().String()
+
+	old := uint32(time.Now().Add(-time.Hour).Unix())
+	p, _ := NewAddrFromString(addr, false)
+	p.Time = old
+	p.Save()
+	if e = TryConnect(p, time.Second); e != nil {
+		t.Fatal("TryConnect failed", e.Error())
+	}
+	if stored := NewPeer(PeerDB.Get(qdb.KeyType(p.UniqID()))); stored.Time <= old {
+		t.Error("Peer's time not updated on success", stored.Time, old)
+	}
+
+	// the success gets saved even if the peer was alive less than a minute ago
+	recent := uint32(time.Now().Add(-30 * time.Second).Unix())
+	p.Time = recent
+	p.Save()
+	if e = TryConnect(p, time.Second); e != nil {
+		t.Fatal("TryConnect failed", e.Error())
+	}
+	if stored := NewPeer(PeerDB.Get(qdb.KeyType(p.UniqID()))); stored.Time <= recent {
+		t.Error("Recent peer's time not saved on success", stored.Time, recent)
+	}
+
+	// a blocked IP must not be dialed
+	sys.IPBlocked = func(ip4 []byte) bool { return ip4[0] == 127 }
+	p.Time = old
+	p.Save()
+	e = TryConnect(p, time.Second)
+	sys.IPBlocked = nil
+	if e == nil {
+		t.Error("TryConnect to a blocked IP succeeded")
+	}
+	if stored := NewPeer(PeerDB.Get(qdb.KeyType(p.UniqID()))); stored.Time != old {
+		t.Error("Blocked peer's time changed", stored.Time, old)
+	}
+
+	ln.Close() // nothing listens on the port anymore
+	p.Time = old
+	p.Save()
+	if e = TryConnect(p, time.Second); e == nil {
+		t.Fatal("TryConnect to a closed port succeeded")
+	}
+	if stored := NewPeer(PeerDB.Get(qdb.KeyType(p.UniqID()))); stored.Time >= old {
+		t.Error("Peer's time not decreased on failure", stored.Time, old)
+	}
+
+	p.Ban()
+	if TryConnect(p, time.Second) == nil {
+		t.Error("TryConnect to a banned peer succeeded")
+	}
+}
+
+// socks5Proxy accepts one connection and answers the SOCKS5 handshake, sending the requested
+// "host:port" to the channel. It refuses the CONNECT request if ok is false.
+func socks5Proxy(t *testing.T, ok bool) (addr string, req chan string) {
+	ln, e := net.Listen("tcp4", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	req = make(chan string, 1)
+	go func() {
+		defer ln.Close()
+		con, e := ln.Accept()
+		if e != nil {
+			return
+		}
+		defer con.Close()
+		b := make([]byte, 262)
+		if _, e = io.ReadFull(con, b[:3]); e != nil || !bytes.Equal(b[:3], []byte{5, 1, 0}) {
+			req <- "bad greeting"
+			return
+		}
+		con.Write([]byte{5, 0})
+		if _, e = io.ReadFull(con, b[:5]); e != nil || b[1] != 1 || b[3] != 3 {
+			req <- "bad request"
+			return
+		}
+		n := int(b[4])
+		if _, e = io.ReadFull(con, b[:n+2]); e != nil {
+			return
+		}
+		req <- fmt.Sprint(string(b[:n]), ":", binary.BigEndian.Uint16(b[n:]))
+		if ok {
+			con.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+		} else {
+			con.Write([]byte{5, 4, 0, 1, 0, 0, 0, 0, 0, 0}) // host unreachable
+		}
+	}()
+	return ln.Addr().String(), req
+}
+
+func TestTryConnectOnion(t *testing.T) {
+	openTestDB(t)
+	defer closeTestDB()
+	defer SetSocksProxy("")
+
+	const addr = "2gzyxa5ihm7nsggfxnu52rck2vv4rvmdlkiu3zzui5du4xyclen53wid.onion:11047"
+	old := uint32(time.Now().Add(-time.Hour).Unix())
+	p, _ := NewAddrFromString(addr, false)
+	p.Time = old
+	p.Save()
+	if TryConnect(p, time.Second) != ErrNoSocksProxy {
+		t.Error("Onion peer dialed without a proxy")
+	}
+
+	proxy, req := socks5Proxy(t, true)
+	SetSocksProxy(proxy)
+	if e := TryConnect(p, time.Second); e != nil {
+		t.Fatal("TryConnect through the proxy failed", e.Error())
+	}
+	if r := <-req; r != addr {
+		t.Error("Bad address sent to the proxy", r)
+	}
+	if stored := NewPeer(PeerDB.Get(qdb.KeyType(p.UniqID()))); stored.Time <= old {
+		t.Error("Onion peer's time not updated on success", stored.Time, old)
+	}
+
+	proxy, req = socks5Proxy(t, false)
+	SetSocksProxy(proxy)
+	p.Time = old
+	p.Save()
+	if TryConnect(p, time.Second) == nil {
+		t.Error("TryConnect succeeded with the proxy refusing the connection")
+	}
+	<-req
+	if stored := NewPeer(PeerDB.Get(qdb.KeyType(p.UniqID()))); stored.Time >= old {
+		t.Error("Onion peer's time not decreased on failure", stored.Time, old)
+	}
+}
+
+func TestLabels(t *testing.T) {
+	openTestDB(t)
+	defer closeTestDB()
+
+	for i := 1; i <= 5; i++ {
+		NewPeerFromString(fmt.Sprint("85.12.1.", i, ":11047"), false)
+	}
+	if SetLabel("85.12.1.1:11047", "seed") != nil || SetLabel("85.12.1.2:11047", "seed") != nil ||
+		SetLabel("85.12.1.2:11047", "my-node") != nil || SetLabel("85.12.1.2:11047", "seed") != nil {
+		t.Fatal("SetLabel failed")
+	}
+	NewPeerFromString("85.12.1.1:11047", false) // seen again
+	if SetLabel("85.12.1.9:11047", "seed") == nil {
+		t.Error("Label set for a peer not in the database")
+	}
+
+	seeds := PeersByLabel("seed")
+	if len(seeds) != 2 {
+		t.Fatal("Bad number of peers labeled seed", len(seeds))
+	}
+	for _, p := range seeds {
+		if p.IPv4[0] != 85 || p.IPv4[3] > 2 || len(p.NetGroup) == 0 {
+			t.Error("Bad peer labeled seed", p.String(), p.NetGroup)
+		}
+	}
+	if res := PeersByLabel("my-node"); len(res) != 1 || res[0].IP() != "85.12.1.2:11047" || len(res[0].Labels) != 2 {
+		t.Error("Bad peers labeled my-node", res)
+	}
+	if len(PeersByLabel("problematic")) != 0 {
+		t.Error("Peers found for unused label")
+	}
+
+	SetLabel("85.12.1.2:11047", "")
+	if res := PeersByLabel("seed"); len(res) != 1 || res[0].IP() != "85.12.1.1:11047" {
+		t.Error("Labels not removed", res)
+	}
+}
+
+func TestInitSeeds(t *testing.T) {
+	openTestDB(t)
+	defer closeTestDB()
+	var logged []string
+	defer func(l func(string, ...interface{})) {
+		Logger, lookupHost = l, net.DefaultResolver.LookupHost
+	}(Logger)
+	Logger = func(format string, args ...interface{}) {
+		logged = append(logged, fmt.Sprintf(format, args...))
+	}
+	lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		switch host {
+		case "good1":
+			return []string{"85.12.1.1", "85.12.1.2"}, nil
+		case "good2":
+			return []string{"85.12.2.1"}, nil
+		case "ipv6":
+			return []string{"2001:db8::1"}, nil
+		}
+		return nil, fmt.Errorf("no such host")
+	}
+
+	n, e := initSeeds(context.Background(), []string{"good1", "bad", "good2", "ipv6"}, DefaultTCPport())
+	if n != 3 || e != nil || PeerDB.Count() != 3 {
+		t.Error("Bad result of initSeeds", n, e, PeerDB.Count())
+	}
+	if len(logged) != 1 || !strings.Contains(logged[0], "2 of 4") || !strings.Contains(logged[0], "bad (no such host)") {
+		t.Error("Bad summary logged", logged)
+	}
+	if p, _ := NewAddrFromString("85.12.2.1:11047", false); p == nil || PeerDB.Get(qdb.KeyType(p.UniqID())) == nil {
+		t.Error("Seed not added with the default port")
+	}
+
+	logged = nil
+	if n, e = initSeeds(context.Background(), []string{"bad", "ipv6"}, DefaultTCPport()); n != 0 || e != ErrNoSeeds || len(logged) != 1 {
+		t.Error("All seeds failed not reported", n, e, logged)
+	}
+
+	closeTestDB()
+	saved := MainnetSeeds
+	defer func() {
+		MainnetSeeds = saved
+	}()
+	MainnetSeeds = []string{"bad"}
+	seeded, e := InitPeers(context.Background(), testdir+string(os.PathSeparator))
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	if e = <-seeded; e != ErrNoSeeds {
+		t.Error("InitPeers does not report failed seeds", e)
+	}
+	closeTestDB()
+	MainnetSeeds = []string{"good2"}
+	if seeded, e = InitPeers(context.Background(), testdir+string(os.PathSeparator)); e != nil {
+		t.Fatal(e.Error())
+	}
+	if e = <-seeded; e != nil || PeerDB.Count() != 1 {
+		t.Error("InitPeers fails with MainnetSeeds overridden", e)
+	}
+}
+
+func TestBanExpiry(t *testing.T) {
+	openTestDB(t)
+	defer closeTestDB()
+
+	p1, _ := NewPeerFromString("85.12.1.1:11047", false)
+	p2, _ := NewPeerFromString("85.12.2.1:11047", false)
+	p1.Ban()
+	p2.Banned = uint32(time.Now().Add(-BanDuration - time.Minute).Unix()) // banned long ago
+	p2.Save()
+	if !p1.IsBanned() || p2.IsBanned() {
+		t.Fatal("Bad IsBanned", p1.IsBanned(), p2.IsBanned())
+	}
+	if res := GetBestPeers(10, nil); len(res) != 1 || res[0].IP() != "85.12.2.1:11047" {
+		t.Error("Bad GetBestPeers", res)
+	}
+
+	ExpirePeers()
+	if stored := NewPeer(PeerDB.Get(qdb.KeyType(p2.UniqID()))); stored.Banned != 0 {
+		t.Error("Expired ban not cleared")
+	}
+	if stored := NewPeer(PeerDB.Get(qdb.KeyType(p1.UniqID()))); stored.Banned == 0 {
+		t.Error("Active ban cleared")
+	}
+
+	if _, e := NewPeerFromString("85.12.1.1:11047", false); e == nil {
+		t.Error("Banned peer accepted")
+	}
+	if _, e := NewPeerFromString("85.12.2.1:11047", false); e != nil {
+		t.Error("Peer with expired ban not accepted", e)
+	}
+
+	p1.Unban()
+	if stored := NewPeer(PeerDB.Get(qdb.KeyType(p1.UniqID()))); stored.IsBanned() {
+		t.Error("Unban failed")
+	}
+	if len(GetBestPeers(10, nil)) != 2 {
+		t.Error("Unbanned peer not returned by GetBestPeers")
+	}
+}
+
+func TestExportImportPeers(t *testing.T) {
+	openTestDB(t)
+	defer closeTestDB()
+
+	peers := make(map[string]*PeerAddr)
+	for i := 1; i <= 20; i++ {
+		p, _ := NewPeerFromString(fmt.Sprint("85.12.1.", i, ":11047"), false)
+		p.Services = uint64(i)
+		p.Time -= uint32(60 * i)
+		p.Save()
+		peers[p.IP()] = p
+	}
+	fn := testdir + "_peers.txt"
+	defer os.Remove(fn)
+	if e := ExportPeers(fn); e != nil {
+		t.Fatal(e.Error())
+	}
+
+	closeTestDB()
+	openTestDB(t)
+	n, e := ImportPeers(fn)
+	if e != nil || n != len(peers) || PeerDB.Count() != len(peers) {
+		t.Fatal("ImportPeers failed", n, e, PeerDB.Count())
+	}
+	PeerDB.Browse(func(k qdb.KeyType, v []byte) uint32 {
+		p := NewPeer(v)
+		if org := peers[p.IP()]; org == nil || org.Services != p.Services || org.Time != p.Time {
+			t.Error("Bad peer after import", p.String())
+		}
+		return 0
+	})
+	if n, e = ImportPeers(fn); e != nil || n != 0 || PeerDB.Count() != len(peers) {
+		t.Error("Peers imported twice", n, e)
+	}
+
+	ioutil.WriteFile(fn, []byte("# comment\n\n85.12.2.1\n85.12.2.2:1234 9\n127.0.0.1:11047\n"), 0600)
+	if n, e = ImportPeers(fn); e != nil || n != 2 {
+		t.Fatal("ImportPeers failed", n, e)
+	}
+	if p, _ := NewAddrFromString("85.12.2.1", false); p.Port != DefaultTCPport() || PeerDB.Get(qdb.KeyType(p.UniqID())) == nil {
+		t.Error("Peer without port not imported")
+	}
+	if p, _ := NewAddrFromString("85.12.2.2:1234", false); PeerDB.Get(qdb.KeyType(p.UniqID())) == nil ||
+		NewPeer(PeerDB.Get(qdb.KeyType(p.UniqID()))).Services != 9 {
+		t.Error("Peer with port and services not imported")
+	}
+
+	ioutil.WriteFile(fn, []byte("85.12.3.1:11047 x\n"), 0600)
+	if _, e = ImportPeers(fn); e == nil {
+		t.Error("Bad services accepted")
+	}
+}
+
+func TestGetBestPeersWithServices(t *testing.T) {
+	openTestDB(t)
+	defer closeTestDB()
+
+	for i := 1; i <= 16; i++ {
+		p, _ := NewPeerFromString(fmt.Sprint("85.12.1.", i, ":11047"), false)
+		p.Services = uint64(i % 8) // bits 0, 1 and 2 in all combinations
+		p.Save()
+	}
+	if res := GetBestPeers(100, nil); len(res) != 16 {
+		t.Error("Bad number of peers from GetBestPeers", len(res))
+	}
+	for _, required := range []uint64{0, 1, 2, 4, 5, 7, 8} {
+		res := GetBestPeersWithServices(100, required, nil)
+		exp := 0
+		for i := 1; i <= 16; i++ {
+			if uint64(i%8)&required == required {
+				exp++
+			}
+		}
+		if len(res) != exp {
+			t.Error("Bad number of peers with services", required, len(res), exp)
+		}
+		for _, p := range res {
+			if p.Services&required != required {
+				t.Error("Peer without the required services", required, p.String())
+			}
+		}
+	}
+	if res := GetBestPeersWithServices(3, 1, nil); len(res) != 3 {
+		t.Error("Limit not applied", len(res))
+	}
+}
+
+func TestProxyPeer(t *testing.T) {
+	openTestDB(t)
+	defer closeTestDB()
+	defer SetProxyPeer(nil)
+
+	NewPeerFromString("85.12.1.1:11047", false)
+	proxy, _ := NewAddrFromString("85.12.2.1:11047", false)
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 1000; i++ {
+			if i&1 == 0 {
+				SetProxyPeer(proxy)
+			} else {
+				SetProxyPeer(nil)
+			}
+		}
+		done <- true
+	}()
+	for i := 0; i < 1000; i++ {
+		if res := GetBestPeers(10, nil); len(res) != 1 {
+			t.Fatal("Bad number of peers", len(res))
+		}
+		GetRandomPeer(nil)
+	}
+	<-done
+
+	SetProxyPeer(proxy)
+	if ProxyPeer() != proxy || GetRandomPeer(nil) != proxy {
+		t.Error("Proxy peer not returned")
+	}
+	if res := GetBestPeers(10, nil); len(res) != 1 || res[0] != proxy {
+		t.Error("GetBestPeers does not return the proxy peer", res)
+	}
+	if res := GetBestPeers(10, func(p *PeerAddr) bool { return p == proxy }); len(res) != 0 {
+		t.Error("GetBestPeers returns connected proxy peer", res)
+	}
+	SetProxyPeer(nil)
+	if res := GetBestPeers(10, nil); len(res) != 1 || res[0].IP() != "85.12.1.1:11047" {
+		t.Error("Peers from the database not returned after clearing the proxy", res)
+	}
+}
+
+func TestOnionPeer(t *testing.T) {
+	openTestDB(t)
+	defer closeTestDB()
+
+	const addr = "2gzyxa5ihm7nsggfxnu52rck2vv4rvmdlkiu3zzui5du4xyclen53wid.onion:11047"
+	p, e := NewPeerFromString(addr, false)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	if !p.IsOnion() || p.IP() != addr {
+		t.Error("Bad onion peer", p.IP())
+	}
+	if p, e = NewAddrFromString("2GZYXA5IHM7NSGGFXNU52RCK2VV4RVMDLKIU3ZZUI5DU4XYCLEN53WID.onion", false); e != nil ||
+		p.IP() != addr {
+		t.Error("Onion address without port not parsed", e)
+	}
+	if _, e = NewAddrFromString("xxx.onion:11047", false); e == nil {
+		t.Error("Bad onion address parsed")
+	}
+	stored := NewPeer(PeerDB.Get(qdb.KeyType(p.UniqID())))
+	if !stored.IsOnion() || stored.IP() != addr || !strings.HasPrefix(stored.String(), addr) {
+		t.Error("Bad onion peer stored", stored.String())
+	}
+	if len(GetBestPeers(10, nil)) != 0 || TryConnect(p, time.Second) == nil {
+		t.Error("Onion peer used for connecting")
+	}
+}
+
+func TestPeerScore(t *testing.T) {
+	openTestDB(t)
+	defer closeTestDB()
+
+	good, _ := NewPeerFromString("85.12.1.1:11047", false)
+	flaky, _ := NewPeerFromString("85.12.2.1:11047", false)
+	good.Time -= 3600 // seen an hour ago
+	for i := 0; i < 100; i++ {
+		good.GotGoodData()
+	}
+	flaky.GotBadData(10)
+	if res := GetBestPeers(2, nil); len(res) != 2 || res[0].IP() != good.IP() {
+		t.Error("Peer with good score not first", res)
+	}
+
+	// the score survives the peer being seen again
+	flaky, _ = NewPeerFromString("85.12.2.1:11047", false)
+	if flaky.Misbehaving != 10 {
+		t.Error("Score lost", flaky.Misbehaving)
+	}
+	flaky.GotBadData(MaxMisbehaving - 11)
+	if flaky.IsBanned() {
+		t.Error("Peer banned before reaching MaxMisbehaving")
+	}
+	flaky.GotBadData(1)
+	if stored := NewPeer(PeerDB.Get(qdb.KeyType(flaky.UniqID()))); !stored.IsBanned() || stored.Misbehaving != MaxMisbehaving {
+		t.Error("Peer not banned after reaching MaxMisbehaving", stored.Misbehaving)
+	}
+	flaky.Unban()
+	if stored := NewPeer(PeerDB.Get(qdb.KeyType(flaky.UniqID()))); stored.IsBanned() || stored.Misbehaving != 0 {
+		t.Error("Misbehaving not cleared by Unban", stored.Misbehaving)
+	}
+	if stored := NewPeer(PeerDB.Get(qdb.KeyType(good.UniqID()))); stored.GoodConnections != 100 {
+		t.Error("GoodConnections not stored", stored.GoodConnections)
+	}
+}
+
+func TestInitPeersContext(t *testing.T) {
+	defer func(l func(string, ...interface{})) {
+		Logger, lookupHost, ConnectOnly = l, net.DefaultResolver.LookupHost, ""
+		SetProxyPeer(nil)
+		os.RemoveAll(testdir)
+	}(Logger)
+	Logger = nil
+	lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		switch host {
+		case "node":
+			return []string{"2001:db8::1", "85.12.1.1"}, nil
+		case "slow":
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("no such host")
+	}
+	dir := testdir + string(os.PathSeparator)
+
+	for _, bad := range []string{"typo", "node:port", "node:1:2"} {
+		ConnectOnly = bad
+		if _, e := InitPeers(context.Background(), dir); e == nil || PeerDB != nil {
+			t.Error("InitPeers does not fail for ConnectOnly", bad)
+		}
+	}
+
+	ConnectOnly = "node"
+	if _, e := InitPeers(context.Background(), dir); e != nil {
+		t.Fatal(e.Error())
+	}
+	if p := ProxyPeer(); p == nil || p.IP() != "85.12.1.1:11047" {
+		t.Error("Bad proxy peer", p)
+	}
+	ClosePeerDB()
+	SetProxyPeer(nil)
+
+	ConnectOnly = "node:1234"
+	if _, e := InitPeers(context.Background(), dir); e != nil || ProxyPeer() == nil || ProxyPeer().Port != 1234 {
+		t.Error("Bad proxy peer with port", e)
+	}
+	ClosePeerDB()
+	SetProxyPeer(nil)
+
+	// cancelling the context stops the seeds lookup
+	ConnectOnly = ""
+	saved := MainnetSeeds
+	defer func() {
+		MainnetSeeds = saved
+	}()
+	MainnetSeeds = []string{"slow", "node"}
+	ctx, cancel := context.WithCancel(context.Background())
+	seeded, e := InitPeers(ctx, dir)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	cancel()
+	if e = <-seeded; e != context.Canceled || PeerDB.Count() != 0 {
+		t.Error("Seeds lookup not cancelled", e)
+	}
+	ClosePeerDB()
+
+	// and so does closing the database
+	if seeded, e = InitPeers(context.Background(), dir); e != nil {
+		t.Fatal(e.Error())
+	}
+	ClosePeerDB()
+	if e = <-seeded; e != context.Canceled {
+		t.Error("Seeds lookup not stopped by ClosePeerDB", e)
+	}
+}
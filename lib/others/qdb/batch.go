@@ -0,0 +1,146 @@
+package qdb
+
+import (
+	"bytes"
+)
+
+// Batch - Set of changes to be written to the database at once, by Commit().
+// A batch is not safe for concurrent use.
+type Batch struct {
+	db   *DB
+	keys []KeyType           // in order of the first change
+	recs map[KeyType]*oneIdx // nil value means the key is to be deleted
+}
+
+// Batch - Returns a new, empty batch of changes for the database.
+func (db *DB) Batch() *Batch {
+	return &Batch{db: db, recs: make(map[KeyType]*oneIdx)}
+}
+
+func (b *Batch) set(key KeyType, rec *oneIdx) {
+	if _, ok := b.recs[key]; !ok {
+		b.keys = append(b.keys, key)
+	}
+	b.recs[key] = rec
+}
+
+// Put - Adds or updates record with a given key, when the batch gets committed.
+// Returns ErrTooLong if the value is too long, leaving the batch unchanged.
+func (b *Batch) Put(key KeyType, value []byte) error {
+	return b.PutExt(key, value, 0)
+}
+
+// PutExt - Adds or updates record with a given key and flags, when the batch gets committed.
+// Only the flags taken by DB.PutExt are used, the others are ignored.
+func (b *Batch) PutExt(key KeyType, value []byte, flags uint32) error {
+	if b.db.toolong(value) {
+		return ErrTooLong
+	}
+	b.set(key, b.db.newrec(value, flags&publicFlags))
+	return nil
+}
+
+// Del - Removes record with a given key, when the batch gets committed.
+func (b *Batch) Del(key KeyType) {
+	b.set(key, nil)
+}
+
+// Len - Returns number of the records changed by the batch.
+func (b *Batch) Len() int {
+	return len(b.keys)
+}
+
+// Commit - Writes all the changes with a single append to the data file and a single
+// write to the index log. If writing fails, the database in memory is left untouched.
+// The batch is empty after a successful commit and can be reused.
+func (b *Batch) Commit() (e error) {
+	db := b.db
+	if db.rejected() {
+		return ErrReadOnly
+	}
+	db.Mutex.Lock()
+	defer db.Mutex.Unlock()
+	if db.Idx == nil {
+		return ErrClosed
+	}
+
+	// in tombstone mode, deleting a key means storing a tombstone (only for existing keys)
+	if db.O.TombstoneGrace != 0 {
+		for _, k := range b.keys {
+			if b.recs[k] == nil {
+				if cur := db.Idx.get(k); cur != nil && !cur.deleted() {
+					b.recs[k] = newTombstone()
+				} else {
+					delete(b.recs, k)
+				}
+			}
+		}
+	}
+
+	if !db.VolatileMode {
+		// stage the data and the index records, before touching anything in memory
+		dat := new(bytes.Buffer)
+		bidx := new(bytes.Buffer)
+		db.checklogfile()
+		fpos := db.LastValidLogPos
+		staged := make(map[KeyType]oneIdx, len(b.recs))
+		for _, k := range b.keys {
+			rec, ok := b.recs[k]
+			if !ok {
+				continue
+			}
+			if rec == nil {
+				db.Idx.deltolog(bidx, k)
+				continue
+			}
+			tmp := *rec
+			tmp.datpos = uint32(fpos + int64(dat.Len()))
+			tmp.DataSeq = db.DataSeq
+			db.writerec(dat, rec.Slice())
+			db.Idx.addtolog(bidx, k, &tmp)
+			staged[k] = tmp
+		}
+
+		if _, e = db.LogFile.WriteAt(dat.Bytes(), fpos); e != nil {
+			return
+		}
+		db.LastValidLogPos += int64(dat.Len())
+		db.Idx.checklogfile()
+		if _, e = db.Idx.file.Write(bidx.Bytes()); e != nil {
+			return
+		}
+
+		for k, tmp := range staged {
+			rec := b.recs[k]
+			rec.datpos, rec.DataSeq = tmp.datpos, tmp.DataSeq
+		}
+	}
+
+	for _, k := range b.keys {
+		rec, ok := b.recs[k]
+		if !ok {
+			continue
+		}
+		if rec == nil {
+			db.Idx.memdel(k)
+		} else {
+			db.Idx.memput(k, rec)
+			if !db.VolatileMode {
+				rec.freerec()
+			}
+		}
+		db.unpend(k) // what is on disk now supersedes the pending change
+	}
+	cntadd("BatchRecords", uint64(len(b.keys)))
+
+	if db.VolatileMode {
+		db.NoSyncMode = true
+	} else if db.Idx.ExtraSpaceUsed > (uint64(db.O.ForcedDefragPerc) * db.Idx.DiskSpaceNeeded / 100) {
+		cnt("DefragNow")
+		db.defrag()
+	}
+
+	b.keys = nil
+	b.recs = make(map[KeyType]*oneIdx)
+	return
+}
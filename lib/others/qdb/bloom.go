@@ -0,0 +1,134 @@
+package qdb
+
+import (
+	"math"
+	"sync/atomic"
+)
+
+const (
+	bloomHashes       = 4  // number of counters per key
+	bloomCountersPer  = 16 // minimum number of counters per key, the filter is sized for
+	bloomMinCapacity  = 1024
+	bloomCounterLimit = 255 // a counter that got that high is never decremented
+	bloomBlock        = 64  // see slots()
+)
+
+// bloomFilter - Counting Bloom filter of the index keys (see ExtraOpts.UseBloomFilter).
+// It never misses a key that is in the index, so a key it does not have is surely absent.
+// As it keeps a counter (not a bit) for each slot, the keys can be removed from it.
+type bloomFilter struct {
+	counts   []uint8
+	mask     uint64
+	keys     int // number of keys in the filter
+	capacity int // number of keys the filter has been sized for
+
+	// updated atomically, as Get only read-locks the database
+	lookups, negatives, falsePositives uint64
+}
+
+// BloomStats - State of the Bloom filter, as returned by DB.BloomStats
+type BloomStats struct {
+	Keys           int     // number of keys in the filter
+	Size           int     // memory used by the filter, in bytes
+	Lookups        uint64  // number of the index lookups done through the filter (by the writes as well)
+	Negatives      uint64  // lookups answered by the filter alone ("definitely absent")
+	FalsePositives uint64  // lookups passed on to the index, for keys that were not there
+	ExpectedFPRate float64 // false positive rate expected for the current number of keys
+}
+
+func newBloomFilter(capacity int) (bf *bloomFilter) {
+	if capacity < bloomMinCapacity {
+		capacity = bloomMinCapacity
+	}
+	size := uint64(1)
+	for size < uint64(capacity)*bloomCountersPer {
+		size <<= 1
+	}
+	return &bloomFilter{counts: make([]uint8, size), mask: size - 1, capacity: capacity}
+}
+
+// slots returns the filter's block for the key and the key's counters within it.
+// All the counters of a key are in one 64 bytes block (a CPU cache line), so a lookup
+// costs a single memory access, at the price of a slightly higher false positive rate.
+func (bf *bloomFilter) slots(k KeyType) (blk []uint8, h uint64) {
+	h = uint64(k) // the keys are not necessarily random, so mix them first
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	b := (h & bf.mask) &^ (bloomBlock - 1)
+	return bf.counts[b : b+bloomBlock], h >> 40 // 4 x 6 bits for the counters
+}
+
+func (bf *bloomFilter) add(k KeyType) {
+	blk, h := bf.slots(k)
+	for i := 0; i < bloomHashes; i, h = i+1, h>>6 {
+		if c := &blk[h%bloomBlock]; *c < bloomCounterLimit {
+			*c++
+		}
+	}
+	bf.keys++
+}
+
+func (bf *bloomFilter) remove(k KeyType) {
+	blk, h := bf.slots(k)
+	for i := 0; i < bloomHashes; i, h = i+1, h>>6 {
+		if c := &blk[h%bloomBlock]; *c < bloomCounterLimit {
+			*c--
+		}
+	}
+	bf.keys--
+}
+
+func (bf *bloomFilter) has(k KeyType) bool {
+	atomic.AddUint64(&bf.lookups, 1)
+	blk, h := bf.slots(k)
+	for i := 0; i < bloomHashes; i, h = i+1, h>>6 {
+		if blk[h%bloomBlock] == 0 {
+			atomic.AddUint64(&bf.negatives, 1)
+			return false
+		}
+	}
+	return true
+}
+
+// rebuildBloom makes a new filter, sized to the current number of keys, with some room to grow
+func (idx *Index) rebuildBloom() {
+	bf := newBloomFilter(2 * len(idx.Index))
+	for k := range idx.Index {
+		bf.add(k)
+	}
+	if old := idx.bloom; old != nil {
+		bf.lookups, bf.negatives, bf.falsePositives = old.lookups, old.negatives, old.falsePositives
+	}
+	idx.bloom = bf
+}
+
+// bloomAdd adds a new key to the filter, rebuilding it if it got too full
+func (idx *Index) bloomAdd(k KeyType) {
+	if idx.bloom.keys >= idx.bloom.capacity {
+		idx.rebuildBloom() // the key is in the index already
+		return
+	}
+	idx.bloom.add(k)
+}
+
+// BloomStats - Returns the state of the Bloom filter (see ExtraOpts.UseBloomFilter).
+// Returns false if the database does not use it.
+func (db *DB) BloomStats() (s BloomStats, ok bool) {
+	db.Mutex.RLock()
+	defer db.Mutex.RUnlock()
+	if db.Idx == nil || db.Idx.bloom == nil {
+		return
+	}
+	bf := db.Idx.bloom
+	s.Keys = bf.keys
+	s.Size = len(bf.counts)
+	s.Lookups = atomic.LoadUint64(&bf.lookups)
+	s.Negatives = atomic.LoadUint64(&bf.negatives)
+	s.FalsePositives = atomic.LoadUint64(&bf.falsePositives)
+	s.ExpectedFPRate = math.Pow(1-math.Exp(-bloomHashes*float64(bf.keys)/float64(len(bf.counts))), bloomHashes)
+	ok = true
+	return
+}
@@ -0,0 +1,86 @@
+package qdb
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// MaxPending values tried by CalibratePending
+var calibratePendingValues = []uint32{250, 1000, DefaultMaxPending, DefaultMaxPendingNoSync}
+
+// CalibratePending - Measures the write speed of the storage with a few different MaxPending
+// values and sets the best performing one in the database's options.
+// The measurements are done on scratch databases, created in a new temporary directory next
+// to db.Dir (so on the same storage) and removed afterwards, so the records of this database
+// are not modified. MaxPendingNoSync keeps the default proportion to MaxPending.
+// The probe takes about probeDuration. It does nothing for a MemoryOnly database, which has
+// no storage to measure, and a ReadOnly one gets ErrReadOnly. If the scratch database cannot
+// be created, the error is returned and the options are not changed.
+func (db *DB) CalibratePending(probeDuration time.Duration) (e error) {
+	if db.MemoryOnly {
+		return
+	}
+	if db.ReadOnly {
+		return ErrReadOnly
+	}
+	db.Mutex.Lock()
+	if db.Idx == nil {
+		db.Mutex.Unlock()
+		return ErrClosed
+	}
+	recsize := 64
+	if n := db.Idx.size(); n > 0 {
+		if avg := int(db.Idx.DiskSpaceNeeded/uint64(n)) - 24; avg > 0 {
+			recsize = avg
+		}
+	}
+	db.Mutex.Unlock()
+
+	scratch, e := ioutil.TempDir(filepath.Dir(filepath.Clean(db.Dir)), "qdb-calibrate")
+	if e != nil {
+		return
+	}
+	defer os.RemoveAll(scratch)
+
+	var best uint32
+	var bestRate float64
+	probe := probeDuration / time.Duration(len(calibratePendingValues))
+	for i, mp := range calibratePendingValues {
+		var tmp *DB
+		dir := filepath.Join(scratch, strconv.Itoa(i))
+		if e = NewDBExt(&tmp, &NewDBOpts{Dir: dir, ExtraOpts: &ExtraOpts{DefragPercentVal: db.O.DefragPercentVal,
+			ForcedDefragPerc: db.O.ForcedDefragPerc, MaxPending: mp, MaxPendingNoSync: noSyncPending(mp)}}); e != nil {
+			return
+		}
+		var n int
+		sta := time.Now()
+		for time.Since(sta) < probe {
+			val := make([]byte, recsize) // the database keeps the slice, so it cannot be reused
+			rand.Read(val)
+			tmp.Put(KeyType(rand.Int63()), val)
+			n++
+		}
+		tmp.Close()
+		rate := float64(n) / time.Since(sta).Seconds()
+		if rate > bestRate {
+			best, bestRate = mp, rate
+		}
+		os.RemoveAll(dir)
+	}
+
+	db.Mutex.Lock()
+	db.O.MaxPending = best
+	db.O.MaxPendingNoSync = noSyncPending(best)
+	db.Mutex.Unlock()
+	cnt("Calibrated")
+	return
+}
+
+// noSyncPending returns MaxPendingNoSync for the given MaxPending, in the default proportion
+func noSyncPending(maxPending uint32) uint32 {
+	return maxPending * (DefaultMaxPendingNoSync / DefaultMaxPending)
+}
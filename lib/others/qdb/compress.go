@@ -0,0 +1,110 @@
+package qdb
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+
+	"github.com/ParallelCoinTeam/duod/lib/others/zstd"
+	"github.com/golang/snappy"
+)
+
+// Compression codecs, for ExtraOpts.Compression.
+// The codec of each record is stored in its flags, so the records compressed with different
+// codecs (or not compressed) can be mixed in one database. Changing the option only affects
+// the new records, until a full defrag re-compresses all the old ones.
+const (
+	// CompressNone -
+	CompressNone = 0
+	// CompressSnappy -
+	CompressSnappy = 1
+	// CompressGzip - Compresses better than snappy, but is much slower (prefer CompressZstd)
+	CompressGzip = 2
+	// CompressZstd - Compresses better than snappy, at a lower CPU cost than gzip
+	CompressZstd = 3
+
+	codecShift = 20
+	codecMask  = 0x00F00000
+)
+
+func (idx *oneIdx) codec() byte {
+	return byte((idx.flags & codecMask) >> codecShift)
+}
+
+// value returns the record's value, decrypted and decompressed if needed
+func (db *DB) value(idx *oneIdx) ([]byte, bool) {
+	if idx.deleted() {
+		return idx.Slice(), true // the tombstones are never encrypted (nor compressed)
+	}
+	return unpack(db.aead, idx.codec(), idx.Slice())
+}
+
+// newrec returns a new record, with the value compressed as set in the database's options
+// (and then encrypted, if the database is encrypted).
+// The value is stored uncompressed if compressing does not make it shorter.
+func (db *DB) newrec(value []byte, flags uint32) *oneIdx {
+	flags &^= codecMask
+	if c := db.O.Compression; c != CompressNone {
+		if d, e := encode(c, value); e == nil && len(d) < len(value) {
+			return newIdx(db.seal(d), flags|uint32(c)<<codecShift)
+		}
+	}
+	return newIdx(db.seal(value), flags)
+}
+
+// recode returns the record's data compressed with the current codec, along with the new flags.
+// It returns false if the record is already stored that way (or if compressing does not help).
+func (db *DB) recode(rec *oneIdx) (d []byte, flags uint32, ok bool) {
+	if rec.codec() == db.O.Compression || rec.deleted() {
+		return
+	}
+	v, ok := db.value(rec)
+	if !ok {
+		return
+	}
+	n := db.newrec(v, rec.flags)
+	if n.codec() == rec.codec() {
+		return nil, 0, false
+	}
+	return n.Slice(), n.flags, true
+}
+
+func encode(c byte, v []byte) ([]byte, error) {
+	switch c {
+	case CompressSnappy:
+		return snappy.Encode(nil, v), nil
+	case CompressGzip:
+		buf := new(bytes.Buffer)
+		gz := gzip.NewWriter(buf)
+		gz.Write(v)
+		gz.Close()
+		return buf.Bytes(), nil
+	case CompressZstd:
+		return zstd.Compress(nil, v), nil
+	}
+	return nil, errors.New("qdb: unknown compression codec")
+}
+
+// decode returns the value of a record stored with the given codec.
+// Returns false if the data cannot be decompressed.
+func decode(c byte, d []byte) ([]byte, bool) {
+	switch c {
+	case CompressNone:
+		return d, true
+	case CompressSnappy:
+		v, e := snappy.Decode(nil, d)
+		return v, e == nil
+	case CompressGzip:
+		gz, e := gzip.NewReader(bytes.NewReader(d))
+		if e != nil {
+			return nil, false
+		}
+		v, e := ioutil.ReadAll(gz)
+		return v, e == nil
+	case CompressZstd:
+		v, e := zstd.Decompress(nil, d)
+		return v, e == nil
+	}
+	return nil, false
+}
@@ -20,9 +20,15 @@ package qdb
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // KeyType -
@@ -33,6 +39,21 @@ var (
 	ExtraMemoryConsumed int64 // if we are using the glibc memory manager
 	// ExtraMemoryAllocCnt -
 	ExtraMemoryAllocCnt int64 // if we are using the glibc memory manager
+
+	// ErrReadOnly - Returned when trying to modify a database opened in ReadOnly mode
+	ErrReadOnly = errors.New("qdb: database is read-only")
+
+	// ErrTooLong - Returned when trying to store a record longer than ExtraOpts.MaxRecordLen
+	ErrTooLong = errors.New("qdb: record too long")
+
+	// ErrClosed - Returned when trying to modify a database that has been closed
+	ErrClosed = errors.New("qdb: database is closed")
+
+	// ErrNoKey - Returned when opening an encrypted database without ExtraOpts.EncryptionKey
+	ErrNoKey = errors.New("qdb: the database is encrypted - EncryptionKey needed")
+
+	// ErrBadKey - Returned when opening an encrypted database with a wrong ExtraOpts.EncryptionKey
+	ErrBadKey = errors.New("qdb: wrong encryption key")
 )
 
 const (
@@ -56,6 +77,16 @@ const (
 	DefaultMaxPending = 2500
 	// DefaultMaxPendingNoSync -
 	DefaultMaxPendingNoSync = 10000
+
+	typeTagShift = 24 // the record's type tag is stored in the top byte of the flags
+
+	defragProgressEvery = 1000 // records between the progress reports (and checks for cancel)
+
+	isTombstone = 0x00010000 // the record is a deleted key, kept for the grace period
+	hasExpiry   = 0x00020000 // the record has expiry time (see expiry.go)
+
+	// the flags that can be given to PutExt - the others are only set by qdb itself
+	publicFlags = NoBrowse | NoCache | YesCache | YesBrowse
 )
 
 // DB -
@@ -67,20 +98,45 @@ type DB struct {
 	LastValidLogPos int64
 	DataSeq         uint32
 
-	// access mutex:
-	Mutex sync.Mutex
+	// access mutex (the read-only methods only read-lock it):
+	Mutex sync.RWMutex
+
+	// guards the records' data and flags, as well as DatFiles, while the mutex is only read-locked
+	cacheMutex sync.Mutex
 
 	//index:
 	Idx *Index
 
 	NoSyncMode     bool
 	PendingRecords map[KeyType]bool
+	PendingBytes   uint64             // estimated memory used by the pending records
+	pendingLen     map[KeyType]uint32 // what each pending record adds to PendingBytes
 
 	DatFiles map[uint32]*os.File
+	datStat  map[uint32]os.FileInfo // state of the data files, when they were opened
 
 	O ExtraOpts
 
 	VolatileMode bool // this will only store database on disk when you close it
+	MemoryOnly   bool // no files at all - implies VolatileMode, but nothing gets stored on Close
+	ReadOnly     bool // the files are never modified and all the changes get rejected
+
+	repairOnLoad bool // see NewDBOpts.RepairOnLoad
+
+	inFlight int32  // non-zero while a background sync/defrag holds the mutex
+	bgJob    func() // background job to be started by unlock()
+
+	stepper *defragStepper // incremental defrag in progress
+
+	aead cipher.AEAD // encrypts the records (see ExtraOpts.EncryptionKey), nil if not encrypted
+
+	syncStop chan bool      // closed to stop the periodic sync (see ExtraOpts.SyncInterval)
+	syncer   sync.WaitGroup // the periodic sync goroutine
+}
+
+type defragStepper struct {
+	keys []KeyType // records to be moved to the new data file
+	pos  int
 }
 
 type oneIdx struct {
@@ -100,15 +156,80 @@ type NewDBOpts struct {
 	WalkFunction WalkFunction
 	LoadData     bool
 	Volatile     bool
+	MemoryOnly   bool                    // see below
+	ReadOnly     bool                    // see below
+	OrderedKeys  bool                    // keep the keys sorted, for efficient ordered browsing
+	KeyLess      func(a, b KeyType) bool // order of the keys in OrderedKeys mode (nil for ascending)
+	RepairOnLoad bool                    // see below
 	*ExtraOpts
 }
 
+// In ReadOnly mode, the database's files are opened for reading only and never modified.
+// Del, Defrag, DefragStep and Sync do nothing, PutIf returns false, while Put, PutExt,
+// PutTyped, PutSync, Batch.Commit and ReplaceAll return ErrReadOnly. Close does not flush anything.
+// qdb does not lock its folder, so many processes can read the same database this way
+// while another one writes to it, but a reader only sees the records as they were when it
+// opened the database. Open it with LoadData, to have all the records read in at once,
+// because a defrag done by the writer removes the data files that the reader may still need.
+// Use Revalidate to find out whether the files have been changed by the writer.
+
+// In MemoryOnly mode, the database does not create, read or write any files (Dir is ignored).
+// Get, Put, Del and all the Browse functions work as usual, while Sync, Defrag and Flush
+// do nothing. PutSync returns an error. Close only frees the records' data.
+
+// If the process gets killed while writing the index log, the log may end with an incomplete
+// entry. It is always ignored when loading the database (and reported via Logger), but only
+// with RepairOnLoad the log gets truncated back to the last complete entry. Without it, the
+// log is left as it is (e.g. to have a look at the damaged file) until the first write,
+// which truncates it first, so the new entries never get appended after the incomplete one.
+
 // ExtraOpts -
 type ExtraOpts struct {
 	DefragPercentVal uint32 // Defrag() will not be done if we waste less disk space
 	ForcedDefragPerc uint32 // forced defrag when extra disk usage goes above this
 	MaxPending       uint32
 	MaxPendingNoSync uint32
+	TombstoneGrace   uint32 // if not zero, deleted keys are kept as tombstones for that many seconds (purged on sync)
+	MaxPendingBytes  uint32 // if not zero, sync when PendingBytes goes above it (also in NoSync mode)
+	VerifyChecksums  bool   // store CRC32 with each record and verify it when loading (new databases only)
+	LogOnly          bool   // never write qdbidx.0/1 snapshots - defrag rewrites qdbidx.log instead
+	MaxRecordLen     uint32 // if not zero, longer records are rejected with ErrTooLong (the limit is 4GB-1 anyway)
+	Compression      byte   // codec used to compress the new records (CompressNone, CompressSnappy, CompressGzip or CompressZstd)
+	Expiry           bool   // allow the records with expiry time (see PutTTL) - it sticks to the database once set
+	MaxDatFileSize   uint32 // if not zero, defrag starts a new data file when the current one would get bigger
+
+	// UseBloomFilter keeps a Bloom filter of the keys in memory (about 16 to 64 bytes per record),
+	// so looking up a key that does not exist mostly does not need to touch the index map.
+	// It is rebuilt after loading and defragmenting the database (see BloomStats).
+	UseBloomFilter bool
+
+	// EncryptionKey, if set, is the AES-256 key (32 bytes) the records' data is encrypted with,
+	// using AES-GCM with a random nonce for each record. It can only be set for a new database
+	// and then it is needed to open it (a wrong key gets ErrBadKey and a missing one ErrNoKey).
+	// The index files are not encrypted. It is ignored in MemoryOnly mode.
+	EncryptionKey []byte
+
+	// SyncInterval, if not zero, makes a background goroutine write the pending records to disk
+	// (and fsync the files) that often, so no more than that much of the changes can be lost
+	// in a crash. It does nothing in NoSync mode.
+	SyncInterval time.Duration
+
+	// OnCorrupt, if not nil, is called for each record with a bad checksum, found while browsing
+	// or loading the database. It is called with the database locked, so it must not call its methods.
+	// As the readers only read-lock the database, it can be called by many goroutines at once.
+	OnCorrupt func(key KeyType)
+
+	// OnRemoveDataFile, if not nil, is called just before an old data file gets deleted (after
+	// a defrag), so any references to it can be dropped. It is called with the database locked.
+	OnRemoveDataFile func(seq uint32)
+
+	// OnCacheLoad and OnCacheFree, if not nil, are called when a record's value (n bytes, as stored
+	// on disk) gets read from disk and kept in memory, and when such a copy is dropped from memory
+	// because the record has NoCache flag. Records that are replaced, deleted, or dropped when closing
+	// the database are not reported. They are called with the database locked (maybe only read-locked,
+	// by many goroutines at once), so they must not call its methods.
+	OnCacheLoad func(key KeyType, n int)
+	OnCacheFree func(key KeyType, n int)
 }
 
 // WalkFunction -
@@ -125,13 +246,15 @@ func (idx oneIdx) String() string {
 func NewDBExt(_db **DB, opts *NewDBOpts) (e error) {
 	cnt("NewDB")
 	db := new(DB)
-	*_db = db
 	dir := opts.Dir
 	if len(dir) > 0 && dir[len(dir)-1] != '\\' && dir[len(dir)-1] != '/' {
 		dir += string(os.PathSeparator)
 	}
 
-	db.VolatileMode = opts.Volatile
+	db.VolatileMode = opts.Volatile || opts.MemoryOnly
+	db.MemoryOnly = opts.MemoryOnly
+	db.ReadOnly = opts.ReadOnly
+	db.repairOnLoad = opts.RepairOnLoad
 
 	if opts.ExtraOpts == nil {
 		db.O.DefragPercentVal = DefaultDefragPercentVal
@@ -142,16 +265,56 @@ func NewDBExt(_db **DB, opts *NewDBOpts) (e error) {
 		db.O = *opts.ExtraOpts
 	}
 
-	os.MkdirAll(dir, 0770)
 	db.Dir = dir
 	db.DatFiles = make(map[uint32]*os.File)
-	db.PendingRecords = make(map[KeyType]bool, db.O.MaxPending)
+	db.datStat = make(map[uint32]os.FileInfo)
+	db.resetPending()
+
+	if db.MemoryOnly {
+		db.Idx = newMemIdx(db, opts.Records)
+		if opts.OrderedKeys {
+			db.Idx.setOrdered(opts.KeyLess)
+		}
+		if db.O.UseBloomFilter {
+			db.Idx.rebuildBloom()
+		}
+		*_db = db
+		return
+	}
+
+	if !db.ReadOnly {
+		if e = os.MkdirAll(dir, 0770); e != nil {
+			return
+		}
+	}
+	if e = db.applyManifest(); e != nil {
+		return
+	}
 
 	db.Idx = NewDBidx(db, opts.Records)
+	if opts.OrderedKeys {
+		db.Idx.setOrdered(opts.KeyLess)
+	}
 	if opts.LoadData {
 		db.Idx.load(opts.WalkFunction)
 	}
+	if db.O.UseBloomFilter {
+		db.Idx.rebuildBloom()
+	}
 	db.DataSeq = db.Idx.MaxDatfileSequence + 1
+
+	if !db.ReadOnly {
+		// create the data file now, so an unwritable folder is reported here, not at the first sync
+		db.checklogfile()
+		if db.LogFile == nil {
+			db.Idx.close()
+			return errors.New("qdb: cannot create data file in " + db.Dir)
+		}
+		if db.O.SyncInterval > 0 && !db.VolatileMode {
+			db.startSyncer()
+		}
+	}
+	*_db = db
 	return
 }
 
@@ -164,157 +327,705 @@ func NewDB(dir string, load bool) (*DB, error) {
 
 // Count - Returns number of records in the DB
 func (db *DB) Count() (l int) {
-	db.Mutex.Lock()
+	db.Mutex.RLock()
+	defer db.Mutex.RUnlock()
+	if db.Idx == nil {
+		return
+	}
 	l = db.Idx.size()
-	db.Mutex.Unlock()
 	return
 }
 
 // Browse - Browses through all the DB records calling the walk function for each record.
 // If the walk function returns false, it aborts the browsing and returns.
+// Many goroutines can browse the database at the same time, while the writers have to wait.
 func (db *DB) Browse(walk WalkFunction) {
-	db.Mutex.Lock()
+	db.Mutex.RLock()
+	defer db.Mutex.RUnlock() // the walk function may panic
+	if db.Idx == nil {
+		return
+	}
+	db.Idx.browse(db.browsable(walk))
+}
+
+// BrowseAll - works almost like normal browse except that it also returns non-browsable records
+func (db *DB) BrowseAll(walk WalkFunction) {
+	db.Mutex.RLock()
+	defer db.Mutex.RUnlock()
+	if db.Idx == nil {
+		return
+	}
+	db.Idx.browse(db.walker(walk, true))
+}
+
+// BrowseMulti - Browses through all the DB records once, calling each of the walk functions
+// for every record. The results of the walk functions are OR-ed, so browsing gets aborted
+// as soon as any of them returns BrAbort.
+func (db *DB) BrowseMulti(walks ...WalkFunction) {
+	db.Browse(func(k KeyType, v []byte) (res uint32) {
+		for _, walk := range walks {
+			res |= walk(k, v)
+		}
+		return
+	})
+}
+
+// BrowseErr - Browses through all the DB records like Browse, but the walk function also returns
+// an error. Browsing stops at the first non-nil error, which is then returned (the flags returned
+// along with it still get applied). Returns ErrClosed if the database has been closed.
+func (db *DB) BrowseErr(walk func(key KeyType, val []byte) (uint32, error)) (e error) {
+	db.Mutex.RLock()
+	defer db.Mutex.RUnlock()
+	if db.Idx == nil {
+		return ErrClosed
+	}
+	db.Idx.browse(db.browsable(func(k KeyType, v []byte) uint32 {
+		res, er := walk(k, v)
+		if er != nil {
+			e = er
+			res |= BrAbort
+		}
+		return res
+	}))
+	return
+}
+
+// BrowseSorted - Browses through all the DB records in the order of their keys.
+// It is efficient only if the database was opened with OrderedKeys option.
+func (db *DB) BrowseSorted(walk WalkFunction) {
+	db.Mutex.RLock()
+	defer db.Mutex.RUnlock()
+	if db.Idx == nil {
+		return
+	}
+	db.Idx.browseSorted(nil, nil, false, db.browsable(walk))
+}
+
+// BrowseFrom - Browses in order through the records with keys not lower than the given one.
+func (db *DB) BrowseFrom(from KeyType, walk WalkFunction) {
+	db.Mutex.RLock()
+	defer db.Mutex.RUnlock()
+	if db.Idx == nil {
+		return
+	}
+	db.Idx.browseSorted(&from, nil, false, db.browsable(walk))
+}
+
+// BrowseRange - Browses in order through the records with keys from the given range,
+// i.e. from <= key <= to (both limits are inclusive).
+func (db *DB) BrowseRange(from, to KeyType, walk WalkFunction) {
+	db.Mutex.RLock()
+	defer db.Mutex.RUnlock()
+	if db.Idx == nil {
+		return
+	}
+	db.Idx.browseSorted(&from, &to, true, db.browsable(walk))
+}
+
+// BrowseByDataPos - Browses through the DB records in the order of their position in the data
+// files, which is roughly the order they were written in. Reading the files sequentially is also
+// faster than the random order. Records not synced to disk yet are browsed at the end.
+func (db *DB) BrowseByDataPos(walk WalkFunction) {
+	db.Mutex.RLock()
+	defer db.Mutex.RUnlock()
+	if db.Idx == nil {
+		return
+	}
+	db.Idx.browseByDataPos(db.browsable(walk))
+}
+
+// BrowseByType - Browses through the DB records with the given type tag.
+// Records with other tags are skipped without being loaded from disk.
+func (db *DB) BrowseByType(tag byte, walk WalkFunction) {
+	db.Mutex.RLock()
+	defer db.Mutex.RUnlock()
+	if db.Idx == nil {
+		return
+	}
+	br := db.browsable(walk)
 	db.Idx.browse(func(k KeyType, v *oneIdx) bool {
-		if (v.flags & NoBrowse) != 0 {
+		if byte(db.flags(v)>>typeTagShift) != tag {
 			return true
 		}
-		db.loadrec(v)
-		res := walk(k, v.Slice())
-		v.applyBrowsingFlags(res)
-		v.freerec()
-		return (res & BrAbort) == 0
+		return br(k, v)
 	})
-	//println("br", db.Dir, "done")
-	db.Mutex.Unlock()
 }
 
-// BrowseAll - works almost like normal browse except that it also returns non-browsable records
-func (db *DB) BrowseAll(walk WalkFunction) {
-	db.Mutex.Lock()
+// BrowseKeys - Browses through the keys of the DB records, passing the length of each record
+// instead of its data, so nothing gets read from disk. The walk function can return BrAbort.
+func (db *DB) BrowseKeys(walk func(key KeyType, datlen uint32) uint32) {
+	db.Mutex.RLock()
+	defer db.Mutex.RUnlock()
+	if db.Idx == nil {
+		return
+	}
 	db.Idx.browse(func(k KeyType, v *oneIdx) bool {
-		db.loadrec(v)
-		res := walk(k, v.Slice())
+		if db.absent(k, v, NoBrowse) {
+			return true
+		}
+		res := walk(k, v.datlen)
+		db.cacheMutex.Lock()
 		v.applyBrowsingFlags(res)
-		v.freerec()
+		db.cacheMutex.Unlock()
 		return (res & BrAbort) == 0
 	})
-	//println("br", db.Dir, "done")
-	db.Mutex.Unlock()
+}
+
+// browsable wraps the walk function, so it is only called for browsable records
+func (db *DB) browsable(walk WalkFunction) func(k KeyType, v *oneIdx) bool {
+	return db.walker(walk, false)
+}
+
+// walker wraps the walk function, so it is called with the record's value
+// for each record that is not deleted (or expired) and (unless all is true) browsable.
+// It can be used with the mutex only read-locked.
+func (db *DB) walker(walk WalkFunction, all bool) func(k KeyType, v *oneIdx) bool {
+	skip := uint32(NoBrowse)
+	if all {
+		skip = 0
+	}
+	return func(k KeyType, v *oneIdx) bool {
+		if db.absent(k, v, skip) {
+			return true
+		}
+		val, ok := db.readrec(k, v, false)
+		if !ok {
+			db.corrupt(k)
+			return true
+		}
+		res := walk(k, val)
+		var freed bool
+		db.cacheMutex.Lock()
+		v.applyBrowsingFlags(res)
+		if !membind_use_wrapper {
+			freed = v.freerec() // the wrapper's memory might still be used by other readers
+		}
+		db.cacheMutex.Unlock()
+		if freed {
+			db.cacheFreed(k, v)
+		}
+		return (res & BrAbort) == 0
+	}
+}
+
+// flags returns the record's flags, which other readers may be changing
+func (db *DB) flags(v *oneIdx) (res uint32) {
+	db.cacheMutex.Lock()
+	res = v.flags
+	db.cacheMutex.Unlock()
+	return
 }
 
 // Get -
 func (db *DB) Get(key KeyType) (value []byte) {
-	db.Mutex.Lock()
+	db.Mutex.RLock()
+	defer db.Mutex.RUnlock()
+	if db.Idx == nil {
+		return
+	}
 	idx := db.Idx.get(key)
-	if idx != nil {
-		db.loadrec(idx)
-		idx.applyBrowsingFlags(YesCache) // we are giving out the pointer, so keep it in cache
-		value = idx.Slice()
+	if idx != nil && !db.absent(key, idx, 0) {
+		value, _ = db.readrec(key, idx, true) // we are giving out the pointer, so keep it in cache
 	}
 	//fmt.Printf("get %016x -> %s\n", key, hex.EncodeToString(value))
-	db.Mutex.Unlock()
+	return
+}
+
+// GetMany - Returns the values of the records with the given keys, locking the database once.
+// The values are in the same order as the keys, with nil for the keys not found.
+func (db *DB) GetMany(keys []KeyType) (values [][]byte) {
+	values = make([][]byte, len(keys))
+	db.Mutex.RLock()
+	defer db.Mutex.RUnlock()
+	if db.Idx == nil {
+		return
+	}
+	for i, key := range keys {
+		if idx := db.Idx.get(key); idx != nil && !db.absent(key, idx, 0) {
+			values[i], _ = db.readrec(key, idx, true) // we are giving out the pointer, so keep it in cache
+		}
+	}
+	return
+}
+
+// GetTyped - Returns the record's value along with its type tag.
+func (db *DB) GetTyped(key KeyType) (tag byte, value []byte, ok bool) {
+	db.Mutex.RLock()
+	defer db.Mutex.RUnlock()
+	if db.Idx == nil {
+		return
+	}
+	idx := db.Idx.get(key)
+	if idx != nil && !db.absent(key, idx, 0) {
+		if value, ok = db.readrec(key, idx, true); ok { // we are giving out the pointer, so keep it in cache
+			tag = byte(db.flags(idx) >> typeTagShift)
+		}
+	}
 	return
 }
 
 // GetNoMutex - Use this one inside Browse
 func (db *DB) GetNoMutex(key KeyType) (value []byte) {
+	if db.Idx == nil {
+		return
+	}
 	idx := db.Idx.get(key)
-	if idx != nil {
-		db.loadrec(idx)
-		value = idx.Slice()
+	if idx != nil && !db.absent(key, idx, 0) {
+		value, _ = db.readrec(key, idx, false)
 	}
 	//fmt.Printf("get %016x -> %s\n", key, hex.EncodeToString(value))
 	return
 }
 
-// Put - Adds or updates record with a given key.
-func (db *DB) Put(key KeyType, value []byte) {
-	db.Mutex.Lock()
-	db.Idx.memput(key, newIdx(value, 0))
-	if db.VolatileMode {
-		db.NoSyncMode = true
-		db.Mutex.Unlock()
+// GetOk - Like Get, but ok tells whether the key was found (the record's value may be empty).
+func (db *DB) GetOk(key KeyType) (value []byte, ok bool) {
+	db.Mutex.RLock()
+	defer db.Mutex.RUnlock()
+	value, ok = db.getOk(key)
+	return
+}
+
+// GetOkNoMutex - Use this one inside Browse
+func (db *DB) GetOkNoMutex(key KeyType) (value []byte, ok bool) {
+	return db.getOk(key)
+}
+
+func (db *DB) getOk(key KeyType) (value []byte, ok bool) {
+	if db.Idx == nil {
 		return
 	}
-	db.PendingRecords[key] = true
-	if db.syncneeded() {
-		go func() {
-			db.sync()
-			db.Mutex.Unlock()
-		}()
-	} else {
-		db.Mutex.Unlock()
+	idx := db.Idx.get(key)
+	if idx != nil && !db.absent(key, idx, 0) {
+		value, ok = db.readrec(key, idx, true) // we are giving out the pointer, so keep it in cache
+	}
+	return
+}
+
+// GetRange - Returns length bytes of the record's value, starting at offset off.
+// If the record is not in memory, only the requested part is read from disk (and not cached),
+// so its checksum (in VerifyChecksums mode) cannot be verified. Compressed and encrypted records are read whole.
+// Returns false if the record does not exist or the range goes beyond its value.
+func (db *DB) GetRange(key KeyType, off, length int) (value []byte, ok bool) {
+	if off < 0 || length < 0 {
+		return
+	}
+	db.Mutex.RLock()
+	defer db.Mutex.RUnlock()
+	if db.Idx == nil {
+		return
+	}
+	idx := db.Idx.get(key)
+	if idx != nil && db.absent(key, idx, 0) {
+		return
+	}
+	if idx != nil && ((db.flags(idx)&codecMask) != 0 || db.aead != nil) {
+		// the compressed (or encrypted) record needs to be read whole
+		if v, good := db.readrec(key, idx, false); good && off+length <= len(v) {
+			value, ok = v[off:off+length], true
+		}
+		return
+	}
+	if idx != nil && off+length <= int(idx.datlen) {
+		value = make([]byte, length)
+		var f *os.File
+		db.cacheMutex.Lock()
+		if idx.data != nil {
+			copy(value, idx.Slice()[off:])
+			ok = true
+		} else {
+			f, _ = db.datfile(idx.DataSeq)
+		}
+		db.cacheMutex.Unlock()
+		if f != nil {
+			n, _ := f.ReadAt(value, int64(idx.datpos)+int64(off))
+			ok = n == length
+		}
+		if !ok {
+			value = nil
+		}
 	}
+	return
+}
+
+// Put - Adds or updates record with a given key.
+// Returns ErrTooLong if the value is too long, leaving the database unchanged.
+func (db *DB) Put(key KeyType, value []byte) error {
+	return db.PutExt(key, value, 0)
 }
 
 // PutExt - Adds or updates record with a given key.
-func (db *DB) PutExt(key KeyType, value []byte, flags uint32) {
+// Only NoBrowse, NoCache, YesCache and YesBrowse flags are taken, the others are ignored.
+func (db *DB) PutExt(key KeyType, value []byte, flags uint32) error {
+	return db.put(key, value, flags&publicFlags)
+}
+
+// put adds or updates record with a given key and (any) flags
+func (db *DB) put(key KeyType, value []byte, flags uint32) error {
+	if db.rejected() {
+		return ErrReadOnly
+	}
+	if db.toolong(value) {
+		return ErrTooLong
+	}
 	db.Mutex.Lock()
+	defer db.unlock()
+	if db.Idx == nil {
+		return ErrClosed
+	}
 	//fmt.Printf("put %016x %s\n", key, hex.EncodeToString(value))
-	db.Idx.memput(key, newIdx(value, flags))
+	db.Idx.memput(key, db.newrec(value, flags))
+	db.changed(key)
+	return nil
+}
+
+// PutSync - Adds or updates record with a given key, writing it to disk before returning.
+// The record is synced to disk regardless of the NoSync mode, while other pending records
+// are not. If writing fails, the error is returned and the database is left unchanged.
+func (db *DB) PutSync(key KeyType, value []byte) (e error) {
+	if db.rejected() {
+		return ErrReadOnly
+	}
 	if db.VolatileMode {
-		db.NoSyncMode = true
-		db.Mutex.Unlock()
-		return
+		return errors.New("qdb: PutSync in volatile mode")
 	}
-	db.PendingRecords[key] = true
-	if db.syncneeded() {
-		go func() {
-			db.sync()
-			db.Mutex.Unlock()
-		}()
-	} else {
-		db.Mutex.Unlock()
+	if db.toolong(value) {
+		return ErrTooLong
 	}
+	db.Mutex.Lock()
+	defer db.Mutex.Unlock()
+	if db.Idx == nil {
+		return ErrClosed
+	}
+	rec := db.newrec(value, 0)
+	if e = db.writesync(key, rec); e == nil {
+		db.Idx.memput(key, rec)
+		db.unpend(key)
+		cnt("PutSync")
+	}
+	return
+}
+
+// PutIf - Adds or updates record with a given key, but only if cond returns true.
+// The condition function gets the current value of the record (if found) and it is called
+// with the database locked, so it must not call any other methods of the database.
+// If the value is too long, false is returned without calling cond.
+func (db *DB) PutIf(key KeyType, value []byte, cond func(existing []byte, found bool) bool) bool {
+	var existing []byte
+	var found bool
+	if db.rejected() || db.toolong(value) {
+		return false
+	}
+	db.Mutex.Lock()
+	defer db.unlock()
+	if db.Idx == nil {
+		return false
+	}
+	if idx := db.Idx.get(key); idx != nil && !db.absent(key, idx, 0) && db.load(key, idx) {
+		existing, found = db.value(idx)
+	}
+	if !cond(existing, found) {
+		return false
+	}
+	db.Idx.memput(key, db.newrec(value, 0))
+	db.changed(key)
+	return true
+}
+
+// PutTyped - Adds or updates record with a given key, tagging it with the given type.
+func (db *DB) PutTyped(key KeyType, tag byte, value []byte) error {
+	return db.put(key, value, uint32(tag)<<typeTagShift)
 }
 
 // Del - Removes record with a given key.
 func (db *DB) Del(key KeyType) {
 	//println("del", hex.EncodeToString(key[:]))
+	if db.rejected() {
+		return
+	}
 	db.Mutex.Lock()
-	db.Idx.memdel(key)
-	if db.VolatileMode {
-		db.NoSyncMode = true
-		db.Mutex.Unlock()
+	defer db.unlock()
+	if db.Idx == nil {
 		return
 	}
-	db.PendingRecords[key] = true
-	if db.syncneeded() {
-		go func() {
-			db.sync()
-			db.Mutex.Unlock()
-		}()
+	db.del(key)
+}
+
+// DelMany - Removes the records with the given keys, locking the database only once.
+// At most one sync gets triggered, after all the records are removed.
+func (db *DB) DelMany(keys []KeyType) {
+	if db.rejected() || len(keys) == 0 {
+		return
+	}
+	db.Mutex.Lock()
+	defer db.unlock()
+	if db.Idx == nil {
+		return
+	}
+	for _, k := range keys {
+		db.del(k)
+	}
+}
+
+// DelRange - Removes the records with keys from the given range, like DelMany.
+// Both limits are inclusive, as in BrowseRange.
+// Returns the number of records removed.
+func (db *DB) DelRange(from, to KeyType) (cnt int) {
+	if db.rejected() {
+		return
+	}
+	db.Mutex.Lock()
+	defer db.unlock()
+	if db.Idx == nil {
+		return
+	}
+	var keys []KeyType
+	db.Idx.browseSorted(&from, &to, true, func(k KeyType, v *oneIdx) bool {
+		if !v.deleted() {
+			keys = append(keys, k)
+		}
+		return true
+	})
+	for _, k := range keys {
+		db.del(k)
+	}
+	return len(keys)
+}
+
+// del removes the record, or replaces it with a tombstone (in tombstone mode)
+func (db *DB) del(key KeyType) {
+	if db.O.TombstoneGrace != 0 {
+		if rec := db.Idx.get(key); rec == nil || rec.deleted() {
+			return
+		}
+		db.Idx.memput(key, newTombstone())
 	} else {
-		db.Mutex.Unlock()
+		db.Idx.memdel(key)
 	}
+	db.changed(key)
 }
 
 // ApplyFlags -
 func (db *DB) ApplyFlags(key KeyType, fl uint32) {
 	db.Mutex.Lock()
+	defer db.Mutex.Unlock()
+	if db.Idx == nil {
+		return
+	}
 	if idx := db.Idx.get(key); idx != nil {
 		idx.applyBrowsingFlags(fl)
 	}
-	db.Mutex.Unlock()
 }
 
 // Defrag - Defragments the DB on the disk.
 // Return true if defrag hes been performed, and false if was not needed.
 func (db *DB) Defrag(force bool) (doing bool) {
-	if db.VolatileMode {
+	if db.VolatileMode || db.rejected() {
 		return
 	}
 	db.Mutex.Lock()
+	defer db.unlock()
+	if db.Idx == nil {
+		return
+	}
 	doing = force || db.Idx.ExtraSpaceUsed > (uint64(db.O.DefragPercentVal)*db.Idx.DiskSpaceNeeded/100)
 	if doing {
 		cnt("DefragYes")
-		go func() {
-			db.defrag()
-			db.Mutex.Unlock()
-		}()
+		db.bgJob = db.defrag
 	} else {
 		cnt("DefragNo")
-		db.Mutex.Unlock()
+	}
+	return
+}
+
+// DefragCtx - Defragments the DB on the disk, like Defrag(true), but in the current goroutine.
+// The progress function (if not nil) gets called every now and then, with the number of
+// records processed so far. Cancelling ctx aborts the defragmentation, leaving the database
+// as it was before (check ctx.Err() to find out whether it has been completed).
+func (db *DB) DefragCtx(ctx context.Context, progress func(done, total int)) {
+	if db.VolatileMode || db.rejected() {
+		return
+	}
+	db.Mutex.Lock()
+	defer db.Mutex.Unlock()
+	if db.Idx == nil {
+		return
+	}
+	cnt("DefragCtx")
+	db.defragCtx(ctx, progress)
+}
+
+// Crop - Releases the memory held by the database, as much as it can without losing anything:
+// the values of the records stored on disk are dropped from memory (to be read again when needed)
+// and the internal maps get rebuilt, as Go maps never shrink after the records are removed.
+// When the glibc memory manager is used, only the records with NoCache flag are dropped,
+// as the values given out by Get may still be in use.
+func (db *DB) Crop() {
+	db.Mutex.Lock()
+	defer db.Mutex.Unlock()
+	if db.Idx == nil {
+		return
+	}
+	cnt("Crop")
+	index := make(map[KeyType]*oneIdx, len(db.Idx.Index))
+	for k, rec := range db.Idx.Index {
+		if rec.data != nil && rec.datpos != 0 && (!membind_use_wrapper || (rec.flags&NoCache) != 0) {
+			rec.FreeData()
+			if !rec.deleted() {
+				db.cacheFreed(k, rec)
+			}
+		}
+		index[k] = rec
+	}
+	db.Idx.Index = index
+	if db.PendingRecords != nil {
+		pending := make(map[KeyType]bool, len(db.PendingRecords))
+		for k, v := range db.PendingRecords {
+			pending[k] = v
+		}
+		db.PendingRecords = pending
+		pendingLen := make(map[KeyType]uint32, len(db.pendingLen))
+		for k, v := range db.pendingLen {
+			pendingLen[k] = v
+		}
+		db.pendingLen = pendingLen
+	}
+	if db.Idx.expires != nil {
+		expires := make(map[KeyType]uint32, len(db.Idx.expires))
+		for k, v := range db.Idx.expires {
+			expires[k] = v
+		}
+		db.Idx.expires = expires
+	}
+	if cap(db.Idx.sorted) > 2*len(db.Idx.sorted) {
+		db.Idx.sorted = append([]KeyType(nil), db.Idx.sorted...)
+	}
+	if db.Idx.bloom != nil {
+		db.Idx.rebuildBloom()
+	}
+}
+
+// DefragStep - Does a part of the defragmentation, moving up to maxRecords records
+// to the new data file. Returns true when the defragmentation is complete.
+// The database stays consistent if it gets closed before the defragmentation is complete.
+func (db *DB) DefragStep(maxRecords int) (done bool) {
+	if db.VolatileMode || db.rejected() {
+		return true
+	}
+	db.Mutex.Lock()
+	defer db.Mutex.Unlock()
+	if db.Idx == nil {
+		return true
+	}
+	if db.stepper == nil {
+		cnt("DefragStepStart")
+		db.stepper = &defragStepper{keys: make([]KeyType, 0, len(db.Idx.Index))}
+		for k := range db.Idx.Index {
+			db.stepper.keys = append(db.stepper.keys, k)
+		}
+		// all the records, including the pending ones, will be written to a new data file
+		db.DataSeq++
+		if db.LogFile != nil {
+			db.LogFile.Close()
+			db.LogFile = nil
+		}
+	}
+
+	st := db.stepper
+	for ; st.pos < len(st.keys) && maxRecords > 0; st.pos++ {
+		k := st.keys[st.pos]
+		rec := db.Idx.get(k)
+		if rec == nil || rec.DataSeq == db.DataSeq || db.PendingRecords[k] {
+			continue // deleted, already moved or going to be written by sync()
+		}
+		if !db.load(k, rec) {
+			continue // corrupt - leave it where it is
+		}
+		rec.datpos = uint32(db.addtolog(nil, k, rec.Slice()))
+		rec.DataSeq = db.DataSeq
+		db.Idx.addtolog(nil, k, rec)
+		db.uncache(k, rec)
+		maxRecords--
+	}
+
+	if st.pos >= len(st.keys) {
+		db.sync()              // move all the pending records to the new data file as well
+		if db.stepper != nil { // sync() might have done the full defrag already
+			db.checklogfile()
+			db.LogFile.Sync()
+			used := map[uint32]bool{db.DataSeq: true}
+			db.Idx.browse(func(key KeyType, rec *oneIdx) bool {
+				used[rec.DataSeq] = true
+				return true
+			})
+			db.Idx.writedatfile()
+			db.cleanupold(used)
+			db.Idx.ExtraSpaceUsed = 0
+			if db.Idx.bloom != nil {
+				db.Idx.rebuildBloom()
+			}
+			db.stepper = nil
+			cnt("DefragStepDone")
+		}
+		done = true
+	}
+	return
+}
+
+// ReplaceAll - Atomically replaces the entire content of the database with the given records.
+// It works like a forced defrag, except that the new files are built from the map
+// instead of the current records. Readers see either the old or the new set, never a mix.
+func (db *DB) ReplaceAll(records map[KeyType][]byte) (e error) {
+	recs := make(map[KeyType]*oneIdx, len(records))
+	for k, v := range records {
+		if db.toolong(v) {
+			return ErrTooLong
+		}
+		recs[k] = db.newrec(v, 0)
+	}
+	cnt("ReplaceAll")
+	return db.replace(recs, nil)
+}
+
+// replace the content of the database with the given records
+// (expires holds the expiry times of the records with hasExpiry flag)
+func (db *DB) replace(records map[KeyType]*oneIdx, expires map[KeyType]uint32) (e error) {
+	if db.rejected() {
+		return ErrReadOnly
+	}
+	db.Mutex.Lock()
+	defer db.Mutex.Unlock()
+	if db.Idx == nil {
+		return ErrClosed
+	}
+	for _, rec := range db.Idx.Index {
+		rec.FreeData()
+	}
+	db.Idx.Index = make(map[KeyType]*oneIdx, len(records))
+	db.Idx.tombstones = 0
+	db.Idx.graves = nil
+	db.Idx.DiskSpaceNeeded = 0
+	db.Idx.ExtraSpaceUsed = 0
+	ordered := db.Idx.ordered
+	db.Idx.ordered = false
+	db.Idx.expires = nil
+	for k, rec := range records {
+		db.Idx.memput(k, rec)
+		if t, ok := expires[k]; ok {
+			db.Idx.setExpiry(k, t)
+		}
+	}
+	if ordered {
+		db.Idx.ordered = true
+		db.Idx.sortKeys()
+	}
+	if db.Idx.bloom != nil {
+		db.Idx.rebuildBloom() // it still has the old keys
+	}
+	db.resetPending()
+	if db.VolatileMode {
+		db.NoSyncMode = true
+	} else if !db.defragCtx(context.Background(), nil) {
+		e = errors.New("qdb: cannot create data file in " + db.Dir)
 	}
 	return
 }
@@ -325,35 +1036,102 @@ func (db *DB) NoSync() {
 		return
 	}
 	db.Mutex.Lock()
+	defer db.Mutex.Unlock()
+	if db.Idx == nil {
+		return
+	}
 	db.NoSyncMode = true
-	db.Mutex.Unlock()
 }
 
 // Sync - Write all the pending changes to disk now.
 // Re enable syncing if it has been disabled.
 func (db *DB) Sync() {
-	if db.VolatileMode {
+	if db.VolatileMode || db.rejected() {
 		return
 	}
 	db.Mutex.Lock()
+	defer db.unlock()
+	if db.Idx == nil {
+		return
+	}
 	db.NoSyncMode = false
-	go func() {
-		db.sync()
-		db.Mutex.Unlock()
-	}()
+	db.bgJob = db.sync
+}
+
+// InFlight - Returns true if a background sync or defrag is currently running.
+func (db *DB) InFlight() bool {
+	return atomic.LoadInt32(&db.inFlight) != 0
+}
+
+// WaitIdle - Blocks until no background sync or defrag is running.
+func (db *DB) WaitIdle() {
+	// background jobs keep the mutex locked until they are done
+	db.Mutex.Lock()
+	db.Mutex.Unlock()
+}
+
+// startSyncer starts the goroutine writing the pending records every SyncInterval
+func (db *DB) startSyncer() {
+	db.syncStop = make(chan bool)
+	db.syncer.Add(1)
+	go func(stop chan bool) {
+		defer db.syncer.Done()
+		tick := time.NewTicker(db.O.SyncInterval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-tick.C:
+			}
+			db.Mutex.Lock()
+			if db.Idx == nil {
+				db.Mutex.Unlock()
+				return
+			}
+			if !db.NoSyncMode && (len(db.PendingRecords) > 0 || db.purgeTombstones() > 0) {
+				cnt("SyncPeriodic")
+				db.sync()
+				if db.LogFile != nil {
+					db.LogFile.Sync()
+				}
+				if db.Idx.file != nil {
+					db.Idx.file.Sync()
+				}
+			}
+			db.Mutex.Unlock()
+		}
+	}(db.syncStop)
 }
 
 // Close the database.
 // Writes all the pending changes to disk.
+// Closing it again does nothing, while the other methods behave as if the database was empty
+// (the ones modifying it return ErrClosed, or do nothing).
 func (db *DB) Close() {
 	db.Mutex.Lock()
-	if db.VolatileMode {
-		// flush all the data to disk when closing
-		if db.NoSyncMode {
-			db.defrag()
+	defer db.syncer.Wait() // after unlocking, so the periodic sync can finish
+	defer db.Mutex.Unlock()
+	if db.Idx == nil {
+		return
+	}
+	if db.syncStop != nil {
+		close(db.syncStop)
+		db.syncStop = nil
+	}
+	if db.MemoryOnly {
+		for _, rec := range db.Idx.Index {
+			rec.FreeData()
+		}
+	} else if !db.ReadOnly {
+		if db.VolatileMode {
+			// flush all the data to disk when closing
+			if db.NoSyncMode {
+				db.defrag()
+			}
+		} else {
+			db.sync()
 		}
-	} else {
-		db.sync()
 	}
 	if db.LogFile != nil {
 		db.LogFile.Close()
@@ -364,11 +1142,14 @@ func (db *DB) Close() {
 	for _, f := range db.DatFiles {
 		f.Close()
 	}
-	db.Mutex.Unlock()
+	db.DatFiles = make(map[uint32]*os.File)
 }
 
 // Flush -
 func (db *DB) Flush() {
+	if db.Idx == nil {
+		return
+	}
 	if db.VolatileMode {
 		return
 	}
@@ -381,39 +1162,241 @@ func (db *DB) Flush() {
 	}
 }
 
+// rejected returns true (and counts it) if the database cannot be modified
+func (db *DB) rejected() bool {
+	if db.ReadOnly {
+		cnt("ReadOnlyRejected")
+		return true
+	}
+	return false
+}
+
+// toolong returns true (and counts it) if the value cannot be stored as a record
+func (db *DB) toolong(value []byte) bool {
+	max := uint64(0xFFFFFFFF)
+	if db.O.MaxRecordLen != 0 {
+		max = uint64(db.O.MaxRecordLen)
+	}
+	if uint64(len(value)) > max {
+		cnt("TooLongRejected")
+		return true
+	}
+	return false
+}
+
+// changed must be called, with the mutex locked, after a record has been modified.
+// It schedules a background sync, if one is needed (see unlock).
+func (db *DB) changed(key KeyType) {
+	if db.VolatileMode {
+		db.NoSyncMode = true
+		return
+	}
+	db.PendingRecords[key] = true
+	n := uint32(KeySize)
+	if rec := db.Idx.get(key); rec != nil {
+		n += rec.datlen
+	}
+	// a key changed again while pending is only written once, so only its last size counts
+	db.PendingBytes -= uint64(db.pendingLen[key])
+	db.PendingBytes += uint64(n)
+	db.pendingLen[key] = n
+	if db.syncneeded() {
+		db.bgJob = db.sync
+	}
+}
+
+// unpend removes the key from the pending records, after it has been written to disk
+func (db *DB) unpend(key KeyType) {
+	delete(db.PendingRecords, key)
+	db.PendingBytes -= uint64(db.pendingLen[key])
+	delete(db.pendingLen, key)
+}
+
+// resetPending clears the pending records, after all of them have been written to disk
+func (db *DB) resetPending() {
+	db.PendingRecords = make(map[KeyType]bool, db.O.MaxPending)
+	db.pendingLen = make(map[KeyType]uint32, db.O.MaxPending)
+	db.PendingBytes = 0
+}
+
+// unlock is deferred by the methods that may start a background job, right after locking the mutex.
+// If a job has been scheduled (in bgJob), the still locked mutex is handed over to the goroutine
+// running it, which unlocks it when the job is done. Otherwise, also after a panic, it unlocks now.
+func (db *DB) unlock() {
+	if job := db.bgJob; job != nil {
+		db.bgJob = nil
+		db.inBackground(job)
+	} else {
+		db.Mutex.Unlock()
+	}
+}
+
+// run the given job in a goroutine, that will unlock the (already locked) mutex when done
+func (db *DB) inBackground(job func()) {
+	atomic.StoreInt32(&db.inFlight, 1)
+	go func() {
+		job()
+		atomic.StoreInt32(&db.inFlight, 0)
+		db.Mutex.Unlock()
+	}()
+}
+
 func (db *DB) defrag() {
-	db.DataSeq++
-	if db.LogFile != nil {
-		db.LogFile.Close()
-		db.LogFile = nil
+	db.defragCtx(context.Background(), nil)
+}
+
+// defragCtx writes all the records to a new data file (or a few, with MaxDatFileSize set),
+// followed by a new index file. If ctx gets cancelled (or a new file cannot be created),
+// the new files are removed and false is returned - the database is left untouched then.
+func (db *DB) defragCtx(ctx context.Context, progress func(done, total int)) bool {
+	first := db.DataSeq + 1
+	seq := first
+	f, _ := os.Create(db.seq2fn(seq))
+	if f == nil {
+		return false
 	}
-	db.checklogfile()
-	bufile := bufio.NewWriterSize(db.LogFile, 0x100000)
-	used := make(map[uint32]bool, 10)
+	binary.Write(f, binary.LittleEndian, seq)
+	fpos := int64(4)
+	bufile := bufio.NewWriterSize(f, 0x100000)
+
+	// nextFile switches over to the next data file, when the current one is full (see MaxDatFileSize)
+	nextFile := func() bool {
+		bufile.Flush()
+		f.Sync()
+		f.Close()
+		seq++
+		if f, _ = os.Create(db.seq2fn(seq)); f == nil {
+			return false
+		}
+		binary.Write(f, binary.LittleEndian, seq)
+		fpos = 4
+		bufile.Reset(f)
+		return true
+	}
+
+	type movedRec struct {
+		rec   *oneIdx
+		pos   uint32
+		seq   uint32
+		data  []byte // if not nil, the record has been re-compressed to this
+		flags uint32
+	}
+	moved := make([]movedRec, 0, len(db.Idx.Index))
+	var expired, bad []KeyType
+	var done int
+	var failed bool
+	total := len(db.Idx.Index)
+	now := time.Now()
 	db.Idx.browse(func(key KeyType, rec *oneIdx) bool {
-		db.loadrec(rec)
-		rec.datpos = uint32(db.addtolog(bufile, key, rec.Slice()))
-		rec.DataSeq = db.DataSeq
-		used[rec.DataSeq] = true
-		rec.freerec()
+		if done%defragProgressEvery == 0 {
+			if ctx.Err() != nil {
+				return false
+			}
+			if progress != nil {
+				progress(done, total)
+			}
+		}
+		done++
+		if rec.deleted() && db.tombstoneExpired(key, rec, now) {
+			expired = append(expired, key)
+			return true
+		}
+		if !db.load(key, rec) {
+			bad = append(bad, key)
+			return true
+		}
+		var m movedRec
+		val := rec.Slice()
+		if d, fl, ok := db.recode(rec); ok {
+			m.data, m.flags = d, fl
+			val = d
+		}
+		if max := int64(db.O.MaxDatFileSize); max > 0 && fpos > 4 {
+			size := int64(len(val))
+			if db.O.VerifyChecksums {
+				size += 4
+			}
+			if fpos+size > max && !nextFile() {
+				failed = true
+				return false
+			}
+		}
+		m.rec, m.pos, m.seq = rec, uint32(fpos), seq
+		fpos += db.writerec(bufile, val)
+		moved = append(moved, m)
+		db.uncache(key, rec)
 		return true
 	})
+	if failed || ctx.Err() != nil {
+		if f != nil {
+			f.Close()
+		}
+		for s := first; s <= seq; s++ {
+			os.Remove(db.seq2fn(s))
+		}
+		if failed {
+			cnt("DefragFailed")
+		} else {
+			cnt("DefragCancelled")
+		}
+		return false
+	}
 
 	// first write & flush the data file:
 	bufile.Flush()
-	db.LogFile.Sync()
+	f.Sync()
+
+	// then switch over to it
+	db.stepper = nil // full defrag supersedes the incremental one
+	if db.LogFile != nil {
+		db.LogFile.Close()
+	}
+	db.LogFile, db.DataSeq, db.LastValidLogPos = f, seq, fpos
+	for _, m := range moved {
+		m.rec.datpos, m.rec.DataSeq = m.pos, m.seq
+		if m.data != nil {
+			db.Idx.DiskSpaceNeeded += uint64(len(m.data)) - uint64(m.rec.datlen)
+			cached := m.rec.data != nil
+			m.rec.FreeData()
+			m.rec.datlen, m.rec.flags = uint32(len(m.data)), m.flags
+			if cached {
+				m.rec.SetData(m.data)
+			}
+		}
+	}
+	for _, k := range expired {
+		db.Idx.memdel(k)
+	}
+	cntadd("TombstonesPurged", uint64(len(expired)))
+	// the corrupt records cannot be moved, so they get dropped
+	for _, k := range bad {
+		db.corrupt(k)
+		db.Idx.memdel(k)
+	}
 
 	// now the index:
 	db.Idx.writedatfile() // this will close the file
 
+	used := make(map[uint32]bool, seq-first+1)
+	for s := first; s <= seq; s++ {
+		used[s] = true
+	}
 	db.cleanupold(used)
 	db.Idx.ExtraSpaceUsed = 0
+	if db.Idx.bloom != nil {
+		db.Idx.rebuildBloom()
+	}
+	if progress != nil {
+		progress(total, total)
+	}
+	return true
 }
 
 func (db *DB) sync() {
 	if db.VolatileMode {
 		return
 	}
+	db.purgeTombstones()
 	if len(db.PendingRecords) > 0 {
 		cnt("SyncOK")
 		bidx := new(bytes.Buffer)
@@ -434,7 +1417,7 @@ func (db *DB) sync() {
 			}
 		}
 		db.Idx.writebuf(bidx.Bytes())
-		db.PendingRecords = make(map[KeyType]bool, db.O.MaxPending)
+		db.resetPending()
 
 		if db.Idx.ExtraSpaceUsed > (uint64(db.O.ForcedDefragPerc) * db.Idx.DiskSpaceNeeded / 100) {
 			cnt("DefragNow")
@@ -449,6 +1432,10 @@ func (db *DB) syncneeded() bool {
 	if db.VolatileMode {
 		return false
 	}
+	if db.O.MaxPendingBytes != 0 && db.PendingBytes > uint64(db.O.MaxPendingBytes) {
+		cnt("SyncNeedBytes")
+		return true
+	}
 	if len(db.PendingRecords) > int(db.O.MaxPendingNoSync) {
 		cnt("SyncNeedBig")
 		return true
@@ -460,10 +1447,22 @@ func (db *DB) syncneeded() bool {
 	return false
 }
 
-func (idx *oneIdx) freerec() {
-	if (idx.flags & NoCache) != 0 {
+// freerec frees the record's data if it has NoCache flag, but only if the data is on disk.
+// Returns true if the data was in memory.
+func (idx *oneIdx) freerec() bool {
+	if (idx.flags&NoCache) != 0 && idx.datpos != 0 && idx.data != nil {
 		idx.FreeData()
+		return true
 	}
+	return false
+}
+
+func (idx *oneIdx) deleted() bool {
+	return (idx.flags & isTombstone) != 0
+}
+
+func (idx *oneIdx) typeTag() byte {
+	return byte(idx.flags >> typeTagShift)
 }
 
 func (idx *oneIdx) applyBrowsingFlags(res uint32) {
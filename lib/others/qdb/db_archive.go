@@ -0,0 +1,223 @@
+package qdb
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+/*
+The archive is a single stream with the entire content of the database
+(all values are LSB):
+ [0:4] - "QDBA" marker
+ [4:8] - format version
+ [8:16] - number of records
+Followed by the records, each one being:
+ [0:8] - key
+ [8:12] - flags
+ [12:16] - length of the value
+ [16:] - the value (compressed, if the flags say so, but never encrypted)
+ followed by the expiry time (4 bytes), if the flags say so
+*/
+
+const (
+	archiveMarker  = "QDBA"
+	archiveVersion = 1
+)
+
+// WriteTo - Writes the entire database to the given writer, as a single archive.
+// The records of an encrypted database are decrypted, so the archive is not.
+func (db *DB) WriteTo(w io.Writer) (n int64, e error) {
+	var hdr [16]byte
+	var k int
+
+	db.Mutex.Lock()
+	defer db.Mutex.Unlock()
+	if db.Idx == nil {
+		return 0, ErrClosed
+	}
+
+	copy(hdr[0:4], archiveMarker)
+	binary.LittleEndian.PutUint32(hdr[4:8], archiveVersion)
+	binary.LittleEndian.PutUint64(hdr[8:16], uint64(len(db.Idx.Index)))
+	k, e = w.Write(hdr[:])
+	n += int64(k)
+
+	if e == nil {
+		db.Idx.browse(func(key KeyType, rec *oneIdx) bool {
+			var d []byte
+			ok := db.load(key, rec)
+			if ok {
+				if d = rec.Slice(); !rec.deleted() {
+					d, ok = unseal(db.aead, d) // the tombstones are never encrypted
+				}
+			}
+			if !ok {
+				e = fmt.Errorf("qdb: corrupt record %016x", uint64(key))
+				return false
+			}
+			binary.LittleEndian.PutUint64(hdr[0:8], uint64(key))
+			binary.LittleEndian.PutUint32(hdr[8:12], rec.flags)
+			binary.LittleEndian.PutUint32(hdr[12:16], uint32(len(d)))
+			if k, e = w.Write(hdr[:]); e == nil {
+				n += int64(k)
+				k, e = w.Write(d)
+				n += int64(k)
+				if e == nil && (rec.flags&hasExpiry) != 0 {
+					e = binary.Write(w, binary.LittleEndian, db.Idx.expires[key])
+					n += 4
+				}
+			} else {
+				n += int64(k)
+			}
+			db.uncache(key, rec)
+			return e == nil
+		})
+	}
+	return
+}
+
+// ReadFrom - Creates a database in the given folder, with the content read from an archive.
+// If the folder already contains a database, its content gets replaced.
+func ReadFrom(dir string, r io.Reader) (db *DB, e error) {
+	var hdr [16]byte
+
+	if _, e = io.ReadFull(r, hdr[:]); e != nil {
+		return
+	}
+	if string(hdr[0:4]) != archiveMarker {
+		e = errors.New("qdb: not an archive")
+		return
+	}
+	if ver := binary.LittleEndian.Uint32(hdr[4:8]); ver != archiveVersion {
+		e = errors.New("qdb: unsupported archive version")
+		return
+	}
+
+	count := binary.LittleEndian.Uint64(hdr[8:16])
+	recs := make(map[KeyType]*oneIdx)
+	expires := make(map[KeyType]uint32)
+	for i := uint64(0); i < count; i++ {
+		if _, e = io.ReadFull(r, hdr[:]); e != nil {
+			return
+		}
+		// the buffer only grows as the data comes, so a bad length cannot make it allocate
+		// much more than the archive really has
+		val := new(bytes.Buffer)
+		if _, e = io.CopyN(val, r, int64(binary.LittleEndian.Uint32(hdr[12:16]))); e != nil {
+			if e == io.EOF {
+				e = io.ErrUnexpectedEOF
+			}
+			return
+		}
+		key, flags := KeyType(binary.LittleEndian.Uint64(hdr[0:8])), binary.LittleEndian.Uint32(hdr[8:12])
+		if (flags & hasExpiry) != 0 {
+			var t uint32
+			if e = binary.Read(r, binary.LittleEndian, &t); e != nil {
+				return
+			}
+			expires[key] = t
+		}
+		recs[key] = newIdx(val.Bytes(), flags)
+	}
+
+	if db, e = NewDB(dir, false); e != nil {
+		return
+	}
+	if len(expires) > 0 && !db.O.Expiry {
+		db.O.Expiry = true
+		e = db.writeManifest()
+	}
+	if e == nil {
+		e = db.replace(recs, expires)
+	}
+	if e != nil {
+		db.Close()
+		db = nil
+	}
+	return
+}
+
+// ContentHash - Returns a hash of the entire content of the database, which does not depend
+// on the order of the records, so it can be used to check whether two replicas are in sync.
+// It is a XOR of SHA256 hashes of each record's key (8 bytes LSB) followed by its value.
+func (db *DB) ContentHash() (res [32]byte) {
+	var kb [8]byte
+	h := sha256.New()
+	db.BrowseAll(func(k KeyType, v []byte) uint32 {
+		binary.LittleEndian.PutUint64(kb[:], uint64(k))
+		h.Reset()
+		h.Write(kb[:])
+		h.Write(v)
+		for i, b := range h.Sum(nil) {
+			res[i] ^= b
+		}
+		return 0
+	})
+	return
+}
+
+// Backup - Writes a consistent copy of the database into the given folder, which can be opened
+// with NewDB as any other database. The folder must not contain a database already.
+// The database is locked while the copy is being made, but its own files are not modified:
+// the pending records are copied from memory, instead of being flushed first.
+// All the records go into a single data file, so the copy is also defragmented.
+func (db *DB) Backup(destDir string) (e error) {
+	db.Mutex.Lock()
+	defer db.Mutex.Unlock()
+	if db.Idx == nil {
+		return ErrClosed
+	}
+
+	if len(destDir) > 0 && destDir[len(destDir)-1] != '\\' && destDir[len(destDir)-1] != '/' {
+		destDir += string(os.PathSeparator)
+	}
+	bk := &DB{Dir: destDir, O: db.O}
+	if bk.exists() {
+		return errors.New("qdb: the backup folder already contains a database")
+	}
+	if e = os.MkdirAll(destDir, 0770); e != nil {
+		return
+	}
+	if e = bk.applyManifest(); e != nil {
+		return
+	}
+
+	const seq = 1
+	ff, e := os.Create(bk.seq2fn(seq))
+	if e != nil {
+		return
+	}
+	f := bufio.NewWriterSize(ff, 0x100000)
+	binary.Write(f, binary.LittleEndian, uint32(seq))
+	bk.LastValidLogPos = 4
+
+	recs := make(map[KeyType]*oneIdx, len(db.Idx.Index))
+	db.Idx.browse(func(key KeyType, rec *oneIdx) bool {
+		if !db.load(key, rec) {
+			e = fmt.Errorf("qdb: corrupt record %016x", uint64(key))
+			return false
+		}
+		recs[key] = &oneIdx{datpos: uint32(bk.addtolog(f, key, rec.Slice())),
+			datlen: rec.datlen, DataSeq: seq, flags: rec.flags}
+		db.uncache(key, rec)
+		return true
+	})
+	if e == nil {
+		e = f.Flush()
+	}
+	if e == nil {
+		e = ff.Sync()
+	}
+	ff.Close()
+	if e != nil {
+		return
+	}
+
+	return writeidxfile(destDir+"qdbidx.0", 1, recs, db.Idx.expires)
+}
@@ -13,17 +13,26 @@ They data is stored on a disk, in a folder specified during the call to NewDB().
 There are can be three possible files in that folder
  * qdb.0, qdb.1 - these files store a compact version of the entire database
  * qdb.log - this one stores the changes since the most recent qdb.0 or qdb.1
+ * qdb.opts - the options that the database was created with
+
+In LogOnly mode there are no qdb.0/qdb.1 files - qdb.log then stores the entire database
+and it gets rewritten (through a temporary file) each time the database is defragmented.
 
 */
 package qdb
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 )
 
 func (db *DB) seq2fn(seq uint32) string {
@@ -41,19 +50,173 @@ func (db *DB) checklogfile() {
 }
 
 // load record from disk, if not loaded yet
-func (db *DB) loadrec(idx *oneIdx) {
+// returns false if the record's checksum does not match (the data is not loaded then)
+func (db *DB) loadrec(idx *oneIdx) bool {
 	if idx.data == nil {
-		var f *os.File
-		if f, _ = db.DatFiles[idx.DataSeq]; f == nil {
-			fn := db.seq2fn(idx.DataSeq)
-			f, _ = os.Open(fn)
-			if f == nil {
-				println("file", fn, "not found")
-				os.Exit(1)
+		f, e := db.datfile(idx.DataSeq)
+		if e != nil || idx.LoadData(f) != nil {
+			return false
+		}
+		if db.O.VerifyChecksums {
+			var crc [4]byte
+			if _, e = f.ReadAt(crc[:], int64(idx.datpos)+int64(idx.datlen)); e != nil ||
+				binary.LittleEndian.Uint32(crc[:]) != crc32.ChecksumIEEE(idx.Slice()) {
+				idx.FreeData()
+				return false
 			}
-			db.DatFiles[idx.DataSeq] = f
 		}
-		idx.LoadData(f)
+	}
+	return true
+}
+
+// load is like loadrec, but it also reports the record loaded from disk to OnCacheLoad
+func (db *DB) load(k KeyType, idx *oneIdx) bool {
+	if idx.data != nil {
+		return true
+	}
+	if !db.loadrec(idx) {
+		return false
+	}
+	if !idx.deleted() {
+		db.cacheLoaded(k, idx)
+	}
+	return true
+}
+
+// uncache frees the record's data if it has NoCache flag (see freerec), reporting it to OnCacheFree
+func (db *DB) uncache(k KeyType, idx *oneIdx) {
+	if idx.freerec() && !idx.deleted() {
+		db.cacheFreed(k, idx)
+	}
+}
+
+func (db *DB) cacheLoaded(k KeyType, idx *oneIdx) {
+	if db.O.OnCacheLoad != nil {
+		db.O.OnCacheLoad(k, int(idx.datlen))
+	}
+}
+
+func (db *DB) cacheFreed(k KeyType, idx *oneIdx) {
+	if db.O.OnCacheFree != nil {
+		db.O.OnCacheFree(k, int(idx.datlen))
+	}
+}
+
+// readrec returns the record's value, reading it from disk if it is not in memory.
+// The value read from disk is kept in memory, unless the record has NoCache flag.
+// If yescache is true, the flag gets cleared first, so the value is always kept.
+// It can be called with the mutex only read-locked (the disk is then read without
+// holding cacheMutex, so many readers can do it at the same time).
+// The value gets decrypted and decompressed, but it is kept in memory as stored on disk.
+// Returns false if the record's checksum does not match, or it cannot be decrypted or decompressed,
+// or if it cannot be read from disk (e.g. the data file has been removed or truncated by another process).
+func (db *DB) readrec(k KeyType, idx *oneIdx, yescache bool) (value []byte, ok bool) {
+	c := byte((db.flags(idx) & codecMask) >> codecShift) // the codec never changes while read-locked
+	f, value, e := db.cached(idx, yescache)
+	if e != nil {
+		return nil, false
+	}
+	if f == nil {
+		return unpack(db.aead, c, value)
+	}
+
+	l := int(idx.datlen)
+	if db.O.VerifyChecksums {
+		l += 4
+	}
+	d := make([]byte, l)
+	if n, e := f.ReadAt(d, int64(idx.datpos)); n != l {
+		logf("cannot read record %016x: %v", uint64(k), e)
+		return nil, false
+	}
+	value = d[:idx.datlen]
+	if db.O.VerifyChecksums && binary.LittleEndian.Uint32(d[idx.datlen:]) != crc32.ChecksumIEEE(value) {
+		return nil, false
+	}
+
+	return unpack(db.aead, c, db.keep(k, idx, value))
+}
+
+// cached returns the record's value if it is in memory, or the data file to read it from
+func (db *DB) cached(idx *oneIdx, yescache bool) (f *os.File, value []byte, e error) {
+	db.cacheMutex.Lock()
+	defer db.cacheMutex.Unlock()
+	if yescache {
+		idx.applyBrowsingFlags(YesCache)
+	}
+	if idx.data != nil {
+		return nil, idx.Slice(), nil
+	}
+	f, e = db.datfile(idx.DataSeq)
+	return
+}
+
+// keep stores the value read from disk in memory, unless the record has NoCache flag
+func (db *DB) keep(k KeyType, idx *oneIdx, value []byte) []byte {
+	if kept := func() bool {
+		db.cacheMutex.Lock()
+		defer db.cacheMutex.Unlock() // storing the data may panic
+		if idx.data == nil && (idx.flags&NoCache) == 0 {
+			idx.SetData(value)
+			value = idx.Slice()
+			return true
+		}
+		return false
+	}(); kept {
+		db.cacheLoaded(k, idx)
+	}
+	return value
+}
+
+// write the record to the data file and the index log, and fsync both
+// sets the record's position, but does not put it into the index
+func (db *DB) writesync(key KeyType, rec *oneIdx) (e error) {
+	db.checklogfile()
+	if db.LogFile == nil {
+		return errors.New("qdb: cannot create data file in " + db.Dir)
+	}
+	dat := new(bytes.Buffer)
+	fpos := db.LastValidLogPos
+	db.writerec(dat, rec.Slice())
+	if _, e = db.LogFile.WriteAt(dat.Bytes(), fpos); e != nil {
+		return
+	}
+	if e = db.LogFile.Sync(); e != nil {
+		return
+	}
+	db.LastValidLogPos += int64(dat.Len())
+	rec.datpos = uint32(fpos)
+	rec.DataSeq = db.DataSeq
+
+	bidx := new(bytes.Buffer)
+	db.Idx.addtolog(bidx, key, rec)
+	db.Idx.checklogfile()
+	if _, e = db.Idx.file.Write(bidx.Bytes()); e == nil {
+		e = db.Idx.file.Sync()
+	}
+	return
+}
+
+// returns the data file with the given sequence, opening it if needed.
+// The file may be missing, e.g. removed by a defrag of another process (in ReadOnly mode).
+func (db *DB) datfile(seq uint32) (f *os.File, e error) {
+	if f = db.DatFiles[seq]; f == nil {
+		if f, e = os.Open(db.seq2fn(seq)); e != nil {
+			logf("cannot open data file: %s", e.Error())
+			cnt("DatFileMissing")
+			return nil, e
+		}
+		db.DatFiles[seq] = f
+		db.datStat[seq], _ = f.Stat()
+	}
+	return
+}
+
+// corrupt is called when a record's checksum does not match
+func (db *DB) corrupt(key KeyType) {
+	cnt("ChecksumError")
+	if db.O.OnCorrupt != nil {
+		db.O.OnCorrupt(key)
 	}
 }
 
@@ -66,12 +229,24 @@ func (db *DB) addtolog(f io.Writer, key KeyType, val []byte) (fpos int64) {
 	}
 
 	fpos = db.LastValidLogPos
-	f.Write(val)
-	db.LastValidLogPos += int64(len(val)) // 4 bytes for CRC
+	db.LastValidLogPos += db.writerec(f, val)
 
 	return
 }
 
+// write the record's data, followed by its CRC (in VerifyChecksums mode)
+// returns number of bytes written
+func (db *DB) writerec(f io.Writer, val []byte) int64 {
+	f.Write(val)
+	if !db.O.VerifyChecksums {
+		return int64(len(val))
+	}
+	var crc [4]byte
+	binary.LittleEndian.PutUint32(crc[:], crc32.ChecksumIEEE(val))
+	f.Write(crc[:])
+	return int64(len(val)) + 4
+}
+
 // add record at the end of the log
 func (db *DB) cleanupold(used map[uint32]bool) {
 	filepath.Walk(db.Dir, func(path string, info os.FileInfo, err error) error {
@@ -81,9 +256,13 @@ func (db *DB) cleanupold(used map[uint32]bool) {
 			if er == nil && uint32(v) != db.DataSeq {
 				if _, ok := used[uint32(v)]; !ok {
 					//println("deleting", v, path)
+					if db.O.OnRemoveDataFile != nil {
+						db.O.OnRemoveDataFile(uint32(v))
+					}
 					if f, _ := db.DatFiles[uint32(v)]; f != nil {
 						f.Close()
 						delete(db.DatFiles, uint32(v))
+						delete(db.datStat, uint32(v))
 					}
 					os.Remove(path)
 				}
@@ -92,3 +271,99 @@ func (db *DB) cleanupold(used map[uint32]bool) {
 		return nil
 	})
 }
+
+// Revalidate - Checks whether the files opened by the database have not been replaced
+// or modified by an external process. The stale handles of the data files get closed,
+// so the files will be opened again when needed, but an error is returned anyway,
+// as the records read from them can no longer be trusted.
+func (db *DB) Revalidate() error {
+	var changed []string
+	db.Mutex.Lock()
+	defer db.Mutex.Unlock()
+	if db.Idx == nil {
+		return ErrClosed
+	}
+	for seq, f := range db.DatFiles {
+		fn := db.seq2fn(seq)
+		cur, er := os.Stat(fn)
+		was := db.datStat[seq]
+		if er != nil || was == nil || !os.SameFile(cur, was) ||
+			seq != db.DataSeq && (cur.Size() != was.Size() || !cur.ModTime().Equal(was.ModTime())) {
+			f.Close()
+			delete(db.DatFiles, seq)
+			delete(db.datStat, seq)
+			changed = append(changed, fn)
+		}
+	}
+	if db.LogFile != nil {
+		fn := db.seq2fn(db.DataSeq)
+		cur, er := os.Stat(fn)
+		was, _ := db.LogFile.Stat()
+		if er != nil || was == nil || !os.SameFile(cur, was) || cur.Size() != db.LastValidLogPos {
+			changed = append(changed, fn)
+		}
+	}
+	if len(changed) > 0 {
+		cnt("Revalidate")
+		return errors.New("qdb: files changed externally: " + strings.Join(changed, ", "))
+	}
+	return nil
+}
+
+// Check - Verifies that every record of the index points to an existing data file,
+// within its size (and, for the current data file, before the last valid position of the log),
+// and that no record uses a data file above the current one (DataSeq, which is set above
+// the index's MaxDatfileSequence when loading).
+// It returns the descriptions of the problems found, without modifying anything.
+func (db *DB) Check() (problems []string) {
+	db.Mutex.RLock()
+	defer db.Mutex.RUnlock()
+	if db.Idx == nil {
+		return []string{ErrClosed.Error()}
+	}
+	if db.MemoryOnly {
+		return
+	}
+	sizes := make(map[uint32]int64)
+	missing := make(map[uint32]int)
+	above := make(map[uint32]int)
+	for k, rec := range db.Idx.Index {
+		if rec.datpos == 0 {
+			continue // not on disk yet
+		}
+		if rec.DataSeq > db.DataSeq {
+			above[rec.DataSeq]++
+		}
+		size, ok := sizes[rec.DataSeq]
+		if !ok {
+			size = -1
+			if fi, er := os.Stat(db.seq2fn(rec.DataSeq)); er == nil {
+				size = fi.Size()
+			}
+			if rec.DataSeq == db.DataSeq && db.LogFile != nil && size > db.LastValidLogPos {
+				size = db.LastValidLogPos
+			}
+			sizes[rec.DataSeq] = size
+		}
+		if size < 0 {
+			missing[rec.DataSeq]++
+			continue
+		}
+		end := int64(rec.datpos) + int64(rec.datlen)
+		if db.O.VerifyChecksums {
+			end += 4
+		}
+		if rec.datpos < 4 || end > size {
+			problems = append(problems, fmt.Sprintf("%016x: record at %d, length %d beyond the end (%d) of data file %08x",
+				uint64(k), rec.datpos, rec.datlen, size, rec.DataSeq))
+		}
+	}
+	for seq, n := range missing {
+		problems = append(problems, fmt.Sprintf("data file %08x missing (%d records)", seq, n))
+	}
+	for seq, n := range above {
+		problems = append(problems, fmt.Sprintf("data file %08x above the current one %08x (%d records)", seq, db.DataSeq, n))
+	}
+	sort.Strings(problems)
+	return
+}
@@ -2,11 +2,21 @@ package qdb
 
 import (
 	"bytes"
+	"context"
 	cr "crypto/rand"
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
 	mr "math/rand"
 	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -181,6 +191,2595 @@ func TestDatabase(t *testing.T) {
 	os.RemoveAll(dbname)
 }
 
+func TestReplaceAll(t *testing.T) {
+	const nrecs = 1000
+	os.RemoveAll(dbname)
+	db, _ := NewDB(dbname, true)
+
+	gen := func(g byte) (recs map[KeyType][]byte) {
+		recs = make(map[KeyType][]byte, nrecs)
+		for i := 0; i < nrecs; i++ {
+			recs[KeyType(i)] = []byte{g, byte(i), byte(i >> 8)}
+		}
+		return
+	}
+	db.ReplaceAll(gen(0))
+
+	var wg sync.WaitGroup
+	done := make(chan bool)
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				var g byte
+				var n int
+				var mixed bool
+				db.Browse(func(k KeyType, v []byte) uint32 {
+					if n == 0 {
+						g = v[0]
+					} else if v[0] != g {
+						mixed = true
+					}
+					n++
+					return 0
+				})
+				if mixed || n != nrecs {
+					t.Error("Inconsistent snapshot", n, mixed)
+					return
+				}
+			}
+		}()
+	}
+	for g := byte(1); g <= 20; g++ {
+		if e := db.ReplaceAll(gen(g)); e != nil {
+			t.Error(e.Error())
+		}
+	}
+	close(done)
+	wg.Wait()
+	db.Close()
+
+	db, _ = NewDB(dbname, true)
+	if db.Count() != nrecs {
+		t.Error("Wrong number of records", db.Count())
+	}
+	if v := db.Get(KeyType(7)); v == nil || v[0] != 20 {
+		t.Error("Bad record after reopen", v)
+	}
+	db.Close()
+	if db.ReplaceAll(nil) == nil {
+		t.Error("ReplaceAll on a closed db should fail")
+	}
+	os.RemoveAll(dbname)
+}
+
+func TestInFlight(t *testing.T) {
+	os.RemoveAll(dbname)
+	db, _ := NewDB(dbname, true)
+	for i := 0; i < 100; i++ {
+		db.Put(KeyType(i), []byte{byte(i)})
+	}
+	db.Sync()
+	if !db.InFlight() {
+		t.Error("Sync should be running in background")
+	}
+	db.WaitIdle()
+	if db.InFlight() {
+		t.Error("Background sync should be finished")
+	}
+	db.Close()
+	os.RemoveAll(dbname)
+}
+
+func TestOrderedKeys(t *testing.T) {
+	var db *DB
+	os.RemoveAll(dbname)
+	NewDBExt(&db, &NewDBOpts{Dir: dbname, LoadData: true, OrderedKeys: true})
+	for i := 0; i < 1000; i++ {
+		db.Put(KeyType(mr.Int63n(100000)), []byte{byte(i)})
+	}
+	db.Del(db.Idx.sorted[10])
+	db.Close()
+
+	NewDBExt(&db, &NewDBOpts{Dir: dbname, LoadData: true, OrderedKeys: true})
+	var prv KeyType
+	var n int
+	db.BrowseSorted(func(k KeyType, v []byte) uint32 {
+		if n > 0 && k <= prv {
+			t.Error("Keys not in order", prv, k)
+		}
+		prv = k
+		n++
+		return 0
+	})
+	if n != db.Count() {
+		t.Error("Not all records browsed", n, db.Count())
+	}
+
+	from, to := db.Idx.sorted[100], db.Idx.sorted[200]
+	n = 0
+	db.BrowseRange(from, to, func(k KeyType, v []byte) uint32 {
+		if k < from || k > to {
+			t.Error("Key out of range", k)
+		}
+		n++
+		return 0
+	})
+	if n != 101 {
+		t.Error("Wrong number of keys in range", n)
+	}
+
+	n = 0
+	db.BrowseFrom(to, func(k KeyType, v []byte) uint32 {
+		n++
+		return 0
+	})
+	if n != db.Count()-200 {
+		t.Error("Wrong number of keys browsed from", n)
+	}
+	db.Close()
+
+	// descending order, with a custom comparator
+	NewDBExt(&db, &NewDBOpts{Dir: dbname, LoadData: true, OrderedKeys: true,
+		KeyLess: func(a, b KeyType) bool { return a > b }})
+	n = 0
+	db.BrowseSorted(func(k KeyType, v []byte) uint32 {
+		if n > 0 && k >= prv {
+			t.Error("Keys not in descending order", prv, k)
+		}
+		prv = k
+		n++
+		return 0
+	})
+	db.Close()
+	os.RemoveAll(dbname)
+}
+
+func TestArchive(t *testing.T) {
+	os.RemoveAll(dbname)
+	os.RemoveAll(dbname + "2")
+	db, _ := NewDB(dbname, true)
+	recs := make(map[KeyType][]byte)
+	for i := 0; i < 1000; i++ {
+		val := make([]byte, mr.Intn(100))
+		cr.Read(val)
+		key := KeyType(mr.Int63())
+		recs[key] = val
+		db.Put(key, val)
+	}
+	db.PutExt(1, []byte("hidden"), NoBrowse)
+
+	buf := new(bytes.Buffer)
+	n, e := db.WriteTo(buf)
+	if e != nil || n != int64(buf.Len()) {
+		t.Fatal("WriteTo failed", n, buf.Len(), e)
+	}
+	db.Close()
+
+	db, e = ReadFrom(dbname+"2", buf)
+	if e != nil {
+		t.Fatal("ReadFrom failed", e.Error())
+	}
+	db.Close()
+
+	db, _ = NewDB(dbname+"2", true)
+	if db.Count() != len(recs)+1 {
+		t.Error("Wrong number of records", db.Count())
+	}
+	for k, v := range recs {
+		if !bytes.Equal(db.Get(k), v) {
+			t.Error("Key data mismatch", k2s(k))
+			break
+		}
+	}
+	db.Browse(func(k KeyType, v []byte) uint32 {
+		if k == 1 {
+			t.Error("Record flags not restored")
+		}
+		return 0
+	})
+	db.Close()
+
+	if _, e = ReadFrom(dbname+"2", bytes.NewReader([]byte("garbage data here"))); e == nil {
+		t.Error("ReadFrom should fail on bad input")
+	}
+
+	// a record claiming 4GB, with a few bytes behind it
+	bad := new(bytes.Buffer)
+	bad.WriteString(archiveMarker)
+	binary.Write(bad, binary.LittleEndian, []uint32{archiveVersion, 1, 0, 1, 0, 0, 0xffffffff})
+	bad.WriteString("short value")
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	allocated := ms.TotalAlloc
+	if _, e = ReadFrom(dbname+"2", bad); e != io.ErrUnexpectedEOF {
+		t.Error("ReadFrom should fail on truncated record", e)
+	}
+	if runtime.ReadMemStats(&ms); ms.TotalAlloc-allocated > 1<<20 {
+		t.Error("ReadFrom allocated for the length of truncated record", ms.TotalAlloc-allocated)
+	}
+	os.RemoveAll(dbname)
+	os.RemoveAll(dbname + "2")
+}
+
+func TestTypeTags(t *testing.T) {
+	os.RemoveAll(dbname)
+	db, _ := NewDB(dbname, true)
+	for i := 0; i < 300; i++ {
+		db.PutTyped(KeyType(i), byte(i%3), []byte{byte(i)})
+	}
+	db.Put(1000, []byte("untagged"))
+	db.Close()
+
+	db, _ = NewDB(dbname, true)
+	if tag, val, ok := db.GetTyped(5); !ok || tag != 2 || val[0] != 5 {
+		t.Error("GetTyped returned", tag, val, ok)
+	}
+	if _, _, ok := db.GetTyped(2000); ok {
+		t.Error("GetTyped found a missing record")
+	}
+	var n int
+	db.BrowseByType(1, func(k KeyType, v []byte) uint32 {
+		if k%3 != 1 || k == 1000 {
+			t.Error("Record of a wrong type browsed", k)
+		}
+		n++
+		return 0
+	})
+	if n != 100 {
+		t.Error("Wrong number of records browsed", n)
+	}
+	n = 0
+	db.BrowseByType(0, func(k KeyType, v []byte) uint32 {
+		n++
+		return 0
+	})
+	if n != 101 {
+		t.Error("Untagged record should have type 0", n)
+	}
+	db.Close()
+	os.RemoveAll(dbname)
+}
+
+func TestPutExtFlags(t *testing.T) {
+	os.RemoveAll(dbname)
+	db, _ := NewDB(dbname, true)
+	// the flags used by qdb itself must not get in from outside
+	internal := uint32(isTombstone | hasExpiry | CompressGzip<<codecShift | 7<<typeTagShift)
+	db.PutExt(1, []byte("one"), internal|NoCache)
+	b := db.Batch()
+	b.PutExt(2, []byte("two"), internal)
+	b.Commit()
+	db.Close()
+
+	db, _ = NewDB(dbname, true)
+	if db.Count() != 2 {
+		t.Error("Bad number of records", db.Count())
+	}
+	for k, v := range map[KeyType]string{1: "one", 2: "two"} {
+		if tag, val, ok := db.GetTyped(k); !ok || tag != 0 || string(val) != v {
+			t.Error("Bad record", k, tag, string(val), ok)
+		}
+		if fl := db.Idx.Index[k].flags; fl&^publicFlags != 0 {
+			t.Errorf("Internal flags set for %d: %x", k, fl)
+		}
+	}
+	db.Close()
+	os.RemoveAll(dbname)
+}
+
+func TestDefragStep(t *testing.T) {
+	os.RemoveAll(dbname)
+	db, _ := NewDB(dbname, true)
+	recs := make(map[KeyType][]byte)
+	for i := 0; i < 2000; i++ {
+		val := []byte(fmt.Sprint("value", i))
+		recs[KeyType(i)] = val
+		db.Put(KeyType(i), val)
+	}
+	db.Sync()
+	for i := 0; i < 1000; i++ {
+		delete(recs, KeyType(i))
+		db.Del(KeyType(i))
+	}
+	db.Sync()
+
+	// interrupt the defrag in the middle
+	for i := 0; i < 5; i++ {
+		db.DefragStep(50)
+	}
+	db.Close()
+	db, _ = NewDB(dbname, true)
+	if db.Count() != len(recs) {
+		t.Error("Wrong number of records after interrupted defrag", db.Count(), len(recs))
+	}
+
+	var steps int
+	for !db.DefragStep(50) {
+		// keep modifying the database between the steps
+		k := KeyType(1000 + steps)
+		recs[k] = []byte(fmt.Sprint("changed", steps))
+		db.Put(k, recs[k])
+		steps++
+	}
+	if steps < 10 {
+		t.Error("Defrag done in too few steps", steps)
+	}
+	db.WaitIdle()
+	if db.Idx.ExtraSpaceUsed != 0 {
+		t.Error("Extra space still used", db.Idx.ExtraSpaceUsed)
+	}
+	var datfiles int
+	filepath.Walk(dbname, func(path string, info os.FileInfo, err error) error {
+		if filepath.Ext(path) == ".dat" {
+			datfiles++
+		}
+		return nil
+	})
+	if datfiles != 1 {
+		t.Error("Old data files not removed", datfiles)
+	}
+	db.Close()
+
+	db, _ = NewDB(dbname, true)
+	if db.Count() != len(recs) {
+		t.Error("Wrong number of records", db.Count(), len(recs))
+	}
+	for k, v := range recs {
+		if !bytes.Equal(db.Get(k), v) {
+			t.Error("Key data mismatch", k2s(k))
+			break
+		}
+	}
+	db.Close()
+	os.RemoveAll(dbname)
+}
+
+func TestTombstones(t *testing.T) {
+	var db *DB
+	os.RemoveAll(dbname)
+	opts := &NewDBOpts{Dir: dbname, LoadData: true, ExtraOpts: &ExtraOpts{DefragPercentVal: DefaultDefragPercentVal,
+		ForcedDefragPerc: DefaultForcedDefragPerc, MaxPending: DefaultMaxPending,
+		MaxPendingNoSync: DefaultMaxPendingNoSync, TombstoneGrace: 1}}
+	NewDBExt(&db, opts)
+	for i := 0; i < 10; i++ {
+		db.Put(KeyType(i), []byte{byte(i)})
+	}
+	start := time.Now().Add(-time.Second)
+	db.Del(3)
+	db.Del(100) // not existing
+	db.Close()
+
+	deleted := func(since time.Time) (keys []KeyType) {
+		db.BrowseSince(since, func(k KeyType, tim time.Time) bool {
+			keys = append(keys, k)
+			return true
+		})
+		return
+	}
+	tailed := func() (keys []KeyType) {
+		db.TailChanges(func(k KeyType, v []byte) uint32 {
+			if v == nil {
+				keys = append(keys, k)
+			}
+			return 0
+		})
+		return
+	}
+
+	NewDBExt(&db, opts)
+	if db.Get(3) != nil || db.Count() != 9 {
+		t.Error("Deleted record still visible", db.Count())
+	}
+	db.Browse(func(k KeyType, v []byte) uint32 {
+		if k == 3 {
+			t.Error("Deleted record browsed")
+		}
+		return 0
+	})
+	if keys := deleted(start); len(keys) != 1 || keys[0] != 3 {
+		t.Error("Tombstone not reported", keys)
+	}
+	if keys := deleted(time.Now().Add(time.Minute)); len(keys) != 0 {
+		t.Error("Tombstone reported as deleted later", keys)
+	}
+	if keys := tailed(); len(keys) != 1 || keys[0] != 3 {
+		t.Error("Tombstone not reported by TailChanges", keys)
+	}
+
+	// after the grace period, the tombstone gets removed by the next sync (without defrag)
+	time.Sleep(2100 * time.Millisecond)
+	db.Put(5, []byte{55})
+	db.Sync()
+	db.WaitIdle()
+	if keys := tailed(); len(keys) != 0 || db.Idx.tombstones != 0 || db.Idx.get(3) != nil {
+		t.Error("Tombstone not purged", keys, db.Idx.tombstones)
+	}
+	db.Close()
+	NewDBExt(&db, opts)
+	if db.Idx.tombstones != 0 || db.Idx.get(3) != nil || db.Count() != 9 {
+		t.Error("Purged tombstone back after reopening", db.Idx.tombstones, db.Count())
+	}
+	db.Close()
+
+	// the periodic sync purges them too, even if there is nothing else to write
+	opts.ExtraOpts.SyncInterval = 100 * time.Millisecond
+	NewDBExt(&db, opts)
+	db.Del(4)
+	db.Sync()
+	db.WaitIdle()
+	if keys := tailed(); len(keys) != 1 || keys[0] != 4 {
+		t.Error("Tombstone not reported by TailChanges", keys)
+	}
+	time.Sleep(2500 * time.Millisecond)
+	db.Mutex.RLock()
+	n := db.Idx.tombstones
+	db.Mutex.RUnlock()
+	if n != 0 {
+		t.Error("Tombstone not purged by the periodic sync", n)
+	}
+	db.Close()
+	os.RemoveAll(dbname)
+}
+
+func TestManifest(t *testing.T) {
+	var db *DB
+	os.RemoveAll(dbname)
+	opts := &ExtraOpts{DefragPercentVal: DefaultDefragPercentVal, ForcedDefragPerc: DefaultForcedDefragPerc,
+		MaxPending: DefaultMaxPending, MaxPendingNoSync: DefaultMaxPendingNoSync, TombstoneGrace: 3600}
+	if e := NewDBExt(&db, &NewDBOpts{Dir: dbname, ExtraOpts: opts}); e != nil {
+		t.Fatal(e.Error())
+	}
+	db.Put(1, []byte("one"))
+	db.Close()
+
+	// reopen without the options
+	db, e := NewDB(dbname, true)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	if db.O.TombstoneGrace != 3600 {
+		t.Error("TombstoneGrace not applied from the manifest", db.O.TombstoneGrace)
+	}
+	db.Del(1)
+	deleted := false
+	db.BrowseSince(time.Time{}, func(k KeyType, _ time.Time) bool {
+		deleted = k == 1
+		return true
+	})
+	if !deleted {
+		t.Error("Tombstone not stored")
+	}
+	db.Close()
+
+	// reopen with incompatible options
+	opts.TombstoneGrace = 60
+	if e = NewDBExt(&db, &NewDBOpts{Dir: dbname, ExtraOpts: opts}); e == nil {
+		t.Error("Incompatible options not detected")
+	}
+	os.RemoveAll(dbname)
+}
+
+func TestGetOk(t *testing.T) {
+	os.RemoveAll(dbname)
+	db, _ := NewDB(dbname, true)
+	db.Put(1, []byte{})
+	db.Put(2, []byte("two"))
+
+	check := func() {
+		if v, ok := db.GetOk(1); !ok || len(v) != 0 {
+			t.Error("Empty record not found", v, ok)
+		}
+		if v, ok := db.GetOk(2); !ok || string(v) != "two" {
+			t.Error("Bad record", v, ok)
+		}
+		if _, ok := db.GetOk(3); ok {
+			t.Error("Missing record found")
+		}
+		db.Browse(func(k KeyType, v []byte) uint32 {
+			if _, ok := db.GetOkNoMutex(1); !ok {
+				t.Error("Empty record not found inside Browse")
+			}
+			return BrAbort
+		})
+	}
+	check()
+	db.Close()
+
+	db, _ = NewDB(dbname, true)
+	check()
+	db.Del(1)
+	if _, ok := db.GetOk(1); ok {
+		t.Error("Deleted record found")
+	}
+	db.Close()
+	os.RemoveAll(dbname)
+}
+
+func TestBrowseByDataPos(t *testing.T) {
+	os.RemoveAll(dbname)
+	db, _ := NewDB(dbname, true)
+	for i := 0; i < 1000; i++ {
+		db.Put(KeyType(mr.Int63()), []byte(fmt.Sprint("rec", i)))
+		if i%100 == 99 {
+			db.Close() // every reopen starts a new data file
+			db, _ = NewDB(dbname, true)
+		}
+	}
+	db.Close()
+
+	db, _ = NewDB(dbname, false)
+	var seq, pos uint32
+	var cnt, batch int
+	db.BrowseByDataPos(func(k KeyType, v []byte) uint32 {
+		rec := db.Idx.get(k)
+		if rec.DataSeq < seq || rec.DataSeq == seq && rec.datpos <= pos {
+			t.Error("Bad order", rec.DataSeq, rec.datpos, seq, pos)
+		}
+		// records synced together are in random order, but the batches must follow each other
+		var n int
+		fmt.Sscanf(string(v), "rec%d", &n)
+		if n/100 < batch {
+			t.Error("Not in insertion order", string(v), batch)
+		}
+		batch = n / 100
+		seq, pos = rec.DataSeq, rec.datpos
+		cnt++
+		return 0
+	})
+	if cnt != 1000 {
+		t.Error("Bad number of records", cnt)
+	}
+	db.Close()
+	os.RemoveAll(dbname)
+}
+
+func TestReadOnlyFilesGone(t *testing.T) {
+	os.RemoveAll(dbname)
+	db, _ := NewDB(dbname, true)
+	for i := 0; i < 100; i++ {
+		db.Put(KeyType(i), []byte(fmt.Sprint("record number ", i)))
+	}
+	db.Close()
+
+	// the data file gets truncated by another process, after it has been opened
+	var ro *DB
+	NewDBExt(&ro, &NewDBOpts{Dir: dbname, ReadOnly: true})
+	var first, last KeyType
+	for k, r := range ro.Idx.Index {
+		if r.datpos < ro.Idx.get(first).datpos {
+			first = k
+		}
+		if r.datpos > ro.Idx.get(last).datpos {
+			last = k
+		}
+	}
+	if string(ro.Get(first)) != fmt.Sprint("record number ", first) {
+		t.Fatal("Bad record", first, string(ro.Get(first)))
+	}
+	fn := ro.seq2fn(ro.Idx.get(last).DataSeq)
+	os.Truncate(fn, int64(ro.Idx.get(last).datpos)+2)
+	if v := ro.Get(last); v != nil {
+		t.Error("Record beyond the end of the data file returned", v)
+	}
+	if v, ok := ro.GetRange(last, 0, 5); ok {
+		t.Error("Range beyond the end of the data file returned", v)
+	}
+	ro.Close()
+
+	// the data file is removed by another process, before it has been opened
+	NewDBExt(&ro, &NewDBOpts{Dir: dbname, ReadOnly: true})
+	os.Remove(fn)
+	if v := ro.Get(first); v != nil {
+		t.Error("Record from a missing data file returned", v)
+	}
+	var cnt int
+	ro.Browse(func(k KeyType, v []byte) uint32 {
+		cnt++
+		return 0
+	})
+	if cnt != 0 {
+		t.Error("Records from a missing data file browsed", cnt)
+	}
+	ro.Close()
+	os.RemoveAll(dbname)
+}
+
+func TestReadOnly(t *testing.T) {
+	os.RemoveAll(dbname)
+	db, _ := NewDB(dbname, true)
+	for i := 0; i < 100; i++ {
+		db.Put(KeyType(i), []byte(fmt.Sprint("rec", i)))
+	}
+	db.Close()
+
+	files := func() (res map[string]int64) {
+		res = make(map[string]int64)
+		fis, _ := ioutil.ReadDir(dbname)
+		for _, fi := range fis {
+			res[fi.Name()] = fi.ModTime().UnixNano() + fi.Size()
+		}
+		return
+	}
+	before := files()
+
+	var ro *DB
+	if e := NewDBExt(&ro, &NewDBOpts{Dir: dbname, LoadData: true, ReadOnly: true}); e != nil {
+		t.Fatal(e.Error())
+	}
+	if ro.Count() != 100 || string(ro.Get(50)) != "rec50" {
+		t.Error("Bad content", ro.Count(), string(ro.Get(50)))
+	}
+	var cnt int
+	ro.Browse(func(k KeyType, v []byte) uint32 {
+		cnt++
+		return 0
+	})
+	if cnt != 100 {
+		t.Error("Bad browse count", cnt)
+	}
+
+	ro.Put(1000, []byte("new"))
+	ro.Del(1)
+	if ro.PutIf(1001, []byte("new"), func([]byte, bool) bool { return true }) {
+		t.Error("PutIf succeeded")
+	}
+	b := ro.Batch()
+	b.Put(1002, []byte("new"))
+	if b.Commit() != ErrReadOnly {
+		t.Error("Batch commit not rejected")
+	}
+	if ro.ReplaceAll(map[KeyType][]byte{1: []byte("x")}) != ErrReadOnly {
+		t.Error("ReplaceAll not rejected")
+	}
+	ro.Defrag(true)
+	ro.Sync()
+	if ro.Count() != 100 || ro.Get(1000) != nil || ro.Get(1) == nil {
+		t.Error("Read-only database modified in memory", ro.Count())
+	}
+	ro.Close()
+
+	after := files()
+	if len(after) != len(before) {
+		t.Error("Files created or removed", before, after)
+	}
+	for fn, st := range before {
+		if after[fn] != st {
+			t.Error("File modified", fn)
+		}
+	}
+	os.RemoveAll(dbname)
+}
+
+func TestChecksums(t *testing.T) {
+	var db *DB
+	os.RemoveAll(dbname)
+	opts := &ExtraOpts{DefragPercentVal: DefaultDefragPercentVal, ForcedDefragPerc: DefaultForcedDefragPerc,
+		MaxPending: DefaultMaxPending, MaxPendingNoSync: DefaultMaxPendingNoSync, VerifyChecksums: true}
+	NewDBExt(&db, &NewDBOpts{Dir: dbname, ExtraOpts: opts})
+	for i := 0; i < 10; i++ {
+		db.Put(KeyType(i), []byte(fmt.Sprint("record number ", i)))
+	}
+	db.Close()
+
+	// reopen without the options - the checksums must be applied from the manifest
+	db, _ = NewDB(dbname, false)
+	if !db.O.VerifyChecksums {
+		t.Fatal("VerifyChecksums not applied from the manifest")
+	}
+	for i := 0; i < 10; i++ {
+		if want := fmt.Sprint("record number ", i); string(db.Get(KeyType(i))) != want {
+			t.Error("Bad record", i, string(db.Get(KeyType(i))))
+		}
+	}
+	rec := db.Idx.get(5)
+	fn := db.seq2fn(rec.DataSeq)
+	pos := int64(rec.datpos) + 3
+	db.Close()
+
+	// flip a byte of record 5
+	f, _ := os.OpenFile(fn, os.O_RDWR, 0600)
+	var b [1]byte
+	f.ReadAt(b[:], pos)
+	b[0] ^= 0xff
+	f.WriteAt(b[:], pos)
+	f.Close()
+
+	var bad []KeyType
+	opts.OnCorrupt = func(k KeyType) {
+		bad = append(bad, k)
+	}
+	NewDBExt(&db, &NewDBOpts{Dir: dbname, ExtraOpts: opts})
+	if db.Get(5) != nil {
+		t.Error("Corrupt record returned")
+	}
+	if string(db.Get(4)) != "record number 4" {
+		t.Error("Good record not returned")
+	}
+	var cnt int
+	db.Browse(func(k KeyType, v []byte) uint32 {
+		cnt++
+		return 0
+	})
+	if cnt != 9 || len(bad) != 1 || bad[0] != 5 {
+		t.Error("Corruption not reported while browsing", cnt, bad)
+	}
+	db.Close()
+
+	// the same when loading the whole database at open
+	bad = nil
+	NewDBExt(&db, &NewDBOpts{Dir: dbname, LoadData: true, ExtraOpts: opts})
+	if len(bad) != 1 || bad[0] != 5 {
+		t.Error("Corruption not reported while loading", bad)
+	}
+	db.Close()
+	os.RemoveAll(dbname)
+
+	// checksums cannot be enabled for a database created without them
+	db, _ = NewDB(dbname, false)
+	db.Put(1, []byte("one"))
+	db.Close()
+	opts.OnCorrupt = nil
+	if e := NewDBExt(&db, &NewDBOpts{Dir: dbname, ExtraOpts: opts}); e == nil {
+		t.Error("Checksums enabled for a database without them")
+	}
+	os.RemoveAll(dbname)
+}
+
+func TestGetRange(t *testing.T) {
+	os.RemoveAll(dbname)
+	db, _ := NewDB(dbname, false)
+	val := make([]byte, 1000000)
+	cr.Read(val)
+	db.Put(1, val)
+
+	check := func() {
+		if v, ok := db.GetRange(1, 123456, 1000); !ok || !bytes.Equal(v, val[123456:124456]) {
+			t.Error("Bad range", ok)
+		}
+		if v, ok := db.GetRange(1, len(val)-10, 10); !ok || !bytes.Equal(v, val[len(val)-10:]) {
+			t.Error("Bad range at the end", ok)
+		}
+		if _, ok := db.GetRange(1, len(val)-10, 11); ok {
+			t.Error("Range beyond the value returned")
+		}
+		if _, ok := db.GetRange(2, 0, 1); ok {
+			t.Error("Range of a missing record returned")
+		}
+	}
+	check() // from memory
+	db.Close()
+
+	db, _ = NewDB(dbname, false)
+	check() // from disk
+	if db.Idx.get(1).data != nil {
+		t.Error("The whole record has been loaded")
+	}
+	db.Close()
+	os.RemoveAll(dbname)
+}
+
+func TestPutSync(t *testing.T) {
+	os.RemoveAll(dbname)
+	db, _ := NewDB(dbname, false)
+	db.NoSync()
+	db.Put(1, []byte("pending"))
+	if e := db.PutSync(2, []byte("durable")); e != nil {
+		t.Fatal(e.Error())
+	}
+	if string(db.Get(2)) != "durable" {
+		t.Error("Bad record in memory", string(db.Get(2)))
+	}
+
+	// the process "crashes" now - see what another one finds on disk
+	var ro *DB
+	NewDBExt(&ro, &NewDBOpts{Dir: dbname, LoadData: true, ReadOnly: true})
+	if string(ro.Get(2)) != "durable" {
+		t.Error("PutSync record not on disk", string(ro.Get(2)))
+	}
+	if ro.Get(1) != nil {
+		t.Error("Pending record on disk")
+	}
+	ro.Close()
+
+	db.Close()
+	os.RemoveAll(dbname)
+}
+
+func TestBrowseRangeNoLoad(t *testing.T) {
+	os.RemoveAll(dbname)
+	db, _ := NewDB(dbname, false)
+	for i := 0; i < 100; i++ {
+		db.Put(KeyType(i), []byte{byte(i)})
+	}
+	db.Close()
+
+	db, _ = NewDB(dbname, false)
+	var cnt int
+	db.BrowseRange(10, 20, func(k KeyType, v []byte) uint32 {
+		cnt++
+		return 0
+	})
+	if cnt != 11 {
+		t.Error("Bad number of records in range", cnt)
+	}
+	for k, rec := range db.Idx.Index {
+		if (k < 10 || k > 20) && rec.data != nil {
+			t.Error("Record out of range loaded from disk", k)
+		}
+	}
+	db.Close()
+
+	// the highest possible key is in the range as well, in both modes
+	for _, ordered := range []bool{false, true} {
+		NewDBExt(&db, &NewDBOpts{Dir: dbname, OrderedKeys: ordered})
+		db.Put(math.MaxUint64, []byte{1})
+		db.Put(math.MaxUint64-1, []byte{2})
+		var keys []KeyType
+		db.BrowseRange(math.MaxUint64-1, math.MaxUint64, func(k KeyType, v []byte) uint32 {
+			keys = append(keys, k)
+			return 0
+		})
+		if len(keys) != 2 || keys[0] != math.MaxUint64-1 || keys[1] != math.MaxUint64 {
+			t.Error("Bad keys at the top of the range", ordered, keys)
+		}
+		keys = nil
+		db.BrowseRange(15, 15, func(k KeyType, v []byte) uint32 {
+			keys = append(keys, k)
+			return 0
+		})
+		if len(keys) != 1 || keys[0] != 15 {
+			t.Error("Bad single key range", ordered, keys)
+		}
+		db.Close()
+	}
+	os.RemoveAll(dbname)
+}
+
+func TestSizeStats(t *testing.T) {
+	os.RemoveAll(dbname)
+	db, _ := NewDB(dbname, false)
+	if cnt, _, _, _, _, _, _ := db.SizeStats(); cnt != 0 {
+		t.Error("Bad count of empty db", cnt)
+	}
+	for i := 1; i <= 200; i++ {
+		db.Put(KeyType(i), make([]byte, i))
+	}
+	cnt, total, min, max, mean, p50, p99 := db.SizeStats()
+	if cnt != 200 || total != 20100 || min != 1 || max != 200 || mean != 100 {
+		t.Error("Bad stats", cnt, total, min, max, mean)
+	}
+	if p50 != 100 || p99 != 198 {
+		t.Error("Bad percentiles", p50, p99)
+	}
+	db.Close()
+
+	// a closed database must stay usable (not locked) after it
+	if cnt, _, _, _, _, _, _ := db.SizeStats(); cnt != 0 {
+		t.Error("Bad count of closed db", cnt)
+	}
+	done := make(chan int)
+	go func() {
+		done <- db.Count()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Database left locked by SizeStats")
+	}
+	os.RemoveAll(dbname)
+}
+
+func TestUnwritableDir(t *testing.T) {
+	os.RemoveAll(dbname)
+	os.MkdirAll(dbname, 0700)
+	defer os.RemoveAll(dbname)
+
+	// a folder cannot be created under a file
+	ioutil.WriteFile(filepath.Join(dbname, "file"), []byte("x"), 0600)
+	if db, e := NewDB(filepath.Join(dbname, "file", "db"), false); e == nil || db != nil {
+		t.Error("Folder under a file not reported", e)
+	}
+
+	if os.Geteuid() == 0 {
+		t.Log("Running as root - read-only folder not tested")
+		return
+	}
+	ro := filepath.Join(dbname, "ro")
+	os.Mkdir(ro, 0500)
+	defer os.Chmod(ro, 0700)
+	if db, e := NewDB(filepath.Join(ro, "db"), false); e == nil || db != nil {
+		t.Error("Folder under a read-only parent not reported", e)
+	}
+	os.Chmod(ro, 0700)
+	os.Mkdir(filepath.Join(ro, "db"), 0700)
+	os.Chmod(filepath.Join(ro, "db"), 0500)
+	defer os.Chmod(filepath.Join(ro, "db"), 0700)
+	if db, e := NewDB(filepath.Join(ro, "db"), false); e == nil || db != nil {
+		t.Error("Read-only folder not reported", e)
+	}
+}
+
+func TestDBGetStats(t *testing.T) {
+	os.RemoveAll(dbname)
+	db, _ := NewDB(dbname, false)
+	db.NoSync()
+	for i := 0; i < 100; i++ {
+		db.Put(KeyType(i), make([]byte, 10))
+	}
+	s := db.GetStats()
+	if s.RecordCount != 100 || s.PendingRecords != 100 || s.ExtraSpaceUsed != 0 {
+		t.Error("Bad stats", s)
+	}
+	db.Sync()
+	for i := 0; i < 50; i++ {
+		db.Put(KeyType(i), make([]byte, 10))
+	}
+	db.WaitIdle()
+	s = db.GetStats()
+	if s.RecordCount != 100 || s.PendingRecords != 50 || s.DiskSpaceNeeded != 100*(24+10) {
+		t.Error("Bad stats after sync", s)
+	}
+	if s.ExtraSpaceUsed != 50*(24+10) || s.DefragRatio != 50 {
+		t.Error("Bad fragmentation", s)
+	}
+	db.Close()
+	os.RemoveAll(dbname)
+}
+
+func TestBrowsePanic(t *testing.T) {
+	os.RemoveAll(dbname)
+	db, _ := NewDB(dbname, false)
+	db.Put(1, []byte("one"))
+	db.Close()
+	db, _ = NewDB(dbname, false)
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("Panic did not propagate")
+			}
+		}()
+		db.BrowseAll(func(k KeyType, v []byte) uint32 {
+			panic("walk")
+		})
+	}()
+
+	done := make(chan bool)
+	go func() {
+		db.Get(1)
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Database locked after a panic in the walk function")
+	}
+	db.Close()
+	os.RemoveAll(dbname)
+}
+
+func TestPanicUnlocks(t *testing.T) {
+	os.RemoveAll(dbname)
+	db, _ := NewDB(dbname, false)
+	db.Put(1, []byte("one"))
+	db.Close()
+	db, _ = NewDB(dbname, false)
+
+	// make loading of the records from disk panic
+	membind_use_wrapper = true
+	_heap_alloc = func(le uint32) data_ptr_t {
+		panic("loadrec")
+	}
+	mustPanic := func(name string, f func()) {
+		defer func() {
+			if recover() == nil {
+				t.Error(name, "did not panic")
+			}
+		}()
+		f()
+	}
+	mustPanic("Get", func() { db.Get(1) })
+	mustPanic("PutIf", func() {
+		db.PutIf(1, []byte("uno"), func([]byte, bool) bool { return true })
+	})
+	mustPanic("Browse", func() {
+		db.Browse(func(k KeyType, v []byte) uint32 { return 0 })
+	})
+	membind_use_wrapper = false
+	_heap_alloc = nil
+
+	done := make(chan bool)
+	go func() {
+		db.Put(2, []byte("two"))
+		db.Sync() // the mutex is handed over to the background sync
+		db.WaitIdle()
+		done <- string(db.Get(1)) == "one" && string(db.Get(2)) == "two"
+	}()
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Error("Bad records after the panics")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Database locked after a panic")
+	}
+	if db.InFlight() {
+		t.Error("Background sync not finished")
+	}
+	db.Close()
+	os.RemoveAll(dbname)
+}
+
+func TestDefragCtx(t *testing.T) {
+	os.RemoveAll(dbname)
+	db, _ := NewDB(dbname, false)
+	for n := 0; n < 2; n++ {
+		for i := 0; i < 5000; i++ {
+			db.Put(KeyType(i), []byte(fmt.Sprintf("rec%d-%d", n, i)))
+		}
+		db.Sync()
+	}
+	db.WaitIdle()
+
+	files := func() (res map[string]int64) {
+		res = make(map[string]int64)
+		fis, _ := ioutil.ReadDir(dbname)
+		for _, fi := range fis {
+			res[fi.Name()] = fi.Size()
+		}
+		return
+	}
+	before := files()
+	extra := db.Idx.ExtraSpaceUsed
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var last int
+	db.DefragCtx(ctx, func(done, total int) {
+		if done >= 2000 {
+			cancel()
+		}
+		last = done
+	})
+	if ctx.Err() == nil || last >= 5000 {
+		t.Fatal("Defrag not cancelled", last)
+	}
+	if after := files(); fmt.Sprint(after) != fmt.Sprint(before) {
+		t.Error("Files changed by cancelled defrag", before, after)
+	}
+	if db.Idx.ExtraSpaceUsed != extra {
+		t.Error("ExtraSpaceUsed changed by cancelled defrag")
+	}
+	if string(db.Get(100)) != "rec1-100" {
+		t.Error("Bad record after cancelled defrag", string(db.Get(100)))
+	}
+
+	var calls int
+	db.DefragCtx(context.Background(), func(done, total int) {
+		calls++
+		last = done
+		if total != 5000 {
+			t.Error("Bad total", total)
+		}
+	})
+	if last != 5000 || calls < 5 {
+		t.Error("Bad progress", last, calls)
+	}
+	if db.Idx.ExtraSpaceUsed != 0 {
+		t.Error("Defrag not done")
+	}
+	db.Close()
+
+	db, _ = NewDB(dbname, true)
+	if db.Count() != 5000 || string(db.Get(4999)) != "rec1-4999" {
+		t.Error("Bad content after defrag", db.Count(), string(db.Get(4999)))
+	}
+	db.Close()
+	os.RemoveAll(dbname)
+}
+
+func TestMaxDatFileSize(t *testing.T) {
+	os.RemoveAll(dbname)
+	var db *DB
+	opts := &NewDBOpts{Dir: dbname, LoadData: true, ExtraOpts: &ExtraOpts{MaxDatFileSize: 10000}}
+	NewDBExt(&db, opts)
+	for n := 0; n < 2; n++ {
+		ba := db.Batch()
+		for i := 0; i < 1000; i++ {
+			ba.Put(KeyType(i), []byte(fmt.Sprintf("record%d-%d", n, i)))
+		}
+		ba.Commit()
+		db.Sync()
+	}
+	db.Put(5000, make([]byte, 20000)) // bigger than the limit - it gets a file of its own
+	db.DefragCtx(context.Background(), nil)
+
+	datfiles := func() (res map[string]int64) {
+		res = make(map[string]int64)
+		fis, _ := ioutil.ReadDir(dbname)
+		for _, fi := range fis {
+			if strings.HasSuffix(fi.Name(), ".dat") {
+				res[fi.Name()] = fi.Size()
+			}
+		}
+		return
+	}
+	files := datfiles()
+	// about 15000 bytes of the records make two full files and the big record gets its own
+	if len(files) < 3 {
+		t.Fatal("Not enough data files", files)
+	}
+	var big int
+	for fn, size := range files {
+		if size > 10000 {
+			if size != 4+20000 {
+				t.Error("Data file too big", fn, size)
+			}
+			big++
+		}
+	}
+	if big != 1 {
+		t.Error("Big record not in a file of its own", files)
+	}
+	seqs := make(map[uint32]bool)
+	db.Idx.browse(func(k KeyType, v *oneIdx) bool {
+		seqs[v.DataSeq] = true
+		return true
+	})
+	if len(seqs) != len(files) {
+		t.Error("Records not spread over the data files", len(seqs), files)
+	}
+	db.Close()
+
+	NewDBExt(&db, opts)
+	if db.Count() != 1001 || string(db.Get(0)) != "record1-0" || string(db.Get(999)) != "record1-999" ||
+		len(db.Get(5000)) != 20000 {
+		t.Error("Bad content after reload", db.Count())
+	}
+	if p := db.Check(); len(p) != 0 {
+		t.Error("Check failed", p)
+	}
+	db.DefragCtx(context.Background(), nil)
+	// the records are written in a random order, so the number of the new files may differ
+	after := datfiles()
+	big = 0
+	for fn, size := range after {
+		if _, ok := files[fn]; ok {
+			t.Error("Old data file not replaced", fn, files, after)
+		}
+		if size > 10000 {
+			big++
+		}
+	}
+	if len(after) < 3 || big != 1 {
+		t.Error("Bad data files after defrag", after)
+	}
+	db.Close()
+	os.RemoveAll(dbname)
+}
+
+func TestLogger(t *testing.T) {
+	var msgs []string
+	defer func(l func(string, ...interface{})) { Logger = l }(Logger)
+	Logger = func(format string, args ...interface{}) {
+		msgs = append(msgs, fmt.Sprintf(format, args...))
+	}
+
+	os.RemoveAll(dbname)
+	os.MkdirAll(dbname, 0700)
+	ioutil.WriteFile(filepath.Join(dbname, "qdbidx.0"), []byte("garbage index file"), 0600)
+	db, _ := NewDB(dbname, true)
+	db.Close()
+	os.RemoveAll(dbname)
+	if len(msgs) == 0 {
+		t.Error("Nothing logged for a corrupt index file")
+	}
+}
+
+func TestMemoryOnly(t *testing.T) {
+	var db *DB
+	os.RemoveAll(dbname)
+	if e := NewDBExt(&db, &NewDBOpts{Dir: dbname, MemoryOnly: true, OrderedKeys: true}); e != nil {
+		t.Fatal(e.Error())
+	}
+	for i := 0; i < 1000; i++ {
+		db.Put(KeyType(i), []byte(fmt.Sprintf("rec%d", i)))
+	}
+	for i := 0; i < 1000; i += 2 {
+		db.Del(KeyType(i))
+	}
+	db.Sync()
+	db.Defrag(true)
+	db.Flush()
+	if db.Count() != 500 || string(db.Get(999)) != "rec999" || db.Get(998) != nil {
+		t.Error("Bad content", db.Count(), string(db.Get(999)))
+	}
+	var prev KeyType
+	var n int
+	db.BrowseSorted(func(k KeyType, v []byte) uint32 {
+		if k <= prev || string(v) != fmt.Sprintf("rec%d", k) {
+			t.Error("Bad record", k, string(v))
+		}
+		prev = k
+		n++
+		return 0
+	})
+	if n != 500 {
+		t.Error("Bad number of browsed records", n)
+	}
+	db.Close()
+	if _, e := os.Stat(dbname); !os.IsNotExist(e) {
+		t.Error("Files created in MemoryOnly mode")
+		os.RemoveAll(dbname)
+	}
+}
+
+func TestLogOnly(t *testing.T) {
+	var db *DB
+	os.RemoveAll(dbname)
+	opts := &NewDBOpts{Dir: dbname, ExtraOpts: &ExtraOpts{LogOnly: true}}
+	noSnapshots := func() {
+		for _, fn := range []string{"qdbidx.0", "qdbidx.1"} {
+			if _, e := os.Stat(filepath.Join(dbname, fn)); e == nil {
+				t.Error("Snapshot created in LogOnly mode", fn)
+			}
+		}
+	}
+	check := func(when string) {
+		if db.Count() != 500 {
+			t.Error("Bad count", when, db.Count())
+		}
+		for i := 0; i < 1000; i++ {
+			v := db.Get(KeyType(i))
+			if (i&1 == 0) != (v == nil) || v != nil && string(v) != fmt.Sprintf("rec%d", i) {
+				t.Error("Bad record", when, i, string(v))
+			}
+		}
+	}
+
+	NewDBExt(&db, opts)
+	for i := 0; i < 1000; i++ {
+		db.Put(KeyType(i), []byte(fmt.Sprintf("rec%d", i)))
+	}
+	for i := 0; i < 1000; i += 2 {
+		db.Del(KeyType(i))
+	}
+	db.Close()
+	noSnapshots()
+
+	NewDBExt(&db, opts)
+	check("after reopen")
+	db.Defrag(true)
+	db.WaitIdle()
+	db.Put(1, []byte("rec1"))
+	db.Close()
+	noSnapshots()
+
+	NewDBExt(&db, opts)
+	check("after defrag")
+	db.Close()
+
+	// a database with snapshots gets converted
+	NewDBExt(&db, &NewDBOpts{Dir: dbname})
+	db.Defrag(true)
+	db.Close()
+	NewDBExt(&db, opts)
+	check("after conversion")
+	db.Close()
+	noSnapshots()
+
+	// and the other way around
+	NewDBExt(&db, &NewDBOpts{Dir: dbname})
+	check("without LogOnly")
+	db.Close()
+	os.RemoveAll(dbname)
+}
+
+func TestBrowseKeys(t *testing.T) {
+	os.RemoveAll(dbname)
+	db, _ := NewDB(dbname, false)
+	for i := 1; i <= 100; i++ {
+		db.Put(KeyType(i), make([]byte, i))
+	}
+	db.Del(100)
+	db.Close()
+
+	db, _ = NewDB(dbname, false)
+	var cnt int
+	var total uint32
+	db.BrowseKeys(func(k KeyType, datlen uint32) uint32 {
+		if datlen != uint32(k) {
+			t.Error("Bad length of record", k, datlen)
+		}
+		cnt++
+		total += datlen
+		return 0
+	})
+	if cnt != 99 || total != 4950 {
+		t.Error("Bad keys browsed", cnt, total)
+	}
+	for k, rec := range db.Idx.Index {
+		if rec.data != nil {
+			t.Error("Record loaded from disk", k)
+		}
+	}
+
+	cnt = 0
+	db.BrowseKeys(func(k KeyType, datlen uint32) uint32 {
+		cnt++
+		return BrAbort
+	})
+	if cnt != 1 {
+		t.Error("BrAbort ignored", cnt)
+	}
+	db.Close()
+	os.RemoveAll(dbname)
+}
+
+func TestOnRemoveDataFile(t *testing.T) {
+	var db *DB
+	removed := make(map[uint32]bool)
+	os.RemoveAll(dbname)
+	opts := &NewDBOpts{Dir: dbname, ExtraOpts: &ExtraOpts{OnRemoveDataFile: func(seq uint32) {
+		if _, e := os.Stat(db.seq2fn(seq)); e != nil {
+			t.Error("Data file already gone", seq)
+		}
+		removed[seq] = true
+	}}}
+	datfiles := func() map[uint32]bool {
+		res := make(map[uint32]bool)
+		fis, _ := ioutil.ReadDir(dbname)
+		for _, fi := range fis {
+			var seq uint32
+			if n, _ := fmt.Sscanf(fi.Name(), "%08x.dat", &seq); n == 1 {
+				res[seq] = true
+			}
+		}
+		return res
+	}
+	NewDBExt(&db, opts)
+	for n := 0; n < 3; n++ {
+		for i := 0; i < 100; i++ {
+			db.Put(KeyType(i), []byte(fmt.Sprintf("rec%d-%d", n, i)))
+		}
+		db.Sync()
+		db.WaitIdle()
+		before := datfiles()
+		removed = make(map[uint32]bool)
+		db.DefragCtx(context.Background(), nil)
+		after := datfiles()
+		if len(removed) == 0 || len(after) != 1 {
+			t.Error("Old data files not removed", n, removed, after)
+		}
+		for seq := range before {
+			if removed[seq] == after[seq] {
+				t.Error("Callback not fired for removed data file", n, seq)
+			}
+		}
+		for seq := range removed {
+			if !before[seq] {
+				t.Error("Callback fired for unknown data file", n, seq)
+			}
+		}
+	}
+	db.Close()
+	os.RemoveAll(dbname)
+}
+
+func TestCacheHooks(t *testing.T) {
+	os.RemoveAll(dbname)
+	db, _ := NewDB(dbname, false)
+	for i := 1; i <= 10; i++ {
+		db.Put(KeyType(i), make([]byte, i))
+	}
+	db.PutExt(11, make([]byte, 11), NoCache)
+	db.Close()
+
+	loaded := make(map[KeyType]int)
+	freed := make(map[KeyType]int)
+	NewDBExt(&db, &NewDBOpts{Dir: dbname, LoadData: false, ExtraOpts: &ExtraOpts{
+		OnCacheLoad: func(k KeyType, n int) { loaded[k] += n },
+		OnCacheFree: func(k KeyType, n int) { freed[k] += n },
+	}})
+	db.Get(1)
+	db.Get(1)
+	if len(loaded) != 1 || loaded[1] != 1 {
+		t.Error("Bad OnCacheLoad calls after Get", loaded)
+	}
+	db.DefragCtx(context.Background(), nil)
+	if len(loaded) != 11 {
+		t.Error("Bad OnCacheLoad calls after defrag", loaded)
+	}
+	for k, n := range loaded {
+		if n != int(k) {
+			t.Error("Bad length of loaded record", k, n)
+		}
+	}
+	if len(freed) != 1 || freed[11] != 11 {
+		t.Error("Bad OnCacheFree calls", freed)
+	}
+	db.Close()
+	os.RemoveAll(dbname)
+}
+
+func TestCrop(t *testing.T) {
+	os.RemoveAll(dbname)
+	db, _ := NewDB(dbname, false)
+	for i := 0; i < 1000; i++ {
+		db.Put(KeyType(i), make([]byte, 100))
+	}
+	db.Close()
+
+	db, _ = NewDB(dbname, false)
+	m0 := db.MemoryUsed()
+	db.Browse(func(k KeyType, v []byte) uint32 {
+		return 0
+	})
+	m1 := db.MemoryUsed()
+	if m1 < m0+100*1000 {
+		t.Error("Browsed records not counted", m0, m1)
+	}
+	for i := 0; i < 900; i++ {
+		db.Del(KeyType(i))
+	}
+	db.Put(2000, []byte("pending"))
+	db.Crop()
+	if m2 := db.MemoryUsed(); m2 >= m0 {
+		t.Error("Memory not released", m0, m1, m2)
+	}
+	if len(db.Get(950)) != 100 || string(db.Get(2000)) != "pending" || db.Count() != 101 {
+		t.Error("Bad records after Crop")
+	}
+	db.Close()
+	db.Crop()
+	if db.MemoryUsed() != 0 {
+		t.Error("Memory used by closed database")
+	}
+	os.RemoveAll(dbname)
+}
+
+func TestBloomFilter(t *testing.T) {
+	os.RemoveAll(dbname)
+	var db *DB
+	opts := &NewDBOpts{Dir: dbname, ExtraOpts: &ExtraOpts{UseBloomFilter: true}}
+	NewDBExt(&db, opts)
+	ba := db.Batch()
+	var dels []KeyType
+	for i := 0; i < 3000; i++ { // more than the initial filter has been sized for
+		ba.Put(KeyType(i), []byte{byte(i)})
+		if i%2 == 0 {
+			dels = append(dels, KeyType(i))
+		}
+	}
+	ba.Commit()
+	db.DelMany(dels)
+	s0, _ := db.BloomStats()
+	for i := 0; i < 3000; i++ {
+		if v := db.Get(KeyType(i)); (v != nil) != (i%2 == 1) {
+			t.Fatal("Bad record", i, v)
+		}
+	}
+	s, ok := db.BloomStats()
+	if !ok || s.Keys != 1500 || s.Lookups-s0.Lookups != 3000 || s.Negatives-s0.Negatives+s.FalsePositives-s0.FalsePositives != 1500 {
+		t.Error("Bad BloomStats", s0, s)
+	}
+	if s.FalsePositives-s0.FalsePositives > 100 || s.ExpectedFPRate <= 0 || s.ExpectedFPRate > 0.01 {
+		t.Error("Too many false positives", s)
+	}
+	db.Close()
+
+	// rebuilt on load
+	NewDBExt(&db, opts)
+	if s, ok = db.BloomStats(); !ok || s.Keys != 1500 || s.Lookups != 0 {
+		t.Error("Bad BloomStats after load", s)
+	}
+	if db.Get(1) == nil || db.Get(2) != nil {
+		t.Error("Bad records after load")
+	}
+	db.ReplaceAll(map[KeyType][]byte{5000: []byte("new")})
+	if s, _ = db.BloomStats(); s.Keys != 1 || db.Get(1) != nil || string(db.Get(5000)) != "new" {
+		t.Error("Bad filter after ReplaceAll", s)
+	}
+	db.Close()
+
+	if _, ok = db.BloomStats(); ok {
+		t.Error("BloomStats of closed database")
+	}
+	db, _ = NewDB(dbname, true)
+	if _, ok = db.BloomStats(); ok {
+		t.Error("BloomStats without UseBloomFilter")
+	}
+	db.Close()
+	os.RemoveAll(dbname)
+}
+
+func TestRawKeys(t *testing.T) {
+	os.RemoveAll(dbname)
+	db, _ := NewDB(dbname, false)
+	var h1, h2 [32]byte
+	h1[31], h2[31] = 1, 2 // same first 8 bytes
+	db.PutRaw(h1[:], []byte("one"))
+	db.PutRaw(h2[:], []byte("two"))
+	if db.Count() != 2 || string(db.GetRaw(h1[:])) != "one" || string(db.GetRaw(h2[:])) != "two" {
+		t.Error("Bad records stored with raw keys")
+	}
+	if KeyFromBytes(h1[:]) != KeyFromBytes(append([]byte{}, h1[:]...)) {
+		t.Error("KeyFromBytes not consistent")
+	}
+	db.DelRaw(h1[:])
+	db.Close()
+
+	db, _ = NewDB(dbname, false)
+	if db.GetRaw(h1[:]) != nil || string(db.Get(KeyFromBytes(h2[:]))) != "two" {
+		t.Error("Bad records after reopening")
+	}
+	db.Close()
+	os.RemoveAll(dbname)
+}
+
+func TestCheck(t *testing.T) {
+	os.RemoveAll(dbname)
+	db, _ := NewDB(dbname, false)
+	for i := 0; i < 100; i++ {
+		db.Put(KeyType(i), make([]byte, 100))
+	}
+	db.Sync()
+	db.WaitIdle()
+	for i := 100; i < 110; i++ {
+		db.Put(KeyType(i), make([]byte, 100))
+	}
+	if p := db.Check(); len(p) != 0 {
+		t.Error("Problems found in a good database", p)
+	}
+	db.DefragCtx(context.Background(), nil)
+	db.Put(200, []byte("pending"))
+	if p := db.Check(); len(p) != 0 {
+		t.Error("Problems found after defrag", p)
+	}
+	db.Close()
+	if p := db.Check(); len(p) != 1 {
+		t.Error("Closed database not reported", p)
+	}
+
+	db, _ = NewDB(dbname, false)
+	if p := db.Check(); len(p) != 0 {
+		t.Error("Problems found after reopening", p)
+	}
+	rec := db.Idx.get(0)
+	rec.DataSeq += 5
+	if p := db.Check(); len(p) != 2 || !strings.Contains(p[0], "above the current one") {
+		t.Error("Record in a future data file not reported", p)
+	}
+	rec.DataSeq -= 5
+	fn := db.seq2fn(rec.DataSeq)
+	// cut the data file at the start of its last record
+	var last KeyType
+	for k, r := range db.Idx.Index {
+		if r.DataSeq == rec.DataSeq && r.datpos > db.Idx.get(last).datpos {
+			last = k
+		}
+	}
+	os.Truncate(fn, int64(db.Idx.get(last).datpos))
+	if p := db.Check(); len(p) != 1 || !strings.HasPrefix(p[0], fmt.Sprintf("%016x: ", uint64(last))) ||
+		!strings.Contains(p[0], "beyond the end") {
+		t.Error("Truncated data file not reported", last, p)
+	}
+	os.Remove(fn)
+	if p := db.Check(); len(p) != 1 || !strings.Contains(p[0], "missing (111 records)") {
+		t.Error("Missing data file not reported", p)
+	}
+	if db.Count() != 111 {
+		t.Error("Check modified the database", db.Count())
+	}
+	db.Close()
+	os.RemoveAll(dbname)
+}
+
+func TestMaxRecordLen(t *testing.T) {
+	var db *DB
+	os.RemoveAll(dbname)
+	NewDBExt(&db, &NewDBOpts{Dir: dbname, ExtraOpts: &ExtraOpts{MaxRecordLen: 100}})
+	if e := db.Put(1, make([]byte, 100)); e != nil {
+		t.Fatal("Record at the limit rejected", e)
+	}
+	if e := db.Put(1, make([]byte, 101)); e != ErrTooLong {
+		t.Error("Record over the limit not rejected", e)
+	}
+	if e := db.Put(2, make([]byte, 101)); e != ErrTooLong {
+		t.Error("Record over the limit not rejected", e)
+	}
+	if db.PutIf(2, make([]byte, 101), func([]byte, bool) bool { return true }) {
+		t.Error("PutIf stored a record over the limit")
+	}
+	b := db.Batch()
+	if b.Put(3, make([]byte, 101)) != ErrTooLong || b.Len() != 0 {
+		t.Error("Record over the limit added to a batch")
+	}
+	if db.ReplaceAll(map[KeyType][]byte{4: make([]byte, 101)}) != ErrTooLong {
+		t.Error("ReplaceAll accepted a record over the limit")
+	}
+	db.Close()
+
+	db, _ = NewDB(dbname, true)
+	if db.Count() != 1 || len(db.Get(1)) != 100 {
+		t.Error("Store changed by a rejected record", db.Count(), len(db.Get(1)))
+	}
+	db.Close()
+	os.RemoveAll(dbname)
+}
+
+func TestSnapshot(t *testing.T) {
+	var db *DB
+	os.RemoveAll(dbname)
+	NewDBExt(&db, &NewDBOpts{Dir: dbname, ExtraOpts: &ExtraOpts{VerifyChecksums: true,
+		DefragPercentVal: DefaultDefragPercentVal, ForcedDefragPerc: DefaultForcedDefragPerc,
+		MaxPending: DefaultMaxPending, MaxPendingNoSync: DefaultMaxPendingNoSync}})
+	for i := 0; i < 1000; i++ {
+		db.Put(KeyType(i), []byte(fmt.Sprintf("rec%d", i)))
+	}
+	db.Sync()
+	db.WaitIdle()
+	db.Put(1000, []byte("pending")) // not on disk yet
+
+	s := db.Snapshot()
+	defer s.Release()
+
+	// writers are not blocked by the snapshot
+	for i := 0; i < 1000; i += 2 {
+		db.Put(KeyType(i), []byte("changed"))
+	}
+	for i := 1; i < 1000; i += 2 {
+		db.Del(KeyType(i))
+	}
+	db.Put(1001, []byte("new"))
+	db.DefragCtx(context.Background(), nil) // removes the data files used by the snapshot
+
+	if s.Count() != 1001 {
+		t.Error("Bad snapshot count", s.Count())
+	}
+	if string(s.Get(1000)) != "pending" || s.Get(1001) != nil {
+		t.Error("Bad snapshot records", string(s.Get(1000)), s.Get(1001))
+	}
+	var n int
+	s.Browse(func(k KeyType, v []byte) uint32 {
+		if k < 1000 && string(v) != fmt.Sprintf("rec%d", k) {
+			t.Error("Bad snapshot record", k, string(v))
+		}
+		n++
+		return 0
+	})
+	if n != 1001 {
+		t.Error("Bad number of browsed records", n)
+	}
+	if db.Count() != 502 || string(db.Get(0)) != "changed" || db.Get(1) != nil {
+		t.Error("Bad database content", db.Count(), string(db.Get(0)))
+	}
+	db.Close()
+	os.RemoveAll(dbname)
+}
+
+func TestIterator(t *testing.T) {
+	os.RemoveAll(dbname)
+	db, _ := NewDB(dbname, false)
+	for i := 0; i < 500; i++ {
+		db.Put(KeyType(i), []byte(fmt.Sprintf("rec%d", i)))
+	}
+	db.Sync()
+	db.Put(500, []byte("pending"))
+	db.PutExt(501, []byte("hidden"), NoBrowse)
+	db.Del(7)
+
+	browsed := make(map[KeyType]string)
+	db.Browse(func(k KeyType, v []byte) uint32 {
+		browsed[k] = string(v)
+		return 0
+	})
+
+	it := db.NewIterator()
+	db.Del(8) // deleted records are skipped
+	db.Put(502, []byte("new"))
+	iterated := make(map[KeyType]string)
+	for it.Next() {
+		db.Put(503, []byte("write")) // the database is not locked between the calls
+		iterated[it.Key()] = string(it.Value())
+	}
+	delete(browsed, 8)
+	if len(iterated) != len(browsed) || len(iterated) != 499 {
+		t.Error("Bad number of iterated records", len(iterated), len(browsed))
+	}
+	for k, v := range browsed {
+		if iterated[k] != v {
+			t.Error("Bad iterated record", k, iterated[k], v)
+		}
+	}
+	if it.Next() || it.Value() != nil {
+		t.Error("Next after the end")
+	}
+
+	it = db.NewIterator()
+	if !it.Next() {
+		t.Error("Next fails")
+	}
+	it.Close()
+	if it.Next() {
+		t.Error("Next after Close")
+	}
+
+	// the records with NoCache flag do not stay in memory after iterating
+	for i := 600; i < 700; i++ {
+		db.PutExt(KeyType(i), []byte(fmt.Sprintf("rec%d", i)), NoCache)
+	}
+	db.Sync()
+	db.WaitIdle()
+	iterated = make(map[KeyType]string)
+	for it = db.NewIterator(); it.Next(); {
+		iterated[it.Key()] = string(it.Value())
+	}
+	for i := 600; i < 700; i++ {
+		if iterated[KeyType(i)] != fmt.Sprintf("rec%d", i) {
+			t.Error("Bad iterated record", i, iterated[KeyType(i)])
+		}
+		if db.Idx.get(KeyType(i)).data != nil {
+			t.Error("Record left in memory by the iterator", i)
+			break
+		}
+	}
+	db.Close()
+	os.RemoveAll(dbname)
+}
+
+func TestDelMany(t *testing.T) {
+	os.RemoveAll(dbname)
+	db, _ := NewDB(dbname, false)
+	for i := 0; i < 100; i++ {
+		db.Put(KeyType(i), []byte{byte(i)})
+	}
+	db.Put(0xFFFFFFFFFFFFFFFF, []byte{0xff})
+	db.DelMany([]KeyType{1, 3, 5, 200})
+	var browsed int
+	db.BrowseRange(10, 20, func(k KeyType, v []byte) uint32 {
+		browsed++
+		return 0
+	})
+	if cnt := db.DelRange(10, 20); cnt != 11 || cnt != browsed {
+		t.Error("Bad number of records deleted by DelRange", cnt, browsed)
+	}
+	if cnt := db.DelRange(5, 12); cnt != 4 {
+		t.Error("DelRange counts deleted records", cnt)
+	}
+	if cnt := db.DelRange(0xFFFFFFFFFFFFFF00, 0xFFFFFFFFFFFFFFFF); cnt != 1 {
+		t.Error("Record with the highest key not deleted by DelRange", cnt)
+	}
+	db.Close()
+
+	db, _ = NewDB(dbname, false)
+	if db.Count() != 82 {
+		t.Error("Bad number of records", db.Count())
+	}
+	for _, k := range []KeyType{1, 3, 5, 6, 9, 10, 19, 20, 0xFFFFFFFFFFFFFFFF} {
+		if db.Get(k) != nil {
+			t.Error("Record not deleted", k)
+		}
+	}
+	for _, k := range []KeyType{0, 2, 4, 21, 99} {
+		if v := db.Get(k); len(v) != 1 || v[0] != byte(k) {
+			t.Error("Record deleted", k)
+		}
+	}
+	db.Close()
+	os.RemoveAll(dbname)
+}
+
+func TestContentHash(t *testing.T) {
+	var db1, db2 *DB
+	os.RemoveAll(dbname)
+	os.RemoveAll(dbname + "2")
+	NewDBExt(&db1, &NewDBOpts{Dir: dbname})
+	NewDBExt(&db2, &NewDBOpts{Dir: dbname + "2"})
+	if db1.ContentHash() != db2.ContentHash() {
+		t.Error("Empty databases hash differently")
+	}
+	for i := 0; i < 1000; i++ {
+		db1.Put(KeyType(i), []byte(fmt.Sprintf("rec%d", i)))
+		db2.Put(KeyType(999-i), []byte(fmt.Sprintf("rec%d", 999-i)))
+	}
+	db2.Put(1000, []byte("extra"))
+	db2.Del(1000)
+	h := db1.ContentHash()
+	if h != db2.ContentHash() {
+		t.Error("Same records hash differently")
+	}
+	db2.Put(500, []byte("rec500 "))
+	if h == db2.ContentHash() {
+		t.Error("Different records hash the same")
+	}
+	db2.Put(500, []byte("rec500"))
+	db2.Close()
+	NewDBExt(&db2, &NewDBOpts{Dir: dbname + "2"})
+	if h != db2.ContentHash() {
+		t.Error("Hash changed after reopening")
+	}
+	db1.Close()
+	db2.Close()
+	os.RemoveAll(dbname)
+	os.RemoveAll(dbname + "2")
+}
+
+func TestConcurrentReads(t *testing.T) {
+	os.RemoveAll(dbname)
+	db, _ := NewDB(dbname, false)
+	for i := 0; i < 1000; i++ {
+		db.Put(KeyType(i), []byte(fmt.Sprintf("rec%d", i)))
+	}
+	db.Close()
+	db, _ = NewDB(dbname, false) // nothing loaded yet
+
+	// a reader does not wait for another one to finish browsing
+	got := make(chan bool)
+	db.Browse(func(k KeyType, v []byte) uint32 {
+		go func() {
+			got <- string(db.Get(k)) == string(v) && db.Count() == 1000
+		}()
+		select {
+		case ok := <-got:
+			if !ok {
+				t.Error("Bad record read during browsing")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Reader blocked by browsing")
+		}
+		return BrAbort
+	})
+
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for n := 0; n < 5; n++ {
+				db.Browse(func(k KeyType, v []byte) uint32 {
+					if k < 1000 && string(v) != fmt.Sprintf("rec%d", k) {
+						t.Error("Bad record browsed", k, string(v))
+					}
+					if k%7 == KeyType(r) {
+						return NoCache
+					}
+					return 0
+				})
+				for i := 0; i < 1000; i += 10 {
+					if v := db.Get(KeyType(i)); string(v) != fmt.Sprintf("rec%d", i) {
+						t.Error("Bad record", i, string(v))
+					}
+				}
+			}
+		}(r)
+	}
+	for i := 1000; i < 2000; i++ {
+		db.Put(KeyType(i), []byte("new"))
+	}
+	wg.Wait()
+	db.Close()
+	os.RemoveAll(dbname)
+}
+
+func TestGetMany(t *testing.T) {
+	os.RemoveAll(dbname)
+	db, _ := NewDB(dbname, false)
+	for i := 0; i < 100; i++ {
+		db.Put(KeyType(i), []byte(fmt.Sprintf("rec%d", i)))
+	}
+	db.Put(100, []byte{})
+	db.Close()
+
+	db, _ = NewDB(dbname, false)
+	res := db.GetMany([]KeyType{5, 1000, 99, 100, 5})
+	if len(res) != 5 || string(res[0]) != "rec5" || res[1] != nil || string(res[2]) != "rec99" ||
+		res[3] == nil || len(res[3]) != 0 || string(res[4]) != "rec5" {
+		t.Error("Bad values", res)
+	}
+	if db.Idx.Index[99].data == nil {
+		t.Error("Value given out not kept in cache")
+	}
+	if len(db.GetMany(nil)) != 0 {
+		t.Error("Values returned for no keys")
+	}
+	db.Close()
+	os.RemoveAll(dbname)
+}
+
+func TestCompression(t *testing.T) {
+	var db *DB
+	os.RemoveAll(dbname)
+	val := func(i int) []byte {
+		return []byte(fmt.Sprintf(`{"id":%d,"name":"record number %d","desc":"%s"}`, i, i,
+			bytes.Repeat([]byte("lorem ipsum "), 20)))
+	}
+	check := func(when string) {
+		for i := 0; i < 1000; i++ {
+			if v := db.Get(KeyType(i)); !bytes.Equal(v, val(i)) {
+				t.Fatal("Bad record", when, i, string(v))
+			}
+		}
+		var n int
+		db.Browse(func(k KeyType, v []byte) uint32 {
+			if !bytes.Equal(v, val(int(k))) {
+				t.Error("Bad record browsed", when, k, string(v))
+			}
+			n++
+			return 0
+		})
+		if v, ok := db.GetRange(7, 2, 6); !ok || string(v) != `id":7,` {
+			t.Error("Bad range", when, string(v))
+		}
+		if v, ok := db.GetRange(700, 2, 8); !ok || string(v) != `id":700,` {
+			t.Error("Bad range", when, string(v))
+		}
+		if n != 1000 {
+			t.Error("Bad number of records", when, n)
+		}
+	}
+	datsize := func() (res int64) {
+		fis, _ := ioutil.ReadDir(dbname)
+		for _, fi := range fis {
+			if filepath.Ext(fi.Name()) == ".dat" {
+				res += fi.Size()
+			}
+		}
+		return
+	}
+
+	// start without compression
+	NewDBExt(&db, &NewDBOpts{Dir: dbname})
+	for i := 0; i < 500; i++ {
+		db.Put(KeyType(i), val(i))
+	}
+	db.Close()
+
+	opts := &NewDBOpts{Dir: dbname, ExtraOpts: &ExtraOpts{Compression: CompressZstd,
+		DefragPercentVal: DefaultDefragPercentVal, ForcedDefragPerc: DefaultForcedDefragPerc,
+		MaxPending: DefaultMaxPending, MaxPendingNoSync: DefaultMaxPendingNoSync}}
+	NewDBExt(&db, opts)
+	for i := 500; i < 1000; i++ {
+		db.Put(KeyType(i), val(i))
+	}
+	check("mixed")
+	s := db.Snapshot()
+	if v := s.Get(999); !bytes.Equal(v, val(999)) {
+		t.Error("Bad snapshot record", string(v))
+	}
+	s.Release()
+	db.Close()
+	mixed := datsize()
+
+	// the full defrag compresses all the old records
+	NewDBExt(&db, opts)
+	check("reopened")
+	db.DefragCtx(context.Background(), nil)
+	check("defragmented")
+	for k, rec := range db.Idx.Index {
+		if rec.codec() != CompressZstd {
+			t.Error("Record not re-compressed", k)
+		}
+	}
+	db.Close()
+	if compressed := datsize(); compressed >= mixed {
+		t.Error("Data not compressed", compressed, mixed)
+	}
+
+	// and back
+	NewDBExt(&db, &NewDBOpts{Dir: dbname})
+	check("without compression")
+	db.DefragCtx(context.Background(), nil)
+	check("decompressed")
+	for k, rec := range db.Idx.Index {
+		if rec.codec() != CompressNone {
+			t.Error("Record not decompressed", k)
+		}
+	}
+	db.Close()
+	os.RemoveAll(dbname)
+}
+
+func TestEncryption(t *testing.T) {
+	var db *DB
+	os.RemoveAll(dbname)
+	key := bytes.Repeat([]byte{0x5a}, 32)
+	val := func(i int) []byte {
+		return []byte(fmt.Sprintf("secret record %d %s", i, bytes.Repeat([]byte("x"), 100+i%50)))
+	}
+	check := func(when string) {
+		for i := 0; i < 1000; i++ {
+			if v := db.Get(KeyType(i)); !bytes.Equal(v, val(i)) {
+				t.Fatal("Bad record", when, i, string(v))
+			}
+		}
+		if v, ok := db.GetRange(77, 7, 6); !ok || string(v) != "record" {
+			t.Error("Bad range", when, string(v))
+		}
+		if n := db.Count(); n != 1000 {
+			t.Error("Bad number of records", when, n)
+		}
+	}
+	opts := func(key []byte, c byte) *NewDBOpts {
+		return &NewDBOpts{Dir: dbname, LoadData: true, ExtraOpts: &ExtraOpts{EncryptionKey: key,
+			Compression: c, VerifyChecksums: true,
+			DefragPercentVal: DefaultDefragPercentVal, ForcedDefragPerc: DefaultForcedDefragPerc,
+			MaxPending: DefaultMaxPending, MaxPendingNoSync: DefaultMaxPendingNoSync}}
+	}
+
+	if e := NewDBExt(&db, opts(key[:16], CompressNone)); e == nil {
+		t.Fatal("16 bytes key accepted")
+	}
+	if e := NewDBExt(&db, opts(key, CompressNone)); e != nil {
+		t.Fatal(e)
+	}
+	for i := 0; i < 1000; i++ {
+		db.Put(KeyType(i), val(i))
+	}
+	check("new")
+	s := db.Snapshot()
+	db.Close()
+	if v := s.Get(999); !bytes.Equal(v, val(999)) {
+		t.Error("Bad snapshot record", string(v))
+	}
+	s.Release()
+
+	// the values must not be found in the files
+	fis, _ := ioutil.ReadDir(dbname)
+	for _, fi := range fis {
+		if d, _ := ioutil.ReadFile(filepath.Join(dbname, fi.Name())); bytes.Contains(d, []byte("secret")) {
+			t.Error("Plaintext found in", fi.Name())
+		}
+	}
+
+	if e := NewDBExt(&db, opts(nil, CompressNone)); e != ErrNoKey {
+		t.Fatal("Opened without the key", e)
+	}
+	bad := append([]byte{}, key...)
+	bad[31]++
+	if e := NewDBExt(&db, opts(bad, CompressNone)); e != ErrBadKey {
+		t.Fatal("Opened with a wrong key", e)
+	}
+
+	// the full defrag re-compresses the records, which must stay encrypted
+	if e := NewDBExt(&db, opts(key, CompressGzip)); e != nil {
+		t.Fatal(e)
+	}
+	check("reopened")
+	db.DefragCtx(context.Background(), nil)
+	check("defragmented")
+	for k, rec := range db.Idx.Index {
+		if rec.codec() != CompressGzip {
+			t.Error("Record not re-compressed", k)
+		}
+	}
+
+	// the backup is encrypted just the same
+	os.RemoveAll(dbname + "bk")
+	if e := db.Backup(dbname + "bk"); e != nil {
+		t.Fatal(e)
+	}
+	var bk *DB
+	if e := NewDBExt(&bk, &NewDBOpts{Dir: dbname + "bk"}); e != ErrNoKey {
+		t.Error("Backup opened without the key", e)
+	}
+	if e := NewDBExt(&bk, &NewDBOpts{Dir: dbname + "bk", ExtraOpts: &ExtraOpts{EncryptionKey: key}}); e != nil {
+		t.Fatal(e)
+	}
+	if v := bk.Get(123); !bytes.Equal(v, val(123)) {
+		t.Error("Bad backup record", string(v))
+	}
+	bk.Close()
+	os.RemoveAll(dbname + "bk")
+
+	// the archive is not encrypted
+	buf := new(bytes.Buffer)
+	if _, e := db.WriteTo(buf); e != nil {
+		t.Fatal(e)
+	}
+	db.Close()
+	os.RemoveAll(dbname)
+	var e error
+	if db, e = ReadFrom(dbname, buf); e != nil {
+		t.Fatal(e)
+	}
+	check("restored")
+	db.Close()
+
+	// and the encryption cannot be enabled for an existing database
+	if e := NewDBExt(&db, opts(key, CompressNone)); e == nil {
+		t.Error("Encryption enabled for an unencrypted database")
+	}
+	os.RemoveAll(dbname)
+}
+
+func TestBackup(t *testing.T) {
+	var db *DB
+	os.RemoveAll(dbname)
+	os.RemoveAll(dbname + "bk")
+	NewDBExt(&db, &NewDBOpts{Dir: dbname, ExtraOpts: &ExtraOpts{MaxPending: 1000000, MaxPendingNoSync: 1000000,
+		VerifyChecksums: true, Compression: CompressSnappy}})
+	for i := 0; i < 1000; i++ {
+		db.Put(KeyType(i), bytes.Repeat([]byte(fmt.Sprintf("rec%d ", i)), i%7+1))
+	}
+	db.Sync()
+	for i := 0; i < 1000; i += 3 {
+		db.Put(KeyType(i), []byte(fmt.Sprintf("new%d", i))) // pending
+	}
+	for i := 1; i < 1000; i += 10 {
+		db.Del(KeyType(i))
+	}
+	files := func(dir string) (res []string) {
+		fis, _ := ioutil.ReadDir(dir)
+		for _, fi := range fis {
+			res = append(res, fmt.Sprint(fi.Name(), fi.Size()))
+		}
+		return
+	}
+	before, seq := files(dbname), db.DataSeq
+
+	if e := db.Backup(dbname + "bk"); e != nil {
+		t.Fatal(e)
+	}
+	if !reflect.DeepEqual(before, files(dbname)) || seq != db.DataSeq {
+		t.Error("Backup modified the source database")
+	}
+	if e := db.Backup(dbname + "bk"); e == nil {
+		t.Error("Backup overwrote an existing database")
+	}
+
+	bk, e := NewDB(dbname+"bk", true)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if bk.Count() != db.Count() || bk.ContentHash() != db.ContentHash() {
+		t.Error("Backup has different records", bk.Count(), db.Count())
+	}
+	db.BrowseAll(func(k KeyType, v []byte) uint32 {
+		if !bytes.Equal(bk.Get(k), v) {
+			t.Error("Bad record in backup", k)
+		}
+		return 0
+	})
+	if !bk.O.VerifyChecksums {
+		t.Error("Backup's manifest lost VerifyChecksums")
+	}
+	bk.Close()
+	db.Close()
+	os.RemoveAll(dbname)
+	os.RemoveAll(dbname + "bk")
+}
+
+func TestExpiry(t *testing.T) {
+	var db *DB
+	os.RemoveAll(dbname)
+	NewDBExt(&db, &NewDBOpts{Dir: dbname})
+	if db.PutTTL(1, []byte("x"), 1) == nil {
+		t.Error("PutTTL worked without Expiry option")
+	}
+	db.Close()
+	NewDBExt(&db, &NewDBOpts{Dir: dbname, ExtraOpts: &ExtraOpts{Expiry: true}})
+	db.Close()
+
+	now := uint32(time.Now().Unix())
+	check := func(when string) {
+		for i := 0; i < 100; i++ {
+			v := db.Get(KeyType(i))
+			if (i%3 == 1) != (v == nil) {
+				t.Error(when, "- bad record", i, v)
+			}
+		}
+		var n int
+		db.Browse(func(k KeyType, v []byte) uint32 {
+			if k%3 == 1 {
+				t.Error(when, "- expired record browsed", k)
+			}
+			n++
+			return 0
+		})
+		if n != 67 {
+			t.Error(when, "- browsed", n)
+		}
+		if db.ExpiresAt(2) != now+3600 || db.ExpiresAt(0) != 0 {
+			t.Error(when, "- expiry time lost")
+		}
+	}
+
+	NewDBExt(&db, &NewDBOpts{Dir: dbname}) // the option is in the manifest now
+	for i := 0; i < 100; i++ {
+		switch i % 3 {
+		case 0:
+			db.Put(KeyType(i), []byte(fmt.Sprint("rec", i)))
+		case 1:
+			db.PutTTL(KeyType(i), []byte(fmt.Sprint("exp", i)), now-10)
+		case 2:
+			db.PutTTL(KeyType(i), []byte(fmt.Sprint("ttl", i)), now+3600)
+		}
+	}
+	db.PutTTL(99, []byte("exp"), now-10)
+	db.Put(99, []byte("rec99")) // overwriting clears the expiry time
+	check("memory")
+	db.Close()
+	NewDBExt(&db, &NewDBOpts{Dir: dbname})
+	check("log")
+	db.Defrag(true)
+	db.Close()
+	NewDBExt(&db, &NewDBOpts{Dir: dbname})
+	check("snapshot")
+
+	if n := db.PurgeExpired(); n != 33 {
+		t.Error("PurgeExpired", n)
+	}
+	if db.Count() != 67 || db.PurgeExpired() != 0 {
+		t.Error("Bad count after purge", db.Count())
+	}
+	db.Close()
+	NewDBExt(&db, &NewDBOpts{Dir: dbname})
+	check("purged")
+	if db.Count() != 67 {
+		t.Error("Bad count after reopening", db.Count())
+	}
+	db.Close()
+	os.RemoveAll(dbname)
+}
+
+func TestCloseTwice(t *testing.T) {
+	os.RemoveAll(dbname)
+	db, _ := NewDB(dbname, false)
+	db.Put(1, []byte("one"))
+	db.Close()
+	db.Close()
+
+	if db.Get(1) != nil || db.Count() != 0 {
+		t.Error("Record found after Close")
+	}
+	if _, ok := db.GetOk(1); ok {
+		t.Error("GetOk found a record after Close")
+	}
+	db.Browse(func(k KeyType, v []byte) uint32 {
+		t.Error("Browsing after Close")
+		return 0
+	})
+	if db.Put(2, []byte("two")) != ErrClosed || db.PutSync(2, []byte("two")) != ErrClosed {
+		t.Error("Put did not return ErrClosed")
+	}
+	b := db.Batch()
+	b.Put(3, []byte("three"))
+	if b.Commit() != ErrClosed || db.Backup(dbname+"bk") != ErrClosed {
+		t.Error("Commit/Backup did not return ErrClosed")
+	}
+	db.Del(1)
+	db.Sync()
+	db.Defrag(true)
+	db.Flush()
+	if s := db.Snapshot(); s.Count() != 0 {
+		t.Error("Snapshot not empty after Close")
+	}
+
+	db, _ = NewDB(dbname, false)
+	if string(db.Get(1)) != "one" || db.Count() != 1 {
+		t.Error("Record lost after closing twice")
+	}
+	db.Close()
+	os.RemoveAll(dbname)
+}
+
+func TestSyncInterval(t *testing.T) {
+	var db *DB
+	os.RemoveAll(dbname)
+	ngr := runtime.NumGoroutine()
+	NewDBExt(&db, &NewDBOpts{Dir: dbname, ExtraOpts: &ExtraOpts{MaxPending: 1000, MaxPendingNoSync: 1000,
+		SyncInterval: 20 * time.Millisecond}})
+	db.Put(1, []byte("one"))
+	pending := func() int {
+		db.Mutex.Lock()
+		defer db.Mutex.Unlock()
+		return len(db.PendingRecords)
+	}
+	for i := 0; i < 100 && pending() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if pending() != 0 {
+		t.Error("Pending record not written")
+	}
+	var ro *DB
+	NewDBExt(&ro, &NewDBOpts{Dir: dbname, ReadOnly: true})
+	if ro == nil || string(ro.Get(1)) != "one" {
+		t.Error("Record not on disk")
+	}
+	if ro != nil {
+		ro.Close()
+	}
+
+	db.NoSync()
+	db.Put(2, []byte("two"))
+	time.Sleep(100 * time.Millisecond)
+	if pending() != 1 {
+		t.Error("Periodic sync in NoSync mode")
+	}
+	db.Close()
+	db.Close()
+	if n := runtime.NumGoroutine(); n > ngr {
+		t.Error("Goroutine left running", n, ngr)
+	}
+	db, _ = NewDB(dbname, false)
+	if string(db.Get(2)) != "two" {
+		t.Error("Record lost on Close")
+	}
+	db.Close()
+	os.RemoveAll(dbname)
+}
+
+func TestRepairOnLoad(t *testing.T) {
+	var msgs []string
+	defer func(l func(string, ...interface{})) { Logger = l }(Logger)
+	Logger = func(format string, args ...interface{}) {
+		msgs = append(msgs, fmt.Sprintf(format, args...))
+	}
+
+	os.RemoveAll(dbname)
+	db, _ := NewDB(dbname, false)
+	db.Defrag(true)
+	for i := 0; i < 100; i++ {
+		db.Put(KeyType(i), []byte(fmt.Sprint("rec", i)))
+	}
+	db.Close()
+	logfn := filepath.Join(dbname, "qdbidx.log")
+	fi, _ := os.Stat(logfn)
+	size := fi.Size()
+
+	// half of an entry, as if the process got killed while writing it
+	f, _ := os.OpenFile(logfn, os.O_WRONLY|os.O_APPEND, 0600)
+	f.Write([]byte{1, 2, 3, 4, 5, 6, 7, 8, 1, 0, 0, 0, 5, 0})
+	f.Close()
+
+	check := func(when string) {
+		if db.Count() != 100 {
+			t.Error(when, "- bad count", db.Count())
+		}
+		for i := 0; i < 100; i++ {
+			if string(db.Get(KeyType(i))) != fmt.Sprint("rec", i) {
+				t.Error(when, "- bad record", i)
+			}
+		}
+	}
+
+	db, _ = NewDB(dbname, false)
+	check("not repaired")
+	db.Close()
+	if fi, _ = os.Stat(logfn); fi.Size() != size+14 {
+		t.Error("Log modified without RepairOnLoad")
+	}
+	if len(msgs) == 0 {
+		t.Error("Incomplete entry not reported")
+	}
+
+	// the first write drops the incomplete entry anyway, so the new one is not lost
+	db, _ = NewDB(dbname, false)
+	db.Put(100, []byte("rec100"))
+	db.Close()
+	db, _ = NewDB(dbname, false)
+	if db.Count() != 101 || string(db.Get(100)) != "rec100" {
+		t.Error("Log broken after write without RepairOnLoad", db.Count(), string(db.Get(100)))
+	}
+	db.Del(100)
+	db.Close()
+
+	// again, to check the repair
+	f, _ = os.OpenFile(logfn, os.O_WRONLY|os.O_APPEND, 0600)
+	f.Write([]byte{1, 2, 3, 4, 5, 6, 7, 8, 1, 0, 0, 0, 5, 0})
+	f.Close()
+	fi, _ = os.Stat(logfn)
+	size = fi.Size() - 14
+
+	msgs = nil
+	NewDBExt(&db, &NewDBOpts{Dir: dbname, RepairOnLoad: true})
+	check("repaired")
+	if fi, _ = os.Stat(logfn); fi.Size() != size {
+		t.Error("Log not truncated", fi.Size(), size)
+	}
+	if len(msgs) == 0 {
+		t.Error("Repair not reported")
+	}
+	db.Put(100, []byte("rec100"))
+	db.Close()
+
+	msgs = nil
+	db, _ = NewDB(dbname, false)
+	if db.Count() != 101 || string(db.Get(100)) != "rec100" || len(msgs) != 0 {
+		t.Error("Log broken after repair", db.Count(), msgs)
+	}
+	db.Close()
+	os.RemoveAll(dbname)
+}
+
+const benchRecs = 50000
+
+func BenchmarkPuts(b *testing.B) {
+	val := make([]byte, 100)
+	for n := 0; n < b.N; n++ {
+		os.RemoveAll(dbname)
+		db, _ := NewDB(dbname, true)
+		for i := 0; i < benchRecs; i++ {
+			db.Put(KeyType(i), val)
+		}
+		db.Close()
+	}
+	os.RemoveAll(dbname)
+}
+
+func BenchmarkBatch(b *testing.B) {
+	val := make([]byte, 100)
+	for n := 0; n < b.N; n++ {
+		os.RemoveAll(dbname)
+		db, _ := NewDB(dbname, true)
+		ba := db.Batch()
+		for i := 0; i < benchRecs; i++ {
+			ba.Put(KeyType(i), val)
+		}
+		ba.Commit()
+		db.Close()
+	}
+	os.RemoveAll(dbname)
+}
+
+const benchDels = 10000
+
+func benchDelDB(b *testing.B) *DB {
+	b.StopTimer()
+	os.RemoveAll(dbname)
+	db, _ := NewDB(dbname, true)
+	val := make([]byte, 100)
+	ba := db.Batch()
+	for i := 0; i < benchDels; i++ {
+		ba.Put(KeyType(i), val)
+	}
+	ba.Commit()
+	b.StartTimer()
+	return db
+}
+
+func BenchmarkDels(b *testing.B) {
+	for n := 0; n < b.N; n++ {
+		db := benchDelDB(b)
+		for i := 0; i < benchDels; i++ {
+			db.Del(KeyType(i))
+		}
+		db.Sync()
+		db.WaitIdle()
+		b.StopTimer()
+		db.Close()
+	}
+	os.RemoveAll(dbname)
+}
+
+func BenchmarkDelMany(b *testing.B) {
+	keys := make([]KeyType, benchDels)
+	for i := range keys {
+		keys[i] = KeyType(i)
+	}
+	for n := 0; n < b.N; n++ {
+		db := benchDelDB(b)
+		db.DelMany(keys)
+		db.Sync()
+		db.WaitIdle()
+		b.StopTimer()
+		db.Close()
+	}
+	os.RemoveAll(dbname)
+}
+
+func benchGetDB(b *testing.B) (db *DB, keys []KeyType) {
+	os.RemoveAll(dbname)
+	db, _ = NewDB(dbname, true)
+	keys = make([]KeyType, 1000)
+	for i := range keys {
+		keys[i] = KeyType(i * 7)
+		db.Put(keys[i], make([]byte, 100))
+	}
+	b.ResetTimer()
+	return
+}
+
+func BenchmarkGets(b *testing.B) {
+	db, keys := benchGetDB(b)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			for _, k := range keys {
+				db.Get(k)
+			}
+		}
+	})
+	db.Close()
+	os.RemoveAll(dbname)
+}
+
+// mostly missing keys, like when checking whether something has been seen before.
+// The index is much bigger than the CPU cache, which is when the filter pays off.
+func benchGetMisses(b *testing.B, bloom bool) {
+	var db *DB
+	NewDBExt(&db, &NewDBOpts{Dir: dbname, MemoryOnly: true, Records: 1000000,
+		ExtraOpts: &ExtraOpts{UseBloomFilter: bloom}})
+	for i := 0; i < 1000000; i++ {
+		db.Put(KeyType(i), nil)
+	}
+	b.ResetTimer()
+	k := uint64(1)
+	for n := 0; n < b.N; n++ {
+		if n%100 == 0 {
+			db.Get(KeyType(n % 1000000)) // one hit per 100 lookups
+			continue
+		}
+		k = k*6364136223846793005 + 1442695040888963407 // a random key, not reused
+		db.Get(KeyType(k))
+	}
+	b.StopTimer()
+	db.Close()
+}
+
+func BenchmarkGetMisses(b *testing.B) {
+	benchGetMisses(b, false)
+}
+
+func BenchmarkGetMissesBloom(b *testing.B) {
+	benchGetMisses(b, true)
+}
+
+func BenchmarkGetMany(b *testing.B) {
+	db, keys := benchGetDB(b)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			db.GetMany(keys)
+		}
+	})
+	db.Close()
+	os.RemoveAll(dbname)
+}
+
 func k2s(k KeyType) string {
 	return fmt.Sprintf("%16x", k)
 }
+
+func TestCalibratePending(t *testing.T) {
+	os.RemoveAll(dbname)
+	db, _ := NewDB(dbname, false)
+	for i := 0; i < 100; i++ {
+		db.Put(KeyType(i), []byte(fmt.Sprint("record number ", i)))
+	}
+	// a directory next to the database must not be touched by the probe
+	other := dbname + ".calibrate"
+	os.MkdirAll(other, 0700)
+	ioutil.WriteFile(other+"/keep", []byte("keep"), 0600)
+	defer os.RemoveAll(other)
+
+	if e := db.CalibratePending(200 * time.Millisecond); e != nil {
+		t.Fatal("CalibratePending failed", e)
+	}
+	var known bool
+	for _, mp := range calibratePendingValues {
+		known = known || db.O.MaxPending == mp
+	}
+	if !known || db.O.MaxPendingNoSync != db.O.MaxPending*(DefaultMaxPendingNoSync/DefaultMaxPending) {
+		t.Error("Bad calibrated values", db.O.MaxPending, db.O.MaxPendingNoSync)
+	}
+	if d, _ := ioutil.ReadFile(other + "/keep"); string(d) != "keep" {
+		t.Error("Sibling directory removed by CalibratePending")
+	}
+	if m, _ := filepath.Glob("qdb-calibrate*"); len(m) != 0 {
+		t.Error("Scratch directory not removed", m)
+	}
+	db.Close()
+
+	db, _ = NewDB(dbname, false)
+	if db.Count() != 100 || string(db.Get(7)) != "record number 7" {
+		t.Error("Records modified by CalibratePending", db.Count())
+	}
+	db.Close()
+	os.RemoveAll(dbname)
+}
@@ -0,0 +1,65 @@
+package qdb
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+)
+
+// At-rest encryption (see ExtraOpts.EncryptionKey).
+// Each record's data (compressed first, if it is) is stored as a random nonce, followed by
+// the data sealed with AES-256-GCM. The records are kept that way in memory as well, so the
+// data files, snapshots and backups get them as they are, while the values are only decrypted
+// when being read. The index files, which only have the keys and the records' positions,
+// are not encrypted.
+
+// keyCheck is sealed into the manifest, so a wrong key is detected when opening the database
+const keyCheck = "qdb key check"
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, errors.New("qdb: EncryptionKey must be 32 bytes long")
+	}
+	b, e := aes.NewCipher(key)
+	if e != nil {
+		return nil, e
+	}
+	return cipher.NewGCM(b)
+}
+
+// seal returns the data encrypted with a new random nonce, if the database is encrypted
+func (db *DB) seal(d []byte) []byte {
+	if db.aead == nil {
+		return d
+	}
+	ns := db.aead.NonceSize()
+	res := make([]byte, ns, ns+len(d)+db.aead.Overhead())
+	if _, e := rand.Read(res); e != nil {
+		panic("qdb: cannot generate nonce - " + e.Error())
+	}
+	return db.aead.Seal(res, res[:ns], d, nil)
+}
+
+// unseal returns the data decrypted (or as it is, if aead is nil).
+// Returns false if it cannot be decrypted (wrong key or damaged data).
+func unseal(aead cipher.AEAD, d []byte) ([]byte, bool) {
+	if aead == nil {
+		return d, true
+	}
+	ns := aead.NonceSize()
+	if len(d) < ns+aead.Overhead() {
+		return nil, false
+	}
+	v, e := aead.Open(nil, d[:ns], d[ns:], nil)
+	return v, e == nil
+}
+
+// unpack returns the value of a record stored with the given codec, decrypting it first
+func unpack(aead cipher.AEAD, c byte, d []byte) ([]byte, bool) {
+	d, ok := unseal(aead, d)
+	if !ok {
+		return nil, false
+	}
+	return decode(c, d)
+}
@@ -0,0 +1,93 @@
+package qdb
+
+import (
+	"errors"
+	"time"
+)
+
+// The expiry time of a record (unix time, in seconds) is kept in the index, so the expired
+// records can be found without reading their data. Only the records with hasExpiry flag
+// have it - their entries in the index files (qdbidx.0/1 and the log) are followed
+// by 4 more bytes with the expiry time (LSB).
+// An expired record is treated as absent by Get and Browse functions, but it is still
+// counted (and stored on disk) until PurgeExpired removes it.
+
+// Index.expires maps the keys of the records with hasExpiry flag to their expiry time
+// (it is nil if there are none), so the databases without expiry pay nothing for it.
+
+// PutTTL - Adds or updates record with a given key, which expires at the given unix time.
+// If expiresAt is zero, the record never expires (as if it was stored with Put).
+// This only works if the Expiry option is set.
+func (db *DB) PutTTL(key KeyType, value []byte, expiresAt uint32) error {
+	if expiresAt == 0 {
+		return db.Put(key, value)
+	}
+	if !db.O.Expiry {
+		return errors.New("qdb: Expiry option not set")
+	}
+	if db.rejected() {
+		return ErrReadOnly
+	}
+	if db.toolong(value) {
+		return ErrTooLong
+	}
+	db.Mutex.Lock()
+	defer db.unlock()
+	if db.Idx == nil {
+		return ErrClosed
+	}
+	db.Idx.memput(key, db.newrec(value, hasExpiry))
+	db.Idx.setExpiry(key, expiresAt)
+	db.changed(key)
+	return nil
+}
+
+// ExpiresAt - Returns the expiry time of the record, or zero if it never expires (or does not exist).
+func (db *DB) ExpiresAt(key KeyType) uint32 {
+	db.Mutex.RLock()
+	defer db.Mutex.RUnlock()
+	if db.Idx == nil {
+		return 0
+	}
+	return db.Idx.expires[key]
+}
+
+// PurgeExpired - Deletes all the expired records, returning how many there were.
+// In tombstone mode, they are replaced with tombstones, as if deleted with Del.
+func (db *DB) PurgeExpired() (n int) {
+	if db.rejected() {
+		return
+	}
+	db.Mutex.Lock()
+	defer db.unlock()
+	if db.Idx == nil {
+		return
+	}
+	now := uint32(time.Now().Unix())
+	for k, t := range db.Idx.expires {
+		if t <= now {
+			db.del(k)
+			n++
+		}
+	}
+	cntadd("ExpiredPurged", uint64(n))
+	return
+}
+
+// setExpiry sets the expiry time of a record, that has just been put with hasExpiry flag
+func (idx *Index) setExpiry(k KeyType, t uint32) {
+	if idx.expires == nil {
+		idx.expires = make(map[KeyType]uint32)
+	}
+	idx.expires[k] = t
+}
+
+// absent returns true if the record is deleted, expired, or has any of the given flags.
+// It can be called with the mutex only read-locked.
+func (db *DB) absent(k KeyType, v *oneIdx, mask uint32) bool {
+	fl := db.flags(v)
+	if (fl & (mask | isTombstone)) != 0 {
+		return true
+	}
+	return (fl&hasExpiry) != 0 && db.Idx.expires[k] <= uint32(time.Now().Unix())
+}
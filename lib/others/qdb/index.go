@@ -1,8 +1,12 @@
 package qdb
 
 import (
+	"encoding/binary"
+	"hash/crc32"
 	"io/ioutil"
 	"os"
+	"sort"
+	"sync/atomic"
 )
 
 // Index -
@@ -18,10 +22,42 @@ type Index struct {
 
 	DiskSpaceNeeded uint64
 	ExtraSpaceUsed  uint64
+
+	tombstones int                // number of deleted keys, still kept in the index
+	graves     map[KeyType]uint32 // deletion time of the tombstones (see tombstone.go)
+	nextPurge  uint32
+
+	expires map[KeyType]uint32 // expiry time of the records with hasExpiry flag (see expiry.go)
+
+	bloom *bloomFilter // see ExtraOpts.UseBloomFilter
+
+	selfContained bool // the log file holds the entire index (see ExtraOpts.LogOnly)
+
+	logValid int64 // if not zero, the log has an incomplete entry from this offset, to drop before writing
+
+	// ordered mode only:
+	ordered bool
+	sorted  []KeyType
+	less    func(a, b KeyType) bool
 }
 
 // NewDBidx -
 func NewDBidx(db *DB, recs uint) (idx *Index) {
+	idx = newMemIdx(db, recs)
+	used := make(map[uint32]bool, 10)
+	idx.loaddat(used)
+	idx.loadlog(used)
+	if !db.ReadOnly {
+		if db.O.LogOnly && !idx.selfContained {
+			idx.checkpoint() // get rid of the snapshots, if there are any
+		}
+		idx.db.cleanupold(used)
+	}
+	return
+}
+
+// newMemIdx returns an empty index, not loaded from any files
+func newMemIdx(db *DB, recs uint) (idx *Index) {
 	idx = new(Index)
 	idx.db = db
 	idx.IdxFilePath = db.Dir + "qdbidx."
@@ -30,13 +66,33 @@ func NewDBidx(db *DB, recs uint) (idx *Index) {
 	} else {
 		idx.Index = make(map[KeyType]*oneIdx, recs)
 	}
-	used := make(map[uint32]bool, 10)
-	idx.loaddat(used)
-	idx.loadlog(used)
-	idx.db.cleanupold(used)
 	return
 }
 
+// setOrdered enables the sorted keys (to be called after the index has been loaded)
+func (idx *Index) setOrdered(less func(a, b KeyType) bool) {
+	if less == nil {
+		less = func(a, b KeyType) bool { return a < b }
+	}
+	idx.less = less
+	idx.ordered = true
+	idx.sortKeys()
+}
+
+// sortKeys rebuilds the sorted keys from scratch
+func (idx *Index) sortKeys() {
+	idx.sorted = make([]KeyType, 0, len(idx.Index))
+	for k := range idx.Index {
+		idx.sorted = append(idx.sorted, k)
+	}
+	sort.Slice(idx.sorted, func(i, j int) bool { return idx.less(idx.sorted[i], idx.sorted[j]) })
+}
+
+// search returns position of the first sorted key, that is not less than k
+func (idx *Index) search(k KeyType) int {
+	return sort.Search(len(idx.sorted), func(i int) bool { return !idx.less(idx.sorted[i], k) })
+}
+
 func (idx *Index) load(walk WalkFunction) {
 	dats := make(map[uint32][]byte)
 	idx.browse(func(k KeyType, v *oneIdx) bool {
@@ -45,16 +101,28 @@ func (idx *Index) load(walk WalkFunction) {
 			if dat == nil {
 				dat, _ = ioutil.ReadFile(idx.db.seq2fn(v.DataSeq))
 				if dat == nil {
-					println("Database corrupt - missing file:", idx.db.seq2fn(v.DataSeq))
+					logf("Database corrupt - missing file: %s", idx.db.seq2fn(v.DataSeq))
 					os.Exit(1)
 				}
 				dats[v.DataSeq] = dat
 			}
+			if idx.db.O.VerifyChecksums {
+				crc := dat[v.datpos+v.datlen : v.datpos+v.datlen+4]
+				if binary.LittleEndian.Uint32(crc) != crc32.ChecksumIEEE(dat[v.datpos:v.datpos+v.datlen]) {
+					idx.db.corrupt(k)
+					return true
+				}
+			}
 			v.SetData(dat[v.datpos : v.datpos+v.datlen])
 			if walk != nil {
-				res := walk(k, v.Slice())
+				val, ok := idx.db.value(v)
+				if !ok {
+					idx.db.corrupt(k)
+					return true
+				}
+				res := walk(k, val)
 				v.applyBrowsingFlags(res)
-				v.freerec()
+				idx.db.uncache(k, v)
 			}
 		}
 		return true
@@ -62,15 +130,25 @@ func (idx *Index) load(walk WalkFunction) {
 }
 
 func (idx *Index) size() int {
-	return len(idx.Index)
+	return len(idx.Index) - idx.tombstones
 }
 
-func (idx *Index) get(k KeyType) *oneIdx {
-	return idx.Index[k]
+func (idx *Index) get(k KeyType) (rec *oneIdx) {
+	if idx.bloom == nil {
+		return idx.Index[k]
+	}
+	if !idx.bloom.has(k) {
+		return nil
+	}
+	if rec = idx.Index[k]; rec == nil {
+		atomic.AddUint64(&idx.bloom.falsePositives, 1)
+	}
+	return
 }
 
 func (idx *Index) memput(k KeyType, rec *oneIdx) {
-	if prv, ok := idx.Index[k]; ok {
+	prv, existed := idx.Index[k]
+	if existed {
 		prv.FreeData()
 		dif := uint64(24 + prv.datlen)
 		if !idx.db.VolatileMode {
@@ -78,7 +156,24 @@ func (idx *Index) memput(k KeyType, rec *oneIdx) {
 			idx.DiskSpaceNeeded -= dif
 		}
 	}
+	if existed && prv.deleted() {
+		idx.tombstones--
+		delete(idx.graves, k)
+	}
+	if rec.deleted() {
+		idx.tombstones++
+		idx.addGrave(k, rec)
+	}
+	if !existed && idx.ordered {
+		i := idx.search(k)
+		idx.sorted = append(idx.sorted, 0)
+		copy(idx.sorted[i+1:], idx.sorted[i:])
+		idx.sorted[i] = k
+	}
 	idx.Index[k] = rec
+	if !existed && idx.bloom != nil {
+		idx.bloomAdd(k)
+	}
 
 	if !idx.db.VolatileMode {
 		idx.DiskSpaceNeeded += uint64(24 + rec.datlen)
@@ -86,10 +181,17 @@ func (idx *Index) memput(k KeyType, rec *oneIdx) {
 	if rec.DataSeq > idx.MaxDatfileSequence {
 		idx.MaxDatfileSequence = rec.DataSeq
 	}
+	if idx.expires != nil && (rec.flags&hasExpiry) == 0 {
+		delete(idx.expires, k)
+	}
 }
 
 func (idx *Index) memdel(k KeyType) {
 	if cur, ok := idx.Index[k]; ok {
+		if cur.deleted() {
+			idx.tombstones--
+			delete(idx.graves, k)
+		}
 		cur.FreeData()
 		dif := uint64(12 + cur.datlen)
 		if !idx.db.VolatileMode {
@@ -97,6 +199,17 @@ func (idx *Index) memdel(k KeyType) {
 			idx.DiskSpaceNeeded -= dif
 		}
 		delete(idx.Index, k)
+		if idx.bloom != nil {
+			idx.bloom.remove(k)
+		}
+		if idx.expires != nil {
+			delete(idx.expires, k)
+		}
+		if idx.ordered {
+			if i := idx.search(k); i < len(idx.sorted) && idx.sorted[i] == k {
+				idx.sorted = append(idx.sorted[:i], idx.sorted[i+1:]...)
+			}
+		}
 	}
 }
 
@@ -124,10 +237,68 @@ func (idx *Index) browse(walk func(key KeyType, idx *oneIdx) bool) {
 	}
 }
 
+// browseSorted walks through the keys in order, starting from the given one (if not nil)
+// and stopping before the given one (if not nil), or after it if incl is true.
+func (idx *Index) browseSorted(from, to *KeyType, incl bool, walk func(key KeyType, idx *oneIdx) bool) {
+	keys := idx.sorted
+	less := idx.less
+	beyond := func(k KeyType) bool { // true if k is past the upper limit
+		if incl {
+			return less(*to, k)
+		}
+		return !less(k, *to)
+	}
+	if !idx.ordered {
+		// not in ordered mode - we need to sort all the keys now
+		less = func(a, b KeyType) bool { return a < b }
+		keys = make([]KeyType, 0, len(idx.Index))
+		for k := range idx.Index {
+			if (from == nil || !less(k, *from)) && (to == nil || !beyond(k)) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Slice(keys, func(i, j int) bool { return less(keys[i], keys[j]) })
+	} else if from != nil {
+		keys = keys[idx.search(*from):]
+	}
+	for _, k := range keys {
+		if to != nil && beyond(k) {
+			break
+		}
+		if !walk(k, idx.Index[k]) {
+			break
+		}
+	}
+}
+
+// browseByDataPos walks through the records sorted by (DataSeq, datpos), with the ones
+// that have not been written to disk yet (DataSeq zero) at the end
+func (idx *Index) browseByDataPos(walk func(key KeyType, idx *oneIdx) bool) {
+	keys := make([]KeyType, 0, len(idx.Index))
+	for k := range idx.Index {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := idx.Index[keys[i]], idx.Index[keys[j]]
+		if a.DataSeq != b.DataSeq {
+			return b.DataSeq == 0 || (a.DataSeq != 0 && a.DataSeq < b.DataSeq)
+		}
+		return a.datpos < b.datpos
+	})
+	for _, k := range keys {
+		if !walk(k, idx.Index[k]) {
+			break
+		}
+	}
+}
+
 func (idx *Index) close() {
 	if idx.file != nil {
 		idx.file.Close()
 		idx.file = nil
 	}
+	idx.logValid = 0
 	idx.Index = nil
+	idx.sorted = nil
+	idx.bloom = nil
 }
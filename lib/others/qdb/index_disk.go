@@ -10,6 +10,9 @@ import (
 	"io/ioutil"
 )
 
+// sequence in the header of a log file that holds the entire index, without any snapshot
+const selfContainedSeq = 0xFFFFFFFF
+
 // Opens file and checks the ffffffff-sequence-FINI marker at the end
 func readAndCheckFile(fn string) (seq uint32, data []byte) {
 	var le int
@@ -25,29 +28,29 @@ func readAndCheckFile(fn string) (seq uint32, data []byte) {
 	f.Close()
 
 	if d == nil {
-		println(fn, "could not read file")
+		logf("%s could not read file", fn)
 		return
 	}
 
 	le = len(d)
 	if le < 16 {
-		println(fn, "len", le)
+		logf("%s len %d", fn, le)
 		return
 	}
 
 	if string(d[le-4:le]) != "FINI" {
-		println(fn, "no FINI")
+		logf("%s no FINI", fn)
 		return
 	}
 
 	if binary.LittleEndian.Uint32(d[le-12:le-8]) != 0xFFFFFFFF {
-		println(fn, "no FFFFFFFF")
+		logf("%s no FFFFFFFF", fn)
 		return
 	}
 
 	seq = binary.LittleEndian.Uint32(d[0:4])
 	if seq != binary.LittleEndian.Uint32(d[le-8:le-4]) {
-		println(fn, "seq mismatch", seq, binary.LittleEndian.Uint32(d[le-8:le-4]))
+		logf("%s seq mismatch %d %d", fn, seq, binary.LittleEndian.Uint32(d[le-8:le-4]))
 		return
 	}
 
@@ -103,51 +106,121 @@ func (idx *Index) loaddat(used map[uint32]bool) {
 		flgz := binary.LittleEndian.Uint32(d[pos+20 : pos+24])
 		idx.memput(key, &oneIdx{datpos: fpos, datlen: flen, DataSeq: fseq, flags: flgz})
 		used[fseq] = true
+		if (flgz & hasExpiry) != 0 {
+			if pos+28 > len(d)-12 {
+				break
+			}
+			idx.setExpiry(key, binary.LittleEndian.Uint32(d[pos+24:pos+28]))
+			pos += 4
+		}
 	}
 	return
 }
 
 func (idx *Index) loadlog(used map[uint32]bool) {
-	idx.file, _ = os.OpenFile(idx.IdxFilePath+"log", os.O_RDWR, 0660)
+	mode := os.O_RDWR
+	if idx.db.ReadOnly {
+		mode = os.O_RDONLY
+	}
+	idx.file, _ = os.OpenFile(idx.IdxFilePath+"log", mode, 0660)
 	if idx.file == nil {
 		return
 	}
 
 	var iseq uint32
 	binary.Read(idx.file, binary.LittleEndian, &iseq)
-	if iseq != idx.VersionSequence {
-		println("incorrect seq in the log file", iseq, idx.VersionSequence)
+	if iseq == selfContainedSeq {
+		// the log holds the entire index, so whatever got loaded from a snapshot is obsolete
+		idx.Index = make(map[KeyType]*oneIdx, len(idx.Index))
+		idx.tombstones = 0
+		idx.graves = nil
+		idx.expires = nil
+		idx.DiskSpaceNeeded = 0
+		idx.ExtraSpaceUsed = 0
+		for seq := range used {
+			delete(used, seq)
+		}
+		idx.selfContained = true
+	} else if iseq != idx.VersionSequence {
+		logf("incorrect seq in the log file %d %d", iseq, idx.VersionSequence)
 		idx.file.Close()
 		idx.file = nil
-		os.Remove(idx.IdxFilePath + "log")
+		if !idx.db.ReadOnly {
+			os.Remove(idx.IdxFilePath + "log")
+		}
 		return
 	}
 
 	d, _ := ioutil.ReadAll(idx.file)
-	for pos := 0; pos+12 <= len(d); {
+	var valid int // end of the last complete entry
+	for valid+12 <= len(d) {
+		pos := valid
 		key := KeyType(binary.LittleEndian.Uint64(d[pos : pos+8]))
 		fpos := binary.LittleEndian.Uint32(d[pos+8 : pos+12])
 		pos += 12
 		if fpos != 0 {
 			if pos+12 > len(d) {
-				println("Unexpected END of file")
 				break
 			}
 			flen := binary.LittleEndian.Uint32(d[pos : pos+4])
 			fseq := binary.LittleEndian.Uint32(d[pos+4 : pos+8])
 			flgz := binary.LittleEndian.Uint32(d[pos+8 : pos+12])
 			pos += 12
+			var exp uint32
+			if (flgz & hasExpiry) != 0 {
+				if pos+4 > len(d) {
+					break
+				}
+				exp = binary.LittleEndian.Uint32(d[pos : pos+4])
+				pos += 4
+			}
 			idx.memput(key, &oneIdx{datpos: fpos, datlen: flen, DataSeq: fseq, flags: flgz})
+			if exp != 0 {
+				idx.setExpiry(key, exp)
+			}
 			used[fseq] = true
 		} else {
 			idx.memdel(key)
 		}
+		valid = pos
 	}
 
+	if valid < len(d) {
+		// most likely the process got killed while writing the entry
+		cnt("LogIncomplete")
+		if !idx.db.repairOnLoad || idx.db.ReadOnly {
+			// left as it is for now, but the next write must not land after the junk
+			logf("%slog has incomplete entry at the end (%d bytes)", idx.IdxFilePath, len(d)-valid)
+			idx.logValid = int64(4 + valid)
+		} else if idx.droplogtail(int64(4 + valid)) {
+			logf("%slog repaired - %d bytes of incomplete entry discarded", idx.IdxFilePath, len(d)-valid)
+		}
+	}
 	return
 }
 
+// droplogtail truncates the log file at the end of its last complete entry
+func (idx *Index) droplogtail(valid int64) bool {
+	idx.logValid = 0
+	if e := idx.file.Truncate(valid); e != nil {
+		logf("%slog could not be repaired: %s", idx.IdxFilePath, e.Error())
+		idx.file.Close()
+		idx.file = nil
+		idx.writedatfile() // a new snapshot, so the next write starts a new log instead of appending to the junk
+		return false
+	}
+	idx.file.Seek(valid, os.SEEK_SET)
+	return true
+}
+
 func (idx *Index) checklogfile() {
+	if idx.file != nil && idx.logValid != 0 && idx.droplogtail(idx.logValid) {
+		logf("%slog had incomplete entry at the end - discarded before writing", idx.IdxFilePath)
+	}
+	if idx.file == nil && idx.selfContained {
+		idx.checkpoint() // a new log must hold the entire index
+		return
+	}
 	if idx.file == nil {
 		idx.file, _ = os.Create(idx.IdxFilePath + "log")
 		binary.Write(idx.file, binary.LittleEndian, uint32(idx.VersionSequence))
@@ -165,6 +238,9 @@ func (idx *Index) addtolog(wr io.Writer, k KeyType, rec *oneIdx) {
 	binary.Write(wr, binary.LittleEndian, rec.datlen)
 	binary.Write(wr, binary.LittleEndian, rec.DataSeq)
 	binary.Write(wr, binary.LittleEndian, rec.flags)
+	if (rec.flags & hasExpiry) != 0 {
+		binary.Write(wr, binary.LittleEndian, idx.expires[k])
+	}
 }
 
 func (idx *Index) deltolog(wr io.Writer, k KeyType) {
@@ -177,36 +253,88 @@ func (idx *Index) deltolog(wr io.Writer, k KeyType) {
 }
 
 func (idx *Index) writedatfile() {
+	if idx.db.O.LogOnly {
+		idx.checkpoint()
+		return
+	}
+	idx.selfContained = false
 	idx.DatfileIndex = 1 - idx.DatfileIndex
 	idx.VersionSequence++
+	writeidxfile(fmt.Sprint(idx.IdxFilePath, idx.DatfileIndex), idx.VersionSequence, idx.Index, idx.expires)
 
-	//f := new(bytes.Buffer)
-	ff, _ := os.Create(fmt.Sprint(idx.IdxFilePath, idx.DatfileIndex))
+	// now delete the previous log
+	if idx.file != nil {
+		idx.file.Close()
+		idx.file = nil
+	}
+	idx.logValid = 0
+	os.Remove(idx.IdxFilePath + "log")
+	os.Remove(fmt.Sprint(idx.IdxFilePath, 1-idx.DatfileIndex))
+}
+
+// writeidxfile writes the index snapshot file with the given records
+// (expires holds the expiry times of the records with hasExpiry flag)
+func writeidxfile(fn string, seq uint32, recs map[KeyType]*oneIdx, expires map[KeyType]uint32) (e error) {
+	var ff *os.File
+	if ff, e = os.Create(fn); e != nil {
+		return
+	}
 	f := bufio.NewWriterSize(ff, 0x100000)
-	binary.Write(f, binary.LittleEndian, idx.VersionSequence)
-	idx.browse(func(key KeyType, rec *oneIdx) bool {
+	binary.Write(f, binary.LittleEndian, seq)
+	for key, rec := range recs {
 		binary.Write(f, binary.LittleEndian, key)
 		binary.Write(f, binary.LittleEndian, rec.datpos)
 		binary.Write(f, binary.LittleEndian, rec.datlen)
 		binary.Write(f, binary.LittleEndian, rec.DataSeq)
 		binary.Write(f, binary.LittleEndian, rec.flags)
-		return true
-	})
+		if (rec.flags & hasExpiry) != 0 {
+			binary.Write(f, binary.LittleEndian, expires[key])
+		}
+	}
 	f.Write([]byte{0xff, 0xff, 0xff, 0xff})
-	binary.Write(f, binary.LittleEndian, idx.VersionSequence)
+	binary.Write(f, binary.LittleEndian, seq)
 	f.Write([]byte("FINI"))
 
-	//ioutil.WriteFile(fmt.Sprint(idx.IdxFilePath, idx.DatfileIndex), f.Bytes(), 0600)
+	e = f.Flush()
+	ff.Close()
+	return
+}
+
+// checkpoint replaces the log file with a new one, holding the entire index.
+// It is used instead of writedatfile in LogOnly mode, so no snapshots get written.
+// The new log is written to a temporary file first and then renamed, so either the old
+// or the new one is there after a crash. The snapshots are only removed after that.
+func (idx *Index) checkpoint() {
+	fn := idx.IdxFilePath + "log"
+	ff, _ := os.Create(fn + ".tmp")
+	if ff == nil {
+		logf("%s could not create checkpoint", fn)
+		return
+	}
+	f := bufio.NewWriterSize(ff, 0x100000)
+	binary.Write(f, binary.LittleEndian, uint32(selfContainedSeq))
+	idx.browse(func(key KeyType, rec *oneIdx) bool {
+		idx.addtolog(f, key, rec)
+		return true
+	})
 	f.Flush()
+	ff.Sync()
 	ff.Close()
 
-	// now delete the previous log
 	if idx.file != nil {
 		idx.file.Close()
 		idx.file = nil
 	}
-	os.Remove(idx.IdxFilePath + "log")
-	os.Remove(fmt.Sprint(idx.IdxFilePath, 1-idx.DatfileIndex))
+	idx.logValid = 0
+	if e := os.Rename(fn+".tmp", fn); e != nil {
+		logf("%s", e.Error())
+		os.Remove(fn + ".tmp")
+		return
+	}
+	os.Remove(idx.IdxFilePath + "0")
+	os.Remove(idx.IdxFilePath + "1")
+	idx.file, _ = os.OpenFile(fn, os.O_WRONLY|os.O_APPEND, 0660)
+	idx.selfContained = true
 }
 
 func (idx *Index) writebuf(d []byte) {
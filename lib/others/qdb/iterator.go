@@ -0,0 +1,89 @@
+package qdb
+
+// Iterator - Pull-style traversal of the database records, as an alternative to Browse.
+// The keys of the browsable records are collected when the iterator is made, while each
+// record's value is read by Next, so the database is only locked for the time of these calls
+// and not between them. Records added afterwards are not visited and the deleted ones are skipped.
+// A concurrent Defrag invalidates the iterator (the records get rewritten), so the traversal
+// should be started over with a new iterator after it.
+type Iterator struct {
+	db   *DB
+	keys []KeyType
+	pos  int
+	key  KeyType
+	val  []byte
+}
+
+// NewIterator - Returns an iterator over the current records of the database, in a random order.
+func (db *DB) NewIterator() *Iterator {
+	it := &Iterator{db: db}
+	db.BrowseKeys(func(k KeyType, _ uint32) uint32 {
+		it.keys = append(it.keys, k)
+		return 0
+	})
+	return it
+}
+
+// Next - Moves to the next record. Returns false when there are no more records.
+// Like Browse, it skips the records with NoBrowse flag and does not keep in memory
+// the ones with NoCache flag.
+func (it *Iterator) Next() bool {
+	for it.pos < len(it.keys) {
+		k := it.keys[it.pos]
+		it.pos++
+		if v := it.db.iterGet(k); v != nil {
+			it.key, it.val = k, v
+			return true
+		}
+	}
+	it.key, it.val = 0, nil
+	return false
+}
+
+// iterGet returns the record's value, the way the walk function would get it from Browse
+func (db *DB) iterGet(k KeyType) (val []byte) {
+	db.Mutex.RLock()
+	defer db.Mutex.RUnlock()
+	if db.Idx == nil {
+		return
+	}
+	v := db.Idx.get(k)
+	if v == nil || db.absent(k, v, NoBrowse) {
+		return
+	}
+	val, ok := db.readrec(k, v, false)
+	if !ok {
+		db.corrupt(k)
+		return nil
+	}
+	if membind_use_wrapper {
+		// the cached value may be freed once we unlock, and it cannot be freed here,
+		// as the wrapper's memory might still be used by other readers
+		val = append([]byte(nil), val...)
+		return
+	}
+	db.cacheMutex.Lock()
+	freed := v.freerec()
+	db.cacheMutex.Unlock()
+	if freed {
+		db.cacheFreed(k, v)
+	}
+	return
+}
+
+// Key - Returns the key of the current record
+func (it *Iterator) Key() KeyType {
+	return it.key
+}
+
+// Value - Returns the value of the current record
+func (it *Iterator) Value() []byte {
+	return it.val
+}
+
+// Close - Releases the iterator. Next returns false after that.
+func (it *Iterator) Close() {
+	it.keys = nil
+	it.pos = 0
+	it.key, it.val = 0, nil
+}
@@ -0,0 +1,18 @@
+package qdb
+
+import (
+	"fmt"
+	"os"
+)
+
+// Logger - Used for all the diagnostic messages of the package.
+// By default they go to stderr, like println did. Set it to nil to mute them.
+var Logger = func(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+}
+
+func logf(format string, args ...interface{}) {
+	if Logger != nil {
+		Logger(format, args...)
+	}
+}
@@ -0,0 +1,106 @@
+package qdb
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+)
+
+// The manifest records the options that affect how the database's files must be
+// interpreted, so the database can be reopened without passing them again.
+
+const manifestFile = "qdb.opts"
+
+type manifest struct {
+	Version         uint32
+	TombstoneGrace  uint32 `json:",omitempty"`
+	VerifyChecksums bool   `json:",omitempty"`
+	Expiry          bool   `json:",omitempty"`
+	KeyCheck        []byte `json:",omitempty"` // keyCheck, sealed with the encryption key
+}
+
+const manifestVersion = 1
+
+// applyManifest reads the manifest from the db's folder and applies its options to db.O.
+// If there is no manifest yet, it gets created from the current options.
+func (db *DB) applyManifest() (e error) {
+	var m manifest
+	if len(db.O.EncryptionKey) > 0 {
+		if db.aead, e = newAEAD(db.O.EncryptionKey); e != nil {
+			return
+		}
+	}
+	d, er := ioutil.ReadFile(db.Dir + manifestFile)
+	if er != nil {
+		if !os.IsNotExist(er) {
+			return er
+		}
+		if db.aead != nil && db.exists() {
+			return errors.New("qdb: cannot enable encryption for an existing database")
+		}
+		if db.ReadOnly {
+			return
+		}
+		if db.O.VerifyChecksums && db.exists() {
+			return errors.New("qdb: cannot enable checksums for an existing database")
+		}
+		return db.writeManifest()
+	}
+	if e = json.Unmarshal(d, &m); e != nil {
+		return errors.New("qdb: corrupt manifest - " + e.Error())
+	}
+	if m.Version > manifestVersion {
+		return errors.New("qdb: unsupported manifest version")
+	}
+
+	if db.O.TombstoneGrace == 0 {
+		db.O.TombstoneGrace = m.TombstoneGrace
+	} else if db.O.TombstoneGrace != m.TombstoneGrace {
+		return errors.New("qdb: TombstoneGrace does not match the database's manifest")
+	}
+
+	if db.O.VerifyChecksums && !m.VerifyChecksums {
+		return errors.New("qdb: the database has been created without checksums")
+	}
+	db.O.VerifyChecksums = m.VerifyChecksums
+
+	if m.KeyCheck == nil {
+		if db.aead != nil {
+			return errors.New("qdb: the database has been created without encryption")
+		}
+	} else if db.aead == nil {
+		return ErrNoKey
+	} else if v, ok := unseal(db.aead, m.KeyCheck); !ok || string(v) != keyCheck {
+		return ErrBadKey
+	}
+
+	// the index files may have the expiry times, so it cannot be disabled once set
+	if m.Expiry {
+		db.O.Expiry = true
+	} else if db.O.Expiry && !db.ReadOnly {
+		return db.writeManifest()
+	}
+	return
+}
+
+// writeManifest creates (or replaces) the manifest with the current options
+func (db *DB) writeManifest() error {
+	m := manifest{Version: manifestVersion, TombstoneGrace: db.O.TombstoneGrace,
+		VerifyChecksums: db.O.VerifyChecksums, Expiry: db.O.Expiry}
+	if db.aead != nil {
+		m.KeyCheck = db.seal([]byte(keyCheck))
+	}
+	d, _ := json.Marshal(&m)
+	return ioutil.WriteFile(db.Dir+manifestFile, d, 0660)
+}
+
+// exists returns true if there are any index files in the db's folder
+func (db *DB) exists() bool {
+	for _, ext := range []string{"0", "1", "log"} {
+		if _, er := os.Stat(db.Dir + "qdbidx." + ext); er == nil {
+			return true
+		}
+	}
+	return false
+}
@@ -1,6 +1,7 @@
 package qdb
 
 import (
+	"io"
 	"os"
 	"reflect"
 	"sync/atomic"
@@ -56,17 +57,26 @@ func (idx *oneIdx) SetData(v []byte) {
 	}
 }
 
-func (idx *oneIdx) LoadData(f *os.File) {
+// LoadData - Reads the record's data from the file. If it cannot be read whole,
+// the data is freed and the error is returned.
+func (idx *oneIdx) LoadData(f *os.File) (e error) {
+	var n int
 	if membind_use_wrapper {
 		idx.data = _heap_alloc(idx.datlen)
 		atomic.AddInt64(&ExtraMemoryConsumed, int64(idx.datlen))
 		atomic.AddInt64(&ExtraMemoryAllocCnt, 1)
-		f.Seek(int64(idx.datpos), os.SEEK_SET)
-		f.Read(*(*[]byte)(unsafe.Pointer(&reflect.SliceHeader{Data: uintptr(idx.data), Len: int(idx.datlen), Cap: int(idx.datlen)})))
+		n, e = f.ReadAt(*(*[]byte)(unsafe.Pointer(&reflect.SliceHeader{Data: uintptr(idx.data), Len: int(idx.datlen), Cap: int(idx.datlen)})), int64(idx.datpos))
 	} else {
 		ptr := make([]byte, int(idx.datlen))
 		idx.data = data_ptr_t(&ptr)
-		f.Seek(int64(idx.datpos), os.SEEK_SET)
-		f.Read(ptr)
+		n, e = f.ReadAt(ptr, int64(idx.datpos))
 	}
+	if n == int(idx.datlen) {
+		return nil
+	}
+	if e == nil {
+		e = io.ErrUnexpectedEOF
+	}
+	idx.FreeData()
+	return
 }
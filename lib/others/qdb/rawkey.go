@@ -0,0 +1,31 @@
+package qdb
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// KeyFromBytes - Returns the key of the record stored by PutRaw under the given key of any width.
+// The key is the first 8 bytes (little endian) of the key's SHA256, so different keys sharing
+// a prefix (like block hashes) do not collide more often than random ones. Still, the keys are
+// only 64 bits wide: with n records, the chance that any two of them collide is about n*n/2^65
+// (around one in 37 million for a million records) and a colliding record overwrites the other.
+func KeyFromBytes(key []byte) KeyType {
+	h := sha256.Sum256(key)
+	return KeyType(binary.LittleEndian.Uint64(h[:8]))
+}
+
+// PutRaw - Adds or updates the record with the given key of any width (see KeyFromBytes).
+func (db *DB) PutRaw(key []byte, value []byte) error {
+	return db.Put(KeyFromBytes(key), value)
+}
+
+// GetRaw - Returns the value of the record stored by PutRaw, or nil if it does not exist.
+func (db *DB) GetRaw(key []byte) []byte {
+	return db.Get(KeyFromBytes(key))
+}
+
+// DelRaw - Removes the record stored by PutRaw.
+func (db *DB) DelRaw(key []byte) {
+	db.Del(KeyFromBytes(key))
+}
@@ -0,0 +1,120 @@
+package qdb
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+)
+
+// Snapshot - A read-only view of the database, as it was when the snapshot was taken.
+// Reading from a snapshot does not lock the database, so the writers can proceed.
+// The records' data is read from the data files, which the snapshot keeps open,
+// so they stay readable even if a defrag removes them in the meantime.
+// Only the records not written to disk yet are kept in memory by the snapshot.
+// A snapshot is safe for concurrent use, but it must be released when no longer needed.
+type Snapshot struct {
+	recs   map[KeyType]snapRec
+	files  map[uint32]*os.File
+	verify bool
+	aead   cipher.AEAD // see ExtraOpts.EncryptionKey
+}
+
+type snapRec struct {
+	datpos, datlen, DataSeq uint32
+	codec                   byte
+	data                    []byte // only for the records that are not on disk
+}
+
+// Snapshot - Takes a snapshot of the current content of the database.
+// This only copies the index (and the pending records), with the database locked.
+func (db *DB) Snapshot() (s *Snapshot) {
+	db.Mutex.Lock()
+	defer db.Mutex.Unlock()
+	cnt("Snapshot")
+	s = &Snapshot{recs: make(map[KeyType]snapRec), files: make(map[uint32]*os.File), verify: db.O.VerifyChecksums, aead: db.aead}
+	if db.Idx == nil {
+		return // closed, so the snapshot is empty
+	}
+	db.Idx.browse(func(k KeyType, v *oneIdx) bool {
+		if db.absent(k, v, NoBrowse) {
+			return true
+		}
+		r := snapRec{datpos: v.datpos, datlen: v.datlen, DataSeq: v.DataSeq, codec: v.codec()}
+		if v.datpos == 0 {
+			// not on disk yet, so the snapshot needs its own copy
+			r.data = append([]byte{}, v.Slice()...)
+		} else if _, ok := s.files[v.DataSeq]; !ok {
+			s.files[v.DataSeq], _ = os.Open(db.seq2fn(v.DataSeq))
+		}
+		s.recs[k] = r
+		return true
+	})
+	return
+}
+
+// load returns the record's value, or nil if it cannot be read
+func (s *Snapshot) load(r snapRec) []byte {
+	if r.datpos == 0 {
+		v, _ := unpack(s.aead, r.codec, r.data)
+		return v
+	}
+	f := s.files[r.DataSeq]
+	if f == nil {
+		return nil
+	}
+	l := int(r.datlen)
+	if s.verify {
+		l += 4
+	}
+	d := make([]byte, l)
+	if _, e := f.ReadAt(d, int64(r.datpos)); e != nil {
+		return nil
+	}
+	if s.verify {
+		if binary.LittleEndian.Uint32(d[r.datlen:]) != crc32.ChecksumIEEE(d[:r.datlen]) {
+			cnt("ChecksumError")
+			return nil
+		}
+		d = d[:r.datlen]
+	}
+	d, _ = unpack(s.aead, r.codec, d)
+	return d
+}
+
+// Count - Returns number of records in the snapshot
+func (s *Snapshot) Count() int {
+	return len(s.recs)
+}
+
+// Get - Returns the value of the record, as it was when the snapshot was taken.
+// Returns nil if the record did not exist then (or if it could not be read).
+func (s *Snapshot) Get(key KeyType) []byte {
+	if r, ok := s.recs[key]; ok {
+		return s.load(r)
+	}
+	return nil
+}
+
+// Browse - Browses through all the records of the snapshot, in a random order.
+// Browsing gets aborted if the walk function returns BrAbort (other flags are ignored).
+// Records that cannot be read are skipped.
+func (s *Snapshot) Browse(walk WalkFunction) {
+	for k, r := range s.recs {
+		if v := s.load(r); v != nil && (walk(k, v)&BrAbort) != 0 {
+			return
+		}
+	}
+}
+
+// Release - Closes the data files kept open by the snapshot.
+// The snapshot cannot be used anymore after that.
+func (s *Snapshot) Release() {
+	for _, f := range s.files {
+		if f != nil {
+			f.Close()
+		}
+	}
+	s.files = nil
+	s.recs = nil
+}
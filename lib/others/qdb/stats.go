@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"sort"
 	"sync"
+	"unsafe"
 )
 
 var (
@@ -40,3 +41,85 @@ func GetStats() (s string) {
 	counterMutex.Unlock()
 	return s
 }
+
+// SizeStats - Returns statistics of the records' value sizes (tombstones not included).
+// The percentiles are nearest-rank. It only uses the index, so nothing is read from disk.
+func (db *DB) SizeStats() (count int, total, min, max, mean, p50, p99 uint64) {
+	db.Mutex.RLock()
+	defer db.Mutex.RUnlock()
+	if db.Idx == nil {
+		return
+	}
+	sizes := make([]uint64, 0, len(db.Idx.Index))
+	for _, rec := range db.Idx.Index {
+		if !rec.deleted() {
+			sizes = append(sizes, uint64(rec.datlen))
+			total += uint64(rec.datlen)
+		}
+	}
+
+	if count = len(sizes); count == 0 {
+		return
+	}
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i] < sizes[j] })
+	min, max = sizes[0], sizes[count-1]
+	mean = total / uint64(count)
+	p50 = sizes[(count*50+99)/100-1]
+	p99 = sizes[(count*99+99)/100-1]
+	return
+}
+
+// Stats - State of a database, as returned by DB.GetStats
+type Stats struct {
+	RecordCount     int
+	DiskSpaceNeeded uint64
+	ExtraSpaceUsed  uint64
+	DefragRatio     uint64 // ExtraSpaceUsed as percentage of DiskSpaceNeeded
+	DatFiles        int    // number of open data files
+	PendingRecords  int
+	DataSeq         uint32
+}
+
+// MemoryUsed - Returns the estimated number of bytes used by the database's index
+// (including the pending and expiry maps) and the records' values kept in memory.
+func (db *DB) MemoryUsed() (res int64) {
+	db.Mutex.RLock()
+	defer db.Mutex.RUnlock()
+	if db.Idx == nil {
+		return
+	}
+	const entry = KeySize + int64(unsafe.Sizeof(uintptr(0))) + int64(unsafe.Sizeof(oneIdx{}))
+	res = int64(len(db.Idx.Index)) * entry
+	db.cacheMutex.Lock()
+	for _, rec := range db.Idx.Index {
+		if rec.data != nil {
+			res += int64(rec.datlen)
+		}
+	}
+	db.cacheMutex.Unlock()
+	res += int64(len(db.PendingRecords)) * (2*KeySize + 5)
+	res += int64(len(db.Idx.expires)) * (KeySize + 4)
+	res += int64(cap(db.Idx.sorted)) * KeySize
+	if db.Idx.bloom != nil {
+		res += int64(len(db.Idx.bloom.counts))
+	}
+	return
+}
+
+// GetStats - Returns the current state of the database. It does not do any disk I/O.
+func (db *DB) GetStats() (s Stats) {
+	db.Mutex.Lock()
+	defer db.Mutex.Unlock()
+	if db.Idx != nil {
+		s.RecordCount = db.Idx.size()
+		s.DiskSpaceNeeded = db.Idx.DiskSpaceNeeded
+		s.ExtraSpaceUsed = db.Idx.ExtraSpaceUsed
+		if s.DiskSpaceNeeded > 0 {
+			s.DefragRatio = 100 * s.ExtraSpaceUsed / s.DiskSpaceNeeded
+		}
+	}
+	s.DatFiles = len(db.DatFiles)
+	s.PendingRecords = len(db.PendingRecords)
+	s.DataSeq = db.DataSeq
+	return
+}
@@ -0,0 +1,125 @@
+package qdb
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// The tombstone record's value is the unix time of the deletion (LSB, 8 bytes)
+
+// Index.graves maps the keys of the tombstones to their deletion time, so the expired ones can be
+// purged without reading their data. It is nil until first needed (e.g. after loading the database)
+// and Index.nextPurge is the earliest time when one of the tombstones expires.
+
+func newTombstone() *oneIdx {
+	v := make([]byte, 8)
+	binary.LittleEndian.PutUint64(v, uint64(time.Now().Unix()))
+	return newIdx(v, isTombstone)
+}
+
+// deletedAt returns the time of the deletion, for a tombstone record
+func (db *DB) deletedAt(k KeyType, rec *oneIdx) time.Time {
+	if t, ok := db.Idx.graves[k]; ok {
+		return time.Unix(int64(t), 0)
+	}
+	if !db.loadrec(rec) {
+		return time.Time{} // corrupt, so treat it as expired
+	}
+	ts := binary.LittleEndian.Uint64(rec.Slice())
+	rec.freerec()
+	return time.Unix(int64(ts), 0)
+}
+
+func (db *DB) tombstoneExpired(k KeyType, rec *oneIdx, now time.Time) bool {
+	return now.After(db.deletedAt(k, rec).Add(time.Duration(db.O.TombstoneGrace) * time.Second))
+}
+
+// addGrave records the deletion time of a tombstone that has just been put into the index
+func (idx *Index) addGrave(k KeyType, rec *oneIdx) {
+	if idx.graves == nil || rec.data == nil {
+		return
+	}
+	t := uint32(binary.LittleEndian.Uint64(rec.Slice()))
+	idx.graves[k] = t
+	if exp := t + idx.db.O.TombstoneGrace + 1; exp < idx.nextPurge {
+		idx.nextPurge = exp
+	}
+}
+
+// purgeTombstones removes from the index the tombstones whose grace period has ended and marks
+// them as pending, so the following sync writes their deletion to the index file.
+// Returns the number of the removed tombstones.
+func (db *DB) purgeTombstones() (n int) {
+	if db.O.TombstoneGrace == 0 || db.Idx.tombstones == 0 {
+		return
+	}
+	now := time.Now()
+	if db.Idx.graves == nil {
+		db.Idx.graves = make(map[KeyType]uint32, db.Idx.tombstones)
+		for k, rec := range db.Idx.Index {
+			if rec.deleted() {
+				db.Idx.graves[k] = uint32(db.deletedAt(k, rec).Unix())
+			}
+		}
+	} else if uint32(now.Unix()) < db.Idx.nextPurge {
+		return
+	}
+	db.Idx.nextPurge = 0xFFFFFFFF
+	for k, t := range db.Idx.graves {
+		if exp := t + db.O.TombstoneGrace + 1; uint32(now.Unix()) >= exp {
+			db.Idx.memdel(k)
+			db.PendingRecords[k] = true
+			n++
+		} else if exp < db.Idx.nextPurge {
+			db.Idx.nextPurge = exp
+		}
+	}
+	cntadd("TombstonesPurged", uint64(n))
+	return
+}
+
+// BrowseSince - Calls the walk function for each key deleted at, or after, the given time
+// and within the grace period (a zero time reports all of them).
+// This only works if TombstoneGrace option is set. Return false from walk to abort browsing.
+func (db *DB) BrowseSince(since time.Time, walk func(key KeyType, deleted time.Time) bool) {
+	db.Mutex.Lock()
+	defer db.Mutex.Unlock()
+	if db.Idx == nil {
+		return
+	}
+	if db.Idx.tombstones > 0 {
+		now := time.Now()
+		db.Idx.browse(func(k KeyType, v *oneIdx) bool {
+			if !v.deleted() || db.tombstoneExpired(k, v, now) {
+				return true
+			}
+			if t := db.deletedAt(k, v); !t.Before(since) {
+				return walk(k, t)
+			}
+			return true
+		})
+	}
+}
+
+// TailChanges - Browses through the records in the order they were written (see BrowseByDataPos),
+// including the keys deleted within the grace period (see TombstoneGrace), for which the walk
+// function gets a nil value. This way a follower can replicate the deletions as well.
+// For the deleted keys, only BrAbort is taken from the walk function's result.
+func (db *DB) TailChanges(walk WalkFunction) {
+	db.Mutex.Lock()
+	defer db.Mutex.Unlock()
+	if db.Idx == nil {
+		return
+	}
+	now := time.Now()
+	br := db.browsable(walk)
+	db.Idx.browseByDataPos(func(k KeyType, v *oneIdx) bool {
+		if !v.deleted() {
+			return br(k, v)
+		}
+		if db.tombstoneExpired(k, v, now) {
+			return true
+		}
+		return (walk(k, nil) & BrAbort) == 0
+	})
+}
@@ -20,7 +20,10 @@ func ValidIPv4(ip []byte) bool {
 	return true
 }
 
-// IsIPBlocked -
+// IPBlocked - If set, the IPv4 addresses it returns true for are blocked (see IsIPBlocked)
+var IPBlocked func(ip4 []byte) bool
+
+// IsIPBlocked - Returns true if we must not connect to (nor advertise) the IPv4 address
 func IsIPBlocked(ip4 []byte) bool {
-	return false
+	return IPBlocked != nil && IPBlocked(ip4)
 }
@@ -1,8 +1,10 @@
 package utils
 
 import (
+	"encoding/base32"
 	"encoding/binary"
 	"hash/crc64"
+	"strings"
 
 	"github.com/ParallelCoinTeam/duod/lib/btc"
 )
@@ -12,9 +14,29 @@ type OnePeer struct {
 	btc.NetAddr
 	Time   uint32 // When seen last time
 	Banned uint32 // time when this address baned or zero if never
+
+	NetGroup  []byte   // network group of the IP, as computed by the peers database
+	Labels    []string // set by the node's operator, to categorize the peers
+	BanReason string   // why the peer has been banned (up to 254 bytes)
+	Onion     []byte   // for Tor peers: v3 onion address (32 bytes pubkey, 2 bytes checksum, version)
+
+	Misbehaving     uint32 // sum of the misbehaviour points (since the last ban)
+	GoodConnections uint32 // number of times the peer gave us good data
 }
 
-var crctab = crc64.MakeTable(crc64.ISO)
+const (
+	// OnionLen - Length of the decoded v3 onion address
+	OnionLen = 35
+	// BanReasonMark - A label starting with this byte holds the ban reason (see BanReason)
+	BanReasonMark = "\x00"
+)
+
+var (
+	crctab = crc64.MakeTable(crc64.ISO)
+	// OnionPrefix - The fixed fields of an onion peer start with the OnionCat prefix fd87:d87e:eb43::/48
+	OnionPrefix = []byte{0xfd, 0x87, 0xd8, 0x7e, 0xeb, 0x43}
+	onionEnc    = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
 
 /*
 Serialized peer record (all values are LSB unless specified otherwise):
@@ -24,8 +46,48 @@ Serialized peer record (all values are LSB unless specified otherwise):
  [24:28] - IPv4 (network order)
  [28:30] - TCP port (big endian)
  [30:34] - OPTIONAL: if present, unix timestamp of when the peer was banned
+ [34:] - OPTIONAL: if present, network group of the IP (the ban field is then always present)
+ [34+ng:] - OPTIONAL: if present, labels of the peer (the network group is then always present)
+ [34+ng+lb:] - OPTIONAL: if present, Misbehaving (4 bytes) and GoodConnections (4 bytes)
+   of the peer's score (the labels are then always present)
+ [42+ng+lb:] - OPTIONAL: if present, 35 bytes of v3 onion address (the score is then always present)
+
+For an onion peer, the IPv6 field starts with OnionPrefix and is followed (also in the IPv4 field)
+by the first 10 bytes of the onion address, so the older versions see it as an unroutable IPv6.
+
+The length of the network group (ng) follows from its first byte: 3 for 4 (IPv4), 5 for 6 (IPv6)
+and 1 for 0 (no network group). For any other value, the network group takes the rest of the record.
+The labels are stored as the number of labels, followed by each label preceded by its length (all bytes).
+The ban reason is stored as the first label, starting with BanReasonMark byte (the older versions
+see it as just another label).
 */
 
+// netGroupLen returns the length of the network group stored at the beginning of v
+func netGroupLen(v []byte) int {
+	switch v[0] {
+	case 0:
+		return 1
+	case 4:
+		return 3
+	case 6:
+		return 5
+	}
+	return len(v)
+}
+
+// PeerTimeFromBytes - Returns Time field of a serialized peer record
+func PeerTimeFromBytes(v []byte) uint32 {
+	return binary.LittleEndian.Uint32(v[0:4])
+}
+
+// PeerBannedFromBytes - Returns Banned field of a serialized peer record
+func PeerBannedFromBytes(v []byte) uint32 {
+	if len(v) >= 34 {
+		return binary.LittleEndian.Uint32(v[30:34])
+	}
+	return 0
+}
+
 // NewPeer -
 func NewPeer(v []byte) (p *OnePeer) {
 	if len(v) < 30 {
@@ -33,22 +95,100 @@ func NewPeer(v []byte) (p *OnePeer) {
 		return
 	}
 	p = new(OnePeer)
-	p.Time = binary.LittleEndian.Uint32(v[0:4])
+	p.Time = PeerTimeFromBytes(v)
 	p.Services = binary.LittleEndian.Uint64(v[4:12])
 	copy(p.IPv6[:], v[12:24])
 	copy(p.IPv4[:], v[24:28])
 	p.Port = binary.BigEndian.Uint16(v[28:30])
 	if len(v) >= 34 {
-		p.Banned = binary.LittleEndian.Uint32(v[30:34])
+		p.Banned = PeerBannedFromBytes(v)
+		if len(v) > 34 {
+			v = v[34:]
+			ng := netGroupLen(v)
+			if ng > len(v) {
+				ng = len(v)
+			}
+			if v[0] != 0 {
+				p.NetGroup = make([]byte, ng)
+				copy(p.NetGroup, v[:ng])
+			}
+			var rest []byte
+			p.Labels, rest = labelsFromBytes(v[ng:])
+			if len(p.Labels) > 0 && strings.HasPrefix(p.Labels[0], BanReasonMark) {
+				p.BanReason = p.Labels[0][len(BanReasonMark):]
+				if p.Labels = p.Labels[1:]; len(p.Labels) == 0 {
+					p.Labels = nil
+				}
+			}
+			if len(rest) >= 8 {
+				p.Misbehaving = binary.LittleEndian.Uint32(rest[0:4])
+				p.GoodConnections = binary.LittleEndian.Uint32(rest[4:8])
+				if rest = rest[8:]; len(rest) >= OnionLen {
+					p.Onion = make([]byte, OnionLen)
+					copy(p.Onion, rest)
+				}
+			}
+		}
 	}
 	return
 }
 
-// Bytes -
+// labelsFromBytes decodes the labels' part of a serialized peer record, returning also what follows it
+func labelsFromBytes(v []byte) (res []string, rest []byte) {
+	if len(v) == 0 {
+		return
+	}
+	cnt := int(v[0])
+	v = v[1:]
+	for i := 0; i < cnt && len(v) > 0 && len(v) > int(v[0]); i++ {
+		res = append(res, string(v[1:1+v[0]]))
+		v = v[1+v[0]:]
+	}
+	rest = v
+	return
+}
+
+// Bytes - Serializes the peer record. Labels longer than 255 bytes (and the ban reason
+// longer than 254) get truncated and only the first 255 labels (including the reason) are stored.
 func (p *OnePeer) Bytes() (res []byte) {
-	if p.Banned != 0 {
-		res = make([]byte, 34)
+	withScore := p.Misbehaving != 0 || p.GoodConnections != 0 || p.IsOnion()
+	if len(p.Labels) > 0 || p.BanReason != "" || withScore {
+		res = make([]byte, 34, 64)
+		binary.LittleEndian.PutUint32(res[30:34], p.Banned)
+		if len(p.NetGroup) > 0 {
+			res = append(res, p.NetGroup...)
+		} else {
+			res = append(res, 0)
+		}
+		labels := p.Labels
+		if p.BanReason != "" {
+			labels = append([]string{BanReasonMark + p.BanReason}, labels...)
+		}
+		cnt := len(labels)
+		if cnt > 255 {
+			cnt = 255
+		}
+		res = append(res, byte(cnt))
+		for _, l := range labels[:cnt] {
+			if len(l) > 255 {
+				l = l[:255]
+			}
+			res = append(res, byte(len(l)))
+			res = append(res, l...)
+		}
+		if withScore {
+			var score [8]byte
+			binary.LittleEndian.PutUint32(score[0:4], p.Misbehaving)
+			binary.LittleEndian.PutUint32(score[4:8], p.GoodConnections)
+			res = append(res, score[:]...)
+		}
+		if p.IsOnion() {
+			res = append(res, p.Onion...)
+		}
+	} else if p.Banned != 0 || len(p.NetGroup) > 0 {
+		res = make([]byte, 34+len(p.NetGroup))
 		binary.LittleEndian.PutUint32(res[30:34], p.Banned)
+		copy(res[34:], p.NetGroup)
 	} else {
 		res = make([]byte, 30)
 	}
@@ -66,5 +206,41 @@ func (p *OnePeer) UniqID() uint64 {
 	h.Write(p.IPv6[:])
 	h.Write(p.IPv4[:])
 	h.Write([]byte{byte(p.Port >> 8), byte(p.Port)})
+	if p.IsOnion() {
+		h.Write(p.Onion)
+	}
 	return h.Sum64()
 }
+
+// IsOnion - Returns true for a Tor peer
+func (p *OnePeer) IsOnion() bool {
+	return len(p.Onion) == OnionLen
+}
+
+// SetOnion - Makes it a Tor peer with the given (decoded) v3 onion address
+func (p *OnePeer) SetOnion(onion []byte) {
+	p.Onion = make([]byte, OnionLen)
+	copy(p.Onion, onion)
+	copy(p.IPv6[:], OnionPrefix)
+	copy(p.IPv6[len(OnionPrefix):], onion)
+	copy(p.IPv4[:], onion[12-len(OnionPrefix):])
+}
+
+// OnionHost - Returns the host name of a Tor peer ("xxx.onion"), or an empty string for other peers
+func (p *OnePeer) OnionHost() string {
+	if !p.IsOnion() {
+		return ""
+	}
+	return strings.ToLower(onionEnc.EncodeToString(p.Onion)) + ".onion"
+}
+
+// DecodeOnion - Decodes a v3 onion host name (with or without ".onion" suffix).
+// Only the length and the version are checked, not the checksum.
+func DecodeOnion(host string) (onion []byte, ok bool) {
+	host = strings.TrimSuffix(strings.ToLower(host), ".onion")
+	d, e := onionEnc.DecodeString(strings.ToUpper(host))
+	if e != nil || len(d) != OnionLen || d[OnionLen-1] != 3 {
+		return
+	}
+	return d, true
+}
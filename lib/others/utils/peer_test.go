@@ -0,0 +1,150 @@
+package utils
+
+import (
+	"testing"
+)
+
+func TestPeerFromBytes(t *testing.T) {
+	p := new(OnePeer)
+	p.Time = 0x12345678
+	p.Port = 11047
+	copy(p.IPv4[:], []byte{85, 12, 1, 2})
+
+	v := p.Bytes()
+	if PeerTimeFromBytes(v) != p.Time {
+		t.Error("Bad time", PeerTimeFromBytes(v))
+	}
+	if PeerBannedFromBytes(v) != 0 {
+		t.Error("Bad banned", PeerBannedFromBytes(v))
+	}
+
+	p.Banned = 0x9abcdef0
+	p.NetGroup = []byte{4, 85, 12}
+	v = p.Bytes()
+	if PeerTimeFromBytes(v) != p.Time || PeerBannedFromBytes(v) != p.Banned {
+		t.Error("Bad time/banned", PeerTimeFromBytes(v), PeerBannedFromBytes(v))
+	}
+	if np := NewPeer(v); np.Time != p.Time || np.Banned != p.Banned || np.Port != p.Port || np.IPv4 != p.IPv4 {
+		t.Error("NewPeer does not match", np)
+	}
+}
+
+func TestPeerLabels(t *testing.T) {
+	p := new(OnePeer)
+	p.Port = 11047
+	p.Labels = []string{"seed", "my-node"}
+	np := NewPeer(p.Bytes())
+	if len(np.NetGroup) != 0 || len(np.Labels) != 2 || np.Labels[0] != "seed" || np.Labels[1] != "my-node" {
+		t.Error("Bad labels without netgroup", np.NetGroup, np.Labels)
+	}
+
+	for _, ng := range [][]byte{{4, 85, 12}, {6, 0x20, 0x01, 0x0d, 0xb8}} {
+		p.NetGroup = ng
+		np = NewPeer(p.Bytes())
+		if string(np.NetGroup) != string(ng) || len(np.Labels) != 2 || np.Labels[1] != "my-node" {
+			t.Error("Bad labels with netgroup", np.NetGroup, np.Labels)
+		}
+	}
+
+	p.Labels = nil
+	if np = NewPeer(p.Bytes()); len(np.Labels) != 0 || string(np.NetGroup) != string(p.NetGroup) {
+		t.Error("Unexpected labels", np.NetGroup, np.Labels)
+	}
+}
+
+func TestPeerOnion(t *testing.T) {
+	const host = "2gzyxa5ihm7nsggfxnu52rck2vv4rvmdlkiu3zzui5du4xyclen53wid.onion"
+	onion, ok := DecodeOnion(host)
+	if !ok || len(onion) != OnionLen {
+		t.Fatal("DecodeOnion failed")
+	}
+	if _, ok = DecodeOnion("2gzyxa5ihm7nsggfxnu52rck2vv4rvmdlkiu3zzui5du4xyclen53wi.onion"); ok {
+		t.Error("Too short onion address decoded")
+	}
+	if _, ok = DecodeOnion("expyuzz4wqqyqhjn.onion"); ok {
+		t.Error("v2 onion address decoded")
+	}
+
+	p := new(OnePeer)
+	p.Port = 11047
+	p.Time = 0x12345678
+	p.SetOnion(onion)
+	if !p.IsOnion() || p.OnionHost() != host || string(p.IPv6[:6]) != string(OnionPrefix) {
+		t.Error("Bad onion peer", p.OnionHost(), p.IPv6)
+	}
+	np := NewPeer(p.Bytes())
+	if !np.IsOnion() || np.OnionHost() != host || np.UniqID() != p.UniqID() || np.Port != p.Port || np.Time != p.Time {
+		t.Error("Onion peer not restored", np)
+	}
+
+	p.Labels = []string{"tor"}
+	p.NetGroup = []byte{6, 0xfd, 0x87, 0xd8, 0x7e}
+	p.Banned = 1
+	np = NewPeer(p.Bytes())
+	if !np.IsOnion() || np.OnionHost() != host || len(np.Labels) != 1 || np.Labels[0] != "tor" || np.Banned != 1 {
+		t.Error("Onion peer with labels not restored", np)
+	}
+
+	p2 := new(OnePeer)
+	p2.Port = 11047
+	p2.IPv6, p2.IPv4 = p.IPv6, p.IPv4
+	if p2.UniqID() == p.UniqID() {
+		t.Error("UniqID does not include the onion address")
+	}
+	if NewPeer(p2.Bytes()).IsOnion() {
+		t.Error("Not onion peer restored as onion")
+	}
+}
+
+func TestPeerScore(t *testing.T) {
+	p := new(OnePeer)
+	p.Port = 11047
+	v := p.Bytes()
+	if np := NewPeer(v); np.Misbehaving != 0 || np.GoodConnections != 0 || len(v) != 30 {
+		t.Error("Score stored for a new peer", len(v))
+	}
+
+	p.Misbehaving, p.GoodConnections = 0x12345678, 0x9abcdef0
+	np := NewPeer(p.Bytes())
+	if np.Misbehaving != p.Misbehaving || np.GoodConnections != p.GoodConnections || len(np.Labels) != 0 {
+		t.Error("Score not restored", np)
+	}
+
+	p.Labels = []string{"seed"}
+	onion, _ := DecodeOnion("2gzyxa5ihm7nsggfxnu52rck2vv4rvmdlkiu3zzui5du4xyclen53wid")
+	p.SetOnion(onion)
+	np = NewPeer(p.Bytes())
+	if np.Misbehaving != p.Misbehaving || np.GoodConnections != p.GoodConnections || len(np.Labels) != 1 || !np.IsOnion() {
+		t.Error("Score with labels and onion not restored", np)
+	}
+
+	// a record written before the score existed
+	p = new(OnePeer)
+	p.Labels = []string{"seed"}
+	if np = NewPeer(p.Bytes()); np.Misbehaving != 0 || np.GoodConnections != 0 || np.Labels[0] != "seed" {
+		t.Error("Bad record without score", np)
+	}
+}
+
+func TestPeerBanReason(t *testing.T) {
+	p := new(OnePeer)
+	p.Port = 11047
+	p.Banned = 0x9abcdef0
+	p.BanReason = "sent invalid blocks"
+	np := NewPeer(p.Bytes())
+	if np.BanReason != p.BanReason || len(np.Labels) != 0 || np.Banned != p.Banned {
+		t.Error("Bad ban reason without labels", np.BanReason, np.Labels)
+	}
+
+	p.Labels = []string{"seed"}
+	p.NetGroup = []byte{4, 85, 12}
+	np = NewPeer(p.Bytes())
+	if np.BanReason != p.BanReason || len(np.Labels) != 1 || np.Labels[0] != "seed" {
+		t.Error("Bad ban reason with labels", np.BanReason, np.Labels)
+	}
+
+	p.BanReason = ""
+	if np = NewPeer(p.Bytes()); np.BanReason != "" || len(np.Labels) != 1 {
+		t.Error("Unexpected ban reason", np.BanReason, np.Labels)
+	}
+}
@@ -0,0 +1,324 @@
+package zstd
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// The encoder below produces standard zstd frames (RFC 8878), readable by any zstd decoder.
+// It finds the matches with a simple hash table and stores the literals raw and the sequences
+// with the predefined FSE tables, so it is fast, but compresses worse than the reference encoder.
+
+const (
+	maxBlockSize = 128 << 10
+	maxOffset    = 4 << 20 // also the window size of the frames bigger than that
+	minMatch     = 4
+	hashLog      = 15
+)
+
+// Predefined distributions (RFC 8878, 3.1.1.3.2.2)
+var (
+	literalLengthNorm = []int16{4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1,
+		2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1, -1, -1, -1, -1}
+	matchLengthNorm = []int16{1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		-1, -1, -1, -1, -1, -1, -1}
+	offsetNorm = []int16{1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1}
+
+	literalLengthCTable = newFSECTable(literalLengthNorm, 6)
+	matchLengthCTable   = newFSECTable(matchLengthNorm, 6)
+	offsetCTable        = newFSECTable(offsetNorm, 5)
+)
+
+// Compress appends to dst a zstd frame with the content of src and returns the result
+func Compress(dst, src []byte) []byte {
+	// Frame header: Single_Segment (if the window covers all the content), FCS field and the checksum flag
+	var fcs []byte
+	var descriptor byte = 1 << 2
+	switch {
+	case len(src) < 256:
+		fcs = []byte{byte(len(src))}
+	case len(src) < 256+0x10000:
+		fcs = make([]byte, 2)
+		binary.LittleEndian.PutUint16(fcs, uint16(len(src)-256))
+		descriptor |= 1 << 6
+	case uint64(len(src)) <= 0xFFFFFFFF:
+		fcs = make([]byte, 4)
+		binary.LittleEndian.PutUint32(fcs, uint32(len(src)))
+		descriptor |= 2 << 6
+	default:
+		fcs = make([]byte, 8)
+		binary.LittleEndian.PutUint64(fcs, uint64(len(src)))
+		descriptor |= 3 << 6
+	}
+	dst = append(dst, 0x28, 0xb5, 0x2f, 0xfd)
+	if len(src) <= maxOffset {
+		dst = append(dst, descriptor|1<<5)
+	} else {
+		// Window_Descriptor: exponent for 2^22, no mantissa
+		dst = append(dst, descriptor, byte(bits.Len(maxOffset)-1-10)<<3)
+	}
+	dst = append(dst, fcs...)
+
+	e := encoder{table: make([]int32, 1<<hashLog)}
+	for i := range e.table {
+		e.table[i] = -1
+	}
+	for pos := 0; ; {
+		end := pos + maxBlockSize
+		if end > len(src) {
+			end = len(src)
+		}
+		dst = e.block(dst, src, pos, end, end == len(src))
+		if pos = end; pos == len(src) {
+			break
+		}
+	}
+
+	var xh xxhash64
+	xh.reset()
+	xh.update(src)
+	var sum [4]byte
+	binary.LittleEndian.PutUint32(sum[:], uint32(xh.digest()))
+	return append(dst, sum[:]...)
+}
+
+type sequence struct {
+	litLen, offset, matchLen uint32
+}
+
+type encoder struct {
+	table []int32 // hash of 4 bytes -> the last position where they were seen
+	seqs  []sequence
+	lits  []byte
+	out   []byte
+}
+
+func hash4(b []byte, i int) uint32 {
+	return (binary.LittleEndian.Uint32(b[i:]) * 2654435761) >> (32 - hashLog)
+}
+
+// block appends to dst the block of src[pos:end]. The matches can refer to anything before pos.
+func (e *encoder) block(dst, src []byte, pos, end int, last bool) []byte {
+	e.seqs = e.seqs[:0]
+	e.lits = e.lits[:0]
+	lit := pos
+	for i := pos; i+minMatch <= end; {
+		h := hash4(src, i)
+		c := int(e.table[h])
+		e.table[h] = int32(i)
+		if c < 0 || i-c > maxOffset || binary.LittleEndian.Uint32(src[c:]) != binary.LittleEndian.Uint32(src[i:]) {
+			i++
+			continue
+		}
+		n := minMatch
+		for i+n < end && src[c+n] == src[i+n] {
+			n++
+		}
+		e.lits = append(e.lits, src[lit:i]...)
+		e.seqs = append(e.seqs, sequence{uint32(i - lit), uint32(i - c), uint32(n)})
+		for j := i + 1; j < i+n && j+minMatch <= end; j += 3 {
+			e.table[hash4(src, j)] = int32(j)
+		}
+		i += n
+		lit = i
+	}
+	e.lits = append(e.lits, src[lit:end]...)
+
+	var hdr uint32
+	if last {
+		hdr = 1
+	}
+	if len(e.seqs) > 0 {
+		e.out = e.compressed(e.out[:0])
+		if len(e.out) < end-pos {
+			hdr |= 2<<1 | uint32(len(e.out))<<3
+			return append(append(dst, byte(hdr), byte(hdr>>8), byte(hdr>>16)), e.out...)
+		}
+	}
+	hdr |= uint32(end-pos) << 3 // raw block
+	return append(append(dst, byte(hdr), byte(hdr>>8), byte(hdr>>16)), src[pos:end]...)
+}
+
+// compressed appends to out the content of a compressed block: raw literals and the sequences
+func (e *encoder) compressed(out []byte) []byte {
+	switch n := len(e.lits); {
+	case n < 32:
+		out = append(out, byte(n<<3))
+	case n < 4096:
+		out = append(out, byte(n<<4)|1<<2, byte(n>>4))
+	default:
+		out = append(out, byte(n<<4)|3<<2, byte(n>>4), byte(n>>12))
+	}
+	out = append(out, e.lits...)
+
+	switch n := len(e.seqs); {
+	case n < 128:
+		out = append(out, byte(n))
+	case n < 0x7F00:
+		out = append(out, byte(n>>8)+128, byte(n))
+	default:
+		out = append(out, 0xFF, byte(n-0x7F00), byte((n-0x7F00)>>8))
+	}
+	out = append(out, 0) // all three tables are predefined
+
+	// The sequences are written backwards, so the decoder reads them forwards
+	var bw bitWriter
+	bw.out = out
+	var llState, mlState, ofState fseCState
+	for i := len(e.seqs) - 1; i >= 0; i-- {
+		s := &e.seqs[i]
+		llCode, llBits, llVal := literalLengthCode(s.litLen)
+		mlCode, mlBits, mlVal := matchLengthCode(s.matchLen)
+		ofCode := uint8(bits.Len32(s.offset+3) - 1) // offset values 1..3 are for the repeated offsets
+		ofVal := s.offset + 3 - 1<<ofCode
+		if i == len(e.seqs)-1 {
+			mlState.init(matchLengthCTable, mlCode)
+			ofState.init(offsetCTable, ofCode)
+			llState.init(literalLengthCTable, llCode)
+		} else {
+			ofState.encode(&bw, ofCode)
+			mlState.encode(&bw, mlCode)
+			llState.encode(&bw, llCode)
+		}
+		bw.add(llVal, llBits)
+		bw.add(mlVal, mlBits)
+		bw.add(ofVal, ofCode)
+	}
+	mlState.flush(&bw)
+	ofState.flush(&bw)
+	llState.flush(&bw)
+	return bw.close()
+}
+
+func literalLengthCode(ll uint32) (code, nbits uint8, val uint32) {
+	if ll < 16 {
+		return uint8(ll), 0, 0
+	}
+	for code = 35; literalLengthBase[code-literalLengthOffset]&0xFFFFFF > ll; code-- {
+	}
+	b := literalLengthBase[code-literalLengthOffset]
+	return code, uint8(b >> 24), ll - b&0xFFFFFF
+}
+
+func matchLengthCode(ml uint32) (code, nbits uint8, val uint32) {
+	if ml < 35 {
+		return uint8(ml - 3), 0, 0
+	}
+	for code = 52; matchLengthBase[code-matchLengthOffset]&0xFFFFFF > ml; code-- {
+	}
+	b := matchLengthBase[code-matchLengthOffset]
+	return code, uint8(b >> 24), ml - b&0xFFFFFF
+}
+
+// bitWriter writes the bits forwards, LSB first, for the decoder to read them backwards
+type bitWriter struct {
+	out   []byte
+	acc   uint64
+	nbits uint
+}
+
+func (w *bitWriter) add(v uint32, n uint8) {
+	w.acc |= uint64(v&(1<<n-1)) << w.nbits
+	w.nbits += uint(n)
+	for w.nbits >= 8 {
+		w.out = append(w.out, byte(w.acc))
+		w.acc >>= 8
+		w.nbits -= 8
+	}
+}
+
+// close adds the end mark and pads the last byte
+func (w *bitWriter) close() []byte {
+	w.add(1, 1)
+	if w.nbits > 0 {
+		w.out = append(w.out, byte(w.acc))
+	}
+	return w.out
+}
+
+type fseSymbolTransform struct {
+	deltaNbBits    uint32
+	deltaFindState int32
+}
+
+type fseCTable struct {
+	tableLog    uint8
+	stateTable  []uint16
+	symbolTrans []fseSymbolTransform
+}
+
+// newFSECTable builds the encoding table for the given normalized distribution,
+// spreading the symbols exactly as the decoder does (RFC 8878, 4.1.1)
+func newFSECTable(norm []int16, tableLog uint8) *fseCTable {
+	size := 1 << tableLog
+	t := &fseCTable{tableLog: tableLog, stateTable: make([]uint16, size),
+		symbolTrans: make([]fseSymbolTransform, len(norm))}
+
+	symbols := make([]uint8, size)
+	cumul := make([]int, len(norm)+1)
+	high := size - 1
+	for s, c := range norm {
+		if c == -1 {
+			cumul[s+1] = cumul[s] + 1
+			symbols[high] = uint8(s)
+			high--
+		} else {
+			cumul[s+1] = cumul[s] + int(c)
+		}
+	}
+	step := size>>1 + size>>3 + 3
+	pos := 0
+	for s, c := range norm {
+		for i := 0; i < int(c); i++ {
+			symbols[pos] = uint8(s)
+			for pos = (pos + step) & (size - 1); pos > high; pos = (pos + step) & (size - 1) {
+			}
+		}
+	}
+	for u, s := range symbols {
+		t.stateTable[cumul[s]] = uint16(size + u)
+		cumul[s]++
+	}
+
+	total := 0
+	for s, c := range norm {
+		switch c {
+		case 0:
+		case -1, 1:
+			t.symbolTrans[s] = fseSymbolTransform{uint32(tableLog)<<16 - uint32(size), int32(total - 1)}
+			total++
+		default:
+			maxBitsOut := uint32(tableLog) - uint32(bits.Len16(uint16(c-1))-1)
+			minStatePlus := uint32(c) << maxBitsOut
+			t.symbolTrans[s] = fseSymbolTransform{maxBitsOut<<16 - minStatePlus, int32(total - int(c))}
+			total += int(c)
+		}
+	}
+	return t
+}
+
+type fseCState struct {
+	t     *fseCTable
+	state uint32
+}
+
+func (st *fseCState) init(t *fseCTable, sym uint8) {
+	tr := t.symbolTrans[sym]
+	nbBitsOut := (tr.deltaNbBits + 1<<15) >> 16
+	v := nbBitsOut<<16 - tr.deltaNbBits
+	st.t = t
+	st.state = uint32(t.stateTable[int32(v>>nbBitsOut)+tr.deltaFindState])
+}
+
+func (st *fseCState) encode(w *bitWriter, sym uint8) {
+	tr := st.t.symbolTrans[sym]
+	nbBitsOut := (st.state + tr.deltaNbBits) >> 16
+	w.add(st.state, uint8(nbBitsOut))
+	st.state = uint32(st.t.stateTable[int32(st.state>>nbBitsOut)+tr.deltaFindState])
+}
+
+func (st *fseCState) flush(w *bitWriter) {
+	w.add(st.state, st.t.tableLog)
+}
@@ -0,0 +1,71 @@
+package zstd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func testInputs() map[string][]byte {
+	rnd := rand.New(rand.NewSource(1))
+	random := make([]byte, 300000)
+	rnd.Read(random)
+	var text []byte
+	for len(text) < 5<<20 {
+		text = append(text, "{\"key\":"...)
+		text = append(text, byte('a'+rnd.Intn(26)), byte('0'+rnd.Intn(10)))
+		text = append(text, ",\"value\":\"the same old value\"}\n"...)
+	}
+	runs := bytes.Repeat([]byte{7}, 200000)
+	return map[string][]byte{"empty": nil, "byte": {1}, "short": []byte("abcabcabcabcabcabc"),
+		"random": random, "text": text, "runs": runs}
+}
+
+func TestCompress(t *testing.T) {
+	for name, in := range testInputs() {
+		c := Compress(nil, in)
+		out, e := Decompress(nil, c)
+		if e != nil {
+			t.Fatal(name, e)
+		}
+		if !bytes.Equal(out, in) {
+			t.Fatal(name, "decompressed data differs", len(out), len(in))
+		}
+		if len(in) > 1000 && name != "random" && len(c) > len(in)/4 {
+			t.Error(name, "not compressed enough", len(c), len(in))
+		}
+		if name == "random" && len(c) > len(in)+100 {
+			t.Error(name, "expanded too much", len(c), len(in))
+		}
+	}
+}
+
+// TestCompressCLI checks that the reference implementation reads our frames
+func TestCompressCLI(t *testing.T) {
+	zstd, e := exec.LookPath("zstd")
+	if e != nil {
+		t.Skip("no zstd command")
+	}
+	dir, e := ioutil.TempDir("", "zstd")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+	for name, in := range testInputs() {
+		fn := filepath.Join(dir, name+".zst")
+		if e = ioutil.WriteFile(fn, Compress(nil, in), 0600); e != nil {
+			t.Fatal(e)
+		}
+		out, e := exec.Command(zstd, "-d", "-c", fn).Output()
+		if e != nil {
+			t.Fatal(name, e)
+		}
+		if !bytes.Equal(out, in) {
+			t.Fatal(name, "zstd decompressed different data", len(out), len(in))
+		}
+	}
+}
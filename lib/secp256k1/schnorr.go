@@ -0,0 +1,78 @@
+package secp256k1
+
+import (
+	"crypto/sha256"
+)
+
+// TaggedHash - BIP-340 tagged hash: SHA256(SHA256(tag) || SHA256(tag) || data...)
+func TaggedHash(tag string, data ...[]byte) (res [32]byte) {
+	th := sha256.Sum256([]byte(tag))
+	s := sha256.New()
+	s.Write(th[:])
+	s.Write(th[:])
+	for _, d := range data {
+		s.Write(d)
+	}
+	s.Sum(res[:0])
+	return
+}
+
+// liftX - Sets the point with the given X coordinate and even Y (BIP-340's lift_x).
+// Returns false if X is not below the field size or if there is no such point on the curve.
+func (xy *XY) liftX(x []byte) bool {
+	var n Number
+	if n.SetBytes(x); n.Cmp(&TheCurve.p.Int) >= 0 {
+		return false
+	}
+	var fx Field
+	fx.SetB32(x)
+	xy.SetXO(&fx, false)
+	return xy.IsValid()
+}
+
+// SchnorrVerify - Verifies BIP-340 signature (64 bytes) of the message (any length, usually 32 bytes)
+// against the given x-only public key (32 bytes).
+func SchnorrVerify(pubkey, sig, msg []byte) bool {
+	if len(pubkey) != 32 || len(sig) != 64 {
+		return false
+	}
+
+	var pk XY
+	if !pk.liftX(pubkey) {
+		return false
+	}
+
+	var r, s Number
+	if r.SetBytes(sig[:32]); r.Cmp(&TheCurve.p.Int) >= 0 {
+		return false
+	}
+	if s.SetBytes(sig[32:]); s.Cmp(&TheCurve.Order.Int) >= 0 {
+		return false
+	}
+
+	// e = int(hash_BIP0340/challenge(r || P || m)) mod n
+	var e Number
+	h := TaggedHash("BIP0340/challenge", sig[:32], pubkey, msg)
+	e.SetBytes(h[:])
+	e.Mod(&e.Int, &TheCurve.Order.Int)
+	e.Sub(&TheCurve.Order.Int, &e.Int) // R = s*G - e*P = s*G + (n-e)*P
+	e.Mod(&e.Int, &TheCurve.Order.Int)
+
+	var pkj, rj XYZ
+	pkj.SetXY(&pk)
+	pkj.ECmult(&rj, &e, &s)
+	if rj.IsInfinity() {
+		return false
+	}
+
+	var rp XY
+	rp.SetXYZ(&rj)
+	rp.X.Normalize()
+	rp.Y.Normalize()
+	if rp.Y.IsOdd() {
+		return false
+	}
+	var rx [32]byte
+	rp.X.GetB32(rx[:])
+	return string(rx[:]) == string(sig[:32])
+}